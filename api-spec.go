@@ -0,0 +1,517 @@
+package main
+
+import (
+	"myapp/appcache"
+	"myapp/apperr"
+	"myapp/bulk"
+	"myapp/gql"
+	"myapp/handlers"
+	"myapp/openapi"
+	"net/http"
+
+	"github.com/graphql-go/graphql"
+)
+
+// apiSpec describes every route in apiRoutes. Add an operation here whenever an
+// api route is added, TestAPISpecCoversRoutes fails until you do.
+func apiSpec() *openapi.Spec {
+	spec := openapi.New("myapp API", "1.0.0", "/api")
+	spec.Error = apperr.Envelope{}
+
+	idParam := openapi.Param{Name: "id", In: "path", Type: "integer", Description: "user id"}
+	ifNoneMatch := openapi.Param{Name: "If-None-Match", In: "header", Type: "string", Description: "etag of the copy you have, a match gets a 304"}
+	csrfHeader := openapi.Param{Name: "X-CSRF-Token", In: "header", Type: "string", Description: "csrf token, required when using the session instead of a bearer token"}
+	ifMatch := openapi.Param{Name: "If-Match", In: "header", Type: "string", Description: "etag the change is based on, a mismatch gets a 412"}
+
+	// docs
+	spec.Add(openapi.Operation{
+		Method:  http.MethodGet,
+		Path:    "/openapi.json",
+		Summary: "This document",
+		Tag:     "docs",
+	})
+	spec.Add(openapi.Operation{
+		Method:      http.MethodGet,
+		Path:        "/docs",
+		Summary:     "Interactive documentation for this api",
+		Tag:         "docs",
+		ContentType: "text/html",
+	})
+
+	// cache playground, called by javascript on /cache-test. Its values are kept
+	// in a namespace of their own, apart from the /v1/cache api's.
+	cacheErrors := []int{http.StatusBadRequest, http.StatusForbidden, http.StatusInternalServerError}
+	spec.Add(openapi.Operation{
+		Method:   http.MethodPost,
+		Path:     "/save-in-cache",
+		Summary:  "Save any json value in the cache, with an optional ttl in seconds",
+		Tag:      "cache",
+		Request:  handlers.CacheRequest{},
+		Response: handlers.CacheResponse{},
+		Status:   http.StatusCreated,
+		Errors:   append(cacheErrors, http.StatusUnprocessableEntity),
+	})
+	spec.Add(openapi.Operation{
+		Method:   http.MethodPost,
+		Path:     "/get-from-cache",
+		Summary:  "Get a value from the cache, with its remaining ttl",
+		Tag:      "cache",
+		Request:  handlers.CacheRequest{},
+		Response: handlers.CacheResponse{},
+		Errors:   append(cacheErrors, http.StatusNotFound, http.StatusUnprocessableEntity),
+	})
+	spec.Add(openapi.Operation{
+		Method:   http.MethodPost,
+		Path:     "/touch-cache",
+		Summary:  "Give a cached value a new ttl, 0 keeps it until it is deleted",
+		Tag:      "cache",
+		Request:  handlers.CacheRequest{},
+		Response: handlers.CacheResponse{},
+		Errors:   append(cacheErrors, http.StatusNotFound, http.StatusUnprocessableEntity),
+	})
+	spec.Add(openapi.Operation{
+		Method:   http.MethodPost,
+		Path:     "/delete-from-cache",
+		Summary:  "Delete a key from the cache",
+		Tag:      "cache",
+		Request:  handlers.CacheRequest{},
+		Response: handlers.CacheResponse{},
+		Errors:   append(cacheErrors, http.StatusUnprocessableEntity),
+	})
+	spec.Add(openapi.Operation{
+		Method:   http.MethodPost,
+		Path:     "/empty-cache",
+		Summary:  "Empty the playground's values, the rest of the cache is kept",
+		Tag:      "cache",
+		Request:  handlers.CacheRequest{},
+		Response: handlers.CacheResponse{},
+		Errors:   cacheErrors,
+	})
+
+	// graphql
+	graphQLErrors := []int{http.StatusBadRequest}
+	spec.Add(openapi.Operation{
+		Method:  http.MethodGet,
+		Path:    "/graphql",
+		Summary: "Run a graphql query (not a mutation). Signed in users may use their session instead of a bearer token",
+		Tag:     "graphql",
+		Params: []openapi.Param{
+			{Name: "query", In: "query", Type: "string", Description: "the graphql document", Required: true},
+			{Name: "operationName", In: "query", Type: "string", Description: "the operation to run when the document has several"},
+			{Name: "variables", In: "query", Type: "string", Description: "json object of variables"},
+		},
+		Response: graphql.Result{},
+		Errors:   graphQLErrors,
+		Auth:     true,
+	})
+	spec.Add(openapi.Operation{
+		Method:   http.MethodPost,
+		Path:     "/graphql",
+		Summary:  "Run a graphql query or mutation, the body must be json. Queries are limited in depth and complexity",
+		Tag:      "graphql",
+		Request:  gql.Request{},
+		Response: graphql.Result{},
+		Errors:   append(graphQLErrors, http.StatusUnsupportedMediaType),
+		Auth:     true,
+	})
+
+	// users
+	spec.Add(openapi.Operation{
+		Method:  http.MethodGet,
+		Path:    "/v1/users",
+		Summary: "List users, ordered by last name",
+		Tag:     "users",
+		Params: []openapi.Param{
+			{Name: "page", In: "query", Type: "integer", Description: "page number, starting at 1"},
+			{Name: "per_page", In: "query", Type: "integer", Description: "users per page, at most 100"},
+			ifNoneMatch,
+		},
+		Response:    handlers.UserListResponse{},
+		Errors:      []int{http.StatusBadRequest},
+		Auth:        true,
+		Conditional: true,
+	})
+	spec.Add(openapi.Operation{
+		Method:  http.MethodPost,
+		Path:    "/v1/users",
+		Summary: "Create a user. Retries with the same Idempotency-Key replay the first response",
+		Tag:     "users",
+		Params: []openapi.Param{
+			{Name: "Idempotency-Key", In: "header", Description: "unique key for this create, at most 255 characters"},
+		},
+		Request:  handlers.UserRequest{},
+		Response: handlers.UserResponse{},
+		Status:   http.StatusCreated,
+		Errors:   []int{http.StatusBadRequest, http.StatusConflict, http.StatusUnprocessableEntity},
+		Auth:     true,
+	})
+	spec.Add(openapi.Operation{
+		Method:  http.MethodPost,
+		Path:    "/v1/users/import",
+		Summary: "Import a csv or ndjson file of users (first_name, last_name, email, password, active), as the body or the file field of a multipart form. Valid rows are inserted in batches, invalid ones are reported by line. Admins only",
+		Tag:     "users",
+		Params: []openapi.Param{
+			{Name: "format", In: "query", Type: "string", Description: "csv or ndjson, taken from the content type or file name when left out"},
+			{Name: "dry_run", In: "query", Type: "boolean", Description: "only validate the rows"},
+			csrfHeader,
+		},
+		Response: bulk.Report{},
+		Errors:   []int{http.StatusBadRequest, http.StatusForbidden, http.StatusUnsupportedMediaType},
+		Auth:     true,
+	})
+	spec.Add(openapi.Operation{
+		Method:  http.MethodGet,
+		Path:    "/v1/users/export",
+		Summary: "Stream every user as csv, ndjson or json. Password hashes are never exported. Admins only",
+		Tag:     "users",
+		Params: []openapi.Param{
+			{Name: "format", In: "query", Type: "string", Description: "csv, ndjson or json, taken from the Accept header when left out"},
+			{Name: "fields", In: "query", Type: "string", Description: "comma separated fields, default id,first_name,last_name,email,active,created_at,updated_at"},
+		},
+		Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotAcceptable},
+		Auth:   true,
+	})
+	spec.Add(openapi.Operation{
+		Method:      http.MethodGet,
+		Path:        "/v1/users/me",
+		Summary:     "The user that owns the bearer token",
+		Tag:         "users",
+		Params:      []openapi.Param{ifNoneMatch},
+		Response:    handlers.UserResponse{},
+		Auth:        true,
+		Conditional: true,
+	})
+	spec.Add(openapi.Operation{
+		Method:   http.MethodGet,
+		Path:     "/v1/users/me/email-preferences",
+		Summary:  "The categories of mail the bearer token's user gets",
+		Tag:      "users",
+		Response: handlers.EmailPreferencesResponse{},
+		Auth:     true,
+	})
+	spec.Add(openapi.Operation{
+		Method:   http.MethodPut,
+		Path:     "/v1/users/me/email-preferences",
+		Summary:  "Subscribe the bearer token's user to categories of mail or unsubscribe them",
+		Tag:      "users",
+		Request:  handlers.EmailPreferencesRequest{},
+		Response: handlers.EmailPreferencesResponse{},
+		Errors:   []int{http.StatusBadRequest, http.StatusUnprocessableEntity},
+		Auth:     true,
+	})
+	spec.Add(openapi.Operation{
+		Method:  http.MethodPost,
+		Path:    "/v1/unsubscribe",
+		Summary: "One-click unsubscribe (RFC 8058), the target of the List-Unsubscribe header. The signed link is the authentication",
+		Tag:     "users",
+		Params: []openapi.Param{
+			{Name: "email", In: "query", Type: "string", Description: "the address to unsubscribe", Required: true},
+			{Name: "category", In: "query", Type: "string", Description: "product or newsletter", Required: true},
+			{Name: "hash", In: "query", Type: "string", Description: "the link's signature", Required: true},
+		},
+		Status: http.StatusNoContent,
+		Errors: []int{http.StatusBadRequest, http.StatusForbidden},
+	})
+	spec.Add(openapi.Operation{
+		Method:      http.MethodGet,
+		Path:        "/v1/users/{id}",
+		Summary:     "Get a user",
+		Tag:         "users",
+		Params:      []openapi.Param{idParam, ifNoneMatch},
+		Response:    handlers.UserResponse{},
+		Errors:      []int{http.StatusNotFound},
+		Auth:        true,
+		Conditional: true,
+	})
+	spec.Add(openapi.Operation{
+		Method:   http.MethodPut,
+		Path:     "/v1/users/{id}",
+		Summary:  "Update a user, the password is only changed when one is given. Users may only update themselves, admins anyone",
+		Tag:      "users",
+		Params:   []openapi.Param{idParam, ifMatch},
+		Request:  handlers.UserRequest{},
+		Response: handlers.UserResponse{},
+		Errors:   []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict, http.StatusPreconditionFailed, http.StatusUnprocessableEntity},
+		Auth:     true,
+	})
+	spec.Add(openapi.Operation{
+		Method:  http.MethodDelete,
+		Path:    "/v1/users/{id}",
+		Summary: "Delete a user. Users may only delete themselves, admins anyone",
+		Tag:     "users",
+		Params:  []openapi.Param{idParam, ifMatch},
+		Status:  http.StatusNoContent,
+		Errors:  []int{http.StatusForbidden, http.StatusNotFound, http.StatusPreconditionFailed},
+		Auth:    true,
+	})
+
+	// cache administration
+	cacheKey := openapi.Param{Name: "key", In: "path", Type: "string", Description: "cache key, without spaces or * ? [ ]"}
+	cachePrefix := openapi.Param{Name: "prefix", In: "query", Type: "string", Description: "only keys that start with this"}
+	cachePattern := openapi.Param{Name: "pattern", In: "query", Type: "string", Description: "only keys that match this, * ? and [] match as in a shell. Anything but a prefix followed by * needs a cache that can list its keys"}
+	cacheDetails := openapi.Param{Name: "details", In: "query", Type: "boolean", Description: "add the type, size and ttl of each key"}
+	spec.Add(openapi.Operation{
+		Method:   http.MethodGet,
+		Path:     "/v1/cache",
+		Summary:  "List the keys in the cache namespace. Admins only, and only when the cache can list its keys",
+		Tag:      "cache",
+		Params:   []openapi.Param{cachePrefix, cacheDetails},
+		Response: handlers.CacheKeysResponse{},
+		Errors:   []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotImplemented, http.StatusServiceUnavailable},
+		Auth:     true,
+	})
+	spec.Add(openapi.Operation{
+		Method:  http.MethodDelete,
+		Path:    "/v1/cache",
+		Summary: "Delete every value in the cache namespace, those whose key starts with prefix, or those that match pattern. Admins only",
+		Tag:     "cache",
+		Params:  []openapi.Param{cachePrefix, cachePattern, csrfHeader},
+		Status:  http.StatusNoContent,
+		Errors:  []int{http.StatusBadRequest, http.StatusForbidden, http.StatusServiceUnavailable},
+		Auth:    true,
+	})
+	spec.Add(openapi.Operation{
+		Method:   http.MethodGet,
+		Path:     "/v1/cache-stats",
+		Summary:  "Hits, misses, sets and deletes through the cache api since the server started. Admins only",
+		Tag:      "cache",
+		Response: appcache.Stats{},
+		Errors:   []int{http.StatusForbidden},
+		Auth:     true,
+	})
+	spec.Add(openapi.Operation{
+		Method:   http.MethodGet,
+		Path:     "/v1/cache-info",
+		Summary:  "The cache backend, whether it can list its keys, and the stats. Admins only",
+		Tag:      "cache",
+		Response: appcache.Info{},
+		Errors:   []int{http.StatusForbidden},
+		Auth:     true,
+	})
+	spec.Add(openapi.Operation{
+		Method:   http.MethodGet,
+		Path:     "/v1/cache-snapshot",
+		Summary:  "Download the values in the cache namespace, or those whose key starts with prefix, as a json snapshot. Admins only, and only when the cache can list its keys",
+		Tag:      "cache",
+		Params:   []openapi.Param{cachePrefix},
+		Response: appcache.Snapshot{},
+		Errors:   []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotImplemented, http.StatusServiceUnavailable},
+		Auth:     true,
+	})
+	spec.Add(openapi.Operation{
+		Method:   http.MethodPost,
+		Path:     "/v1/cache-snapshot",
+		Summary:  "Save the values in a snapshot, with the ttls they had left. Nothing is saved if any entry is invalid. Admins only",
+		Tag:      "cache",
+		Params:   []openapi.Param{csrfHeader},
+		Request:  appcache.Snapshot{},
+		Response: handlers.CacheImportResponse{},
+		Errors:   []int{http.StatusBadRequest, http.StatusForbidden, http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity, http.StatusServiceUnavailable},
+		Auth:     true,
+	})
+	spec.Add(openapi.Operation{
+		Method:   http.MethodGet,
+		Path:     "/v1/cache/{key}",
+		Summary:  "Get a cached value and when it expires. Admins only",
+		Tag:      "cache",
+		Params:   []openapi.Param{cacheKey},
+		Response: appcache.Entry{},
+		Errors:   []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusServiceUnavailable},
+		Auth:     true,
+	})
+	spec.Add(openapi.Operation{
+		Method:   http.MethodPut,
+		Path:     "/v1/cache/{key}",
+		Summary:  "Save any json value, with an optional ttl in seconds. 201 when the key is new. Admins only",
+		Tag:      "cache",
+		Params:   []openapi.Param{cacheKey, csrfHeader},
+		Request:  handlers.CacheValueRequest{},
+		Response: appcache.Entry{},
+		Errors:   []int{http.StatusBadRequest, http.StatusForbidden, http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity, http.StatusServiceUnavailable},
+		Auth:     true,
+	})
+	spec.Add(openapi.Operation{
+		Method:   http.MethodPost,
+		Path:     "/v1/cache/{key}/touch",
+		Summary:  "Give a cached value a new ttl in seconds, 0 keeps it until it is deleted. Admins only",
+		Tag:      "cache",
+		Params:   []openapi.Param{cacheKey, csrfHeader},
+		Request:  handlers.CacheTouchRequest{},
+		Response: appcache.Entry{},
+		Errors:   []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusUnprocessableEntity, http.StatusServiceUnavailable},
+		Auth:     true,
+	})
+	spec.Add(openapi.Operation{
+		Method:  http.MethodDelete,
+		Path:    "/v1/cache/{key}",
+		Summary: "Delete a cached value. Admins only",
+		Tag:     "cache",
+		Params:  []openapi.Param{cacheKey, csrfHeader},
+		Status:  http.StatusNoContent,
+		Errors:  []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusServiceUnavailable},
+		Auth:    true,
+	})
+
+	// mail outbox
+	mailID := openapi.Param{Name: "id", In: "path", Type: "integer", Description: "outbox message id"}
+	spec.Add(openapi.Operation{
+		Method:  http.MethodGet,
+		Path:    "/v1/mail",
+		Summary: "One page of the mail outbox, newest first, with the number of messages in each status. Admins only",
+		Tag:     "mail",
+		Params: []openapi.Param{
+			{Name: "status", In: "query", Type: "string", Description: "only messages with this status: pending, sent, dead, cancelled or suppressed"},
+			{Name: "page", In: "query", Type: "integer", Description: "page number, starting at 1"},
+			{Name: "per_page", In: "query", Type: "integer", Description: "messages per page, at most 100"},
+		},
+		Response: handlers.MailListResponse{},
+		Errors:   []int{http.StatusBadRequest, http.StatusForbidden},
+		Auth:     true,
+	})
+	spec.Add(openapi.Operation{
+		Method:   http.MethodGet,
+		Path:     "/v1/mail/{id}",
+		Summary:  "Get an outbox message and how its delivery is going. Admins only",
+		Tag:      "mail",
+		Params:   []openapi.Param{mailID},
+		Response: handlers.MailResponse{},
+		Errors:   []int{http.StatusForbidden, http.StatusNotFound},
+		Auth:     true,
+	})
+	spec.Add(openapi.Operation{
+		Method:   http.MethodPost,
+		Path:     "/v1/mail/{id}/retry",
+		Summary:  "Send a dead, cancelled or suppressed message again, with a fresh set of attempts. Admins only",
+		Tag:      "mail",
+		Params:   []openapi.Param{mailID, csrfHeader},
+		Response: handlers.MailResponse{},
+		Status:   http.StatusAccepted,
+		Errors:   []int{http.StatusForbidden, http.StatusNotFound, http.StatusConflict},
+		Auth:     true,
+	})
+	spec.Add(openapi.Operation{
+		Method:   http.MethodPost,
+		Path:     "/v1/mail/{id}/cancel",
+		Summary:  "Stop a dead or suppressed message, or a pending one that isn't being sent or waiting to retry, from being sent. Admins only",
+		Tag:      "mail",
+		Params:   []openapi.Param{mailID, csrfHeader},
+		Response: handlers.MailResponse{},
+		Errors:   []int{http.StatusForbidden, http.StatusNotFound, http.StatusConflict},
+		Auth:     true,
+	})
+
+	// bounces and the addresses suppressed because of them
+	spec.Add(openapi.Operation{
+		Method:  http.MethodPost,
+		Path:    "/v1/mail-events/{provider}",
+		Summary: "Bounce and complaint webhook for a mail provider, signed the provider's way (basic auth for sparkpost)",
+		Tag:     "mail",
+		Params: []openapi.Param{
+			{Name: "provider", In: "path", Type: "string", Description: "mailgun, sendgrid or sparkpost", Required: true},
+		},
+		Status: http.StatusNoContent,
+		Errors: []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusNotFound},
+	})
+	suppressionID := openapi.Param{Name: "id", In: "path", Type: "integer", Description: "suppression id"}
+	spec.Add(openapi.Operation{
+		Method:  http.MethodGet,
+		Path:    "/v1/mail-suppressions",
+		Summary: "List the addresses no mail is sent to after bouncing or complaining. Admins only",
+		Tag:     "mail",
+		Params: []openapi.Param{
+			{Name: "page", In: "query", Type: "integer", Description: "page number, starting at 1"},
+			{Name: "per_page", In: "query", Type: "integer", Description: "addresses per page, at most 100"},
+		},
+		Response: handlers.SuppressionListResponse{},
+		Errors:   []int{http.StatusBadRequest, http.StatusForbidden},
+		Auth:     true,
+	})
+	spec.Add(openapi.Operation{
+		Method:   http.MethodGet,
+		Path:     "/v1/mail-suppressions/{id}",
+		Summary:  "Get a suppressed address with its latest bounces. Admins only",
+		Tag:      "mail",
+		Params:   []openapi.Param{suppressionID},
+		Response: handlers.SuppressionResponse{},
+		Errors:   []int{http.StatusForbidden, http.StatusNotFound},
+		Auth:     true,
+	})
+	spec.Add(openapi.Operation{
+		Method:   http.MethodPost,
+		Path:     "/v1/mail-suppressions/{id}/clear",
+		Summary:  "Send mail to a suppressed address again, only later bounces count towards suppressing it. Admins only",
+		Tag:      "mail",
+		Params:   []openapi.Param{suppressionID, csrfHeader},
+		Response: handlers.SuppressionResponse{},
+		Errors:   []int{http.StatusForbidden, http.StatusNotFound, http.StatusConflict},
+		Auth:     true,
+	})
+
+	webhookID := openapi.Param{Name: "id", In: "path", Type: "integer", Description: "webhook id"}
+	spec.Add(openapi.Operation{
+		Method:   http.MethodGet,
+		Path:     "/v1/webhooks",
+		Summary:  "List the webhooks. Admins only",
+		Tag:      "webhooks",
+		Response: handlers.WebhookListResponse{},
+		Errors:   []int{http.StatusForbidden},
+		Auth:     true,
+	})
+	spec.Add(openapi.Operation{
+		Method:   http.MethodPost,
+		Path:     "/v1/webhooks",
+		Summary:  "Subscribe a public url to user events (user.created, user.updated, user.deleted, user.password_changed or *). The secret is only returned here. Admins only",
+		Tag:      "webhooks",
+		Params:   []openapi.Param{csrfHeader},
+		Request:  handlers.WebhookRequest{},
+		Response: handlers.WebhookResponse{},
+		Status:   http.StatusCreated,
+		Errors:   []int{http.StatusBadRequest, http.StatusForbidden, http.StatusUnprocessableEntity},
+		Auth:     true,
+	})
+	spec.Add(openapi.Operation{
+		Method:  http.MethodDelete,
+		Path:    "/v1/webhooks/{id}",
+		Summary: "Delete a webhook and its delivery log. Admins only",
+		Tag:     "webhooks",
+		Params:  []openapi.Param{webhookID, csrfHeader},
+		Status:  http.StatusNoContent,
+		Errors:  []int{http.StatusForbidden, http.StatusNotFound},
+		Auth:    true,
+	})
+	spec.Add(openapi.Operation{
+		Method:   http.MethodGet,
+		Path:     "/v1/webhooks/{id}/deliveries",
+		Summary:  "The newest deliveries of a webhook. Admins only",
+		Tag:      "webhooks",
+		Params:   []openapi.Param{webhookID},
+		Response: handlers.DeliveryListResponse{},
+		Errors:   []int{http.StatusForbidden, http.StatusNotFound},
+		Auth:     true,
+	})
+	spec.Add(openapi.Operation{
+		Method:   http.MethodPost,
+		Path:     "/v1/webhook-deliveries/{id}/redeliver",
+		Summary:  "Send a delivery again, as a new delivery. Admins only",
+		Tag:      "webhooks",
+		Params:   []openapi.Param{{Name: "id", In: "path", Type: "integer", Description: "delivery id"}, csrfHeader},
+		Response: handlers.DeliveryResponse{},
+		Status:   http.StatusAccepted,
+		Errors:   []int{http.StatusForbidden, http.StatusNotFound},
+		Auth:     true,
+	})
+
+	return spec
+}
+
+// serveSpec writes the openapi document as json
+func (a *application) serveSpec(spec *openapi.Spec) http.HandlerFunc {
+	doc := spec.Document()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := a.App.WriteJSON(w, http.StatusOK, doc)
+		if err != nil {
+			a.App.ErrorLog.Println(err)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+// Package appcache keeps json values in the celeritas cache under a
+// namespace, with an optional ttl and hit and miss counts. Remember loads a
+// value once for everyone who asks for it at the same time.
+package appcache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cmd-ctrl-q/celeritas/cache"
+)
+
+// MaxKeyLength is the longest key accepted, without the namespace
+const MaxKeyLength = 200
+
+var (
+	// ErrNotFound is returned for a key that isn't in the cache
+	ErrNotFound = errors.New("appcache: not found")
+	// ErrNoCache is returned when the app has no cache configured
+	ErrNoCache = errors.New("appcache: no cache is configured")
+	// ErrListUnsupported is returned by Keys when the cache can't list its keys
+	ErrListUnsupported = errors.New("appcache: the cache can't list its keys")
+)
+
+// Lister is implemented by caches that can list their keys. The celeritas
+// redis and badger caches don't, so New wraps them in Redis and Badger.
+type Lister interface {
+	// Keys returns the keys that start with prefix, as they were passed to Set
+	Keys(prefix string) ([]string, error)
+}
+
+// Config holds the cache settings
+type Config struct {
+	// Namespace is put in front of every key, so api keys can't clash with the app's own
+	Namespace string
+	// Stale is how long Remember keeps serving a value past its ttl while it is reloaded
+	Stale time.Duration
+	// ErrorTTL is how long Remember keeps a failed load before trying again
+	ErrorTTL time.Duration
+	// LockTTL is the longest one instance may hold the lock on a load, others wait up to as long
+	LockTTL time.Duration
+}
+
+// NewConfig reads the cache settings from the environment (.env)
+func NewConfig() Config {
+	namespace := os.Getenv("CACHE_NAMESPACE")
+	if namespace == "" {
+		namespace = "api"
+	}
+
+	return Config{
+		Namespace: namespace,
+		Stale:     envSeconds("CACHE_STALE", 30),
+		ErrorTTL:  envSeconds("CACHE_ERROR_TTL", 5),
+		LockTTL:   envSeconds("CACHE_LOCK_TTL", 10),
+	}
+}
+
+// NewPlaygroundConfig reads the settings of the public cache page's store. Its
+// keys go in their own namespace (CACHE_PLAYGROUND_NAMESPACE), so visitors
+// can't read, overwrite or empty what the api and the app keep in the cache.
+func NewPlaygroundConfig() Config {
+	config := NewConfig()
+	api := config.Namespace
+
+	config.Namespace = os.Getenv("CACHE_PLAYGROUND_NAMESPACE")
+	if config.Namespace == "" {
+		config.Namespace = "playground"
+	}
+	if config.Namespace == api {
+		config.Namespace = api + "-playground"
+	}
+
+	return config
+}
+
+func envSeconds(name string, fallback int) time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || seconds < 0 {
+		seconds = fallback
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// Entry is a value in the cache
+type Entry struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+	// ExpiresAt is nil for entries that don't expire
+	ExpiresAt *time.Time `json:"expires_at"`
+	// TTL is the number of seconds left, 0 for entries that don't expire
+	TTL int `json:"ttl"`
+}
+
+// newEntry sets the ttl from expiresAt, a unix time or 0
+func newEntry(key string, value json.RawMessage, expiresAt int64) *Entry {
+	e := &Entry{Key: key, Value: value}
+	if expiresAt != 0 {
+		expires := time.Unix(expiresAt, 0).UTC()
+		e.ExpiresAt = &expires
+		e.TTL = int((time.Until(expires) + time.Second - 1) / time.Second)
+		if e.TTL < 1 {
+			// expiring now, but not gone yet
+			e.TTL = 1
+		}
+	}
+
+	return e
+}
+
+// stored is what is saved in the cache, as a json string. Values saved by
+// Remember stay in the cache until StaleUntil, and one with Err is a failed load.
+type stored struct {
+	Value      json.RawMessage `json:"v,omitempty"`
+	ExpiresAt  int64           `json:"e,omitempty"`
+	StaleUntil int64           `json:"s,omitempty"`
+	Err        string          `json:"x,omitempty"`
+}
+
+// fresh reports whether the value's ttl hasn't run out
+func (e *stored) fresh() bool {
+	return e.ExpiresAt == 0 || time.Now().Unix() < e.ExpiresAt
+}
+
+// Stats counts the store's operations since it was created
+type Stats struct {
+	Hits     uint64  `json:"hits"`
+	Misses   uint64  `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
+	Sets     uint64  `json:"sets"`
+	Deletes  uint64  `json:"deletes"`
+	// Loads counts the values Remember loaded, LoadErrors those that failed
+	Loads      uint64 `json:"loads"`
+	LoadErrors uint64 `json:"load_errors"`
+	// StaleHits counts the stale values Remember served while reloading them
+	StaleHits uint64    `json:"stale_hits"`
+	Since     time.Time `json:"since"`
+}
+
+// Store reads and writes json values in a cache.Cache
+type Store struct {
+	Cache     cache.Cache
+	Namespace string
+
+	stale    time.Duration
+	errorTTL time.Duration
+	lockTTL  time.Duration
+
+	// loads holds the Remember loads in progress in this process, by key
+	mu    sync.Mutex
+	loads map[string]*load
+
+	hits       uint64
+	misses     uint64
+	sets       uint64
+	deletes    uint64
+	loaded     uint64
+	loadErrors uint64
+	staleHits  uint64
+	since      time.Time
+}
+
+// New creates a store over c, which may be nil when no cache is configured
+func New(c cache.Cache, config Config) *Store {
+	return &Store{
+		Cache:     withLister(c),
+		Namespace: config.Namespace,
+		stale:     config.Stale,
+		errorTTL:  config.ErrorTTL,
+		lockTTL:   config.LockTTL,
+		loads:     make(map[string]*load),
+		since:     time.Now(),
+	}
+}
+
+// ValidKey checks a key given by a client
+func ValidKey(key string) error {
+	switch {
+	case key == "":
+		return errors.New("the key is empty")
+	case len(key) > MaxKeyLength:
+		return fmt.Errorf("the key is longer than %d characters", MaxKeyLength)
+	case strings.ContainsAny(key, "*?[] \t\r\n"):
+		return errors.New("the key may not contain spaces or any of * ? [ ]")
+	}
+
+	return nil
+}
+
+func (s *Store) key(key string) string {
+	return s.Namespace + ":" + key
+}
+
+// Get gets the entry for key, or ErrNotFound. A value Remember is reloading,
+// or failed to load, is not found.
+func (s *Store) Get(key string) (*Entry, error) {
+	if s.Cache == nil {
+		return nil, ErrNoCache
+	}
+
+	entry, err := s.read(key)
+	if err == nil && (!entry.fresh() || entry.Err != "") {
+		err = ErrNotFound
+	}
+	if errors.Is(err, ErrNotFound) {
+		atomic.AddUint64(&s.misses, 1)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.AddUint64(&s.hits, 1)
+
+	return newEntry(key, entry.Value, entry.ExpiresAt), nil
+}
+
+// read gets what is saved for key, without counting it
+func (s *Store) read(key string) (*stored, error) {
+	value, err := s.Cache.Get(s.key(key))
+	if err != nil {
+		// the caches return an error for a missing key, tell it apart from a failure
+		if has, hasErr := s.Cache.Has(s.key(key)); hasErr == nil && !has {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	text, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("appcache: %s holds a %T, not json", key, value)
+	}
+
+	var entry stored
+	if err := json.Unmarshal([]byte(text), &entry); err != nil {
+		return nil, fmt.Errorf("appcache: %s: %w", key, err)
+	}
+
+	return &entry, nil
+}
+
+// write saves entry for key, kept by the cache for seconds or for good when 0
+func (s *Store) write(key string, entry stored, seconds int) error {
+	text, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	var expires []int
+	if seconds > 0 {
+		expires = append(expires, seconds)
+	}
+	if err := s.Cache.Set(s.key(key), string(text), expires...); err != nil {
+		return err
+	}
+	atomic.AddUint64(&s.sets, 1)
+
+	return nil
+}
+
+// Has reports whether key is in the cache
+func (s *Store) Has(key string) (bool, error) {
+	if s.Cache == nil {
+		return false, ErrNoCache
+	}
+
+	return s.Cache.Has(s.key(key))
+}
+
+// Set saves value, which must be valid json, for ttl or for good when ttl is 0.
+// The ttl is rounded up to whole seconds.
+func (s *Store) Set(key string, value json.RawMessage, ttl time.Duration) (*Entry, error) {
+	if s.Cache == nil {
+		return nil, ErrNoCache
+	}
+	if !json.Valid(value) {
+		return nil, errors.New("appcache: the value is not valid json")
+	}
+
+	entry := stored{Value: value}
+
+	seconds := toSeconds(ttl)
+	if seconds > 0 {
+		entry.ExpiresAt = time.Now().Unix() + int64(seconds)
+	}
+
+	if err := s.write(key, entry, seconds); err != nil {
+		return nil, err
+	}
+
+	return newEntry(key, value, entry.ExpiresAt), nil
+}
+
+// toSeconds rounds a ttl up to whole seconds
+func toSeconds(ttl time.Duration) int {
+	if ttl <= 0 {
+		return 0
+	}
+
+	return int((ttl + time.Second - 1) / time.Second)
+}
+
+// Touch gives an existing entry a new ttl, 0 makes it permanent. The caches
+// can't change a ttl on their own, so the value is read and saved again; a
+// write to the key in between is lost.
+func (s *Store) Touch(key string, ttl time.Duration) (*Entry, error) {
+	entry, err := s.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Set(key, entry.Value, ttl)
+}
+
+// Delete removes key, it is not an error if it isn't there
+func (s *Store) Delete(key string) error {
+	if s.Cache == nil {
+		return ErrNoCache
+	}
+
+	if err := s.Cache.Forget(s.key(key)); err != nil {
+		return err
+	}
+	atomic.AddUint64(&s.deletes, 1)
+
+	return nil
+}
+
+// DeletePrefix removes every key in the namespace that starts with prefix
+func (s *Store) DeletePrefix(prefix string) error {
+	if s.Cache == nil {
+		return ErrNoCache
+	}
+
+	if err := s.Cache.EmptyByMatch(s.key(prefix)); err != nil {
+		return err
+	}
+	atomic.AddUint64(&s.deletes, 1)
+
+	return nil
+}
+
+// Keys lists the keys that start with prefix, sorted, or ErrListUnsupported
+func (s *Store) Keys(prefix string) ([]string, error) {
+	if s.Cache == nil {
+		return nil, ErrNoCache
+	}
+
+	lister, ok := s.Cache.(Lister)
+	if !ok {
+		return nil, ErrListUnsupported
+	}
+
+	keys, err := lister.Keys(s.key(prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	trimmed := make([]string, 0, len(keys))
+	for _, key := range keys {
+		trimmed = append(trimmed, strings.TrimPrefix(key, s.key("")))
+	}
+	sort.Strings(trimmed)
+
+	return trimmed, nil
+}
+
+// Stats returns the counts so far
+func (s *Store) Stats() Stats {
+	stats := Stats{
+		Hits:    atomic.LoadUint64(&s.hits),
+		Misses:  atomic.LoadUint64(&s.misses),
+		Sets:    atomic.LoadUint64(&s.sets),
+		Deletes: atomic.LoadUint64(&s.deletes),
+
+		Loads:      atomic.LoadUint64(&s.loaded),
+		LoadErrors: atomic.LoadUint64(&s.loadErrors),
+		StaleHits:  atomic.LoadUint64(&s.staleHits),
+		Since:      s.since,
+	}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(total)
+	}
+
+	return stats
+}
@@ -0,0 +1,121 @@
+package appcache
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cmd-ctrl-q/celeritas/cache"
+)
+
+func TestStore(t *testing.T) {
+	memory := NewMemory()
+	store := New(memory, Config{Namespace: "api"})
+
+	if _, err := store.Get("missing"); !errors.Is(err, ErrNotFound) {
+		t.Error("expected ErrNotFound, got", err)
+	}
+
+	entry, err := store.Set("user:1", json.RawMessage(`{"name":"Jack","tags":[1,2]}`), 1500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.ExpiresAt == nil || time.Until(*entry.ExpiresAt) > 2*time.Second {
+		t.Error("expected the ttl to be rounded up to 2 seconds, got", entry.ExpiresAt)
+	}
+	if _, err := store.Set("user:2", json.RawMessage(`42`), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Set("bad", json.RawMessage(`{`), 0); err == nil {
+		t.Error("expected an error for invalid json")
+	}
+
+	if has, _ := memory.Has("api:user:1"); !has {
+		t.Error("expected the key to be stored under the namespace")
+	}
+
+	got, err := store.Get("user:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Value) != `{"name":"Jack","tags":[1,2]}` || got.ExpiresAt == nil {
+		t.Error("unexpected entry", got)
+	}
+	if got, _ := store.Get("user:2"); got == nil || got.ExpiresAt != nil || got.TTL != 0 {
+		t.Error("expected user:2 to never expire, got", got)
+	}
+
+	touched, err := store.Touch("user:2", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if touched.TTL != 60 || string(touched.Value) != `42` {
+		t.Error("expected user:2 to keep its value with a 60 second ttl, got", touched)
+	}
+	if _, err := store.Touch("missing", time.Minute); !errors.Is(err, ErrNotFound) {
+		t.Error("expected ErrNotFound touching a missing key, got", err)
+	}
+
+	keys, err := store.Keys("user:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] != "user:1" || keys[1] != "user:2" {
+		t.Error("unexpected keys", keys)
+	}
+
+	if err := store.DeletePrefix("user:"); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := store.Keys(""); len(keys) != 0 {
+		t.Error("expected the keys to be deleted, got", keys)
+	}
+
+	stats := store.Stats()
+	if stats.Hits != 3 || stats.Misses != 2 || stats.Sets != 3 || stats.Deletes != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if stats.HitRatio != 0.6 {
+		t.Error("expected a hit ratio of 3/5, got", stats.HitRatio)
+	}
+}
+
+// noListCache hides the Keys method of the cache it wraps
+type noListCache struct{ cache.Cache }
+
+func TestStore_Unsupported(t *testing.T) {
+	store := New(noListCache{NewMemory()}, Config{Namespace: "api"})
+	if _, err := store.Keys(""); !errors.Is(err, ErrListUnsupported) {
+		t.Error("expected ErrListUnsupported, got", err)
+	}
+
+	store = New(nil, NewConfig())
+	if _, err := store.Get("key"); !errors.Is(err, ErrNoCache) {
+		t.Error("expected ErrNoCache, got", err)
+	}
+}
+
+func TestValidKey(t *testing.T) {
+	for _, key := range []string{"", "has space", "star*", string(make([]byte, MaxKeyLength+1))} {
+		if ValidKey(key) == nil {
+			t.Errorf("expected %q to be invalid", key)
+		}
+	}
+	if err := ValidKey("user:1/settings"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewPlaygroundConfig(t *testing.T) {
+	t.Setenv("CACHE_NAMESPACE", "")
+	t.Setenv("CACHE_PLAYGROUND_NAMESPACE", "")
+	if got := NewPlaygroundConfig().Namespace; got != "playground" {
+		t.Error("expected the playground namespace, got", got)
+	}
+
+	t.Setenv("CACHE_PLAYGROUND_NAMESPACE", "api")
+	if got := NewPlaygroundConfig().Namespace; got == NewConfig().Namespace {
+		t.Error("expected the playground to keep out of the api's namespace, got", got)
+	}
+}
@@ -0,0 +1,247 @@
+package appcache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrInvalidSnapshot is returned by Import for a snapshot with a bad key, value or ttl
+var ErrInvalidSnapshot = errors.New("appcache: invalid snapshot")
+
+// KeyInfo describes a cached value without the value itself
+type KeyInfo struct {
+	Key string `json:"key"`
+	// Type is the json type of the value: object, array, string, number, boolean or null.
+	// A failed Remember load is "error".
+	Type string `json:"type"`
+	// Size is the length of the value's json in bytes
+	Size      int        `json:"size"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	// TTL is the number of seconds left, 0 for values that don't expire
+	TTL int `json:"ttl"`
+	// Stale is set for a value Remember is serving past its ttl
+	Stale bool `json:"stale"`
+}
+
+// Info describes the cache backend
+type Info struct {
+	Backend   string `json:"backend"`
+	Namespace string `json:"namespace"`
+	// CanList is false for backends that can't list their keys, the browser,
+	// export and pattern deletes need it. The redis and badger caches can.
+	CanList bool  `json:"can_list"`
+	Stats   Stats `json:"stats"`
+}
+
+// Snapshot is an export of the namespace, for debugging. Importing it saves
+// the values again with the ttls they had left.
+type Snapshot struct {
+	Namespace  string          `json:"namespace"`
+	ExportedAt time.Time       `json:"exported_at"`
+	Entries    []SnapshotEntry `json:"entries"`
+}
+
+// SnapshotEntry is one value in a Snapshot
+type SnapshotEntry struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+	// TTL is the number of seconds left, 0 for values that don't expire
+	TTL int `json:"ttl"`
+}
+
+// Info returns the backend's name, whether it can list keys and the stats
+func (s *Store) Info() Info {
+	info := Info{Namespace: s.Namespace, Stats: s.Stats()}
+
+	switch backend := fmt.Sprintf("%T", s.Cache); backend {
+	case "<nil>":
+		info.Backend = "none"
+	case "*appcache.Redis", "*cache.RedisCache":
+		info.Backend = "redis"
+	case "*appcache.Badger", "*cache.BadgerCache":
+		info.Backend = "badger"
+	case "*appcache.Memory":
+		info.Backend = "memory"
+	default:
+		info.Backend = backend
+	}
+	_, info.CanList = s.Cache.(Lister)
+
+	return info
+}
+
+// Describe lists the values whose key starts with prefix, with their type,
+// size and ttl. Keys that expire while they are read are left out.
+func (s *Store) Describe(prefix string) ([]KeyInfo, error) {
+	keys, err := s.Keys(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]KeyInfo, 0, len(keys))
+	for _, key := range keys {
+		entry, err := s.read(key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		e := newEntry(key, entry.Value, entry.ExpiresAt)
+		info := KeyInfo{
+			Key:       key,
+			Type:      jsonType(entry.Value),
+			Size:      len(entry.Value),
+			ExpiresAt: e.ExpiresAt,
+			TTL:       e.TTL,
+			Stale:     !entry.fresh(),
+		}
+		if entry.Err != "" {
+			info.Type = "error"
+		}
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// jsonType names the json type of a value from its first character
+func jsonType(value json.RawMessage) string {
+	text := strings.TrimSpace(string(value))
+	if text == "" {
+		return "null"
+	}
+
+	switch text[0] {
+	case '{':
+		return "object"
+	case '[':
+		return "array"
+	case '"':
+		return "string"
+	case 't', 'f':
+		return "boolean"
+	case 'n':
+		return "null"
+	default:
+		return "number"
+	}
+}
+
+// ValidPattern checks a pattern given by a client, * ? and [] match as in
+// path.Match except that * and ? match / too
+func ValidPattern(pattern string) error {
+	if pattern == "" {
+		return errors.New("the pattern is empty")
+	}
+	if len(pattern) > MaxKeyLength {
+		return fmt.Errorf("the pattern is longer than %d characters", MaxKeyLength)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return errors.New("the pattern is malformed")
+	}
+
+	return nil
+}
+
+// match is path.Match, but with * and ? matching / too. Keys can't hold a
+// space, so / is swapped for one in both.
+func match(pattern, key string) bool {
+	ok, _ := path.Match(strings.ReplaceAll(pattern, "/", " "), strings.ReplaceAll(key, "/", " "))
+	return ok
+}
+
+// DeleteMatch removes the values whose key matches pattern and returns how
+// many there were. A pattern that is a prefix followed by * works on every
+// backend, any other needs one that can list its keys; the count is -1 when
+// it can't.
+func (s *Store) DeleteMatch(pattern string) (int, error) {
+	if s.Cache == nil {
+		return 0, ErrNoCache
+	}
+
+	prefix := strings.TrimSuffix(pattern, "*")
+	if _, ok := s.Cache.(Lister); !ok && !strings.ContainsAny(prefix, "*?[") && prefix != pattern {
+		return -1, s.DeletePrefix(prefix)
+	}
+
+	keys, err := s.Keys("")
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, key := range keys {
+		if !match(pattern, key) {
+			continue
+		}
+		if err := s.Delete(key); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// Export copies the values whose key starts with prefix into a snapshot.
+// Failed Remember loads are left out.
+func (s *Store) Export(prefix string) (*Snapshot, error) {
+	keys, err := s.Keys(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{Namespace: s.Namespace, ExportedAt: time.Now().UTC(), Entries: []SnapshotEntry{}}
+	for _, key := range keys {
+		entry, err := s.read(key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entry.Err != "" {
+			continue
+		}
+
+		e := newEntry(key, entry.Value, entry.ExpiresAt)
+		snapshot.Entries = append(snapshot.Entries, SnapshotEntry{Key: key, Value: entry.Value, TTL: e.TTL})
+	}
+
+	return snapshot, nil
+}
+
+// Import saves every value in the snapshot, in this store's namespace, and
+// returns how many were saved. Every key and value is checked first, so a bad
+// snapshot saves nothing.
+func (s *Store) Import(snapshot Snapshot) (int, error) {
+	if s.Cache == nil {
+		return 0, ErrNoCache
+	}
+
+	for i, entry := range snapshot.Entries {
+		if err := ValidKey(entry.Key); err != nil {
+			return 0, fmt.Errorf("%w: entry %d: %s", ErrInvalidSnapshot, i, err)
+		}
+		if !json.Valid(entry.Value) {
+			return 0, fmt.Errorf("%w: entry %d (%s): the value is not valid json", ErrInvalidSnapshot, i, entry.Key)
+		}
+		if entry.TTL < 0 {
+			return 0, fmt.Errorf("%w: entry %d (%s): the ttl is negative", ErrInvalidSnapshot, i, entry.Key)
+		}
+	}
+
+	for i, entry := range snapshot.Entries {
+		if _, err := s.Set(entry.Key, entry.Value, time.Duration(entry.TTL)*time.Second); err != nil {
+			return i, err
+		}
+	}
+
+	return len(snapshot.Entries), nil
+}
@@ -0,0 +1,126 @@
+package appcache
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStore_Describe(t *testing.T) {
+	store := New(NewMemory(), Config{Namespace: "api"})
+	_, _ = store.Set("user:1", json.RawMessage(`{"name":"Jack"}`), time.Minute)
+	_, _ = store.Set("user:2", json.RawMessage(`[1, 2]`), 0)
+	_, _ = store.Set("count", json.RawMessage(`42`), 0)
+
+	infos, err := store.Describe("user:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatal("expected two keys, got", infos)
+	}
+	if infos[0].Key != "user:1" || infos[0].Type != "object" || infos[0].Size != 15 || infos[0].TTL != 60 {
+		t.Errorf("unexpected info %+v", infos[0])
+	}
+	if infos[1].Type != "array" || infos[1].TTL != 0 || infos[1].ExpiresAt != nil {
+		t.Errorf("unexpected info %+v", infos[1])
+	}
+
+	for value, want := range map[string]string{`"a"`: "string", `true`: "boolean", `null`: "null", `-1.5`: "number"} {
+		if got := jsonType(json.RawMessage(value)); got != want {
+			t.Errorf("expected %s to be a %s, got %s", value, want, got)
+		}
+	}
+
+	if info := store.Info(); info.Backend != "memory" || !info.CanList || info.Namespace != "api" {
+		t.Errorf("unexpected info %+v", info)
+	}
+	if info := New(noListCache{NewMemory()}, Config{}).Info(); info.CanList {
+		t.Error("expected a cache without Keys not to list")
+	}
+}
+
+func TestStore_DeleteMatch(t *testing.T) {
+	store := New(NewMemory(), Config{Namespace: "api"})
+	for _, key := range []string{"user:1:settings", "user:2:settings", "user:2:avatar", "user:3/settings", "team:1:settings"} {
+		_, _ = store.Set(key, json.RawMessage(`1`), 0)
+	}
+
+	deleted, err := store.DeleteMatch("user:*:settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Error("expected two keys deleted, got", deleted)
+	}
+
+	if deleted, _ := store.DeleteMatch("user:*"); deleted != 2 {
+		t.Error("expected * to match / too, got", deleted)
+	}
+	if keys, _ := store.Keys(""); len(keys) != 1 || keys[0] != "team:1:settings" {
+		t.Error("unexpected keys left", keys)
+	}
+
+	// without listing only a prefix works
+	noList := New(noListCache{NewMemory()}, Config{Namespace: "api"})
+	_, _ = noList.Set("user:1", json.RawMessage(`1`), 0)
+	if _, err := noList.DeleteMatch("user:*"); err != nil {
+		t.Error(err)
+	}
+	if has, _ := noList.Has("user:1"); has {
+		t.Error("expected the prefix to be deleted")
+	}
+	if _, err := noList.DeleteMatch("user:*:settings"); !errors.Is(err, ErrListUnsupported) {
+		t.Error("expected ErrListUnsupported, got", err)
+	}
+
+	if ValidPattern("user:[") == nil || ValidPattern("") == nil {
+		t.Error("expected bad patterns to be invalid")
+	}
+}
+
+func TestStore_Snapshot(t *testing.T) {
+	from := New(NewMemory(), Config{Namespace: "api"})
+	_, _ = from.Set("user:1", json.RawMessage(`{"name":"Jack"}`), time.Minute)
+	_, _ = from.Set("count", json.RawMessage(`42`), 0)
+
+	snapshot, err := from.Export("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Entries) != 2 || snapshot.Namespace != "api" {
+		t.Fatalf("unexpected snapshot %+v", snapshot)
+	}
+
+	// round trip it through json, as the browser does
+	text, _ := json.Marshal(snapshot)
+	var decoded Snapshot
+	if err := json.Unmarshal(text, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	to := New(NewMemory(), Config{Namespace: "other"})
+	imported, err := to.Import(decoded)
+	if err != nil || imported != 2 {
+		t.Fatal("import failed", imported, err)
+	}
+	if entry, _ := to.Get("user:1"); entry == nil || string(entry.Value) != `{"name":"Jack"}` || entry.TTL != 60 {
+		t.Error("unexpected imported entry", entry)
+	}
+	if entry, _ := to.Get("count"); entry == nil || entry.TTL != 0 {
+		t.Error("expected count never to expire, got", entry)
+	}
+
+	bad := Snapshot{Entries: []SnapshotEntry{{Key: "ok", Value: json.RawMessage(`1`)}, {Key: "bad key", Value: json.RawMessage(`1`)}}}
+	if _, err := to.Import(bad); !errors.Is(err, ErrInvalidSnapshot) {
+		t.Error("expected ErrInvalidSnapshot, got", err)
+	}
+	if has, _ := to.Has("ok"); has {
+		t.Error("expected nothing saved from a bad snapshot")
+	}
+
+	if _, err := New(noListCache{NewMemory()}, Config{}).Export(""); !errors.Is(err, ErrListUnsupported) {
+		t.Error("expected ErrListUnsupported, got", err)
+	}
+}
@@ -0,0 +1,197 @@
+package appcache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/cmd-ctrl-q/celeritas/cache"
+	"github.com/dgraph-io/badger"
+	"github.com/gomodule/redigo/redis"
+)
+
+// scanCount is how many keys redis is asked to look at per SCAN
+const scanCount = 500
+
+// Redis is the celeritas redis cache with a Lister and a Locker. Keys walks
+// the keyspace with SCAN, so it doesn't block redis the way KEYS does.
+type Redis struct {
+	*cache.RedisCache
+}
+
+// Keys returns the keys that start with prefix, without the cache's own prefix
+func (c *Redis) Keys(prefix string) ([]string, error) {
+	conn := c.Conn.Get()
+	defer conn.Close()
+
+	// the celeritas cache saves every key as Prefix:key
+	own := c.Prefix + ":"
+	pattern := escapeGlob(own+prefix) + "*"
+
+	var keys []string
+	cursor := 0
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", scanCount))
+		if err != nil {
+			return nil, err
+		}
+
+		var page []string
+		if _, err := redis.Scan(reply, &cursor, &page); err != nil {
+			return nil, err
+		}
+		for _, key := range page {
+			keys = append(keys, strings.TrimPrefix(key, own))
+		}
+
+		if cursor == 0 {
+			break
+		}
+	}
+
+	// SCAN may return a key more than once
+	return dedupe(keys), nil
+}
+
+// Add saves value for expires seconds only if key isn't set, with SET NX so
+// redis decides which instance gets it
+func (c *Redis) Add(key string, value interface{}, expires int) (bool, error) {
+	// saved the way the celeritas cache saves it, so its Get can read it
+	key = c.Prefix + ":" + key
+	encoded, err := encode(key, value)
+	if err != nil {
+		return false, err
+	}
+
+	conn := c.Conn.Get()
+	defer conn.Close()
+
+	args := []interface{}{key, encoded, "NX"}
+	if expires > 0 {
+		args = append(args, "EX", expires)
+	}
+	reply, err := conn.Do("SET", args...)
+	if err != nil {
+		return false, err
+	}
+
+	// a nil reply means the key was already set
+	return reply != nil, nil
+}
+
+// encode gob encodes value the way the celeritas caches do, as a
+// cache.Entry holding the one key
+func encode(key string, value interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(cache.Entry{key: value}); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// escapeGlob escapes the characters redis patterns treat specially
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+func dedupe(keys []string) []string {
+	seen := make(map[string]bool, len(keys))
+	unique := keys[:0]
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+
+	return unique
+}
+
+// Badger is the celeritas badger cache with a Lister and a Locker. Keys
+// iterates over the prefix without reading the values; expired keys are
+// skipped by badger.
+type Badger struct {
+	*cache.BadgerCache
+}
+
+// Keys returns the keys that start with prefix. The celeritas badger cache
+// saves keys as they are given.
+func (c *Badger) Keys(prefix string) ([]string, error) {
+	var keys []string
+	err := c.Conn.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+			keys = append(keys, string(it.Item().KeyCopy(nil)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Add saves value for expires seconds only if key isn't set. The check and the
+// write are one transaction, badger fails the later of two that race.
+func (c *Badger) Add(key string, value interface{}, expires int) (bool, error) {
+	encoded, err := encode(key, value)
+	if err != nil {
+		return false, err
+	}
+
+	err = c.Conn.Update(func(txn *badger.Txn) error {
+		if _, err := txn.Get([]byte(key)); err != badger.ErrKeyNotFound {
+			if err == nil {
+				return errTaken
+			}
+			return err
+		}
+
+		entry := badger.NewEntry([]byte(key), encoded)
+		if expires > 0 {
+			entry = entry.WithTTL(time.Duration(expires) * time.Second)
+		}
+		return txn.SetEntry(entry)
+	})
+	if errors.Is(err, errTaken) || errors.Is(err, badger.ErrConflict) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// errTaken ends Badger.Add's transaction when the key is already set
+var errTaken = errors.New("appcache: the key is set")
+
+// withLister wraps the celeritas caches in the adapters above, so every
+// backend the app can be configured with can list its keys
+func withLister(c cache.Cache) cache.Cache {
+	switch c := c.(type) {
+	case *cache.RedisCache:
+		return &Redis{c}
+	case *cache.BadgerCache:
+		return &Badger{c}
+	}
+
+	return c
+}
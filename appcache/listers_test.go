@@ -0,0 +1,122 @@
+package appcache
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/cmd-ctrl-q/celeritas/cache"
+	"github.com/dgraph-io/badger"
+	"github.com/gomodule/redigo/redis"
+)
+
+// testListing stores a few values through the celeritas cache c and checks
+// the browser, export and pattern deletes work on it
+func testListing(t *testing.T, c cache.Cache, backend string) {
+	store := New(c, Config{Namespace: "api"})
+	if info := store.Info(); info.Backend != backend || !info.CanList {
+		t.Fatalf("expected a %s cache that can list, got %+v", backend, info)
+	}
+
+	_, _ = store.Set("user:1", json.RawMessage(`{"name":"Jack"}`), time.Minute)
+	_, _ = store.Set("user:2", json.RawMessage(`[1, 2]`), 0)
+	_, _ = store.Set("post:1", json.RawMessage(`42`), 0)
+	// outside the namespace
+	_ = c.Set("other:user:3", "x")
+
+	keys, err := store.Keys("user:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] != "user:1" || keys[1] != "user:2" {
+		t.Fatal("expected the two user keys, got", keys)
+	}
+
+	infos, err := store.Describe("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 3 || infos[1].Key != "user:1" || infos[1].Type != "object" || infos[1].TTL != 60 {
+		t.Errorf("unexpected infos %+v", infos)
+	}
+
+	snapshot, err := store.Export("user:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Entries) != 2 {
+		t.Errorf("expected two entries, got %+v", snapshot.Entries)
+	}
+
+	// not a prefix pattern, so it needs the keys listed
+	deleted, err := store.DeleteMatch("*:1")
+	if err != nil || deleted != 2 {
+		t.Fatalf("expected two deleted, got %d: %v", deleted, err)
+	}
+	if keys, _ := store.Keys(""); len(keys) != 1 || keys[0] != "user:2" {
+		t.Error("expected only user:2 left, got", keys)
+	}
+	if has, _ := c.Has("other:user:3"); !has {
+		t.Error("expected the key outside the namespace to be kept")
+	}
+}
+
+// testLocking checks Add on the celeritas cache c takes a lock only once, and
+// the lock reads back through the celeritas cache
+func testLocking(t *testing.T, c cache.Cache) {
+	store := New(c, Config{Namespace: "api", LockTTL: time.Minute})
+	if _, ok := store.Cache.(Locker); !ok {
+		t.Fatalf("expected %T to be a Locker", store.Cache)
+	}
+
+	if ok, err := store.lock("lock:api:key", "one"); !ok || err != nil {
+		t.Fatal("expected to take the lock", err)
+	}
+	if ok, err := store.lock("lock:api:key", "two"); ok || err != nil {
+		t.Error("expected the lock to be held", err)
+	}
+	if value, _ := c.Get("lock:api:key"); value != "one" {
+		t.Error("expected the holder's token, got", value)
+	}
+
+	store.unlock("lock:api:key", "one")
+	if ok, _ := store.lock("lock:api:key", "two"); !ok {
+		t.Error("expected the released lock to be taken again")
+	}
+}
+
+func TestRedis(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", server.Addr())
+		},
+	}
+	defer pool.Close()
+
+	testListing(t, &cache.RedisCache{Conn: pool, Prefix: "myapp"}, "redis")
+	testLocking(t, &cache.RedisCache{Conn: pool, Prefix: "myapp"})
+}
+
+func TestBadger(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions(t.TempDir()).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	testListing(t, &cache.BadgerCache{Conn: db}, "badger")
+	testLocking(t, &cache.BadgerCache{Conn: db})
+}
+
+func TestEscapeGlob(t *testing.T) {
+	if got := escapeGlob(`a*b?[c]\`); got != `a\*b\?\[c\]\\` {
+		t.Error("unexpected escape", got)
+	}
+}
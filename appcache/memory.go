@@ -0,0 +1,133 @@
+package appcache
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory is a cache.Cache kept in memory, for tests and development. Unlike
+// the celeritas caches it can list its keys and take locks.
+type Memory struct {
+	mu      sync.Mutex
+	items   map[string]interface{}
+	expires map[string]time.Time
+}
+
+// NewMemory creates an empty memory cache
+func NewMemory() *Memory {
+	return &Memory{
+		items:   make(map[string]interface{}),
+		expires: make(map[string]time.Time),
+	}
+}
+
+// live reports whether key is set and not expired, the caller holds the lock
+func (m *Memory) live(key string) bool {
+	if _, ok := m.items[key]; !ok {
+		return false
+	}
+	if expires, ok := m.expires[key]; ok && !time.Now().Before(expires) {
+		delete(m.items, key)
+		delete(m.expires, key)
+		return false
+	}
+
+	return true
+}
+
+func (m *Memory) Has(key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.live(key), nil
+}
+
+func (m *Memory) Get(key string) (interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.live(key) {
+		return nil, errors.New("key not found")
+	}
+
+	return m.items[key], nil
+}
+
+// Set saves value, expires is an optional lifetime in seconds
+func (m *Memory) Set(key string, value interface{}, expires ...int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.items[key] = value
+	delete(m.expires, key)
+	if len(expires) > 0 && expires[0] > 0 {
+		m.expires[key] = time.Now().Add(time.Duration(expires[0]) * time.Second)
+	}
+
+	return nil
+}
+
+// Add saves value only if key isn't set, expires is a lifetime in seconds
+func (m *Memory) Add(key string, value interface{}, expires int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.live(key) {
+		return false, nil
+	}
+
+	m.items[key] = value
+	delete(m.expires, key)
+	if expires > 0 {
+		m.expires[key] = time.Now().Add(time.Duration(expires) * time.Second)
+	}
+
+	return true, nil
+}
+
+func (m *Memory) Forget(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.items, key)
+	delete(m.expires, key)
+	return nil
+}
+
+// EmptyByMatch removes the keys that start with match
+func (m *Memory) EmptyByMatch(match string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key := range m.items {
+		if strings.HasPrefix(key, match) {
+			delete(m.items, key)
+			delete(m.expires, key)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Empty() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.items = make(map[string]interface{})
+	m.expires = make(map[string]time.Time)
+	return nil
+}
+
+func (m *Memory) Keys(prefix string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []string
+	for key := range m.items {
+		if strings.HasPrefix(key, prefix) && m.live(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
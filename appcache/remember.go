@@ -0,0 +1,257 @@
+package appcache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// lockPoll is how often a caller waiting on another instance's load looks for its value
+const lockPoll = 50 * time.Millisecond
+
+// ErrLoadFailed is returned by Remember while a failed load is kept in the cache
+var ErrLoadFailed = errors.New("appcache: loading the value failed")
+
+// errLocked means another instance is loading the value
+var errLocked = errors.New("appcache: locked by another instance")
+
+// Loader loads the value for a key, it must return valid json
+type Loader func() (json.RawMessage, error)
+
+// Locker is implemented by caches that can take a lock for every instance of
+// the app. Memory, Redis and Badger all do. Without it Remember only stops
+// loads within the process from running twice, the lock it falls back on
+// doesn't hold between instances.
+type Locker interface {
+	// Add saves value for expires seconds only if key isn't set, and reports whether it did
+	Add(key string, value interface{}, expires int) (bool, error)
+}
+
+// load is a Remember load in progress, everyone asking for its key waits on done
+type load struct {
+	done  chan struct{}
+	entry *Entry
+	err   error
+}
+
+// Remember gets the value for key, calling loader and keeping what it returns
+// for ttl when the key isn't cached.
+//
+// Only one load of a key runs in the process at a time, the other callers
+// wait for it, and a lock in the cache keeps other instances from loading it
+// too. For Config.Stale after the ttl the old value is returned straight away
+// while one goroutine reloads it. A failed load is kept for Config.ErrorTTL,
+// during which Remember returns ErrLoadFailed, or the old value if there is one.
+func (s *Store) Remember(key string, ttl time.Duration, loader Loader) (*Entry, error) {
+	if s.Cache == nil {
+		return nil, ErrNoCache
+	}
+
+	entry, err := s.read(key)
+	switch {
+	case err == nil && entry.fresh():
+		atomic.AddUint64(&s.hits, 1)
+		if entry.Err != "" {
+			return nil, fmt.Errorf("%w: %s", ErrLoadFailed, entry.Err)
+		}
+		return newEntry(key, entry.Value, entry.ExpiresAt), nil
+	case err == nil && entry.Err == "":
+		// stale, reload it in the background
+		atomic.AddUint64(&s.staleHits, 1)
+		s.start(key, ttl, loader, entry, false)
+		return newEntry(key, entry.Value, entry.ExpiresAt), nil
+	case err != nil && !errors.Is(err, ErrNotFound):
+		return nil, err
+	}
+
+	atomic.AddUint64(&s.misses, 1)
+	l := s.start(key, ttl, loader, nil, true)
+	<-l.done
+	if errors.Is(l.err, errLocked) {
+		// joined a background reload that another instance is doing, wait for that instead
+		l = s.start(key, ttl, loader, nil, true)
+		<-l.done
+	}
+
+	return l.entry, l.err
+}
+
+// start joins the load of key in progress, or starts one. When wait is false
+// the load runs in its own goroutine.
+func (s *Store) start(key string, ttl time.Duration, loader Loader, stale *stored, wait bool) *load {
+	s.mu.Lock()
+	if l, ok := s.loads[key]; ok {
+		s.mu.Unlock()
+		return l
+	}
+	l := &load{done: make(chan struct{})}
+	s.loads[key] = l
+	s.mu.Unlock()
+
+	run := func() {
+		l.entry, l.err = s.load(key, ttl, loader, stale, wait)
+
+		s.mu.Lock()
+		delete(s.loads, key)
+		s.mu.Unlock()
+		close(l.done)
+	}
+
+	if wait {
+		run()
+	} else {
+		go run()
+	}
+
+	return l
+}
+
+// load takes the lock on key and calls loader. When another instance holds
+// the lock a background reload is dropped, and a caller that needs the value
+// waits for the other instance to save it.
+func (s *Store) load(key string, ttl time.Duration, loader Loader, stale *stored, wait bool) (*Entry, error) {
+	lock := "lock:" + s.key(key)
+	token := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	locked, err := s.lock(lock, token)
+	switch {
+	case err != nil:
+		// the cache is failing, load it without the lock
+	case locked:
+		defer s.unlock(lock, token)
+
+		// the value may have been saved since it was read
+		if entry, err := s.read(key); err == nil && entry.fresh() {
+			if entry.Err != "" {
+				return nil, fmt.Errorf("%w: %s", ErrLoadFailed, entry.Err)
+			}
+			return newEntry(key, entry.Value, entry.ExpiresAt), nil
+		}
+	case !wait:
+		return nil, errLocked
+	default:
+		if entry, ok := s.waitFor(key, lock); ok {
+			if entry.Err != "" {
+				return nil, fmt.Errorf("%w: %s", ErrLoadFailed, entry.Err)
+			}
+			return newEntry(key, entry.Value, entry.ExpiresAt), nil
+		}
+		// the other instance didn't save it in time, load it here
+	}
+
+	value, err := loader()
+	if err == nil && !json.Valid(value) {
+		err = errors.New("appcache: the loader returned invalid json")
+	}
+	if err != nil {
+		atomic.AddUint64(&s.loadErrors, 1)
+		s.saveError(key, err, stale)
+		return nil, err
+	}
+	atomic.AddUint64(&s.loaded, 1)
+
+	return s.save(key, value, ttl)
+}
+
+// save keeps value fresh for ttl and stale for Config.Stale after that
+func (s *Store) save(key string, value json.RawMessage, ttl time.Duration) (*Entry, error) {
+	seconds := toSeconds(ttl)
+	entry := stored{Value: value}
+	if seconds > 0 {
+		entry.ExpiresAt = time.Now().Unix() + int64(seconds)
+		if stale := toSeconds(s.stale); stale > 0 {
+			entry.StaleUntil = entry.ExpiresAt + int64(stale)
+			seconds += stale
+		}
+	}
+
+	if err := s.write(key, entry, seconds); err != nil {
+		return nil, err
+	}
+
+	return newEntry(key, value, entry.ExpiresAt), nil
+}
+
+// saveError keeps a failed load for Config.ErrorTTL. With an old value that
+// value is kept fresh instead, so callers get it rather than the error.
+func (s *Store) saveError(key string, loadErr error, stale *stored) {
+	seconds := toSeconds(s.errorTTL)
+	if seconds == 0 {
+		return
+	}
+
+	entry := stored{Err: loadErr.Error(), ExpiresAt: time.Now().Unix() + int64(seconds)}
+	if stale != nil {
+		entry = *stale
+		entry.ExpiresAt = time.Now().Unix() + int64(seconds)
+		if entry.StaleUntil < entry.ExpiresAt {
+			entry.StaleUntil = entry.ExpiresAt
+		}
+		seconds = int(entry.StaleUntil - time.Now().Unix())
+	}
+
+	// failing to save it only means the next caller loads again
+	_ = s.write(key, entry, seconds)
+}
+
+// lock takes the lock for Config.LockTTL
+func (s *Store) lock(key, token string) (bool, error) {
+	seconds := toSeconds(s.lockTTL)
+	if seconds == 0 {
+		seconds = 1
+	}
+
+	if locker, ok := s.Cache.(Locker); ok {
+		return locker.Add(key, token, seconds)
+	}
+
+	// in-process only: two instances can both find the key missing and set it
+	has, err := s.Cache.Has(key)
+	if err != nil || has {
+		return false, err
+	}
+	if err := s.Cache.Set(key, token, seconds); err != nil {
+		return false, err
+	}
+
+	// read it back, the lock is ours unless another instance set it in between
+	value, err := s.Cache.Get(key)
+	if err != nil {
+		return false, err
+	}
+
+	return value == token, nil
+}
+
+// unlock releases the lock if it is still ours, it may have run out
+func (s *Store) unlock(key, token string) {
+	if value, err := s.Cache.Get(key); err == nil && value == token {
+		_ = s.Cache.Forget(key)
+	}
+}
+
+// waitFor waits up to Config.LockTTL for the instance holding the lock to
+// save a value
+func (s *Store) waitFor(key, lock string) (*stored, bool) {
+	deadline := time.Now().Add(s.lockTTL)
+	for time.Now().Before(deadline) {
+		time.Sleep(lockPoll)
+
+		if entry, err := s.read(key); err == nil && entry.fresh() {
+			return entry, true
+		}
+		if has, err := s.Cache.Has(lock); err != nil || !has {
+			break
+		}
+	}
+
+	entry, err := s.read(key)
+	if err != nil || !entry.fresh() {
+		return nil, false
+	}
+
+	return entry, true
+}
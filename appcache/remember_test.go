@@ -0,0 +1,174 @@
+package appcache
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStore_Remember(t *testing.T) {
+	store := New(NewMemory(), Config{Namespace: "api", LockTTL: time.Second})
+
+	var calls int32
+	loader := func() (json.RawMessage, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(50 * time.Millisecond)
+		return json.RawMessage(`{"count":42}`), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			entry, err := store.Remember("hot", time.Minute, loader)
+			if err != nil || string(entry.Value) != `{"count":42}` {
+				t.Error("unexpected entry", entry, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls != 1 {
+		t.Error("expected one load for concurrent callers, got", calls)
+	}
+	if entry, err := store.Get("hot"); err != nil || entry.TTL != 60 {
+		t.Error("expected the value to be saved for a minute, got", entry, err)
+	}
+	if _, err := store.Remember("hot", time.Minute, loader); err != nil || calls != 1 {
+		t.Error("expected a cached value not to be loaded again", err, calls)
+	}
+}
+
+func TestStore_RememberStale(t *testing.T) {
+	store := New(NewMemory(), Config{Namespace: "api", Stale: time.Minute, ErrorTTL: time.Minute, LockTTL: time.Second})
+
+	// a value whose ttl ran out a second ago
+	now := time.Now().Unix()
+	if err := store.write("stale", stored{Value: json.RawMessage(`"old"`), ExpiresAt: now - 1, StaleUntil: now + 60}, 60); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("stale"); !errors.Is(err, ErrNotFound) {
+		t.Error("expected Get not to return a stale value, got", err)
+	}
+
+	reloaded := make(chan struct{})
+	entry, err := store.Remember("stale", time.Minute, func() (json.RawMessage, error) {
+		defer close(reloaded)
+		return json.RawMessage(`"new"`), nil
+	})
+	if err != nil || string(entry.Value) != `"old"` {
+		t.Error("expected the stale value straight away, got", entry, err)
+	}
+
+	<-reloaded
+	waitForLoads(t, store)
+	if entry, _ := store.Get("stale"); entry == nil || string(entry.Value) != `"new"` {
+		t.Error("expected the value to be reloaded, got", entry)
+	}
+
+	// a failed reload keeps serving the old value
+	if err := store.write("stale", stored{Value: json.RawMessage(`"old"`), ExpiresAt: now - 1, StaleUntil: now + 60}, 60); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Remember("stale", time.Minute, func() (json.RawMessage, error) {
+		return nil, errors.New("database down")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	waitForLoads(t, store)
+	if entry, _ := store.Get("stale"); entry == nil || string(entry.Value) != `"old"` {
+		t.Error("expected the old value to be kept after a failed reload, got", entry)
+	}
+
+	if stats := store.Stats(); stats.StaleHits != 2 || stats.Loads != 1 || stats.LoadErrors != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestStore_RememberError(t *testing.T) {
+	store := New(NewMemory(), Config{Namespace: "api", ErrorTTL: time.Minute, LockTTL: time.Second})
+
+	calls := 0
+	failing := func() (json.RawMessage, error) {
+		calls++
+		return nil, errors.New("database down")
+	}
+
+	if _, err := store.Remember("broken", time.Minute, failing); err == nil || errors.Is(err, ErrLoadFailed) {
+		t.Error("expected the loader's error, got", err)
+	}
+	if _, err := store.Remember("broken", time.Minute, failing); !errors.Is(err, ErrLoadFailed) {
+		t.Error("expected ErrLoadFailed while the error is cached, got", err)
+	}
+	if calls != 1 {
+		t.Error("expected the failed load not to be retried yet, got", calls)
+	}
+
+	if _, err := store.Remember("invalid", time.Minute, func() (json.RawMessage, error) {
+		return json.RawMessage(`{`), nil
+	}); err == nil {
+		t.Error("expected an error for invalid json")
+	}
+}
+
+func TestStore_RememberLocked(t *testing.T) {
+	memory := NewMemory()
+	store := New(memory, Config{Namespace: "api", LockTTL: time.Second})
+
+	// another instance holds the lock and saves the value a little later
+	if ok, _ := memory.Add("lock:api:shared", "other", 1); !ok {
+		t.Fatal("expected to take the lock")
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_, _ = store.save("shared", json.RawMessage(`"theirs"`), time.Minute)
+		_ = memory.Forget("lock:api:shared")
+	}()
+
+	entry, err := store.Remember("shared", time.Minute, func() (json.RawMessage, error) {
+		return json.RawMessage(`"ours"`), nil
+	})
+	if err != nil || string(entry.Value) != `"theirs"` {
+		t.Error("expected the other instance's value, got", entry, err)
+	}
+}
+
+func TestStore_LockWithoutLocker(t *testing.T) {
+	store := New(noListCache{NewMemory()}, Config{Namespace: "api", LockTTL: time.Second})
+
+	if ok, err := store.lock("lock:key", "one"); !ok || err != nil {
+		t.Fatal("expected to take the lock", err)
+	}
+	if ok, _ := store.lock("lock:key", "two"); ok {
+		t.Error("expected the lock to be held")
+	}
+
+	store.unlock("lock:key", "two")
+	if has, _ := store.Cache.Has("lock:key"); !has {
+		t.Error("expected only the holder to release the lock")
+	}
+	store.unlock("lock:key", "one")
+	if has, _ := store.Cache.Has("lock:key"); has {
+		t.Error("expected the lock to be released")
+	}
+}
+
+// waitForLoads waits for the background loads to finish
+func waitForLoads(t *testing.T, store *Store) {
+	t.Helper()
+
+	for i := 0; i < 100; i++ {
+		store.mu.Lock()
+		n := len(store.loads)
+		store.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("background loads didn't finish")
+}
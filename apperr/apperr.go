@@ -0,0 +1,209 @@
+// Package apperr holds the application error type and writes it back to the
+// client as either a jet error page or a json envelope.
+package apperr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/CloudyKit/jet/v6"
+	"github.com/cmd-ctrl-q/celeritas"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+type contextKey string
+
+const jsonKey contextKey = "apperr_json"
+
+// Error is an error with an http status. Message is safe to show the client,
+// Err is the internal cause and is only ever logged.
+type Error struct {
+	Status  int
+	Message string
+	Err     error
+	Fields  []FieldError
+}
+
+// FieldError is a validation error on one field. Code is machine readable, eg "required" or "email".
+type FieldError struct {
+	Field   string `json:"field" xml:"field,attr"`
+	Message string `json:"message" xml:"message"`
+	Code    string `json:"code" xml:"code,attr"`
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%d %s: %v", e.Status, e.Message, e.Err)
+	}
+	return fmt.Sprintf("%d %s", e.Status, e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// New creates an error with a status, a public message and an internal cause
+func New(status int, message string, err error) *Error {
+	if message == "" {
+		message = http.StatusText(status)
+	}
+
+	return &Error{
+		Status:  status,
+		Message: message,
+		Err:     err,
+	}
+}
+
+// BadRequest is returned when the request could not be read
+func BadRequest(message string, err error) *Error {
+	return New(http.StatusBadRequest, message, err)
+}
+
+// Unauthorized is returned when the user is not authenticated
+func Unauthorized(message string, err error) *Error {
+	return New(http.StatusUnauthorized, message, err)
+}
+
+// Forbidden is returned when the user may not perform the action (eg bad csrf token)
+func Forbidden(message string, err error) *Error {
+	return New(http.StatusForbidden, message, err)
+}
+
+// NotFound is returned when the resource does not exist
+func NotFound(message string, err error) *Error {
+	return New(http.StatusNotFound, message, err)
+}
+
+// Internal hides the cause behind a generic message
+func Internal(err error) *Error {
+	return New(http.StatusInternalServerError, "", err)
+}
+
+// Invalid is returned when validation fails. messages are the errors by field
+// (celeritas Validation.Errors), codes the matching codes; fields without a code are "invalid".
+func Invalid(messages, codes map[string]string) *Error {
+	e := New(http.StatusUnprocessableEntity, "The given data was invalid", nil)
+
+	for field, message := range messages {
+		code, ok := codes[field]
+		if !ok {
+			code = "invalid"
+		}
+		e.Fields = append(e.Fields, FieldError{Field: field, Message: message, Code: code})
+	}
+
+	// map order is random, keep the response stable
+	sort.Slice(e.Fields, func(i, j int) bool {
+		return e.Fields[i].Field < e.Fields[j].Field
+	})
+
+	return e
+}
+
+// From converts any error to an *Error, unknown errors become a 500
+func From(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+
+	return Internal(err)
+}
+
+// HandlerFunc is a handler that returns its error instead of writing it
+type HandlerFunc func(w http.ResponseWriter, r *http.Request) error
+
+// Handle adapts a HandlerFunc to an http.HandlerFunc, writing any returned error
+func Handle(app *celeritas.Celeritas, fn HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := fn(w, r); err != nil {
+			Write(app, w, r, err)
+		}
+	}
+}
+
+// JSON marks every request in a route group as wanting json errors
+func JSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), jsonKey, true)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// WantsJSON reports whether the error should be written as json, either
+// because the route group says so or because the client prefers it
+func WantsJSON(r *http.Request) bool {
+	if v, ok := r.Context().Value(jsonKey).(bool); ok && v {
+		return true
+	}
+
+	accept := r.Header.Get("Accept")
+	j := strings.Index(accept, "application/json")
+	if j < 0 {
+		return false
+	}
+
+	html := strings.Index(accept, "text/html")
+	return html < 0 || j < html
+}
+
+// Write logs the cause of err and writes it to the client
+func Write(app *celeritas.Celeritas, w http.ResponseWriter, r *http.Request, err error) {
+	e := From(err)
+
+	if e.Err != nil || e.Status >= http.StatusInternalServerError {
+		app.ErrorLog.Printf("[%s] %s %s: %v", middleware.GetReqID(r.Context()), r.Method, r.URL.Path, e)
+	}
+
+	if WantsJSON(r) {
+		writeJSON(app, w, e)
+		return
+	}
+
+	writeHTML(app, w, r, e)
+}
+
+// Envelope is the json body written for every error
+type Envelope struct {
+	Error   bool         `json:"error"`
+	Status  int          `json:"status"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+func writeJSON(app *celeritas.Celeritas, w http.ResponseWriter, e *Error) {
+	payload := Envelope{
+		Error:   true,
+		Status:  e.Status,
+		Message: e.Message,
+		Fields:  e.Fields,
+	}
+
+	err := app.WriteJSON(w, e.Status, payload)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+}
+
+func writeHTML(app *celeritas.Celeritas, w http.ResponseWriter, r *http.Request, e *Error) {
+	vars := make(jet.VarMap)
+	vars.Set("status", e.Status)
+	vars.Set("statusText", http.StatusText(e.Status))
+	vars.Set("message", e.Message)
+	vars.Set("fields", e.Fields)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(e.Status)
+
+	err := app.Render.Page(w, r, "error", vars, nil)
+	if err != nil {
+		// the status is already written, fall back to plain text
+		app.ErrorLog.Println("error rendering error page:", err)
+		fmt.Fprint(w, e.Message)
+	}
+}
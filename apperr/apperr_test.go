@@ -0,0 +1,86 @@
+package apperr
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFrom(t *testing.T) {
+	cause := errors.New("pq: connection refused")
+
+	e := From(cause)
+	if e.Status != http.StatusInternalServerError {
+		t.Error("unknown errors should be a 500, got", e.Status)
+	}
+	if e.Message == cause.Error() {
+		t.Error("the internal cause leaked into the public message")
+	}
+	if !errors.Is(e, cause) {
+		t.Error("the cause should be unwrapped")
+	}
+
+	wrapped := From(BadRequest("bad json", cause))
+	if wrapped.Status != http.StatusBadRequest || wrapped.Message != "bad json" {
+		t.Error("an *Error should be returned as is, got", wrapped)
+	}
+}
+
+var wantsJSONTests = []struct {
+	name   string
+	accept string
+	want   bool
+}{
+	{"browser", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", false},
+	{"fetch", "application/json", true},
+	{"json first", "application/json, text/html", true},
+	{"html first", "text/html, application/json", false},
+	{"no header", "", false},
+}
+
+func TestWantsJSON(t *testing.T) {
+	for _, e := range wantsJSONTests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", e.accept)
+		if got := WantsJSON(req); got != e.want {
+			t.Errorf("%s: expected %v but got %v", e.name, e.want, got)
+		}
+	}
+
+	// route group marks the request as json regardless of accept
+	var got bool
+	handler := JSON(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = WantsJSON(r)
+	}))
+	req := httptest.NewRequest("GET", "/api/users", nil)
+	req.Header.Set("Accept", "text/html")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if !got {
+		t.Error("route group should want json")
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	e := Invalid(
+		map[string]string{"email": "Invalid email address", "age": "Must be a number"},
+		map[string]string{"email": "email"},
+	)
+
+	if e.Status != http.StatusUnprocessableEntity {
+		t.Error("expected 422, got", e.Status)
+	}
+
+	want := []FieldError{
+		{Field: "age", Message: "Must be a number", Code: "invalid"},
+		{Field: "email", Message: "Invalid email address", Code: "email"},
+	}
+	if len(e.Fields) != len(want) {
+		t.Fatal("wrong number of field errors", e.Fields)
+	}
+	for i := range want {
+		if e.Fields[i] != want[i] {
+			t.Errorf("expected %v but got %v", want[i], e.Fields[i])
+		}
+	}
+}
@@ -0,0 +1,18 @@
+// Package backoff spaces out the retries of the outbox and the webhooks
+package backoff
+
+import "time"
+
+// Exponential is the wait after the given number of failed attempts: base
+// after the first, doubling with every attempt after that, up to max
+func Exponential(base, max time.Duration, attempts int) time.Duration {
+	delay := base
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= max {
+			return max
+		}
+	}
+
+	return delay
+}
@@ -0,0 +1,15 @@
+package backoff
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExponential(t *testing.T) {
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		if got := Exponential(time.Second, 5*time.Second, i+1); got != w {
+			t.Errorf("after %d attempts: expected %s but got %s", i+1, w, got)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// Package bounces takes in the bounce and complaint webhooks of the mail
+// providers, and suppresses the addresses that bounce or complain too often.
+package bounces
+
+import (
+	"errors"
+	"fmt"
+	"myapp/data"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// the providers that can post events
+const (
+	Mailgun   = "mailgun"
+	SendGrid  = "sendgrid"
+	SparkPost = "sparkpost"
+)
+
+var (
+	// ErrBadSignature is returned for a request that wasn't signed by the provider
+	ErrBadSignature = errors.New("bounces: the request signature does not match")
+	// ErrBadPayload is returned for a body that can't be read
+	ErrBadPayload = errors.New("bounces: the request body can't be read")
+)
+
+// Event is a hard bounce or spam complaint, Kind is data.BounceHard or
+// data.BounceComplaint. ID is the provider's id for the event, providers post
+// an event again when they don't get a timely answer.
+type Event struct {
+	Provider string
+	ID       string
+	Email    string
+	Kind     string
+	Reason   string
+}
+
+// Provider checks a webhook request came from the provider and reads the
+// bounces and complaints in it. Other events are left out.
+type Provider interface {
+	Parse(r *http.Request, body []byte) ([]Event, error)
+}
+
+// Config holds the thresholds and the providers' webhook credentials. A
+// provider without credentials has no webhook.
+type Config struct {
+	// BounceThreshold is how many hard bounces suppress an address
+	BounceThreshold int
+	// ComplaintThreshold is how many spam complaints suppress an address
+	ComplaintThreshold int
+	// Tolerance is how old a signed request can be, so old ones can't be replayed
+	Tolerance time.Duration
+
+	MailgunKey        string
+	SendGridKey       string
+	SparkPostUser     string
+	SparkPostPassword string
+}
+
+// NewConfig reads the bounce settings from the environment (.env)
+func NewConfig() Config {
+	bounces, err := strconv.Atoi(os.Getenv("MAIL_BOUNCE_THRESHOLD"))
+	if err != nil || bounces < 1 {
+		bounces = 3
+	}
+
+	complaints, err := strconv.Atoi(os.Getenv("MAIL_COMPLAINT_THRESHOLD"))
+	if err != nil || complaints < 1 {
+		complaints = 1
+	}
+
+	return Config{
+		BounceThreshold:    bounces,
+		ComplaintThreshold: complaints,
+		Tolerance:          10 * time.Minute,
+		MailgunKey:         os.Getenv("MAILGUN_WEBHOOK_KEY"),
+		SendGridKey:        os.Getenv("SENDGRID_WEBHOOK_KEY"),
+		SparkPostUser:      os.Getenv("SPARKPOST_WEBHOOK_USER"),
+		SparkPostPassword:  os.Getenv("SPARKPOST_WEBHOOK_PASSWORD"),
+	}
+}
+
+// Threshold is how many events of the kind suppress an address
+func (c Config) Threshold(kind string) int {
+	if kind == data.BounceComplaint {
+		return c.ComplaintThreshold
+	}
+
+	return c.BounceThreshold
+}
+
+// Ingester records the events posted by the providers
+type Ingester struct {
+	Config
+	Models    data.Models
+	providers map[string]Provider
+}
+
+// New sets up a webhook for every provider with credentials
+func New(models data.Models, config Config) (*Ingester, error) {
+	providers := make(map[string]Provider)
+
+	if config.MailgunKey != "" {
+		providers[Mailgun] = &MailgunProvider{SigningKey: config.MailgunKey, Tolerance: config.Tolerance}
+	}
+	if config.SendGridKey != "" {
+		p, err := NewSendGridProvider(config.SendGridKey, config.Tolerance)
+		if err != nil {
+			return nil, err
+		}
+		providers[SendGrid] = p
+	}
+	if config.SparkPostUser != "" && config.SparkPostPassword != "" {
+		providers[SparkPost] = &SparkPostProvider{User: config.SparkPostUser, Password: config.SparkPostPassword}
+	}
+
+	return &Ingester{Config: config, Models: models, providers: providers}, nil
+}
+
+// Provider gets the provider with the name, false when it has no webhook
+func (i *Ingester) Provider(name string) (Provider, bool) {
+	p, ok := i.providers[name]
+	return p, ok
+}
+
+// Record saves the events against the users with their addresses, and
+// suppresses the addresses that reach a threshold. Only the events since an
+// admin last cleared an address count, and an event seen before isn't
+// recorded again.
+func (i *Ingester) Record(events []Event) error {
+	for _, e := range events {
+		var eventID *string
+		if e.ID != "" {
+			eventID = &e.ID
+		}
+
+		_, err := i.Models.MailBounces.Insert(data.MailBounce{
+			Email:    e.Email,
+			Provider: e.Provider,
+			EventID:  eventID,
+			Kind:     e.Kind,
+			Reason:   e.Reason,
+		})
+		if err != nil {
+			return fmt.Errorf("error recording a %s from %s: %w", e.Kind, e.Provider, err)
+		}
+		// checked for an event recorded already too, the provider retries
+		// a post that failed after it was recorded
+
+		since, err := i.Models.MailSuppressions.Since(e.Email)
+		if err != nil {
+			return err
+		}
+
+		count, err := i.Models.MailBounces.CountSince(e.Email, e.Kind, since)
+		if err != nil {
+			return err
+		}
+		if count < i.Threshold(e.Kind) {
+			continue
+		}
+
+		var userID *int
+		if id, err := i.Models.Users.IDForEmail(e.Email); err == nil {
+			userID = &id
+		}
+
+		err = i.Models.MailSuppressions.Suppress(e.Email, userID, Reason(e, count))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reason describes why an address was suppressed, eg "3 hard bounces, the
+// last: 550 no such user"
+func Reason(e Event, count int) string {
+	kind := "hard bounce"
+	if e.Kind == data.BounceComplaint {
+		kind = "spam complaint"
+	}
+	if count != 1 {
+		kind += "s"
+	}
+
+	reason := fmt.Sprintf("%d %s", count, kind)
+	if e.Reason != "" {
+		reason += ", the last: " + e.Reason
+	}
+
+	return reason
+}
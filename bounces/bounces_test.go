@@ -0,0 +1,185 @@
+package bounces
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"myapp/data"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mailgunBody(key, event, severity string, at time.Time) []byte {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	token := "0123456789abcdef"
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp + token))
+
+	return []byte(fmt.Sprintf(`{
+		"signature": {"timestamp": %q, "token": %q, "signature": %q},
+		"event-data": {"id": "mg-1", "event": %q, "severity": %q, "recipient": "ada@here.com",
+			"delivery-status": {"message": "550 no such user"}}
+	}`, timestamp, token, hex.EncodeToString(mac.Sum(nil)), event, severity))
+}
+
+func TestMailgunProvider_Parse(t *testing.T) {
+	p := &MailgunProvider{SigningKey: "key", Tolerance: time.Minute}
+	r := httptest.NewRequest("POST", "/api/v1/mail-events/mailgun", nil)
+
+	events, err := p.Parse(r, mailgunBody("key", "failed", "permanent", time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Event{Provider: Mailgun, ID: "mg-1", Email: "ada@here.com", Kind: data.BounceHard, Reason: "550 no such user"}
+	if len(events) != 1 || events[0] != want {
+		t.Errorf("expected %+v, got %+v", want, events)
+	}
+
+	events, err = p.Parse(r, mailgunBody("key", "complained", "", time.Now()))
+	if err != nil || len(events) != 1 || events[0].Kind != data.BounceComplaint {
+		t.Errorf("expected a complaint, got %+v: %v", events, err)
+	}
+
+	// soft bounces are retried by mailgun
+	events, err = p.Parse(r, mailgunBody("key", "failed", "temporary", time.Now()))
+	if err != nil || len(events) != 0 {
+		t.Errorf("expected no events for a temporary failure, got %+v: %v", events, err)
+	}
+
+	if _, err := p.Parse(r, mailgunBody("wrong", "failed", "permanent", time.Now())); !errors.Is(err, ErrBadSignature) {
+		t.Error("expected ErrBadSignature for the wrong key, got", err)
+	}
+	if _, err := p.Parse(r, mailgunBody("key", "failed", "permanent", time.Now().Add(-time.Hour))); !errors.Is(err, ErrBadSignature) {
+		t.Error("expected ErrBadSignature for an old request, got", err)
+	}
+	if _, err := p.Parse(r, []byte("not json")); !errors.Is(err, ErrBadPayload) {
+		t.Error("expected ErrBadPayload, got", err)
+	}
+}
+
+func TestSendGridProvider_Parse(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewSendGridProvider(base64.StdEncoding.EncodeToString(der), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte(`[
+		{"email": "ada@here.com", "event": "bounce", "type": "bounce", "reason": "550 unknown user", "sg_event_id": "sg-1"},
+		{"email": "bob@here.com", "event": "bounce", "type": "blocked", "reason": "421 try later"},
+		{"email": "cy@here.com", "event": "spamreport"},
+		{"email": "di@here.com", "event": "delivered"}
+	]`)
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	digest := sha256.Sum256(append([]byte(timestamp), body...))
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("POST", "/api/v1/mail-events/sendgrid", nil)
+	r.Header.Set(SendGridTimestampHeader, timestamp)
+	r.Header.Set(SendGridSignatureHeader, base64.StdEncoding.EncodeToString(signature))
+
+	events, err := p.Parse(r, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Email != "ada@here.com" || events[0].Kind != data.BounceHard || events[0].ID != "sg-1" ||
+		events[1].Email != "cy@here.com" || events[1].Kind != data.BounceComplaint {
+		t.Errorf("expected a bounce and a complaint, got %+v", events)
+	}
+
+	// a changed body no longer matches the signature
+	tampered := []byte(strings.Replace(string(body), "ada@here.com", "eve@here.com", 1))
+	if _, err := p.Parse(r, tampered); !errors.Is(err, ErrBadSignature) {
+		t.Error("expected ErrBadSignature for a changed body, got", err)
+	}
+
+	if _, err := NewSendGridProvider("not a key", time.Minute); err == nil {
+		t.Error("expected an error for a key that isn't base64")
+	}
+}
+
+func TestSparkPostProvider_Parse(t *testing.T) {
+	p := &SparkPostProvider{User: "sparkpost", Password: "secret"}
+
+	body := []byte(`[
+		{"msys": {"message_event": {"event_id": "sp-1", "type": "bounce", "bounce_class": "10", "rcpt_to": "ada@here.com", "reason": "550 invalid recipient"}}},
+		{"msys": {"message_event": {"type": "bounce", "bounce_class": "21", "rcpt_to": "bob@here.com", "reason": "mailbox full"}}},
+		{"msys": {"message_event": {"type": "spam_complaint", "rcpt_to": "cy@here.com"}}},
+		{"msys": {}}
+	]`)
+
+	r := httptest.NewRequest("POST", "/api/v1/mail-events/sparkpost", nil)
+	r.SetBasicAuth("sparkpost", "secret")
+
+	events, err := p.Parse(r, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Email != "ada@here.com" || events[0].Kind != data.BounceHard || events[0].ID != "sp-1" ||
+		events[1].Email != "cy@here.com" || events[1].Kind != data.BounceComplaint {
+		t.Errorf("expected a bounce and a complaint, got %+v", events)
+	}
+
+	r.SetBasicAuth("sparkpost", "wrong")
+	if _, err := p.Parse(r, body); !errors.Is(err, ErrBadSignature) {
+		t.Error("expected ErrBadSignature for the wrong password, got", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	i, err := New(data.Models{}, Config{MailgunKey: "key", SparkPostUser: "sparkpost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sparkpost needs a password as well
+	for name, want := range map[string]bool{Mailgun: true, SendGrid: false, SparkPost: false} {
+		if _, ok := i.Provider(name); ok != want {
+			t.Errorf("%s: expected a webhook %v, got %v", name, want, ok)
+		}
+	}
+}
+
+func TestReason(t *testing.T) {
+	tests := []struct {
+		event Event
+		count int
+		want  string
+	}{
+		{Event{Kind: data.BounceHard, Reason: "550 no such user"}, 3, "3 hard bounces, the last: 550 no such user"},
+		{Event{Kind: data.BounceComplaint}, 1, "1 spam complaint"},
+	}
+
+	for _, tt := range tests {
+		if got := Reason(tt.event, tt.count); got != tt.want {
+			t.Errorf("expected %q, got %q", tt.want, got)
+		}
+	}
+
+	c := Config{BounceThreshold: 3, ComplaintThreshold: 1}
+	if c.Threshold(data.BounceHard) != 3 || c.Threshold(data.BounceComplaint) != 1 {
+		t.Error("wrong thresholds")
+	}
+}
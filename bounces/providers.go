@@ -0,0 +1,238 @@
+package bounces
+
+import (
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"myapp/data"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// MailgunProvider reads Mailgun's webhooks. Each posts one event, signed with
+// the HMAC-SHA256 of its timestamp and token.
+type MailgunProvider struct {
+	SigningKey string
+	Tolerance  time.Duration
+}
+
+type mailgunPayload struct {
+	Signature struct {
+		Timestamp string `json:"timestamp"`
+		Token     string `json:"token"`
+		Signature string `json:"signature"`
+	} `json:"signature"`
+	EventData struct {
+		ID             string `json:"id"`
+		Event          string `json:"event"`
+		Severity       string `json:"severity"`
+		Recipient      string `json:"recipient"`
+		Reason         string `json:"reason"`
+		DeliveryStatus struct {
+			Message     string `json:"message"`
+			Description string `json:"description"`
+		} `json:"delivery-status"`
+	} `json:"event-data"`
+}
+
+func (p *MailgunProvider) Parse(r *http.Request, body []byte) ([]Event, error) {
+	var payload mailgunPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, ErrBadPayload
+	}
+
+	sig := payload.Signature
+	if err := p.verify(sig.Timestamp, sig.Token, sig.Signature); err != nil {
+		return nil, err
+	}
+
+	e := payload.EventData
+	// the token is unique to each post, for events without an id
+	id := e.ID
+	if id == "" {
+		id = sig.Token
+	}
+
+	switch {
+	case e.Event == "failed" && e.Severity == "permanent":
+		reason := e.DeliveryStatus.Message
+		if reason == "" {
+			reason = e.DeliveryStatus.Description
+		}
+		if reason == "" {
+			reason = e.Reason
+		}
+		return []Event{{Provider: Mailgun, ID: id, Email: e.Recipient, Kind: data.BounceHard, Reason: reason}}, nil
+	case e.Event == "complained":
+		return []Event{{Provider: Mailgun, ID: id, Email: e.Recipient, Kind: data.BounceComplaint}}, nil
+	}
+
+	return nil, nil
+}
+
+func (p *MailgunProvider) verify(timestamp, token, signature string) error {
+	if err := checkAge(timestamp, p.Tolerance); err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, []byte(p.SigningKey))
+	_, _ = mac.Write([]byte(timestamp + token))
+	if !hmac.Equal([]byte(signature), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		return ErrBadSignature
+	}
+
+	return nil
+}
+
+// the headers of SendGrid's signed event webhook
+const (
+	SendGridSignatureHeader = "X-Twilio-Email-Event-Webhook-Signature"
+	SendGridTimestampHeader = "X-Twilio-Email-Event-Webhook-Timestamp"
+)
+
+// SendGridProvider reads SendGrid's signed event webhook. It posts a list of
+// events, signed with ECDSA over the timestamp and body.
+type SendGridProvider struct {
+	PublicKey *ecdsa.PublicKey
+	Tolerance time.Duration
+}
+
+// NewSendGridProvider reads the verification key SendGrid shows for the
+// webhook, a base64 DER public key
+func NewSendGridProvider(key string, tolerance time.Duration) (*SendGridProvider, error) {
+	der, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, errors.New("bounces: the SendGrid key is not base64")
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	ecKey, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("bounces: the SendGrid key is not an ECDSA key")
+	}
+
+	return &SendGridProvider{PublicKey: ecKey, Tolerance: tolerance}, nil
+}
+
+type sendGridEvent struct {
+	ID     string `json:"sg_event_id"`
+	Email  string `json:"email"`
+	Event  string `json:"event"`
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+func (p *SendGridProvider) Parse(r *http.Request, body []byte) ([]Event, error) {
+	timestamp := r.Header.Get(SendGridTimestampHeader)
+	if err := checkAge(timestamp, p.Tolerance); err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(r.Header.Get(SendGridSignatureHeader))
+	if err != nil {
+		return nil, ErrBadSignature
+	}
+	digest := sha256.Sum256(append([]byte(timestamp), body...))
+	if !ecdsa.VerifyASN1(p.PublicKey, digest[:], signature) {
+		return nil, ErrBadSignature
+	}
+
+	var payload []sendGridEvent
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, ErrBadPayload
+	}
+
+	var events []Event
+	for _, e := range payload {
+		switch {
+		// blocks are temporary, only bounces are hard
+		case e.Event == "bounce" && e.Type != "blocked":
+			events = append(events, Event{Provider: SendGrid, ID: e.ID, Email: e.Email, Kind: data.BounceHard, Reason: e.Reason})
+		case e.Event == "spamreport":
+			events = append(events, Event{Provider: SendGrid, ID: e.ID, Email: e.Email, Kind: data.BounceComplaint})
+		}
+	}
+
+	return events, nil
+}
+
+// SparkPostProvider reads SparkPost's webhooks. SparkPost doesn't sign them,
+// so the webhook is set up with basic auth instead.
+type SparkPostProvider struct {
+	User     string
+	Password string
+}
+
+type sparkPostEvent struct {
+	Msys struct {
+		MessageEvent *struct {
+			EventID     string `json:"event_id"`
+			Type        string `json:"type"`
+			BounceClass string `json:"bounce_class"`
+			RcptTo      string `json:"rcpt_to"`
+			Reason      string `json:"reason"`
+		} `json:"message_event"`
+	} `json:"msys"`
+}
+
+// sparkPostHardBounces are the bounce classes for an address that doesn't
+// exist or won't take mail, the others are temporary
+var sparkPostHardBounces = map[string]bool{"10": true, "25": true, "30": true}
+
+func (p *SparkPostProvider) Parse(r *http.Request, body []byte) ([]Event, error) {
+	user, password, ok := r.BasicAuth()
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(p.User)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(p.Password)) == 1
+	if !ok || !userOK || !passwordOK {
+		return nil, ErrBadSignature
+	}
+
+	var payload []sparkPostEvent
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, ErrBadPayload
+	}
+
+	var events []Event
+	for _, item := range payload {
+		// the test sent when the webhook is set up has no event
+		e := item.Msys.MessageEvent
+		if e == nil {
+			continue
+		}
+
+		switch {
+		case e.Type == "bounce" && sparkPostHardBounces[e.BounceClass]:
+			events = append(events, Event{Provider: SparkPost, ID: e.EventID, Email: e.RcptTo, Kind: data.BounceHard, Reason: e.Reason})
+		case e.Type == "spam_complaint":
+			events = append(events, Event{Provider: SparkPost, ID: e.EventID, Email: e.RcptTo, Kind: data.BounceComplaint})
+		}
+	}
+
+	return events, nil
+}
+
+// checkAge rejects unix timestamps further than tolerance from now
+func checkAge(timestamp string, tolerance time.Duration) error {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrBadSignature
+	}
+
+	age := time.Since(time.Unix(seconds, 0))
+	if age > tolerance || age < -tolerance {
+		return ErrBadSignature
+	}
+
+	return nil
+}
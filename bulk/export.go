@@ -0,0 +1,217 @@
+package bulk
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"myapp/data"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportBatch is how many users are read from the database at a time
+const exportBatch = 500
+
+// ExportFields are the fields that may be exported, in their default order.
+// There is deliberately no password field.
+var ExportFields = []string{"id", "first_name", "last_name", "email", "active", "created_at", "updated_at"}
+
+var exportValues = map[string]func(u *data.User) interface{}{
+	"id":         func(u *data.User) interface{} { return u.ID },
+	"first_name": func(u *data.User) interface{} { return u.FirstName },
+	"last_name":  func(u *data.User) interface{} { return u.LastName },
+	"email":      func(u *data.User) interface{} { return u.Email },
+	"active":     func(u *data.User) interface{} { return u.Active == 1 },
+	"created_at": func(u *data.User) interface{} { return u.CreatedAt.UTC() },
+	"updated_at": func(u *data.User) interface{} { return u.UpdatedAt.UTC() },
+}
+
+// Source is what the exporter needs from the users table, *data.User implements it
+type Source interface {
+	GetAfter(id, limit int) ([]*data.User, error)
+}
+
+// ParseFields reads a comma separated list of fields, empty means every field
+func ParseFields(list string) ([]string, error) {
+	if strings.TrimSpace(list) == "" {
+		return ExportFields, nil
+	}
+
+	var fields []string
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if _, ok := exportValues[field]; !ok {
+			return nil, fmt.Errorf("unknown field %q, the fields are %s", field, strings.Join(ExportFields, ", "))
+		}
+		if !contains(fields, field) {
+			fields = append(fields, field)
+		}
+	}
+
+	return fields, nil
+}
+
+// ContentType is the media type of an export format
+func ContentType(format string) string {
+	switch format {
+	case CSV:
+		return "text/csv; charset=utf-8"
+	case NDJSON:
+		return "application/x-ndjson"
+	default:
+		return "application/json"
+	}
+}
+
+// Export writes every user to w, a batch at a time, flushing w after each batch
+// when it can be flushed (eg an http.ResponseWriter) so the client gets the
+// users as they are read.
+func Export(w io.Writer, source Source, format string, fields []string) error {
+	var out exportWriter
+	switch format {
+	case CSV:
+		out = &csvExport{w: csv.NewWriter(w), fields: fields}
+	case NDJSON:
+		out = &jsonExport{w: w, fields: fields, lines: true}
+	case JSON:
+		out = &jsonExport{w: w, fields: fields}
+	default:
+		return fmt.Errorf("unknown export format %q, use %s, %s or %s", format, CSV, NDJSON, JSON)
+	}
+
+	if err := out.start(); err != nil {
+		return err
+	}
+
+	after := 0
+	for {
+		users, err := source.GetAfter(after, exportBatch)
+		if err != nil {
+			return err
+		}
+
+		for _, u := range users {
+			if err := out.write(u); err != nil {
+				return err
+			}
+			after = u.ID
+		}
+
+		if err := out.flush(); err != nil {
+			return err
+		}
+		if f, ok := w.(interface{ Flush() }); ok {
+			f.Flush()
+		}
+
+		if len(users) < exportBatch {
+			break
+		}
+	}
+
+	return out.end()
+}
+
+type exportWriter interface {
+	start() error
+	write(u *data.User) error
+	flush() error
+	end() error
+}
+
+type csvExport struct {
+	w      *csv.Writer
+	fields []string
+}
+
+func (e *csvExport) start() error {
+	return e.w.Write(e.fields)
+}
+
+func (e *csvExport) write(u *data.User) error {
+	record := make([]string, len(e.fields))
+	for n, field := range e.fields {
+		switch v := exportValues[field](u).(type) {
+		case int:
+			record[n] = strconv.Itoa(v)
+		case bool:
+			record[n] = strconv.FormatBool(v)
+		case time.Time:
+			record[n] = v.Format(time.RFC3339)
+		default:
+			record[n] = fmt.Sprint(v)
+		}
+	}
+	return e.w.Write(record)
+}
+
+func (e *csvExport) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvExport) end() error {
+	return e.flush()
+}
+
+// jsonExport writes a json array, or one object per line for ndjson. Objects are
+// built by hand so the fields keep the order they were asked for.
+type jsonExport struct {
+	w      io.Writer
+	fields []string
+	lines  bool
+	count  int
+}
+
+func (e *jsonExport) start() error {
+	if e.lines {
+		return nil
+	}
+	_, err := io.WriteString(e.w, "[")
+	return err
+}
+
+func (e *jsonExport) write(u *data.User) error {
+	var b strings.Builder
+	if !e.lines && e.count > 0 {
+		b.WriteString(",")
+	}
+	if !e.lines {
+		b.WriteString("\n")
+	}
+
+	b.WriteString("{")
+	for n, field := range e.fields {
+		value, err := json.Marshal(exportValues[field](u))
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, "%q:%s", field, value)
+	}
+	b.WriteString("}")
+
+	if e.lines {
+		b.WriteString("\n")
+	}
+
+	e.count++
+	_, err := io.WriteString(e.w, b.String())
+	return err
+}
+
+func (e *jsonExport) flush() error {
+	return nil
+}
+
+func (e *jsonExport) end() error {
+	if e.lines {
+		return nil
+	}
+	_, err := io.WriteString(e.w, "\n]\n")
+	return err
+}
@@ -0,0 +1,76 @@
+package bulk
+
+import (
+	"bytes"
+	"encoding/json"
+	"myapp/data"
+	"strings"
+	"testing"
+)
+
+type fakeSource []*data.User
+
+func (s fakeSource) GetAfter(id, limit int) ([]*data.User, error) {
+	var users []*data.User
+	for _, u := range s {
+		if u.ID > id && len(users) < limit {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+func exportUsers(n int) fakeSource {
+	var users fakeSource
+	for id := 1; id <= n; id++ {
+		users = append(users, &data.User{ID: id, FirstName: "Jack", LastName: "Smith", Email: "jack@example.com", Active: 1, Password: "hash"})
+	}
+	return users
+}
+
+func TestExportCSV(t *testing.T) {
+	fields, err := ParseFields("email, id,email")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := Export(&out, exportUsers(exportBatch+1), CSV, fields); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != exportBatch+2 {
+		t.Fatalf("expected a header and %d users, got %d lines", exportBatch+1, len(lines))
+	}
+	if lines[0] != "email,id" || lines[len(lines)-1] != "jack@example.com,501" {
+		t.Error("unexpected csv", lines[0], lines[len(lines)-1])
+	}
+}
+
+func TestExportJSON(t *testing.T) {
+	var out bytes.Buffer
+	if err := Export(&out, exportUsers(2), JSON, ExportFields); err != nil {
+		t.Fatal(err)
+	}
+
+	var users []map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &users); err != nil {
+		t.Fatal(err, out.String())
+	}
+	if len(users) != 2 || users[1]["id"] != float64(2) || users[0]["active"] != true {
+		t.Error("unexpected json", users)
+	}
+	if strings.Contains(out.String(), "hash") {
+		t.Error("the password hash was exported")
+	}
+}
+
+func TestParseFields(t *testing.T) {
+	if _, err := ParseFields("id,password"); err == nil {
+		t.Error("expected an error for the password field")
+	}
+	if fields, _ := ParseFields(""); len(fields) != len(ExportFields) {
+		t.Error("expected every field by default, got", fields)
+	}
+}
@@ -0,0 +1,353 @@
+// Package bulk imports users from csv or ndjson files and streams them back
+// out, for onboarding clients with thousands of users.
+package bulk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"myapp/data"
+	"strconv"
+	"strings"
+
+	"github.com/cmd-ctrl-q/celeritas"
+)
+
+// the file formats
+const (
+	CSV    = "csv"
+	NDJSON = "ndjson"
+	JSON   = "json"
+)
+
+const (
+	// DefaultBatchSize is how many users are inserted per transaction
+	DefaultBatchSize = 500
+	// maxErrors stops a bad file from filling the report
+	maxErrors = 1000
+	// maxLine is the longest ndjson line read
+	maxLine = 65536
+)
+
+// importColumns are the columns a file may have, first_name, last_name and email are required
+var importColumns = []string{"first_name", "last_name", "email", "password", "active"}
+
+// Store is what the importer needs from the users table, *data.User implements it.
+// ExistingEmails is given and returns lowercased emails.
+type Store interface {
+	ExistingEmails(emails []string) (map[string]bool, error)
+	InsertMany(users []data.User) error
+}
+
+// Importer validates the rows of a file with User.Validate and inserts the
+// valid ones in transactional batches. Invalid rows are skipped and reported.
+type Importer struct {
+	App       *celeritas.Celeritas
+	Store     Store
+	BatchSize int
+	// DryRun validates every row without inserting anything
+	DryRun bool
+	// Inserted is called with every batch after it is committed, the users have their ids set
+	Inserted func(users []data.User)
+}
+
+// Report is the outcome of an import
+type Report struct {
+	XMLName  xml.Name `json:"-" xml:"import"`
+	DryRun   bool     `json:"dry_run" xml:"dry_run,attr"`
+	Rows     int      `json:"rows" xml:"rows,attr"`
+	Valid    int      `json:"valid" xml:"valid,attr"`
+	Inserted int      `json:"inserted" xml:"inserted,attr"`
+	// Truncated is set when there were more errors than the report keeps
+	Truncated bool        `json:"truncated" xml:"truncated,attr"`
+	Errors    []LineError `json:"errors" xml:"error"`
+}
+
+// LineError is a problem with one line of the file. Field is empty when the whole line is bad.
+type LineError struct {
+	Line    int    `json:"line" xml:"line,attr"`
+	Field   string `json:"field,omitempty" xml:"field,attr,omitempty"`
+	Code    string `json:"code" xml:"code,attr"`
+	Message string `json:"message" xml:",chardata"`
+}
+
+func (r *Report) addError(line int, field, code, message string) {
+	if len(r.Errors) >= maxErrors {
+		r.Truncated = true
+		return
+	}
+	r.Errors = append(r.Errors, LineError{Line: line, Field: field, Code: code, Message: message})
+}
+
+// FileError means the file could not be read, as opposed to the database failing
+type FileError struct {
+	Err error
+}
+
+func (e *FileError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+type row struct {
+	line   int
+	values map[string]string
+}
+
+type pending struct {
+	line int
+	user data.User
+}
+
+// Import reads a csv or ndjson file. The error is only set when the import
+// could not carry on, either a *FileError or a failed batch, the report then
+// says how far it got.
+func (i *Importer) Import(r io.Reader, format string) (*Report, error) {
+	report := &Report{DryRun: i.DryRun, Errors: []LineError{}}
+
+	batchSize := i.BatchSize
+	if batchSize < 1 {
+		batchSize = DefaultBatchSize
+	}
+
+	seen := make(map[string]int)
+	var batch []pending
+
+	handle := func(rw row) error {
+		report.Rows++
+
+		u, ok := i.validate(rw, report)
+		if !ok {
+			return nil
+		}
+
+		email := strings.ToLower(u.Email)
+		if first, dup := seen[email]; dup {
+			report.addError(rw.line, "email", data.CodeUnique, fmt.Sprintf("Email is already used on line %d", first))
+			return nil
+		}
+		seen[email] = rw.line
+
+		batch = append(batch, pending{line: rw.line, user: u})
+		if len(batch) >= batchSize {
+			err := i.flush(batch, report)
+			batch = batch[:0]
+			return err
+		}
+
+		return nil
+	}
+
+	var err error
+	switch format {
+	case CSV:
+		err = readCSV(r, report, handle)
+	case NDJSON:
+		err = readNDJSON(r, report, handle)
+	default:
+		err = &FileError{fmt.Errorf("unknown import format %q, use %s or %s", format, CSV, NDJSON)}
+	}
+	if err != nil {
+		return report, err
+	}
+
+	if len(batch) > 0 {
+		if err := i.flush(batch, report); err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// validate turns a row into a user, reporting what is wrong with it
+func (i *Importer) validate(rw row, report *Report) (data.User, bool) {
+	u := data.User{
+		FirstName: strings.TrimSpace(rw.values["first_name"]),
+		LastName:  strings.TrimSpace(rw.values["last_name"]),
+		Email:     strings.TrimSpace(rw.values["email"]),
+		Password:  rw.values["password"],
+		Active:    1,
+	}
+
+	validator := data.NewValidator(i.App.Validator(nil))
+	u.Validate(validator)
+
+	if active := strings.TrimSpace(rw.values["active"]); active != "" {
+		on, err := parseBool(active)
+		validator.Rule(err == nil, "active", data.CodeInvalid, "Active must be true or false")
+		if !on {
+			u.Active = 0
+		}
+	}
+
+	if u.Password == "" {
+		// the user sets a password with the forgot password link
+		u.Password = randomPassword()
+	} else {
+		validator.MinLength("password", u.Password, 8, "Password must be at least eight characters")
+	}
+
+	if validator.Valid() {
+		return u, true
+	}
+
+	for _, field := range sortedKeys(validator.Errors) {
+		report.addError(rw.line, field, validator.Code(field), validator.Errors[field])
+	}
+
+	return u, false
+}
+
+// flush checks the batch against the existing users and inserts it in one transaction
+func (i *Importer) flush(batch []pending, report *Report) error {
+	emails := make([]string, 0, len(batch))
+	for _, p := range batch {
+		emails = append(emails, strings.ToLower(p.user.Email))
+	}
+
+	existing, err := i.Store.ExistingEmails(emails)
+	if err != nil {
+		return err
+	}
+
+	users := make([]data.User, 0, len(batch))
+	for _, p := range batch {
+		if existing[strings.ToLower(p.user.Email)] {
+			report.addError(p.line, "email", data.CodeUnique, "A user with that email already exists")
+			continue
+		}
+		users = append(users, p.user)
+	}
+
+	report.Valid += len(users)
+	if i.DryRun || len(users) == 0 {
+		return nil
+	}
+
+	if err := i.Store.InsertMany(users); err != nil {
+		return err
+	}
+	report.Inserted += len(users)
+
+	if i.Inserted != nil {
+		i.Inserted(users)
+	}
+
+	return nil
+}
+
+func readCSV(r io.Reader, report *Report, handle func(row) error) error {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.ReuseRecord = false
+
+	header, err := reader.Read()
+	if err != nil {
+		if err == io.EOF {
+			return &FileError{errors.New("the file is empty")}
+		}
+		return &FileError{fmt.Errorf("could not read the header: %w", err)}
+	}
+
+	columns := make([]string, len(header))
+	for n, name := range header {
+		// excel starts utf-8 files with a byte order mark
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if !contains(importColumns, name) {
+			return &FileError{fmt.Errorf("unknown column %q, the columns are %s", name, strings.Join(importColumns, ", "))}
+		}
+		columns[n] = name
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			report.Rows++
+			report.addError(parseErr.StartLine, "", data.CodeInvalid, parseErr.Err.Error())
+			continue
+		}
+		if err != nil {
+			return &FileError{err}
+		}
+
+		line, _ := reader.FieldPos(0)
+		values := make(map[string]string, len(columns))
+		for n, value := range record {
+			values[columns[n]] = value
+		}
+
+		if err := handle(row{line: line, values: values}); err != nil {
+			return err
+		}
+	}
+}
+
+func readNDJSON(r io.Reader, report *Report, handle func(row) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), maxLine)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+
+		var object map[string]interface{}
+		if err := json.Unmarshal(text, &object); err != nil {
+			report.Rows++
+			report.addError(line, "", data.CodeInvalid, "Line is not a json object")
+			continue
+		}
+
+		values := make(map[string]string, len(object))
+		bad := ""
+		for key, value := range object {
+			if !contains(importColumns, key) {
+				bad = key
+				break
+			}
+			switch v := value.(type) {
+			case string:
+				values[key] = v
+			case bool:
+				values[key] = strconv.FormatBool(v)
+			case float64:
+				values[key] = strconv.FormatFloat(v, 'f', -1, 64)
+			case nil:
+			default:
+				bad = key
+			}
+		}
+		if bad != "" {
+			report.Rows++
+			report.addError(line, bad, data.CodeInvalid, fmt.Sprintf("Unknown or invalid field %q", bad))
+			continue
+		}
+
+		if err := handle(row{line: line, values: values}); err != nil {
+			return err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return &FileError{fmt.Errorf("could not read line %d: %w", line+1, err)}
+	}
+
+	return nil
+}
@@ -0,0 +1,174 @@
+package bulk
+
+import (
+	"errors"
+	"myapp/data"
+	"strings"
+	"testing"
+
+	"github.com/cmd-ctrl-q/celeritas"
+)
+
+type fakeStore struct {
+	existing map[string]bool
+	batches  [][]data.User
+	fail     error
+}
+
+func (s *fakeStore) ExistingEmails(emails []string) (map[string]bool, error) {
+	found := make(map[string]bool)
+	for _, email := range emails {
+		if s.existing[email] {
+			found[email] = true
+		}
+	}
+	return found, nil
+}
+
+func (s *fakeStore) InsertMany(users []data.User) error {
+	if s.fail != nil {
+		return s.fail
+	}
+	batch := make([]data.User, len(users))
+	copy(batch, users)
+	s.batches = append(s.batches, batch)
+	return nil
+}
+
+func newImporter(store *fakeStore) *Importer {
+	return &Importer{App: &celeritas.Celeritas{}, Store: store}
+}
+
+func errorAt(report *Report, line int, field, code string) bool {
+	for _, e := range report.Errors {
+		if e.Line == line && e.Field == field && e.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+const csvFile = "\ufefffirst_name,last_name,email,password,active\n" +
+	"Jack,Smith,jack@example.com,verysecret,true\n" +
+	"J,Smith,not-an-email,short,maybe\n" +
+	"Jill,Jones,jill@example.com,,0\n" +
+	"Jack,Again,jack@example.com,verysecret,1\n" +
+	"Old,User,Old@Example.com,verysecret,1\n"
+
+func TestImportCSV(t *testing.T) {
+	store := &fakeStore{existing: map[string]bool{"old@example.com": true}}
+
+	report, err := newImporter(store).Import(strings.NewReader(csvFile), CSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Rows != 5 || report.Valid != 2 || report.Inserted != 2 {
+		t.Errorf("expected 5 rows, 2 valid and 2 inserted, got %+v", report)
+	}
+
+	for _, e := range []struct {
+		line  int
+		field string
+		code  string
+	}{
+		{3, "first_name", data.CodeMinLength},
+		{3, "email", data.CodeEmail},
+		{3, "password", data.CodeMinLength},
+		{3, "active", data.CodeInvalid},
+		{5, "email", data.CodeUnique},
+		{6, "email", data.CodeUnique},
+	} {
+		if !errorAt(report, e.line, e.field, e.code) {
+			t.Errorf("expected a %s error for %s on line %d, got %+v", e.code, e.field, e.line, report.Errors)
+		}
+	}
+
+	if len(store.batches) != 1 || len(store.batches[0]) != 2 {
+		t.Fatalf("expected one batch of 2 users, got %v", store.batches)
+	}
+	jill := store.batches[0][1]
+	if jill.Active != 0 || jill.Password == "" {
+		t.Error("expected jill to be inactive with a random password, got", jill)
+	}
+}
+
+func TestImportNDJSON(t *testing.T) {
+	file := `{"first_name":"Jack","last_name":"Smith","email":"jack@example.com","active":true}
+
+not json
+{"first_name":"Jill","last_name":"Jones","email":"jill@example.com","admin":true}
+`
+	report, err := newImporter(&fakeStore{}).Import(strings.NewReader(file), NDJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Rows != 3 || report.Inserted != 1 {
+		t.Errorf("expected 3 rows and 1 insert, got %+v", report)
+	}
+	if !errorAt(report, 3, "", data.CodeInvalid) || !errorAt(report, 4, "admin", data.CodeInvalid) {
+		t.Error("expected errors on lines 3 and 4, got", report.Errors)
+	}
+}
+
+func TestImportDryRun(t *testing.T) {
+	store := &fakeStore{}
+	importer := newImporter(store)
+	importer.DryRun = true
+
+	report, err := importer.Import(strings.NewReader(csvFile), CSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !report.DryRun || report.Valid != 3 || report.Inserted != 0 || len(store.batches) != 0 {
+		t.Errorf("expected 3 valid rows and nothing inserted, got %+v", report)
+	}
+}
+
+func TestImportBatches(t *testing.T) {
+	var file strings.Builder
+	file.WriteString("first_name,last_name,email\n")
+	for n := 0; n < 5; n++ {
+		file.WriteString("Jack,Smith,jack" + string(rune('a'+n)) + "@example.com\n")
+	}
+
+	store := &fakeStore{}
+	importer := newImporter(store)
+	importer.BatchSize = 2
+
+	var inserted int
+	importer.Inserted = func(users []data.User) { inserted += len(users) }
+
+	report, err := importer.Import(strings.NewReader(file.String()), CSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.batches) != 3 || report.Inserted != 5 || inserted != 5 {
+		t.Errorf("expected 5 users in 3 batches, got %d batches and %+v", len(store.batches), report)
+	}
+}
+
+func TestImportFailures(t *testing.T) {
+	_, err := newImporter(&fakeStore{}).Import(strings.NewReader("first_name,age\n"), CSV)
+	var fileErr *FileError
+	if !errors.As(err, &fileErr) {
+		t.Error("expected a file error for an unknown column, got", err)
+	}
+
+	_, err = newImporter(&fakeStore{}).Import(strings.NewReader(""), "xlsx")
+	if !errors.As(err, &fileErr) {
+		t.Error("expected a file error for an unknown format, got", err)
+	}
+
+	store := &fakeStore{fail: errors.New("connection lost")}
+	report, err := newImporter(store).Import(strings.NewReader(csvFile), CSV)
+	if err == nil || errors.As(err, &fileErr) {
+		t.Error("expected the database error, got", err)
+	}
+	if report.Inserted != 0 {
+		t.Error("expected nothing inserted, got", report.Inserted)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"myapp/bulk"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const commandUsage = `usage:
+  myapp                                               run the server
+  myapp import-users [-dry-run] [-format csv|ndjson] file
+  myapp export-users [-format csv|ndjson|json] [-fields id,email,...] [file]`
+
+// runCommand runs a command given on the command line instead of the server
+// and returns the exit code
+func (a *application) runCommand(args []string) int {
+	var err error
+	switch args[0] {
+	case "import-users":
+		err = a.importUsers(args[1:])
+	case "export-users":
+		err = a.exportUsers(args[1:])
+	default:
+		err = fmt.Errorf("unknown command %q\n%s", args[0], commandUsage)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+// importUsers imports a file of users, printing the report as json
+func (a *application) importUsers(args []string) error {
+	flags := flag.NewFlagSet("import-users", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only validate the file")
+	format := flags.String("format", "", "csv or ndjson, taken from the file extension by default")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New(commandUsage)
+	}
+
+	path := flags.Arg(0)
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	report, importErr := a.Handlers.Importer(*dryRun).Import(f, *format)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "\t")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+
+	if importErr != nil {
+		return fmt.Errorf("the import stopped after %d users were inserted: %w", report.Inserted, importErr)
+	}
+	if len(report.Errors) > 0 {
+		return fmt.Errorf("%d lines were not imported", len(report.Errors))
+	}
+
+	return nil
+}
+
+// exportUsers writes every user to a file, or to stdout when no file is given
+func (a *application) exportUsers(args []string) error {
+	flags := flag.NewFlagSet("export-users", flag.ContinueOnError)
+	format := flags.String("format", bulk.CSV, "csv, ndjson or json")
+	fieldList := flags.String("fields", "", "comma separated fields, every field by default")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return errors.New(commandUsage)
+	}
+
+	fields, err := bulk.ParseFields(*fieldList)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if flags.NArg() == 1 {
+		f, err := os.Create(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	return bulk.Export(w, &a.Models.Users, *format, fields)
+}
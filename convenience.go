@@ -1,7 +1,11 @@
 // convenience.go contains aliases for http methods
 package main
 
-import "net/http"
+import (
+	"myapp/apperr"
+	"myapp/middleware"
+	"net/http"
+)
 
 func (a *application) get(s string, h http.HandlerFunc) {
 	a.App.Routes.Get(s, h)
@@ -14,3 +18,22 @@ func (a *application) post(s string, h http.HandlerFunc) {
 func (a *application) use(m ...func(http.Handler) http.Handler) {
 	a.App.Routes.Use(m...)
 }
+
+// handle adapts a handler that returns an error, writing the error as a page or json
+func (a *application) handle(h apperr.HandlerFunc) http.HandlerFunc {
+	return apperr.Handle(a.App, h)
+}
+
+// redirect permanently sends the client to url
+func redirect(url string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, url, http.StatusMovedPermanently)
+	}
+}
+
+// purgePages drops the cached pages tagged with any of tags
+func (a *application) purgePages(tags ...string) {
+	if err := middleware.PurgePages(a.App.Cache, tags...); err != nil {
+		a.App.ErrorLog.Println("error purging pages:", err)
+	}
+}
@@ -0,0 +1,189 @@
+package data
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	modelCachePrefix = "model"
+	// tokensVersion covers every api token, a token lookup doesn't know its user until it is read
+	tokensVersion = "tokens"
+)
+
+// ModelCache is the part of a celeritas cache the models use, app.Cache satisfies it
+type ModelCache interface {
+	Has(string) (bool, error)
+	Get(string) (interface{}, error)
+	Set(string, interface{}, ...int) error
+}
+
+// CacheConfig holds the model cache settings
+type CacheConfig struct {
+	// Enabled turns the cache on, it is off unless MODEL_CACHE is true
+	Enabled bool
+	// UserTTL is how long users, email lookups and remember tokens are kept
+	UserTTL time.Duration
+	// TokenTTL is how long api token lookups are kept
+	TokenTTL time.Duration
+}
+
+// NewCacheConfig reads the model cache settings from the environment (.env)
+func NewCacheConfig() CacheConfig {
+	enabled, _ := strconv.ParseBool(os.Getenv("MODEL_CACHE"))
+
+	return CacheConfig{
+		Enabled:  enabled,
+		UserTTL:  envSeconds("MODEL_CACHE_USER_TTL", 300),
+		TokenTTL: envSeconds("MODEL_CACHE_TOKEN_TTL", 60),
+	}
+}
+
+func envSeconds(name string, fallback int) time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || seconds < 0 {
+		seconds = fallback
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// cached is the model cache, nil while it is off
+var cached *modelCache
+
+// EnableCache keeps user and token lookups in c. It does nothing when c is nil
+// or config isn't enabled, so the models always go to the database in tests
+// unless a test turns the cache on.
+func EnableCache(c ModelCache, config CacheConfig) {
+	if c == nil || !config.Enabled {
+		cached = nil
+		return
+	}
+
+	cached = &modelCache{cache: c, config: config}
+}
+
+// DisableCache sends every lookup to the database again
+func DisableCache() {
+	cached = nil
+}
+
+// modelCache is a read-through cache. Each entry holds the version of what it
+// depends on (a user, or all tokens) when it was read, and writes bump the
+// version rather than finding every entry to delete. A lookup reads the
+// version before the database, so a write racing with it leaves an entry
+// that is already stale.
+type modelCache struct {
+	cache  ModelCache
+	config CacheConfig
+}
+
+// cacheEntry is gob encoded rather than json, json would drop User.Password
+type cacheEntry struct {
+	Version string
+	UserID  int
+	User    *User
+	Token   *Token
+}
+
+func userVersion(id int) string {
+	return fmt.Sprintf("user:%d", id)
+}
+
+func cacheKey(kind, key string) string {
+	return modelCachePrefix + ":" + kind + ":" + key
+}
+
+// hashKey keeps secrets (tokens) out of the cache keys
+func hashKey(kind, secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return cacheKey(kind, hex.EncodeToString(sum[:]))
+}
+
+// version gets the current version of name, "0" if it was never bumped
+func (c *modelCache) version(name string) string {
+	key := cacheKey("version", name)
+	if has, err := c.cache.Has(key); err != nil || !has {
+		return "0"
+	}
+
+	value, err := c.cache.Get(key)
+	if err != nil {
+		return "0"
+	}
+	version, _ := value.(string)
+
+	return version
+}
+
+// get reads an entry, any error is a miss
+func (c *modelCache) get(key string) (cacheEntry, bool) {
+	var entry cacheEntry
+
+	value, err := c.cache.Get(key)
+	if err != nil {
+		return entry, false
+	}
+
+	stored, ok := value.(string)
+	if !ok || gob.NewDecoder(bytes.NewBufferString(stored)).Decode(&entry) != nil {
+		return entry, false
+	}
+
+	return entry, true
+}
+
+// set saves an entry, a failure only means the next lookup misses. A ttl under
+// a second isn't cached at all.
+func (c *modelCache) set(key string, entry cacheEntry, ttl time.Duration) {
+	if ttl < time.Second {
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		return
+	}
+
+	_ = c.cache.Set(key, buf.String(), int(ttl/time.Second))
+}
+
+// versionTTL is how long a bumped version is kept, in seconds. Every entry
+// read before the bump expires within it, after that the version may be
+// forgotten, so users that are never written again don't leave keys behind.
+func (c *modelCache) versionTTL() int {
+	ttl := c.config.UserTTL
+	if c.config.TokenTTL > ttl {
+		ttl = c.config.TokenTTL
+	}
+
+	seconds := int((ttl + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	return seconds
+}
+
+// invalidate bumps the versions, which makes every entry that depends on
+// them stale. It is called after the database write has succeeded.
+func invalidate(names ...string) error {
+	if cached == nil {
+		return nil
+	}
+
+	version := strconv.FormatInt(time.Now().UnixNano(), 10)
+	for _, name := range names {
+		if err := cached.cache.Set(cacheKey("version", name), version, cached.versionTTL()); err != nil {
+			return fmt.Errorf("saved, but the cached %s could not be cleared: %w", name, err)
+		}
+	}
+
+	return nil
+}
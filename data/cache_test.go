@@ -0,0 +1,96 @@
+package data
+
+import (
+	"myapp/appcache"
+	"testing"
+	"time"
+)
+
+func TestEnableCache(t *testing.T) {
+	defer DisableCache()
+
+	EnableCache(appcache.NewMemory(), CacheConfig{})
+	if cached != nil {
+		t.Error("expected the cache to stay off unless it is enabled")
+	}
+
+	EnableCache(nil, CacheConfig{Enabled: true})
+	if cached != nil {
+		t.Error("expected the cache to stay off without a cache")
+	}
+
+	EnableCache(appcache.NewMemory(), CacheConfig{Enabled: true})
+	if cached == nil {
+		t.Error("expected the cache to be on")
+	}
+}
+
+func TestModelCache_Entries(t *testing.T) {
+	EnableCache(appcache.NewMemory(), CacheConfig{Enabled: true, UserTTL: time.Minute, TokenTTL: time.Minute})
+	defer DisableCache()
+
+	version := cached.version(userVersion(1))
+	if version != "0" {
+		t.Error("expected version 0 before any write, got", version)
+	}
+
+	user := &User{ID: 1, Email: "me@here.com", Password: "hash", Token: Token{ID: 2, PlainText: "token", Hash: []byte{1, 2}, Expires: time.Now().Add(time.Hour)}}
+	cached.set(cacheKey("user", "1"), cacheEntry{Version: version, UserID: 1, User: user}, time.Minute)
+	cached.set(hashKey("remember", "abc"), cacheEntry{Version: version, UserID: 1}, time.Minute)
+	cached.set(hashKey("token", "token"), cacheEntry{Version: cached.version(tokensVersion), UserID: 1, Token: &user.Token}, time.Minute)
+
+	// these are served from the cache, there is no database in this test
+	var u User
+	got, err := u.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Password != "hash" || got.Token.PlainText != "token" || len(got.Token.Hash) != 2 {
+		t.Error("expected the whole user back, got", got)
+	}
+	if !u.CheckForRememberToken(1, "abc") {
+		t.Error("expected the cached remember token")
+	}
+	var tk Token
+	if token, err := tk.GetByToken("token"); err != nil || token.ID != 2 {
+		t.Error("expected the cached token, got", token, err)
+	}
+
+	if err := invalidate(userVersion(1), tokensVersion); err != nil {
+		t.Fatal(err)
+	}
+	if cached.version(userVersion(1)) == version {
+		t.Error("expected invalidate to change the version")
+	}
+	if entry, ok := cached.get(cacheKey("user", "1")); !ok || entry.Version == cached.version(userVersion(1)) {
+		t.Error("expected the cached user to be stale")
+	}
+	if entry, ok := cached.get(hashKey("token", "token")); !ok || entry.Version == cached.version(tokensVersion) {
+		t.Error("expected the cached token to be stale")
+	}
+}
+
+func TestModelCache_NoTTL(t *testing.T) {
+	c := &modelCache{cache: appcache.NewMemory()}
+	c.set("key", cacheEntry{UserID: 1}, 0)
+	if _, ok := c.get("key"); ok {
+		t.Error("expected a ttl of 0 not to be cached")
+	}
+}
+
+func TestModelCache_VersionTTL(t *testing.T) {
+	for _, e := range []struct {
+		user, token time.Duration
+		want        int
+	}{
+		{5 * time.Minute, time.Minute, 300},
+		{time.Minute, 10 * time.Minute, 600},
+		{1500 * time.Millisecond, 0, 2},
+		{0, 0, 1},
+	} {
+		c := &modelCache{config: CacheConfig{UserTTL: e.user, TokenTTL: e.token}}
+		if got := c.versionTTL(); got != e.want {
+			t.Errorf("%s and %s: expected %d, got %d", e.user, e.token, e.want, got)
+		}
+	}
+}
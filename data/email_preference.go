@@ -0,0 +1,111 @@
+package data
+
+import (
+	"time"
+
+	up "github.com/upper/db/v4"
+)
+
+// Email categories. Transactional mail (password resets, security notices)
+// is always sent, every other category can be opted out of.
+const (
+	EmailTransactional = "transactional"
+	EmailProduct       = "product"
+	EmailNewsletter    = "newsletter"
+)
+
+// EmailCategories lists the categories a user can opt out of
+var EmailCategories = []string{EmailProduct, EmailNewsletter}
+
+// ValidEmailCategory reports whether category can be opted out of
+func ValidEmailCategory(category string) bool {
+	for _, c := range EmailCategories {
+		if c == category {
+			return true
+		}
+	}
+
+	return false
+}
+
+// EmailPreference is a user's choice for one category. Users are subscribed
+// to every category they have no row for.
+type EmailPreference struct {
+	ID         int       `db:"id,omitempty" json:"id"`
+	UserID     int       `db:"user_id" json:"user_id"`
+	Category   string    `db:"category" json:"category"`
+	Subscribed int       `db:"subscribed" json:"subscribed"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt  time.Time `db:"updated_at" json:"updated_at"`
+}
+
+func (p *EmailPreference) Table() string {
+	return "email_preferences"
+}
+
+// GetForUser gets whether the user is subscribed to each category
+func (p *EmailPreference) GetForUser(userID int) (map[string]bool, error) {
+	collection := upper.Collection(p.Table())
+
+	var rows []*EmailPreference
+
+	err := collection.Find(up.Cond{"user_id": userID}).All(&rows)
+	if err != nil {
+		return nil, err
+	}
+
+	prefs := make(map[string]bool, len(EmailCategories))
+	for _, category := range EmailCategories {
+		prefs[category] = true
+	}
+	for _, row := range rows {
+		prefs[row.Category] = row.Subscribed == 1
+	}
+
+	return prefs, nil
+}
+
+// Set subscribes the user to the category or unsubscribes them from it
+func (p *EmailPreference) Set(userID int, category string, subscribed bool) error {
+	value := 0
+	if subscribed {
+		value = 1
+	}
+
+	_, err := upper.SQL().Exec(`
+		INSERT INTO email_preferences (user_id, category, subscribed, created_at, updated_at)
+		VALUES (?, ?, ?, now(), now())
+		ON CONFLICT (user_id, category) DO UPDATE SET subscribed = EXCLUDED.subscribed`,
+		userID, category, value)
+
+	return err
+}
+
+// Allows reports whether mail in the category may be sent to the address.
+// Transactional mail always may, as may mail to an address that isn't a user's.
+func (p *EmailPreference) Allows(email, category string) (bool, error) {
+	if category == EmailTransactional || category == "" {
+		return true, nil
+	}
+
+	var u User
+	theUser, err := u.GetByEmail(email)
+	if IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var pref EmailPreference
+	collection := upper.Collection(p.Table())
+	err = collection.Find(up.Cond{"user_id": theUser.ID, "category": category}).One(&pref)
+	if IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return pref.Subscribed == 1, nil
+}
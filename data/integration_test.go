@@ -8,10 +8,13 @@ package data
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"myapp/appcache"
 	"net/http"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -178,6 +181,128 @@ func createTables(db *sql.DB) error {
 		BEFORE UPDATE ON tokens
 		FOR EACH ROW
 		EXECUTE PROCEDURE trigger_set_timestamp();
+	
+	drop table if exists webhooks cascade;
+	
+	CREATE TABLE webhooks (
+		id SERIAL PRIMARY KEY,
+		url character varying(2048) NOT NULL,
+		events character varying(512) NOT NULL DEFAULT '*',
+		secret character varying(255) NOT NULL,
+		active integer NOT NULL DEFAULT 1,
+		created_at timestamp without time zone NOT NULL DEFAULT now(),
+		updated_at timestamp without time zone NOT NULL DEFAULT now()
+	);
+	
+	CREATE TRIGGER set_timestamp
+		BEFORE UPDATE ON webhooks
+		FOR EACH ROW
+		EXECUTE PROCEDURE trigger_set_timestamp();
+	
+	drop table if exists webhook_deliveries;
+	
+	CREATE TABLE webhook_deliveries (
+		id SERIAL PRIMARY KEY,
+		webhook_id integer NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE ON UPDATE CASCADE,
+		event character varying(255) NOT NULL,
+		payload text NOT NULL,
+		status character varying(20) NOT NULL DEFAULT 'pending',
+		attempts integer NOT NULL DEFAULT 0,
+		response_status integer NOT NULL DEFAULT 0,
+		last_error text NOT NULL DEFAULT '',
+		next_attempt timestamp without time zone NOT NULL DEFAULT now(),
+		created_at timestamp without time zone NOT NULL DEFAULT now(),
+		updated_at timestamp without time zone NOT NULL DEFAULT now()
+	);
+	
+	CREATE INDEX webhook_deliveries_due ON webhook_deliveries (status, next_attempt);
+	
+	CREATE TRIGGER set_timestamp
+		BEFORE UPDATE ON webhook_deliveries
+		FOR EACH ROW
+		EXECUTE PROCEDURE trigger_set_timestamp();
+
+	drop table if exists mail_outbox;
+	
+	CREATE TABLE mail_outbox (
+		id SERIAL PRIMARY KEY,
+		to_address character varying(255) NOT NULL,
+		from_address character varying(255) NOT NULL DEFAULT '',
+		from_name character varying(255) NOT NULL DEFAULT '',
+		subject character varying(998) NOT NULL DEFAULT '',
+		template character varying(255) NOT NULL,
+		data text NOT NULL DEFAULT 'null',
+		attachments text NOT NULL DEFAULT '[]',
+		status character varying(20) NOT NULL DEFAULT 'pending',
+		attempts integer NOT NULL DEFAULT 0,
+		last_error text NOT NULL DEFAULT '',
+		next_attempt timestamp without time zone NOT NULL DEFAULT now(),
+		sent_at timestamp without time zone,
+		created_at timestamp without time zone NOT NULL DEFAULT now(),
+		updated_at timestamp without time zone NOT NULL DEFAULT now()
+	);
+	
+	CREATE INDEX mail_outbox_due ON mail_outbox (status, next_attempt);
+	
+	CREATE TRIGGER set_timestamp
+		BEFORE UPDATE ON mail_outbox
+		FOR EACH ROW
+		EXECUTE PROCEDURE trigger_set_timestamp();
+	
+	drop table if exists email_preferences;
+	
+	CREATE TABLE email_preferences (
+		id SERIAL PRIMARY KEY,
+		user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+		category character varying(50) NOT NULL,
+		subscribed integer NOT NULL DEFAULT 1,
+		created_at timestamp without time zone NOT NULL DEFAULT now(),
+		updated_at timestamp without time zone NOT NULL DEFAULT now(),
+		UNIQUE (user_id, category)
+	);
+	
+	CREATE TRIGGER set_timestamp
+		BEFORE UPDATE ON email_preferences
+		FOR EACH ROW
+		EXECUTE PROCEDURE trigger_set_timestamp();
+	
+	drop table if exists mail_suppressions;
+	drop table if exists mail_bounces;
+	
+	CREATE TABLE mail_bounces (
+		id SERIAL PRIMARY KEY,
+		user_id integer REFERENCES users(id) ON DELETE SET NULL ON UPDATE CASCADE,
+		email character varying(255) NOT NULL,
+		provider character varying(50) NOT NULL,
+		event_id character varying(255),
+		kind character varying(20) NOT NULL,
+		reason text NOT NULL DEFAULT '',
+		created_at timestamp without time zone NOT NULL DEFAULT now(),
+		updated_at timestamp without time zone NOT NULL DEFAULT now(),
+		UNIQUE (provider, event_id)
+	);
+	
+	CREATE INDEX mail_bounces_email ON mail_bounces (email, kind, created_at);
+	
+	CREATE TRIGGER set_timestamp
+		BEFORE UPDATE ON mail_bounces
+		FOR EACH ROW
+		EXECUTE PROCEDURE trigger_set_timestamp();
+	
+	CREATE TABLE mail_suppressions (
+		id SERIAL PRIMARY KEY,
+		user_id integer REFERENCES users(id) ON DELETE SET NULL ON UPDATE CASCADE,
+		email character varying(255) NOT NULL UNIQUE,
+		reason text NOT NULL DEFAULT '',
+		cleared_at timestamp without time zone,
+		created_at timestamp without time zone NOT NULL DEFAULT now(),
+		updated_at timestamp without time zone NOT NULL DEFAULT now()
+	);
+	
+	CREATE TRIGGER set_timestamp
+		BEFORE UPDATE ON mail_suppressions
+		FOR EACH ROW
+		EXECUTE PROCEDURE trigger_set_timestamp();
 		
 	`
 
@@ -225,6 +350,27 @@ func TestUser_GetAll(t *testing.T) {
 	}
 }
 
+func TestUser_GetPage(t *testing.T) {
+	users, total, err := models.Users.GetPage(1, 10)
+	if err != nil {
+		t.Error("failed to get page of users:", err)
+	}
+
+	if total != 1 || len(users) != 1 {
+		t.Errorf("expected 1 user but got %d (total %d)", len(users), total)
+	}
+
+	// page past the end
+	users, _, err = models.Users.GetPage(5, 10)
+	if err != nil {
+		t.Error("failed to get empty page of users:", err)
+	}
+
+	if len(users) != 0 {
+		t.Error("users returned past the last page")
+	}
+}
+
 func TestUser_GetByEmail(t *testing.T) {
 	u, err := models.Users.GetByEmail(dummyUser.Email)
 	if err != nil {
@@ -295,6 +441,21 @@ func TestUser_ResetPassword(t *testing.T) {
 		t.Error("error resetting password for existing user:", err)
 	}
 
+	// the rest of the user must be left alone
+	u, err := models.Users.Get(1)
+	if err != nil {
+		t.Error("failed to get user:", err)
+	}
+
+	if u.Email != dummyUser.Email {
+		t.Error("user details changed when resetting password:", u.Email)
+	}
+
+	matches, _ := u.PasswordMatches("new_password")
+	if !matches {
+		t.Error("new password does not match")
+	}
+
 	// reset password for non-existing user
 	err = models.Users.ResetPassword(100, "new_password")
 	if err == nil {
@@ -671,3 +832,472 @@ func TestToken_ValidToken(t *testing.T) {
 		t.Error("no error when validating non-existing token")
 	}
 }
+
+func TestWebhook_GetForEvent(t *testing.T) {
+	all, err := models.Webhooks.Insert(Webhook{URL: "http://example.com/all", Events: "*", Secret: "s", Active: 1})
+	if err != nil {
+		t.Fatal("error inserting webhook:", err)
+	}
+	_, err = models.Webhooks.Insert(Webhook{URL: "http://example.com/deleted", Events: "user.deleted", Secret: "s", Active: 1})
+	if err != nil {
+		t.Fatal("error inserting webhook:", err)
+	}
+	_, err = models.Webhooks.Insert(Webhook{URL: "http://example.com/off", Events: "*", Secret: "s", Active: 0})
+	if err != nil {
+		t.Fatal("error inserting webhook:", err)
+	}
+
+	hooks, err := models.Webhooks.GetForEvent("user.created")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != 1 || hooks[0].ID != all {
+		t.Error("expected only the active catch-all webhook, got", hooks)
+	}
+
+	hooks, err = models.Webhooks.GetForEvent("user.deleted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != 2 {
+		t.Error("expected two webhooks for user.deleted, got", len(hooks))
+	}
+}
+
+func TestWebhookDelivery_GetDue(t *testing.T) {
+	hookID, err := models.Webhooks.Insert(Webhook{URL: "http://example.com/due", Events: "*", Secret: "s", Active: 1})
+	if err != nil {
+		t.Fatal("error inserting webhook:", err)
+	}
+
+	now := time.Now()
+	due, err := models.WebhookDeliveries.Insert(WebhookDelivery{WebhookID: hookID, Event: "user.created", Payload: "{}", NextAttempt: now.Add(-time.Minute)})
+	if err != nil {
+		t.Fatal("error inserting delivery:", err)
+	}
+	_, err = models.WebhookDeliveries.Insert(WebhookDelivery{WebhookID: hookID, Event: "user.created", Payload: "{}", NextAttempt: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatal("error inserting delivery:", err)
+	}
+
+	deliveries, err := models.WebhookDeliveries.GetDue(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].ID != due {
+		t.Fatal("expected only the due delivery, got", deliveries)
+	}
+
+	d := deliveries[0]
+	d.Status = DeliveryDelivered
+	d.Attempts = 1
+	if err := models.WebhookDeliveries.Update(*d); err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries, _ = models.WebhookDeliveries.GetDue(now)
+	if len(deliveries) != 0 {
+		t.Error("a delivered delivery should not be due")
+	}
+
+	log, err := models.WebhookDeliveries.GetForWebhook(hookID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != 2 || log[0].ID <= log[1].ID {
+		t.Error("expected both deliveries, newest first")
+	}
+}
+
+func TestOutboxMessage_Claim(t *testing.T) {
+	now := time.Now()
+	id, err := models.Outbox.Insert(OutboxMessage{To: "me@here.com", Template: "test", Data: "null", Attachments: "[]"})
+	if err != nil {
+		t.Fatal("error inserting outbox message:", err)
+	}
+	_, err = models.Outbox.Insert(OutboxMessage{To: "later@here.com", Template: "test", Data: "null", Attachments: "[]", NextAttempt: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatal("error inserting outbox message:", err)
+	}
+
+	due, err := models.Outbox.GetDue(time.Now(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 1 || due[0].ID != id {
+		t.Fatal("expected only the due message, got", due)
+	}
+
+	claimed, err := models.Outbox.Claim(id, now.Add(time.Minute))
+	if err != nil || !claimed {
+		t.Fatal("expected to claim the message:", err)
+	}
+	claimed, err = models.Outbox.Claim(id, now.Add(time.Minute))
+	if err != nil || claimed {
+		t.Fatal("a claimed message should not be claimed again:", err)
+	}
+
+	counts, err := models.Outbox.Counts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[OutboxPending] != 2 || counts[OutboxSent] != 0 {
+		t.Error("wrong counts", counts)
+	}
+}
+
+func TestOutboxMessage_Requeue(t *testing.T) {
+	id, err := models.Outbox.Insert(OutboxMessage{To: "dead@here.com", Template: "test", Data: "null", Attachments: "[]", Status: OutboxDead, Attempts: 5})
+	if err != nil {
+		t.Fatal("error inserting outbox message:", err)
+	}
+
+	requeued, err := models.Outbox.Requeue(id)
+	if err != nil || !requeued {
+		t.Fatal("expected to requeue the dead message:", err)
+	}
+	msg, err := models.Outbox.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Status != OutboxPending || msg.Attempts != 0 || msg.NextAttempt.After(time.Now()) {
+		t.Errorf("expected a due pending message, got %+v", msg)
+	}
+
+	// pending now, and maybe claimed by a worker
+	if _, err := models.Outbox.Claim(id, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	requeued, err = models.Outbox.Requeue(id)
+	if err != nil || requeued {
+		t.Fatal("a pending message should not be requeued:", err)
+	}
+	if msg, _ := models.Outbox.Get(id); !msg.NextAttempt.After(time.Now()) {
+		t.Error("requeueing changed the claimed message's next attempt")
+	}
+}
+
+func TestOutboxMessage_CancelIfIdle(t *testing.T) {
+	id, err := models.Outbox.Insert(OutboxMessage{To: "claimed@here.com", Template: "test", Data: "null", Attachments: "[]", Status: OutboxPending, NextAttempt: time.Now()})
+	if err != nil {
+		t.Fatal("error inserting outbox message:", err)
+	}
+
+	// a worker has it
+	if claimed, err := models.Outbox.Claim(id, time.Now().Add(time.Minute)); err != nil || !claimed {
+		t.Fatal("expected to claim the message:", err)
+	}
+	if cancelled, err := models.Outbox.CancelIfIdle(id); err != nil || cancelled {
+		t.Fatal("a claimed message should not be cancelled:", err)
+	}
+
+	// the worker's outcome is saved while the message is still pending
+	msg, _ := models.Outbox.Get(id)
+	now := time.Now()
+	msg.Status, msg.Attempts, msg.SentAt = OutboxSent, 1, &now
+	if saved, err := models.Outbox.SaveAttempt(*msg); err != nil || !saved {
+		t.Fatal("expected the attempt to be saved:", err)
+	}
+	if cancelled, err := models.Outbox.CancelIfIdle(id); err != nil || cancelled {
+		t.Fatal("a sent message should not be cancelled:", err)
+	}
+
+	id, err = models.Outbox.Insert(OutboxMessage{To: "due@here.com", Template: "test", Data: "null", Attachments: "[]", Status: OutboxPending, NextAttempt: time.Now().Add(-time.Second)})
+	if err != nil {
+		t.Fatal("error inserting outbox message:", err)
+	}
+	if cancelled, err := models.Outbox.CancelIfIdle(id); err != nil || !cancelled {
+		t.Fatal("expected to cancel the due message:", err)
+	}
+
+	// a worker that claimed it before the cancel doesn't overwrite it
+	msg, _ = models.Outbox.Get(id)
+	msg.Status = OutboxSent
+	if saved, err := models.Outbox.SaveAttempt(*msg); err != nil || saved {
+		t.Fatal("the attempt should not overwrite the cancel:", err)
+	}
+	if msg, _ := models.Outbox.Get(id); msg.Status != OutboxCancelled {
+		t.Error("expected the message to stay cancelled, got", msg.Status)
+	}
+}
+
+func TestOutboxMessage_InsertTx(t *testing.T) {
+	rollback := errors.New("roll back")
+	err := Transaction(func(tx *Tx) error {
+		if _, err := models.Outbox.InsertTx(tx, OutboxMessage{To: "rolledback@here.com", Template: "test", Data: "null", Attachments: "[]"}); err != nil {
+			return err
+		}
+		return rollback
+	})
+	if err != rollback {
+		t.Fatal("expected the transaction's error back, got", err)
+	}
+
+	messages, _, err := models.Outbox.GetPage("", 1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range messages {
+		if msg.To == "rolledback@here.com" {
+			t.Error("a message queued in a rolled back transaction was saved")
+		}
+	}
+}
+
+func TestEmailPreference_Allows(t *testing.T) {
+	u, err := models.Users.GetByEmail(dummyUser.Email)
+	if err != nil {
+		t.Fatal("error getting user by email:", err)
+	}
+
+	prefs, err := models.EmailPreferences.GetForUser(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !prefs[EmailProduct] || !prefs[EmailNewsletter] {
+		t.Error("users should start subscribed to every category", prefs)
+	}
+
+	// setting it twice updates the one row
+	for _, subscribed := range []bool{true, false} {
+		if err := models.EmailPreferences.Set(u.ID, EmailNewsletter, subscribed); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	allowed, err := models.EmailPreferences.Allows(u.Email, EmailNewsletter)
+	if err != nil || allowed {
+		t.Error("newsletters should be suppressed after opting out:", err)
+	}
+	allowed, err = models.EmailPreferences.Allows(u.Email, EmailProduct)
+	if err != nil || !allowed {
+		t.Error("product mail should still be allowed:", err)
+	}
+	allowed, err = models.EmailPreferences.Allows(u.Email, EmailTransactional)
+	if err != nil || !allowed {
+		t.Error("transactional mail should always be allowed:", err)
+	}
+	allowed, err = models.EmailPreferences.Allows("nobody@example.com", EmailNewsletter)
+	if err != nil || !allowed {
+		t.Error("mail to an address that isn't a user's should be allowed:", err)
+	}
+
+	prefs, _ = models.EmailPreferences.GetForUser(u.ID)
+	if prefs[EmailNewsletter] || !prefs[EmailProduct] {
+		t.Error("wrong preferences", prefs)
+	}
+}
+
+func TestUser_IDForEmail(t *testing.T) {
+	id, err := models.Users.Insert(User{FirstName: "Ada", LastName: "Lovelace", Email: "Ada@Example.com", Active: 1, Password: "password"})
+	if err != nil {
+		t.Fatal("error inserting user:", err)
+	}
+
+	// providers report addresses lowercased, or in any other case
+	for _, email := range []string{"ada@example.com", "ADA@EXAMPLE.COM"} {
+		if got, err := models.Users.IDForEmail(email); err != nil || got != id {
+			t.Errorf("%s: expected user %d, got %d: %v", email, id, got, err)
+		}
+	}
+
+	if _, err := models.Users.IDForEmail("nobody@example.com"); !IsNotFound(err) {
+		t.Error("expected not found, got", err)
+	}
+}
+
+func TestMailSuppression_Clear(t *testing.T) {
+	u, err := models.Users.GetByEmail(dummyUser.Email)
+	if err != nil {
+		t.Fatal("error getting user by email:", err)
+	}
+
+	// the bounce is recorded against the user, whatever the provider's casing
+	eventID := "event-1"
+	bounce := MailBounce{Email: strings.ToUpper(u.Email), Provider: "mailgun", EventID: &eventID, Kind: BounceHard}
+	id, err := models.MailBounces.Insert(bounce)
+	if err != nil || id == 0 {
+		t.Fatal("expected the bounce to be recorded:", err)
+	}
+	// the provider posting the event again
+	id, err = models.MailBounces.Insert(bounce)
+	if err != nil || id != 0 {
+		t.Fatalf("expected the repeated event to be skipped, got %d: %v", id, err)
+	}
+	bounces, err := models.MailBounces.GetForEmail(u.Email, 10)
+	if err != nil || len(bounces) != 1 {
+		t.Fatal("expected one bounce:", err)
+	}
+	if bounces[0].UserID == nil || *bounces[0].UserID != u.ID {
+		t.Error("the bounce was not recorded against the user")
+	}
+
+	if err := models.MailSuppressions.Suppress(u.Email, &u.ID, "bounced"); err != nil {
+		t.Fatal(err)
+	}
+	suppressed, err := models.MailSuppressions.Suppressed(u.Email)
+	if err != nil || !suppressed {
+		t.Fatal("the address should be suppressed:", err)
+	}
+
+	suppression, err := models.MailSuppressions.GetByEmail(u.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := models.MailSuppressions.Clear(suppression.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := models.MailSuppressions.Clear(suppression.ID); !IsNotFound(err) {
+		t.Error("clearing twice should be not found, got", err)
+	}
+
+	suppressed, _ = models.MailSuppressions.Suppressed(u.Email)
+	if suppressed {
+		t.Error("the address should not be suppressed once cleared")
+	}
+
+	// only bounces after it was cleared count again
+	since, err := models.MailSuppressions.Since(u.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := models.MailBounces.CountSince(u.Email, BounceHard, since)
+	if err != nil || count != 0 {
+		t.Errorf("expected no bounces since it was cleared, got %d: %v", count, err)
+	}
+}
+
+func TestToken_GetTokensForUsers(t *testing.T) {
+	u, err := models.Users.GetByEmail(dummyUser.Email)
+	if err != nil {
+		t.Fatal("error getting user by email:", err)
+	}
+
+	token, err := models.Tokens.GenerateToken(u.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := models.Tokens.Insert(*token, *u); err != nil {
+		t.Fatal(err)
+	}
+
+	byUser, err := models.Tokens.GetTokensForUsers([]int{u.ID, u.ID + 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byUser[u.ID]) != 1 || byUser[u.ID][0].UserID != u.ID {
+		t.Error("expected the user's token, got", byUser[u.ID])
+	}
+	if len(byUser[u.ID+1000]) != 0 {
+		t.Error("a user without tokens should have none")
+	}
+
+	empty, err := models.Tokens.GetTokensForUsers(nil)
+	if err != nil || len(empty) != 0 {
+		t.Error("no ids should be no tokens", empty, err)
+	}
+}
+
+func TestUser_InsertMany(t *testing.T) {
+	users := []User{
+		{FirstName: "Bulk", LastName: "One", Email: "bulk1@example.com", Active: 1, Password: "password"},
+		{FirstName: "Bulk", LastName: "Two", Email: "bulk2@example.com", Active: 1, Password: "password"},
+	}
+
+	if err := models.Users.InsertMany(users); err != nil {
+		t.Fatal("insert many failed:", err)
+	}
+	if users[0].ID == 0 || users[1].ID <= users[0].ID {
+		t.Error("expected ids to be set in order, got", users[0].ID, users[1].ID)
+	}
+
+	u, err := models.Users.Get(users[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := u.PasswordMatches("password"); !ok {
+		t.Error("password was not hashed")
+	}
+
+	existing, err := models.Users.ExistingEmails([]string{"Bulk1@Example.com", "nobody@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !existing["bulk1@example.com"] || existing["nobody@example.com"] {
+		t.Error("unexpected existing emails", existing)
+	}
+
+	// a duplicate email rolls back the whole batch
+	dup := []User{
+		{FirstName: "Bulk", LastName: "Three", Email: "bulk3@example.com", Password: "password"},
+		{FirstName: "Bulk", LastName: "Four", Email: "bulk1@example.com", Password: "password"},
+	}
+	if err := models.Users.InsertMany(dup); err == nil {
+		t.Error("expected an error inserting a duplicate email")
+	}
+	if _, err := models.Users.GetByEmail("bulk3@example.com"); err == nil {
+		t.Error("the batch was not rolled back")
+	}
+
+	after, err := models.Users.GetAfter(users[0].ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) == 0 || after[0].ID != users[1].ID {
+		t.Error("expected the second user first, got", after)
+	}
+}
+
+func TestModelCache(t *testing.T) {
+	EnableCache(appcache.NewMemory(), CacheConfig{Enabled: true, UserTTL: time.Minute, TokenTTL: time.Minute})
+	defer DisableCache()
+
+	id, err := models.Users.Insert(User{FirstName: "Cache", LastName: "Me", Email: "cache@example.com", Active: 1, Password: "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := models.Users.GetByEmail("cache@example.com")
+	if err != nil || u.ID != id {
+		t.Fatal("failed to get user:", err)
+	}
+
+	// an update is seen straight away, under the old and the new email
+	u.LastName = "Changed"
+	u.Email = "cached@example.com"
+	if err := models.Users.Update(*u); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := models.Users.Get(id); u == nil || u.LastName != "Changed" {
+		t.Error("expected the updated user, got", u)
+	}
+	if _, err := models.Users.GetByEmail("cache@example.com"); err == nil {
+		t.Error("expected the old email not to find the user")
+	}
+
+	// a new token replaces the cached one
+	first, _ := models.Tokens.GenerateToken(id, time.Hour)
+	if err := models.Tokens.Insert(*first, *u); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := models.Tokens.GetByToken(first.PlainText); err != nil {
+		t.Fatal("failed to get token:", err)
+	}
+	second, _ := models.Tokens.GenerateToken(id, time.Hour)
+	if err := models.Tokens.Insert(*second, *u); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := models.Tokens.GetByToken(first.PlainText); err == nil {
+		t.Error("expected the replaced token to be gone")
+	}
+	if u, _ := models.Users.Get(id); u == nil || u.Token.PlainText != second.PlainText {
+		t.Error("expected the user's new token")
+	}
+
+	if err := models.Users.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := models.Users.Get(id); err == nil {
+		t.Error("expected the deleted user to be gone")
+	}
+}
@@ -0,0 +1,238 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	up "github.com/upper/db/v4"
+)
+
+// Bounce kinds. Only hard bounces and spam complaints are recorded, soft
+// bounces are retried by the provider.
+const (
+	BounceHard      = "bounce"
+	BounceComplaint = "complaint"
+)
+
+// MailBounce is a hard bounce or spam complaint reported by a mail provider.
+// UserID is nil when the address isn't a user's. EventID is the provider's id
+// for the event, so an event the provider posts again is only recorded once.
+type MailBounce struct {
+	ID        int       `db:"id,omitempty" json:"id"`
+	UserID    *int      `db:"user_id" json:"user_id"`
+	Email     string    `db:"email" json:"email"`
+	Provider  string    `db:"provider" json:"provider"`
+	EventID   *string   `db:"event_id" json:"event_id"`
+	Kind      string    `db:"kind" json:"kind"`
+	Reason    string    `db:"reason" json:"reason"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+}
+
+func (b *MailBounce) Table() string {
+	return "mail_bounces"
+}
+
+// Insert records the bounce against the user with its address, if there is
+// one. It returns 0 for an event of the provider's that was recorded already.
+func (b *MailBounce) Insert(bounce MailBounce) (int, error) {
+	bounce.Email = normalizeEmail(bounce.Email)
+	bounce.CreatedAt = time.Now()
+	bounce.UpdatedAt = time.Now()
+
+	if bounce.UserID == nil {
+		var u User
+		userID, err := u.IDForEmail(bounce.Email)
+		if err != nil && !IsNotFound(err) {
+			return 0, err
+		}
+		if err == nil {
+			bounce.UserID = &userID
+		}
+	}
+
+	row, err := upper.SQL().QueryRow(`
+		INSERT INTO mail_bounces (user_id, email, provider, event_id, kind, reason, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (provider, event_id) DO NOTHING
+		RETURNING id`,
+		bounce.UserID, bounce.Email, bounce.Provider, bounce.EventID, bounce.Kind, bounce.Reason, bounce.CreatedAt, bounce.UpdatedAt)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	err = row.Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// CountSince counts the bounces of the kind for the address since t
+func (b *MailBounce) CountSince(email, kind string, t time.Time) (int, error) {
+	collection := upper.Collection(b.Table())
+	res := collection.Find(up.Cond{"email": normalizeEmail(email), "kind": kind, "created_at >": t})
+
+	count, err := res.Count()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(count), nil
+}
+
+// GetForEmail gets the newest bounces for the address, up to limit
+func (b *MailBounce) GetForEmail(email string, limit int) ([]*MailBounce, error) {
+	collection := upper.Collection(b.Table())
+
+	var bounces []*MailBounce
+
+	err := collection.Find(up.Cond{"email": normalizeEmail(email)}).OrderBy("-id").Limit(limit).All(&bounces)
+	if err != nil {
+		return nil, err
+	}
+
+	return bounces, nil
+}
+
+// MailSuppression is an address no mail is sent to, because it bounced or
+// complained too often. An admin clearing it sets ClearedAt, and only the
+// bounces after that count towards suppressing it again.
+type MailSuppression struct {
+	ID        int        `db:"id,omitempty" json:"id"`
+	UserID    *int       `db:"user_id" json:"user_id"`
+	Email     string     `db:"email" json:"email"`
+	Reason    string     `db:"reason" json:"reason"`
+	ClearedAt *time.Time `db:"cleared_at" json:"cleared_at"`
+	CreatedAt time.Time  `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time  `db:"updated_at" json:"updated_at"`
+}
+
+func (s *MailSuppression) Table() string {
+	return "mail_suppressions"
+}
+
+func (s *MailSuppression) Get(id int) (*MailSuppression, error) {
+	var suppression MailSuppression
+	collection := upper.Collection(s.Table())
+	res := collection.Find(up.Cond{"id": id})
+
+	err := res.One(&suppression)
+	if err != nil {
+		return nil, err
+	}
+
+	return &suppression, nil
+}
+
+// GetByEmail gets the address's suppression, cleared or not
+func (s *MailSuppression) GetByEmail(email string) (*MailSuppression, error) {
+	var suppression MailSuppression
+	collection := upper.Collection(s.Table())
+	res := collection.Find(up.Cond{"email": normalizeEmail(email)})
+
+	err := res.One(&suppression)
+	if err != nil {
+		return nil, err
+	}
+
+	return &suppression, nil
+}
+
+// GetPage gets one page of the suppressed addresses, newest first, along with
+// how many there are. Cleared addresses aren't included.
+func (s *MailSuppression) GetPage(page, perPage int) ([]*MailSuppression, int, error) {
+	collection := upper.Collection(s.Table())
+
+	var suppressions []*MailSuppression
+
+	res := collection.Find(up.Cond{"cleared_at IS": nil}).OrderBy("-updated_at").Paginate(uint(perPage))
+	err := res.Page(uint(page)).All(&suppressions)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total, err := res.TotalEntries()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return suppressions, int(total), nil
+}
+
+// Suppressed reports whether mail to the address is suppressed
+func (s *MailSuppression) Suppressed(email string) (bool, error) {
+	suppression, err := s.GetByEmail(email)
+	if IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return suppression.ClearedAt == nil, nil
+}
+
+// Since is when the address's bounces start counting, the last time it was
+// cleared or the zero time
+func (s *MailSuppression) Since(email string) (time.Time, error) {
+	suppression, err := s.GetByEmail(email)
+	if IsNotFound(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if suppression.ClearedAt == nil {
+		return time.Time{}, nil
+	}
+
+	return *suppression.ClearedAt, nil
+}
+
+// Suppress stops mail to the address, or updates the reason when it already is
+func (s *MailSuppression) Suppress(email string, userID *int, reason string) error {
+	_, err := upper.SQL().Exec(`
+		INSERT INTO mail_suppressions (email, user_id, reason, created_at, updated_at)
+		VALUES (?, ?, ?, now(), now())
+		ON CONFLICT (email) DO UPDATE SET user_id = EXCLUDED.user_id, reason = EXCLUDED.reason, cleared_at = NULL`,
+		normalizeEmail(email), userID, reason)
+
+	return err
+}
+
+// Clear lets mail be sent to the address again
+func (s *MailSuppression) Clear(id int) error {
+	res, err := upper.SQL().
+		Update(s.Table()).
+		Set("cleared_at", time.Now(), "updated_at", time.Now()).
+		Where("id = ? AND cleared_at IS NULL", id).
+		Exec()
+	if err != nil {
+		return err
+	}
+
+	cleared, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if cleared == 0 {
+		return up.ErrNoMoreRows
+	}
+
+	return nil
+}
+
+// normalizeEmail is how addresses are kept in the bounce tables, so the
+// provider's casing doesn't matter
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
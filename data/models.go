@@ -2,6 +2,7 @@ package data
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 
@@ -16,8 +17,14 @@ var upper db2.Session
 type Models struct {
 	// any models inserted here and in the New function
 	// are easily accessible throughout the entire application.
-	Users  User
-	Tokens Token
+	Users             User
+	Tokens            Token
+	Webhooks          Webhook
+	WebhookDeliveries WebhookDelivery
+	Outbox            OutboxMessage
+	EmailPreferences  EmailPreference
+	MailBounces       MailBounce
+	MailSuppressions  MailSuppression
 }
 
 func New(databasePool *sql.DB) Models {
@@ -33,11 +40,39 @@ func New(databasePool *sql.DB) Models {
 	}
 
 	return Models{
-		Users:  User{},
-		Tokens: Token{},
+		Users:             User{},
+		Tokens:            Token{},
+		Webhooks:          Webhook{},
+		WebhookDeliveries: WebhookDelivery{},
+		Outbox:            OutboxMessage{},
+		EmailPreferences:  EmailPreference{},
+		MailBounces:       MailBounce{},
+		MailSuppressions:  MailSuppression{},
 	}
 }
 
+// Tx is a database transaction. Models with a Tx method take part in it, eg
+// Outbox.InsertTx queues a mail that is only sent if the transaction commits.
+type Tx struct {
+	sess db2.Session
+}
+
+// Transaction runs fn in a transaction, which is rolled back if fn returns an error
+func Transaction(fn func(tx *Tx) error) error {
+	return upper.Tx(func(sess db2.Session) error {
+		return fn(&Tx{sess: sess})
+	})
+}
+
+// session is the transaction's session, or the pool's when tx is nil
+func session(tx *Tx) db2.Session {
+	if tx == nil {
+		return upper
+	}
+
+	return tx.sess
+}
+
 func getInsertID(i db2.ID) int {
 	idType := fmt.Sprintf("%T", i)
 	if idType == "int64" {
@@ -48,3 +83,8 @@ func getInsertID(i db2.ID) int {
 	// else cast to an int
 	return i.(int)
 }
+
+// IsNotFound reports whether err means the query returned no rows
+func IsNotFound(err error) bool {
+	return errors.Is(err, db2.ErrNoMoreRows) || errors.Is(err, db2.ErrNilRecord)
+}
@@ -0,0 +1,254 @@
+package data
+
+import (
+	"fmt"
+	"time"
+
+	up "github.com/upper/db/v4"
+)
+
+// Outbox statuses. A message is dead once every attempt has failed,
+// cancelled when an admin gave up on it, and suppressed when the recipient
+// opted out of its category or the address is undeliverable.
+const (
+	OutboxPending    = "pending"
+	OutboxSent       = "sent"
+	OutboxDead       = "dead"
+	OutboxCancelled  = "cancelled"
+	OutboxSuppressed = "suppressed"
+)
+
+// OutboxStatuses lists every outbox status, for validating filters
+var OutboxStatuses = []string{OutboxPending, OutboxSent, OutboxDead, OutboxCancelled, OutboxSuppressed}
+
+// OutboxMessage is a mail waiting to be sent, or the record of one that was.
+// Data is the template data as json and Attachments a json list of file paths.
+type OutboxMessage struct {
+	ID          int        `db:"id,omitempty" json:"id"`
+	To          string     `db:"to_address" json:"to"`
+	From        string     `db:"from_address" json:"from"`
+	FromName    string     `db:"from_name" json:"from_name"`
+	Subject     string     `db:"subject" json:"subject"`
+	Template    string     `db:"template" json:"template"`
+	Data        string     `db:"data" json:"data"`
+	Attachments string     `db:"attachments" json:"attachments"`
+	Status      string     `db:"status" json:"status"`
+	Attempts    int        `db:"attempts" json:"attempts"`
+	LastError   string     `db:"last_error" json:"last_error"`
+	NextAttempt time.Time  `db:"next_attempt" json:"next_attempt"`
+	SentAt      *time.Time `db:"sent_at" json:"sent_at"`
+	CreatedAt   time.Time  `db:"created_at" json:"created_at"`
+	UpdatedAt   time.Time  `db:"updated_at" json:"updated_at"`
+}
+
+func (m *OutboxMessage) Table() string {
+	return "mail_outbox"
+}
+
+func (m *OutboxMessage) Get(id int) (*OutboxMessage, error) {
+	var msg OutboxMessage
+	collection := upper.Collection(m.Table())
+	res := collection.Find(up.Cond{"id": id})
+
+	err := res.One(&msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &msg, nil
+}
+
+// GetPage gets one page of messages with the status, or every status when it
+// is empty, newest first, along with how many there are
+func (m *OutboxMessage) GetPage(status string, page, perPage int) ([]*OutboxMessage, int, error) {
+	collection := upper.Collection(m.Table())
+
+	cond := up.Cond{}
+	if status != "" {
+		cond["status"] = status
+	}
+
+	var messages []*OutboxMessage
+
+	res := collection.Find(cond).OrderBy("-id").Paginate(uint(perPage))
+	err := res.Page(uint(page)).All(&messages)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total, err := res.TotalEntries()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return messages, int(total), nil
+}
+
+// Counts gets the number of messages in each status
+func (m *OutboxMessage) Counts() (map[string]int, error) {
+	var rows []struct {
+		Status string `db:"status"`
+		Count  int    `db:"count"`
+	}
+
+	err := upper.SQL().Select("status", up.Raw("count(*) AS count")).From(m.Table()).GroupBy("status").All(&rows)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int, len(OutboxStatuses))
+	for _, status := range OutboxStatuses {
+		counts[status] = 0
+	}
+	for _, row := range rows {
+		counts[row.Status] = row.Count
+	}
+
+	return counts, nil
+}
+
+// GetDue gets up to limit pending messages whose next attempt is at or before t
+func (m *OutboxMessage) GetDue(t time.Time, limit int) ([]*OutboxMessage, error) {
+	collection := upper.Collection(m.Table())
+
+	var messages []*OutboxMessage
+
+	res := collection.Find(up.Cond{"status": OutboxPending, "next_attempt <=": t}).OrderBy("next_attempt").Limit(limit)
+	err := res.All(&messages)
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+func (m *OutboxMessage) Insert(msg OutboxMessage) (int, error) {
+	return m.InsertTx(nil, msg)
+}
+
+// InsertTx inserts the message in the transaction, so it is only sent if the
+// transaction commits
+func (m *OutboxMessage) InsertTx(tx *Tx, msg OutboxMessage) (int, error) {
+	msg.CreatedAt = time.Now()
+	msg.UpdatedAt = time.Now()
+	if msg.Status == "" {
+		msg.Status = OutboxPending
+	}
+	if msg.NextAttempt.IsZero() {
+		msg.NextAttempt = msg.CreatedAt
+	}
+
+	collection := session(tx).Collection(m.Table())
+	res, err := collection.Insert(&msg)
+	if err != nil {
+		return 0, fmt.Errorf("error inserting an outbox message: %w", err)
+	}
+
+	return getInsertID(res.ID()), nil
+}
+
+func (m *OutboxMessage) Update(msg OutboxMessage) error {
+	msg.UpdatedAt = time.Now()
+	collection := upper.Collection(m.Table())
+	res := collection.Find(msg.ID)
+	err := res.Update(&msg)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Requeue makes a dead, cancelled or suppressed message pending and due now,
+// with no attempts made. It reports false when the message is in any other
+// state; a pending one may be claimed by a worker, so it is left alone.
+func (m *OutboxMessage) Requeue(id int) (bool, error) {
+	now := time.Now()
+	res, err := upper.SQL().
+		Update(m.Table()).
+		Set("status", OutboxPending, "attempts", 0, "next_attempt", now, "updated_at", now).
+		Where("id = ? AND status IN ?", id, []string{OutboxDead, OutboxCancelled, OutboxSuppressed}).
+		Exec()
+	if err != nil {
+		return false, err
+	}
+
+	requeued, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return requeued == 1, nil
+}
+
+// CancelIfIdle cancels a dead or suppressed message, or a pending one that is
+// due, so no worker holds it. It reports false when the message is in any
+// other state: sent, cancelled, or pending with its next attempt ahead, which
+// may mean a worker is sending it right now.
+func (m *OutboxMessage) CancelIfIdle(id int) (bool, error) {
+	now := time.Now()
+	res, err := upper.SQL().
+		Update(m.Table()).
+		Set("status", OutboxCancelled, "updated_at", now).
+		Where("id = ? AND status IN ? AND NOT (status = ? AND next_attempt > ?)",
+			id, []string{OutboxPending, OutboxDead, OutboxSuppressed}, OutboxPending, now).
+		Exec()
+	if err != nil {
+		return false, err
+	}
+
+	cancelled, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return cancelled == 1, nil
+}
+
+// SaveAttempt saves the outcome of a worker's attempt, only if the message is
+// still pending. It reports false when it was changed meanwhile, eg cancelled.
+func (m *OutboxMessage) SaveAttempt(msg OutboxMessage) (bool, error) {
+	res, err := upper.SQL().
+		Update(m.Table()).
+		Set(
+			"status", msg.Status,
+			"attempts", msg.Attempts,
+			"last_error", msg.LastError,
+			"next_attempt", msg.NextAttempt,
+			"sent_at", msg.SentAt,
+			"updated_at", time.Now(),
+		).
+		Where("id = ? AND status = ?", msg.ID, OutboxPending).
+		Exec()
+	if err != nil {
+		return false, err
+	}
+
+	saved, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return saved == 1, nil
+}
+
+// Claim gives the caller the pending message until the time given, by
+// pushing its next attempt back to then. It reports false when the message
+// isn't pending and due, eg because another worker claimed it first.
+func (m *OutboxMessage) Claim(id int, until time.Time) (bool, error) {
+	res, err := upper.SQL().
+		Update(m.Table()).
+		Set("next_attempt", until, "updated_at", time.Now()).
+		Where("id = ? AND status = ? AND next_attempt <= ?", id, OutboxPending, time.Now()).
+		Exec()
+	if err != nil {
+		return false, err
+	}
+
+	claimed, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return claimed == 1, nil
+}
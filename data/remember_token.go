@@ -40,10 +40,25 @@ func (t *RememberToken) InsertToken(userID int, token string) error {
 func (t *RememberToken) Delete(rememberToken string) error {
 	collection := upper.Collection(t.Table())
 	res := collection.Find(up.Cond{"remember_token": rememberToken})
+
+	// the model cache needs to know whose token it was
+	var tokens []RememberToken
+	if cached != nil {
+		if err := res.All(&tokens); err != nil {
+			return err
+		}
+	}
+
 	err := res.Delete()
 	if err != nil {
 		return err
 	}
 
+	for _, token := range tokens {
+		if err := invalidate(userVersion(token.UserID)); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
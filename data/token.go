@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"encoding/base32"
 	"errors"
+	"fmt"
 	"math/rand"
 	"net/http"
 	"strings"
@@ -42,31 +43,34 @@ func (t *Token) Table() string {
 	return "tokens"
 }
 
+// ETag identifies this version of the token, it changes on every update
+func (t *Token) ETag() string {
+	return fmt.Sprintf(`"token-%d-%d"`, t.ID, t.UpdatedAt.UnixNano())
+}
+
 // GetUserForToken gets a user from the given token
 func (t *Token) GetUserForToken(token string) (*User, error) {
 	var u User
-	var theToken Token
 
-	collection := upper.Collection(t.Table())
-	// get token
-	res := collection.Find(up.Cond{"token": token})
-	err := res.One(&theToken)
+	theToken, err := t.GetByToken(token)
 	if err != nil {
 		return nil, err
 	}
 
-	collection = upper.Collection(u.Table())
-	// get user from users table
-	res = collection.Find(up.Cond{"id": t.UserID})
-	err = res.One(&u)
+	// get user from users table, or the model cache when it is on
+	get := u.row
+	if cached != nil {
+		get = u.Get
+	}
+	theUser, err := get(t.UserID)
 	if err != nil {
 		return nil, err
 	}
 
 	// add token to the user
-	u.Token = theToken
+	theUser.Token = *theToken
 
-	return &u, nil
+	return theUser, nil
 }
 
 // GetTokensForUser gets all tokens for a give user
@@ -83,6 +87,29 @@ func (t *Token) GetTokensForUser(id int) ([]*Token, error) {
 	return tokens, nil
 }
 
+// GetTokensForUsers gets the tokens of many users in one query, keyed by user id
+func (t *Token) GetTokensForUsers(ids []int) (map[int][]*Token, error) {
+	byUser := make(map[int][]*Token, len(ids))
+	if len(ids) == 0 {
+		return byUser, nil
+	}
+
+	var tokens []*Token
+	collection := upper.Collection(t.Table())
+	res := collection.Find(up.Cond{"user_id IN": ids}).OrderBy("id")
+
+	err := res.All(&tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, token := range tokens {
+		byUser[token.UserID] = append(byUser[token.UserID], token)
+	}
+
+	return byUser, nil
+}
+
 // Get gets the token associated with the given id
 func (t *Token) Get(id int) (*Token, error) {
 	var token Token
@@ -96,8 +123,30 @@ func (t *Token) Get(id int) (*Token, error) {
 	return &token, nil
 }
 
-// GetByToken gets a token associated with the plaintext token
+// GetByToken gets a token associated with the plaintext token, from the
+// model cache when it is on
 func (t *Token) GetByToken(plainText string) (*Token, error) {
+	c := cached
+	if c == nil {
+		return t.getByToken(plainText)
+	}
+
+	key := hashKey("token", plainText)
+	version := c.version(tokensVersion)
+	if entry, ok := c.get(key); ok && entry.Version == version && entry.Token != nil {
+		return entry.Token, nil
+	}
+
+	token, err := t.getByToken(plainText)
+	if err != nil {
+		return nil, err
+	}
+	c.set(key, cacheEntry{Version: version, UserID: token.UserID, Token: token}, c.config.TokenTTL)
+
+	return token, nil
+}
+
+func (t *Token) getByToken(plainText string) (*Token, error) {
 	var token Token
 	collection := upper.Collection(t.Table())
 	res := collection.Find(up.Cond{"token": plainText})
@@ -114,33 +163,35 @@ func (t *Token) Delete(id int) error {
 	collection := upper.Collection(t.Table())
 	res := collection.Find(id)
 	// check if token exists
-	b, err := res.Exists()
+	var token Token
+	err := res.One(&token)
 	if err != nil {
+		if IsNotFound(err) {
+			return errors.New("no result found in database")
+		}
 		return err
 	}
-	if !b {
-		return errors.New("no result found in database")
-	}
 
 	err = res.Delete()
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return invalidate(userVersion(token.UserID), tokensVersion)
 }
 
 // DeleteByToken deletes the token by the token value
 func (t *Token) DeleteByToken(plainText string) error {
 	collection := upper.Collection(t.Table())
 	res := collection.Find(up.Cond{"token": plainText})
-	b, err := res.Exists()
+	var token Token
+	err := res.One(&token)
 	if err != nil {
+		if IsNotFound(err) {
+			return errors.New("no result found in database")
+		}
 		return err
 	}
-	if !b {
-		return errors.New("no result found in database")
-	}
 
 	// result exists, delete it
 	err = res.Delete()
@@ -148,7 +199,7 @@ func (t *Token) DeleteByToken(plainText string) error {
 		return err
 	}
 
-	return nil
+	return invalidate(userVersion(token.UserID), tokensVersion)
 }
 
 // Insert inserts a new token associated with a given user
@@ -177,7 +228,8 @@ func (t *Token) Insert(token Token, u User) error {
 	id := getInsertID(resultID.ID())
 	t.ID = id
 
-	return nil
+	// the user's earlier tokens were deleted
+	return invalidate(userVersion(u.ID), tokensVersion)
 }
 
 // GenerateToken generates a token for a user with a time to live duration
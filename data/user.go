@@ -3,11 +3,14 @@ package data
 import (
 	"errors"
 	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
-	"github.com/cmd-ctrl-q/celeritas"
 	up "github.com/upper/db/v4"
 )
 
@@ -19,21 +22,32 @@ type User struct {
 	Email     string `db:"email"`
 	Active    int    `db:"user_active"`
 
-	// Password is the hash of the true password
-	Password  string    `db:"password"`
+	// Password is the hash of the true password, it is never written as json
+	Password  string    `db:"password" json:"-"`
 	CreatedAt time.Time `db:"created_at"`
 	UpdatedAt time.Time `db:"updated_at"`
-	Token     Token     `db:"-"`
+	Token     Token     `db:"-" json:"-"`
 }
 
 func (u *User) Table() string {
 	return "users"
 }
 
-func (u *User) Validate(validator *celeritas.Validation) {
-	validator.Check(u.LastName != "", "last_name", "Last name must be provided")
-	validator.Check(u.FirstName != "", "first_name", "First name must be provided")
-	validator.Check(u.Email != "", "email", "Email must be provided")
+// ETag identifies this version of the user in a format (eg json or xml), it
+// changes on every update. A strong etag is for one representation, so each
+// format has its own.
+func (u *User) ETag(format string) string {
+	return fmt.Sprintf(`"user-%d-%d-%s"`, u.ID, u.UpdatedAt.UnixNano(), format)
+}
+
+// Validate checks the user's details. The same rules are used by the html
+// forms and the api, so keep every user rule here.
+func (u *User) Validate(validator *Validator) {
+	validator.Required("last_name", u.LastName, "Last name must be provided")
+	validator.MinLength("last_name", u.LastName, 2, "Must be at least two characters")
+	validator.Required("first_name", u.FirstName, "First name must be provided")
+	validator.MinLength("first_name", u.FirstName, 2, "Must be at least two characters")
+	validator.Required("email", u.Email, "Email must be provided")
 	validator.IsEmail("email", u.Email)
 }
 
@@ -51,7 +65,54 @@ func (u *User) GetAll() ([]*User, error) {
 	return all, nil
 }
 
+// GetPage gets one page of users ordered by last name, along with the total number of users
+func (u *User) GetPage(page, perPage int) ([]*User, int, error) {
+	collection := upper.Collection(u.Table())
+
+	var users []*User
+
+	res := collection.Find().OrderBy("last_name", "id").Paginate(uint(perPage))
+	err := res.Page(uint(page)).All(&users)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total, err := res.TotalEntries()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return users, int(total), nil
+}
+
+// GetByEmail gets the user with the email and their latest unexpired token.
+// With the model cache on it remembers which user has the email.
 func (u *User) GetByEmail(email string) (*User, error) {
+	c := cached
+	key := cacheKey("email", email)
+	if c != nil {
+		if entry, ok := c.get(key); ok {
+			// the user may have changed their email since
+			theUser, err := u.Get(entry.UserID)
+			if err == nil && theUser.Email == email {
+				return theUser, nil
+			}
+		}
+	}
+
+	theUser, err := u.getByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+
+	if c != nil {
+		c.set(key, cacheEntry{UserID: theUser.ID}, c.config.UserTTL)
+	}
+
+	return theUser, nil
+}
+
+func (u *User) getByEmail(email string) (*User, error) {
 	var theUser User
 	collection := upper.Collection(u.Table())
 	res := collection.Find(up.Cond{"email =": email})
@@ -77,20 +138,42 @@ func (u *User) GetByEmail(email string) (*User, error) {
 	return &theUser, nil
 }
 
+// Get gets the user with the id and their latest unexpired token, from the
+// model cache when it is on
 func (u *User) Get(id int) (*User, error) {
-	var theUser User
-	collection := upper.Collection(u.Table())
-	res := collection.Find(up.Cond{"id": id})
+	c := cached
+	if c == nil {
+		return u.get(id)
+	}
 
-	err := res.One(&theUser)
+	key := cacheKey("user", strconv.Itoa(id))
+	version := c.version(userVersion(id))
+	if entry, ok := c.get(key); ok && entry.Version == version && entry.User != nil {
+		theUser := entry.User
+		if theUser.Token.ID == 0 || theUser.Token.Expires.After(time.Now()) {
+			return theUser, nil
+		}
+	}
+
+	theUser, err := u.get(id)
+	if err != nil {
+		return nil, err
+	}
+	c.set(key, cacheEntry{Version: version, UserID: id, User: theUser}, c.config.UserTTL)
+
+	return theUser, nil
+}
+
+func (u *User) get(id int) (*User, error) {
+	theUser, err := u.row(id)
 	if err != nil {
 		return nil, err
 	}
 
 	// get token
 	var token Token
-	collection = upper.Collection(token.Table())
-	res = collection.Find(up.Cond{"user_id =": theUser.ID, "expiry >": time.Now()}).OrderBy("created_at desc")
+	collection := upper.Collection(token.Table())
+	res := collection.Find(up.Cond{"user_id =": theUser.ID, "expiry >": time.Now()}).OrderBy("created_at desc")
 	err = res.One(&token)
 	if err != nil {
 		// if no user
@@ -101,6 +184,20 @@ func (u *User) Get(id int) (*User, error) {
 
 	theUser.Token = token
 
+	return theUser, nil
+}
+
+// row gets just the user, without their token
+func (u *User) row(id int) (*User, error) {
+	var theUser User
+	collection := upper.Collection(u.Table())
+	res := collection.Find(up.Cond{"id": id})
+
+	err := res.One(&theUser)
+	if err != nil {
+		return nil, err
+	}
+
 	return &theUser, nil
 }
 
@@ -113,7 +210,7 @@ func (u *User) Update(theUser User) error {
 		return err
 	}
 
-	return nil
+	return invalidate(userVersion(theUser.ID))
 }
 
 func (u *User) Delete(id int) error {
@@ -124,7 +221,8 @@ func (u *User) Delete(id int) error {
 		return err
 	}
 
-	return nil
+	// the user's tokens go with them
+	return invalidate(userVersion(id), tokensVersion)
 }
 
 func (u *User) Insert(theUser User) (int, error) {
@@ -149,23 +247,143 @@ func (u *User) Insert(theUser User) (int, error) {
 	return id, nil
 }
 
+// InsertMany inserts users in one transaction, so either all of them are
+// inserted or none are, and sets the ids on users. Passwords are hashed in
+// parallel first, as bcrypt is by far the slowest part of an import.
+func (u *User) InsertMany(users []User) error {
+	hashes := make([][]byte, len(users))
+	errs := make([]error, len(users))
+
+	var wg sync.WaitGroup
+	work := make(chan int)
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				hashes[i], errs[i] = bcrypt.GenerateFromPassword([]byte(users[i].Password), 12)
+			}
+		}()
+	}
+	for i := range users {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	return upper.Tx(func(tx up.Session) error {
+		collection := tx.Collection(u.Table())
+		for i, theUser := range users {
+			theUser.ID = 0
+			theUser.CreatedAt = now
+			theUser.UpdatedAt = now
+			theUser.Password = string(hashes[i])
+
+			res, err := collection.Insert(&theUser)
+			if err != nil {
+				return fmt.Errorf("error inserting user %s: %w", theUser.Email, err)
+			}
+
+			users[i].ID = getInsertID(res.ID())
+			users[i].CreatedAt = now
+			users[i].UpdatedAt = now
+		}
+
+		return nil
+	})
+}
+
+// ExistingEmails returns which of the emails already belong to a user,
+// ignoring case. The map is keyed by the lowercased email.
+func (u *User) ExistingEmails(emails []string) (map[string]bool, error) {
+	existing := make(map[string]bool)
+	if len(emails) == 0 {
+		return existing, nil
+	}
+
+	lowered := make([]string, 0, len(emails))
+	for _, email := range emails {
+		lowered = append(lowered, strings.ToLower(email))
+	}
+
+	var users []*User
+	err := upper.SQL().Select("email").From(u.Table()).Where("lower(email) IN ?", lowered).All(&users)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, theUser := range users {
+		existing[strings.ToLower(theUser.Email)] = true
+	}
+
+	return existing, nil
+}
+
+// IDForEmail gets the id of the user with the email, ignoring case, for
+// addresses that come from outside the app (eg a mail provider's bounces)
+func (u *User) IDForEmail(email string) (int, error) {
+	var theUser User
+	err := upper.SQL().Select("id").From(u.Table()).
+		Where("lower(email) = ?", strings.ToLower(strings.TrimSpace(email))).
+		OrderBy("id").Limit(1).
+		One(&theUser)
+	if err != nil {
+		return 0, err
+	}
+
+	return theUser.ID, nil
+}
+
+// GetAfter gets up to limit users with an id greater than id, in id order.
+// Unlike GetPage it doesn't skip or repeat users when rows are added while paging.
+func (u *User) GetAfter(id, limit int) ([]*User, error) {
+	collection := upper.Collection(u.Table())
+
+	var users []*User
+
+	res := collection.Find(up.Cond{"id >": id}).OrderBy("id").Limit(limit)
+	err := res.All(&users)
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
 func (u *User) ResetPassword(id int, password string) error {
-	newHash, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	theUser, err := u.Get(id)
 	if err != nil {
 		return err
 	}
 
-	theUser, err := u.Get(id)
+	// update the fetched user, not the receiver (which may be the empty Models.Users)
+	if err := theUser.SetPassword(password); err != nil {
+		return err
+	}
+	err = theUser.Update(*theUser)
 	if err != nil {
 		return err
 	}
 
-	u.Password = string(newHash)
-	err = theUser.Update(*u)
+	return nil
+}
+
+// SetPassword hashes password into u.Password, without saving it, so it can
+// go in the same Update as the user's other changes
+func (u *User) SetPassword(password string) error {
+	newHash, err := bcrypt.GenerateFromPassword([]byte(password), 12)
 	if err != nil {
 		return err
 	}
 
+	u.Password = string(newHash)
 	return nil
 }
 
@@ -185,7 +403,29 @@ func (u *User) PasswordMatches(plainText string) (bool, error) {
 	return true, nil
 }
 
+// CheckForRememberToken reports whether the user has the remember token. With
+// the model cache on only tokens that were found are remembered.
 func (u *User) CheckForRememberToken(id int, token string) bool {
+	c := cached
+	if c == nil {
+		return u.checkForRememberToken(id, token)
+	}
+
+	key := hashKey("remember", token)
+	version := c.version(userVersion(id))
+	if entry, ok := c.get(key); ok && entry.Version == version && entry.UserID == id {
+		return true
+	}
+
+	if !u.checkForRememberToken(id, token) {
+		return false
+	}
+	c.set(key, cacheEntry{Version: version, UserID: id}, c.config.UserTTL)
+
+	return true
+}
+
+func (u *User) checkForRememberToken(id int, token string) bool {
 	var rememberToken RememberToken
 	rt := RememberToken{}
 	collection := upper.Collection(rt.Table())
@@ -0,0 +1,77 @@
+package data
+
+import (
+	"github.com/cmd-ctrl-q/celeritas"
+)
+
+// machine readable validation codes, sent to api clients next to each message
+const (
+	CodeRequired  = "required"
+	CodeEmail     = "email"
+	CodeMinLength = "min_length"
+	CodeInvalid   = "invalid"
+	CodeUnique    = "unique"
+)
+
+// Validator wraps celeritas.Validation so every error also gets a code. Jet
+// templates keep using validator.Errors, the api uses Codes as well.
+type Validator struct {
+	*celeritas.Validation
+	Codes map[string]string
+}
+
+// NewValidator wraps v, eg data.NewValidator(app.Validator(nil))
+func NewValidator(v *celeritas.Validation) *Validator {
+	return &Validator{
+		Validation: v,
+		Codes:      make(map[string]string),
+	}
+}
+
+// Rule adds message and code to field when ok is false. Like celeritas, only
+// the first error for a field is kept.
+func (v *Validator) Rule(ok bool, field, code, message string) {
+	if ok || v.has(field) {
+		return
+	}
+
+	v.AddError(field, message)
+	v.Codes[field] = code
+}
+
+// Required checks value is not empty
+func (v *Validator) Required(field, value, message string) {
+	v.Rule(value != "", field, CodeRequired, message)
+}
+
+// MinLength checks value has at least n characters
+func (v *Validator) MinLength(field, value string, n int, message string) {
+	v.Rule(len([]rune(value)) >= n, field, CodeMinLength, message)
+}
+
+// IsEmail uses the celeritas email rule, recording its code
+func (v *Validator) IsEmail(field, value string) {
+	if v.has(field) {
+		return
+	}
+
+	v.Validation.IsEmail(field, value)
+	if v.has(field) {
+		v.Codes[field] = CodeEmail
+	}
+}
+
+// Code returns the code for field, errors added straight to the celeritas
+// validation are "invalid"
+func (v *Validator) Code(field string) string {
+	if code, ok := v.Codes[field]; ok {
+		return code
+	}
+
+	return CodeInvalid
+}
+
+func (v *Validator) has(field string) bool {
+	_, exists := v.Errors[field]
+	return exists
+}
@@ -0,0 +1,63 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/cmd-ctrl-q/celeritas"
+)
+
+func TestUser_Validate(t *testing.T) {
+	c := celeritas.Celeritas{}
+
+	u := User{FirstName: "J", LastName: "", Email: "not-an-email"}
+	v := NewValidator(c.Validator(nil))
+	u.Validate(v)
+
+	if v.Valid() {
+		t.Fatal("invalid user passed validation")
+	}
+
+	var tests = []struct {
+		field string
+		code  string
+	}{
+		{"first_name", CodeMinLength},
+		{"last_name", CodeRequired},
+		{"email", CodeEmail},
+	}
+
+	for _, e := range tests {
+		if _, ok := v.Errors[e.field]; !ok {
+			t.Errorf("%s: expected an error", e.field)
+		}
+		if v.Code(e.field) != e.code {
+			t.Errorf("%s: expected code %s but got %s", e.field, e.code, v.Code(e.field))
+		}
+	}
+
+	// a valid user
+	u = User{FirstName: "Jack", LastName: "Smith", Email: "jack@example.com"}
+	v = NewValidator(c.Validator(nil))
+	u.Validate(v)
+	if !v.Valid() {
+		t.Error("valid user failed validation:", v.Errors)
+	}
+}
+
+func TestValidator_Code(t *testing.T) {
+	c := celeritas.Celeritas{}
+	v := NewValidator(c.Validator(nil))
+
+	// errors added straight to the celeritas validation have no code
+	v.Check(false, "age", "Must be a number")
+	if v.Code("age") != CodeInvalid {
+		t.Error("expected invalid, got", v.Code("age"))
+	}
+
+	// only the first error for a field is kept, along with its code
+	v.Required("name", "", "Name must be provided")
+	v.MinLength("name", "", 2, "Too short")
+	if v.Errors["name"] != "Name must be provided" || v.Code("name") != CodeRequired {
+		t.Error("first error for the field was not kept:", v.Errors["name"], v.Code("name"))
+	}
+}
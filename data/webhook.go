@@ -0,0 +1,224 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	up "github.com/upper/db/v4"
+)
+
+// Delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook is a subscription to user events. Events is a comma separated list
+// of event names, or * for every event.
+type Webhook struct {
+	ID        int       `db:"id,omitempty" json:"id"`
+	URL       string    `db:"url" json:"url"`
+	Events    string    `db:"events" json:"events"`
+	Secret    string    `db:"secret" json:"-"`
+	Active    int       `db:"active" json:"active"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+}
+
+func (w *Webhook) Table() string {
+	return "webhooks"
+}
+
+// Subscribes reports whether the webhook wants the event
+func (w *Webhook) Subscribes(event string) bool {
+	for _, e := range strings.Split(w.Events, ",") {
+		e = strings.TrimSpace(e)
+		if e == "*" || e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (w *Webhook) GetAll() ([]*Webhook, error) {
+	collection := upper.Collection(w.Table())
+
+	var all []*Webhook
+
+	res := collection.Find().OrderBy("id")
+	err := res.All(&all)
+	if err != nil {
+		return nil, err
+	}
+
+	return all, nil
+}
+
+// GetForEvent gets the active webhooks subscribed to the event
+func (w *Webhook) GetForEvent(event string) ([]*Webhook, error) {
+	collection := upper.Collection(w.Table())
+
+	var active []*Webhook
+
+	res := collection.Find(up.Cond{"active": 1}).OrderBy("id")
+	err := res.All(&active)
+	if err != nil {
+		return nil, err
+	}
+
+	var hooks []*Webhook
+	for _, hook := range active {
+		if hook.Subscribes(event) {
+			hooks = append(hooks, hook)
+		}
+	}
+
+	return hooks, nil
+}
+
+func (w *Webhook) Get(id int) (*Webhook, error) {
+	var hook Webhook
+	collection := upper.Collection(w.Table())
+	res := collection.Find(up.Cond{"id": id})
+
+	err := res.One(&hook)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hook, nil
+}
+
+func (w *Webhook) Insert(hook Webhook) (int, error) {
+	hook.CreatedAt = time.Now()
+	hook.UpdatedAt = time.Now()
+
+	collection := upper.Collection(w.Table())
+	res, err := collection.Insert(&hook)
+	if err != nil {
+		return 0, fmt.Errorf("error inserting a webhook: %w", err)
+	}
+
+	return getInsertID(res.ID()), nil
+}
+
+func (w *Webhook) Update(hook Webhook) error {
+	hook.UpdatedAt = time.Now()
+	collection := upper.Collection(w.Table())
+	res := collection.Find(hook.ID)
+	err := res.Update(&hook)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Delete deletes the webhook, its deliveries are deleted with it
+func (w *Webhook) Delete(id int) error {
+	collection := upper.Collection(w.Table())
+	res := collection.Find(id)
+	err := res.Delete()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// WebhookDelivery is one event sent (or to be sent) to one webhook, it doubles as the delivery log
+type WebhookDelivery struct {
+	ID        int    `db:"id,omitempty" json:"id"`
+	WebhookID int    `db:"webhook_id" json:"webhook_id"`
+	Event     string `db:"event" json:"event"`
+	Payload   string `db:"payload" json:"payload"`
+	Status    string `db:"status" json:"status"`
+	Attempts  int    `db:"attempts" json:"attempts"`
+	// ResponseStatus is the receiver's status code on the last attempt, 0 if it could not be reached
+	ResponseStatus int       `db:"response_status" json:"response_status"`
+	LastError      string    `db:"last_error" json:"last_error"`
+	NextAttempt    time.Time `db:"next_attempt" json:"next_attempt"`
+	CreatedAt      time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt      time.Time `db:"updated_at" json:"updated_at"`
+}
+
+func (d *WebhookDelivery) Table() string {
+	return "webhook_deliveries"
+}
+
+func (d *WebhookDelivery) Get(id int) (*WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	collection := upper.Collection(d.Table())
+	res := collection.Find(up.Cond{"id": id})
+
+	err := res.One(&delivery)
+	if err != nil {
+		return nil, err
+	}
+
+	return &delivery, nil
+}
+
+// GetForWebhook gets the newest deliveries of a webhook first
+func (d *WebhookDelivery) GetForWebhook(webhookID, limit int) ([]*WebhookDelivery, error) {
+	collection := upper.Collection(d.Table())
+
+	var deliveries []*WebhookDelivery
+
+	res := collection.Find(up.Cond{"webhook_id": webhookID}).OrderBy("-id").Limit(limit)
+	err := res.All(&deliveries)
+	if err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// GetDue gets the pending deliveries whose next attempt is at or before t
+func (d *WebhookDelivery) GetDue(t time.Time) ([]*WebhookDelivery, error) {
+	collection := upper.Collection(d.Table())
+
+	var deliveries []*WebhookDelivery
+
+	res := collection.Find(up.Cond{"status": DeliveryPending, "next_attempt <=": t}).OrderBy("next_attempt")
+	err := res.All(&deliveries)
+	if err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+func (d *WebhookDelivery) Insert(delivery WebhookDelivery) (int, error) {
+	delivery.CreatedAt = time.Now()
+	delivery.UpdatedAt = time.Now()
+	if delivery.Status == "" {
+		delivery.Status = DeliveryPending
+	}
+	if delivery.NextAttempt.IsZero() {
+		delivery.NextAttempt = delivery.CreatedAt
+	}
+
+	collection := upper.Collection(d.Table())
+	res, err := collection.Insert(&delivery)
+	if err != nil {
+		return 0, fmt.Errorf("error inserting a webhook delivery: %w", err)
+	}
+
+	return getInsertID(res.ID()), nil
+}
+
+func (d *WebhookDelivery) Update(delivery WebhookDelivery) error {
+	delivery.UpdatedAt = time.Now()
+	collection := upper.Collection(d.Table())
+	res := collection.Find(delivery.ID)
+	err := res.Update(&delivery)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
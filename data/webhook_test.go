@@ -0,0 +1,24 @@
+package data
+
+import "testing"
+
+var subscribesTests = []struct {
+	events string
+	event  string
+	want   bool
+}{
+	{"*", "user.created", true},
+	{"user.created", "user.created", true},
+	{"user.created, user.deleted", "user.deleted", true},
+	{"user.created,user.deleted", "user.updated", false},
+	{"", "user.created", false},
+}
+
+func TestWebhook_Subscribes(t *testing.T) {
+	for _, e := range subscribesTests {
+		hook := Webhook{Events: e.events}
+		if got := hook.Subscribes(e.event); got != e.want {
+			t.Errorf("%q subscribes to %s: expected %v but got %v", e.events, e.event, e.want, got)
+		}
+	}
+}
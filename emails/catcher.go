@@ -0,0 +1,283 @@
+package emails
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	htmltemplate "html/template"
+	"myapp/data"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/cmd-ctrl-q/celeritas/mailer"
+)
+
+// ErrNoTemplate is returned when previewing a template that isn't in mail/
+var ErrNoTemplate = errors.New("emails: no such mail template")
+
+var (
+	hrefPattern = regexp.MustCompile(`href="([^"]+)"`)
+	urlPattern  = regexp.MustCompile(`https?://[^\s<>"]+`)
+)
+
+// CatcherConfig holds the development mail catcher settings
+type CatcherConfig struct {
+	// Enabled catches mail rather than sending it. It is on in debug mode
+	// unless MAIL_CATCHER is false, and can be turned on outside it, where only
+	// admins can read the caught mail.
+	Enabled bool
+	// Max is how many messages are kept, the oldest go first
+	Max int
+}
+
+// NewCatcherConfig reads the catcher settings from the environment (.env)
+func NewCatcherConfig(debug bool) CatcherConfig {
+	enabled, err := strconv.ParseBool(os.Getenv("MAIL_CATCHER"))
+	if err != nil {
+		enabled = debug
+	}
+
+	max, err := strconv.Atoi(os.Getenv("MAIL_CATCHER_MAX"))
+	if err != nil || max < 1 {
+		max = 100
+	}
+
+	return CatcherConfig{Enabled: enabled, Max: max}
+}
+
+// Caught is a message the catcher kept instead of sending
+type Caught struct {
+	ID          int
+	From        string
+	FromName    string
+	To          string
+	Subject     string
+	Template    string
+	Attachments []string
+	HTML        string
+	Plain       string
+	// Extra are the headers added by the Sender, eg List-Unsubscribe
+	Extra    map[string]string
+	CaughtAt time.Time
+}
+
+// Header is one line of a caught message's headers
+type Header struct {
+	Name  string
+	Value string
+}
+
+// Headers are the message's headers, as the mailer would write them
+func (c *Caught) Headers() []Header {
+	from := c.From
+	if c.FromName != "" {
+		from = c.FromName + " <" + c.From + ">"
+	}
+
+	headers := []Header{
+		{Name: "From", Value: from},
+		{Name: "To", Value: c.To},
+		{Name: "Subject", Value: c.Subject},
+		{Name: "Date", Value: c.CaughtAt.Format(time.RFC1123Z)},
+		{Name: "X-Template", Value: c.Template},
+	}
+	for _, file := range c.Attachments {
+		headers = append(headers, Header{Name: "X-Attachment", Value: file})
+	}
+
+	names := make([]string, 0, len(c.Extra))
+	for name := range c.Extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		headers = append(headers, Header{Name: name, Value: c.Extra[name]})
+	}
+
+	return headers
+}
+
+// Links are the urls in the message, in the order they first appear
+func (c *Caught) Links() []string {
+	var links []string
+	seen := make(map[string]bool)
+	add := func(link string) {
+		if !seen[link] {
+			seen[link] = true
+			links = append(links, link)
+		}
+	}
+
+	for _, m := range hrefPattern.FindAllStringSubmatch(c.HTML, -1) {
+		add(html.UnescapeString(m[1]))
+	}
+	for _, link := range urlPattern.FindAllString(c.Plain, -1) {
+		add(link)
+	}
+
+	return links
+}
+
+// Catcher is a mailer for development. It renders messages as celeritas
+// would and keeps them in memory, to be read at /dev/mail, rather than
+// sending them.
+type Catcher struct {
+	CatcherConfig
+	// Templates is the mail template directory, celeritas' Mail.Templates
+	Templates string
+
+	mu       sync.Mutex
+	messages []*Caught
+	next     int
+}
+
+// NewCatcher creates a catcher for the templates in the directory
+func NewCatcher(templates string, config CatcherConfig) *Catcher {
+	return &Catcher{CatcherConfig: config, Templates: templates}
+}
+
+// Send renders the message and keeps it. A template that doesn't render is
+// an error, as it would be when sending for real.
+func (c *Catcher) Send(msg mailer.Message) error {
+	return c.SendWithHeaders(msg, nil)
+}
+
+// SendWithHeaders is Send, keeping the extra headers to show with the message
+func (c *Catcher) SendWithHeaders(msg mailer.Message, headers map[string]string) error {
+	body, plain, err := renderBody(c.Templates, msg.Template, msg.Data)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.next++
+	c.messages = append(c.messages, &Caught{
+		ID:          c.next,
+		From:        msg.From,
+		FromName:    msg.FromName,
+		To:          msg.To,
+		Subject:     msg.Subject,
+		Template:    msg.Template,
+		Attachments: msg.Attachments,
+		HTML:        body,
+		Plain:       plain,
+		Extra:       headers,
+		CaughtAt:    time.Now(),
+	})
+	if len(c.messages) > c.Max {
+		c.messages = c.messages[len(c.messages)-c.Max:]
+	}
+
+	return nil
+}
+
+// All returns the caught messages, newest first
+func (c *Catcher) All() []*Caught {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	all := make([]*Caught, 0, len(c.messages))
+	for i := len(c.messages) - 1; i >= 0; i-- {
+		all = append(all, c.messages[i])
+	}
+
+	return all
+}
+
+// Get returns the caught message with the id
+func (c *Catcher) Get(id int) (*Caught, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, msg := range c.messages {
+		if msg.ID == id {
+			return msg, true
+		}
+	}
+
+	return nil, false
+}
+
+// Clear forgets every caught message
+func (c *Catcher) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.messages = nil
+}
+
+// Names lists the templates in the directory that can be previewed, the
+// layouts and the rendered template are left out
+func Names(templates string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(templates, "*.html.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".html.tmpl")
+		if name != rendered {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Preview renders the template with its fixture, with the layout when it
+// uses one, without sending anything
+func (r *Renderer) Preview(name string) (string, string, error) {
+	names, err := Names(r.Templates)
+	if err != nil {
+		return "", "", err
+	}
+	i := sort.SearchStrings(names, name)
+	if i == len(names) || names[i] != name {
+		return "", "", ErrNoTemplate
+	}
+
+	if uses(name) {
+		d := r.data(Fixtures[name])
+		if category := Category(name); category != data.EmailTransactional {
+			d.UnsubscribeURL = r.UnsubscribeURL(UnsubscribePath, "ada@here.com", category)
+		}
+		return r.render(name, d)
+	}
+
+	return renderBody(r.Templates, name, Fixtures[name])
+}
+
+// renderBody renders a template on its own, the way celeritas does: the
+// "body" template of mail/<name>.html.tmpl and mail/<name>.plain.tmpl
+func renderBody(templates, name string, data interface{}) (string, string, error) {
+	page, err := htmltemplate.ParseFiles(filepath.Join(templates, name+".html.tmpl"))
+	if err != nil {
+		return "", "", err
+	}
+	var htmlBuf bytes.Buffer
+	if err := page.ExecuteTemplate(&htmlBuf, "body", data); err != nil {
+		return "", "", err
+	}
+
+	text, err := texttemplate.ParseFiles(filepath.Join(templates, name+".plain.tmpl"))
+	if err != nil {
+		return "", "", err
+	}
+	var plainBuf bytes.Buffer
+	if err := text.ExecuteTemplate(&plainBuf, "body", data); err != nil {
+		return "", "", err
+	}
+
+	return htmlBuf.String(), plainBuf.String(), nil
+}
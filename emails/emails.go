@@ -0,0 +1,325 @@
+// Package emails renders the transactional emails in mail/ with the shared
+// layout in mail/layouts. Celeritas renders a template on its own, so these
+// are rendered here and handed to it already rendered, through the
+// "rendered" template.
+package emails
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"myapp/data"
+	"myapp/outbox"
+	"net/url"
+	"os"
+	"path/filepath"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/cmd-ctrl-q/celeritas/mailer"
+	"github.com/cmd-ctrl-q/celeritas/urlsigner"
+)
+
+// the transactional emails, each has an html and a plain text template
+const (
+	Welcome         = "welcome"
+	VerifyEmail     = "verify-email"
+	PasswordReset   = "password-reset"
+	PasswordChanged = "password-changed"
+	NewDeviceLogin  = "new-device-login"
+	AccountLocked   = "account-locked"
+	ProductUpdate   = "product-update"
+)
+
+// Templates lists every email rendered with the layout
+var Templates = []string{Welcome, VerifyEmail, PasswordReset, PasswordChanged, NewDeviceLogin, AccountLocked, ProductUpdate}
+
+// categories maps the emails users can opt out of to their category, every
+// other email is transactional
+var categories = map[string]string{
+	ProductUpdate: data.EmailProduct,
+}
+
+// the unsubscribe links. The page asks before unsubscribing, so a mail
+// scanner following links doesn't unsubscribe anyone; the one-click url, for
+// the List-Unsubscribe header, unsubscribes on a POST (RFC 8058).
+const (
+	UnsubscribePath         = "/users/unsubscribe"
+	OneClickUnsubscribePath = "/api/v1/unsubscribe"
+)
+
+// Category is the email category of the template
+func Category(template string) string {
+	if category, ok := categories[template]; ok {
+		return category
+	}
+
+	return data.EmailTransactional
+}
+
+// rendered is the celeritas template that writes out an email rendered here
+const rendered = "rendered"
+
+// The data each email needs, given as the message's Data. A map with the
+// same keys works too, as it is after a trip through the outbox.
+type (
+	WelcomeData struct {
+		FirstName string
+		Link      string
+	}
+
+	VerifyEmailData struct {
+		FirstName string
+		Link      string
+		// Expires is how long the link works for, eg "24 hours"
+		Expires string
+	}
+
+	PasswordResetData struct {
+		Link string
+	}
+
+	PasswordChangedData struct {
+		FirstName string
+		Time      string
+	}
+
+	NewDeviceLoginData struct {
+		FirstName string
+		Time      string
+		Device    string
+		IP        string
+	}
+
+	AccountLockedData struct {
+		FirstName string
+		// Until is when the user can log in again
+		Until string
+		// Link is a password reset link
+		Link string
+	}
+
+	ProductUpdateData struct {
+		FirstName string
+		Title     string
+		Body      string
+		Link      string
+	}
+)
+
+// Config holds what every email shows
+type Config struct {
+	// Templates is the mail template directory, celeritas' Mail.Templates
+	Templates  string
+	AppName    string
+	AppURL     string
+	SupportURL string
+	// SigningKey signs the unsubscribe links, the app's encryption key
+	SigningKey string
+}
+
+// NewConfig reads the support url from the environment (.env), it is the
+// app's url when MAIL_SUPPORT_URL isn't set
+func NewConfig(templates, appName, appURL, signingKey string) Config {
+	support := os.Getenv("MAIL_SUPPORT_URL")
+	if support == "" {
+		support = appURL
+	}
+
+	return Config{
+		Templates:  templates,
+		AppName:    appName,
+		AppURL:     appURL,
+		SupportURL: support,
+		SigningKey: signingKey,
+	}
+}
+
+// UnsubscribeURL is a signed link that unsubscribes the address from the
+// category without logging in. It doesn't expire.
+func (c Config) UnsubscribeURL(path, email, category string) string {
+	query := url.Values{"email": {email}, "category": {category}}
+	signer := urlsigner.Signer{Secret: []byte(c.SigningKey)}
+
+	return signer.GenerateTokenFromString(c.AppURL + path + "?" + query.Encode())
+}
+
+// UnsubscribeHeaders are the RFC 8058 one-click unsubscribe headers
+func (c Config) UnsubscribeHeaders(email, category string) map[string]string {
+	return map[string]string{
+		"List-Unsubscribe":      "<" + c.UnsubscribeURL(OneClickUnsubscribePath, email, category) + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}
+}
+
+// Data is what the templates are rendered with, the message's own data is Message
+type Data struct {
+	AppName    string
+	AppURL     string
+	SupportURL string
+	Year       int
+	// UnsubscribeURL is set for the emails that can be opted out of
+	UnsubscribeURL string
+	Message        interface{}
+}
+
+// Renderer renders the emails
+type Renderer struct {
+	Config
+}
+
+// Render renders the html and plain text versions of the email. Data missing
+// from a map is an error rather than "<no value>".
+func (r *Renderer) Render(name string, message interface{}) (string, string, error) {
+	return r.render(name, r.data(message))
+}
+
+func (r *Renderer) data(message interface{}) Data {
+	return Data{
+		AppName:    r.AppName,
+		AppURL:     r.AppURL,
+		SupportURL: r.SupportURL,
+		Year:       time.Now().Year(),
+		Message:    message,
+	}
+}
+
+func (r *Renderer) render(name string, data Data) (string, string, error) {
+	html, err := htmltemplate.New(name).Option("missingkey=error").ParseFiles(r.files(name, "html")...)
+	if err != nil {
+		return "", "", err
+	}
+	var htmlBuf bytes.Buffer
+	if err := html.ExecuteTemplate(&htmlBuf, "layout", data); err != nil {
+		return "", "", err
+	}
+
+	plain, err := texttemplate.New(name).Option("missingkey=error").ParseFiles(r.files(name, "plain")...)
+	if err != nil {
+		return "", "", err
+	}
+	var plainBuf bytes.Buffer
+	if err := plain.ExecuteTemplate(&plainBuf, "layout", data); err != nil {
+		return "", "", err
+	}
+
+	return htmlBuf.String(), plainBuf.String(), nil
+}
+
+// files is the layout and the email's template
+func (r *Renderer) files(name, kind string) []string {
+	return []string{
+		filepath.Join(r.Templates, "layouts", "base."+kind+".tmpl"),
+		filepath.Join(r.Templates, name+"."+kind+".tmpl"),
+	}
+}
+
+// Mailer sends a message, *mailer.Mail satisfies it
+type Mailer interface {
+	Send(msg mailer.Message) error
+}
+
+// HeaderMailer is a Mailer that can add headers to a message. Celeritas'
+// mailer.Message has no headers, so the List-Unsubscribe headers are only
+// sent by mailers that implement this (the Transport and the Catcher); the
+// unsubscribe link in the footer works with any.
+type HeaderMailer interface {
+	SendWithHeaders(msg mailer.Message, headers map[string]string) error
+}
+
+// Preferences reports whether a user wants mail in a category, data.EmailPreference satisfies it
+type Preferences interface {
+	Allows(email, category string) (bool, error)
+}
+
+// Suppressions reports whether an address bounced or complained too often to
+// get any mail, data.MailSuppression satisfies it
+type Suppressions interface {
+	Suppressed(email string) (bool, error)
+}
+
+// Sender renders the emails in Templates before handing them to the mailer,
+// any other template (eg panic-alert) is left to the mailer. It can be given
+// to the outbox in place of the mailer. With Preferences set, mail in a
+// category the recipient opted out of isn't sent, and with Suppressions set
+// no mail at all is sent to an undeliverable address.
+type Sender struct {
+	Renderer
+	Mail         Mailer
+	Preferences  Preferences
+	Suppressions Suppressions
+}
+
+// NewSender wraps the mailer
+func NewSender(mail Mailer, preferences Preferences, suppressions Suppressions, config Config) *Sender {
+	return &Sender{Renderer: Renderer{Config: config}, Mail: mail, Preferences: preferences, Suppressions: suppressions}
+}
+
+// Send renders the message if it uses the layout and sends it. It returns
+// outbox.ErrSuppressed when the address is undeliverable or the recipient
+// opted out of its category.
+func (s *Sender) Send(msg mailer.Message) error {
+	if s.Suppressions != nil {
+		suppressed, err := s.Suppressions.Suppressed(msg.To)
+		if err != nil {
+			return err
+		}
+		if suppressed {
+			return fmt.Errorf("%w, %s is undeliverable", outbox.ErrSuppressed, msg.To)
+		}
+	}
+
+	category := Category(msg.Template)
+	if s.Preferences != nil && category != data.EmailTransactional {
+		allowed, err := s.Preferences.Allows(msg.To, category)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return fmt.Errorf("%w, the recipient opted out of %s mail", outbox.ErrSuppressed, category)
+		}
+	}
+
+	if !uses(msg.Template) {
+		return s.Mail.Send(msg)
+	}
+
+	d := s.data(msg.Data)
+	var headers map[string]string
+	if category != data.EmailTransactional {
+		d.UnsubscribeURL = s.UnsubscribeURL(UnsubscribePath, msg.To, category)
+		headers = s.UnsubscribeHeaders(msg.To, category)
+	}
+
+	html, plain, err := s.render(msg.Template, d)
+	if err != nil {
+		return err
+	}
+
+	// both are typed as html, so the mailer doesn't escape them again
+	msg.Template = rendered
+	msg.Data = struct {
+		HTML  htmltemplate.HTML
+		Plain htmltemplate.HTML
+	}{
+		HTML:  htmltemplate.HTML(html),
+		Plain: htmltemplate.HTML(plain),
+	}
+
+	if mail, ok := s.Mail.(HeaderMailer); ok && headers != nil {
+		return mail.SendWithHeaders(msg, headers)
+	}
+
+	return s.Mail.Send(msg)
+}
+
+// uses reports whether the template is rendered with the layout
+func uses(template string) bool {
+	for _, t := range Templates {
+		if t == template {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,286 @@
+package emails
+
+import (
+	"encoding/json"
+	"errors"
+	htmltemplate "html/template"
+	"myapp/data"
+	"myapp/outbox"
+	"strings"
+	"testing"
+
+	"github.com/cmd-ctrl-q/celeritas/mailer"
+	"github.com/cmd-ctrl-q/celeritas/urlsigner"
+)
+
+func testRenderer() *Renderer {
+	return &Renderer{Config: Config{
+		Templates:  "../mail",
+		AppName:    "myapp",
+		AppURL:     "http://localhost:4000",
+		SupportURL: "http://localhost:4000/support",
+		SigningKey: "abcdefghijklmnopqrstuvwxyz012345",
+	}}
+}
+
+func TestRenderer_Render(t *testing.T) {
+	r := testRenderer()
+
+	for _, name := range Templates {
+		sample, ok := Fixtures[name]
+		if !ok {
+			t.Errorf("%s: no fixture", name)
+			continue
+		}
+
+		// the outbox hands the data back as a map, it has to render the same
+		b, err := json.Marshal(sample)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var asMap map[string]interface{}
+		if err := json.Unmarshal(b, &asMap); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, data := range []interface{}{sample, asMap} {
+			html, plain, err := r.Render(name, data)
+			if err != nil {
+				t.Errorf("%s: %s", name, err)
+				continue
+			}
+
+			for kind, out := range map[string]string{"html": html, "plain": plain} {
+				if !strings.Contains(out, "myapp") || !strings.Contains(out, "http://localhost:4000/support") {
+					t.Errorf("%s %s: the layout was not rendered:\n%s", name, kind, out)
+				}
+				if strings.Contains(out, "<no value>") {
+					t.Errorf("%s %s: missing data:\n%s", name, kind, out)
+				}
+			}
+		}
+	}
+}
+
+func TestRenderer_RenderMissingData(t *testing.T) {
+	r := testRenderer()
+
+	if _, _, err := r.Render(PasswordReset, map[string]interface{}{}); err == nil {
+		t.Error("expected an error for data without a link")
+	}
+	if _, _, err := r.Render("no-such-email", Fixtures[PasswordReset]); err == nil {
+		t.Error("expected an error for a missing template")
+	}
+}
+
+// mail records what it was asked to send
+type mail struct {
+	sent []mailer.Message
+}
+
+func (m *mail) Send(msg mailer.Message) error {
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func TestSender_Send(t *testing.T) {
+	m := &mail{}
+	s := &Sender{Renderer: *testRenderer(), Mail: m}
+
+	err := s.Send(mailer.Message{To: "ada@here.com", Template: PasswordReset, Data: Fixtures[PasswordReset]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Send(mailer.Message{To: "ada@here.com", Template: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.sent[0].Template != rendered || m.sent[1].Template != "test" {
+		t.Fatalf("wrong templates sent: %s and %s", m.sent[0].Template, m.sent[1].Template)
+	}
+
+	// celeritas writes it out with the rendered template, without escaping it again
+	tmpl, err := htmltemplate.ParseFiles("../mail/rendered.html.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := tmpl.ExecuteTemplate(&out, "body", m.sent[0].Data); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `href="http://localhost:4000/users/reset-password?email=ada@here.com&amp;hash=abc"`) {
+		t.Error("the rendered html was changed on the way out:\n", out.String())
+	}
+}
+
+func TestCatcher_Send(t *testing.T) {
+	c := NewCatcher("../mail", CatcherConfig{Enabled: true, Max: 2})
+	s := &Sender{Renderer: *testRenderer(), Mail: c}
+
+	for _, to := range []string{"first@here.com", "second@here.com", "third@here.com"} {
+		err := s.Send(mailer.Message{To: to, From: "admin@example.com", Subject: "Password reset", Template: PasswordReset, Data: Fixtures[PasswordReset]})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the newest are kept, newest first
+	all := c.All()
+	if len(all) != 2 || all[0].To != "third@here.com" || all[1].To != "second@here.com" {
+		t.Fatalf("expected the two newest messages, got %d", len(all))
+	}
+	if _, ok := c.Get(all[0].ID); !ok {
+		t.Error("the newest message was not found by id")
+	}
+
+	msg := all[0]
+	if !strings.Contains(msg.HTML, "Reset my password") || !strings.Contains(msg.Plain, "Reset it here") {
+		t.Errorf("the message was not rendered:\n%s\n%s", msg.HTML, msg.Plain)
+	}
+
+	// the html and plain text links are the same, so each is listed once
+	want := []string{"http://localhost:4000", "http://localhost:4000/users/reset-password?email=ada@here.com&hash=abc", "http://localhost:4000/support"}
+	if links := msg.Links(); strings.Join(links, " ") != strings.Join(want, " ") {
+		t.Errorf("expected the links %v, got %v", want, links)
+	}
+
+	c.Clear()
+	if len(c.All()) != 0 {
+		t.Error("clear left messages behind")
+	}
+
+	// a template that doesn't exist fails, as it would when sending for real
+	if err := c.Send(mailer.Message{To: "me@here.com", Template: "no-such-email"}); err == nil {
+		t.Error("expected an error for a missing template")
+	}
+}
+
+func TestRenderer_Preview(t *testing.T) {
+	r := testRenderer()
+
+	names, err := Names(r.Templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range append(Templates, "test", "panic-alert") {
+		found := false
+		for _, n := range names {
+			found = found || n == name
+		}
+		if !found {
+			t.Errorf("%s is not listed for preview", name)
+		}
+	}
+
+	// every template in mail/ has a fixture that renders
+	for _, name := range names {
+		if _, _, err := r.Preview(name); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+
+	if _, _, err := r.Preview("rendered"); err != ErrNoTemplate {
+		t.Error("expected ErrNoTemplate for the rendered template, got", err)
+	}
+}
+
+// preferences opts everyone out of the categories in it
+type preferences map[string]bool
+
+func (p preferences) Allows(email, category string) (bool, error) {
+	return !p[category], nil
+}
+
+func TestSender_SendSuppressed(t *testing.T) {
+	m := &mail{}
+	s := &Sender{Renderer: *testRenderer(), Mail: m, Preferences: preferences{data.EmailProduct: true}}
+
+	err := s.Send(mailer.Message{To: "ada@here.com", Template: ProductUpdate, Data: Fixtures[ProductUpdate]})
+	if !errors.Is(err, outbox.ErrSuppressed) {
+		t.Fatal("expected ErrSuppressed, got", err)
+	}
+
+	// transactional mail can't be opted out of
+	err = s.Send(mailer.Message{To: "ada@here.com", Template: PasswordReset, Data: Fixtures[PasswordReset]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.sent) != 1 {
+		t.Fatalf("expected only the password reset to be sent, %d were", len(m.sent))
+	}
+}
+
+// suppressions is a set of undeliverable addresses
+type suppressions map[string]bool
+
+func (s suppressions) Suppressed(email string) (bool, error) {
+	return s[email], nil
+}
+
+func TestSender_SendUndeliverable(t *testing.T) {
+	m := &mail{}
+	s := &Sender{Renderer: *testRenderer(), Mail: m, Suppressions: suppressions{"bounced@here.com": true}}
+
+	// not even transactional mail goes to an address that bounced
+	err := s.Send(mailer.Message{To: "bounced@here.com", Template: PasswordReset, Data: Fixtures[PasswordReset]})
+	if !errors.Is(err, outbox.ErrSuppressed) {
+		t.Fatal("expected ErrSuppressed, got", err)
+	}
+
+	err = s.Send(mailer.Message{To: "ada@here.com", Template: PasswordReset, Data: Fixtures[PasswordReset]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.sent) != 1 || m.sent[0].To != "ada@here.com" {
+		t.Errorf("expected only the mail to ada@here.com to be sent, got %d", len(m.sent))
+	}
+}
+
+func TestSender_SendUnsubscribe(t *testing.T) {
+	c := NewCatcher("../mail", CatcherConfig{Enabled: true, Max: 10})
+	s := &Sender{Renderer: *testRenderer(), Mail: c, Preferences: preferences{}}
+
+	err := s.Send(mailer.Message{To: "ada@here.com", Template: ProductUpdate, Data: Fixtures[ProductUpdate]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Send(mailer.Message{To: "ada@here.com", Template: PasswordReset, Data: Fixtures[PasswordReset]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := c.All()
+	reset, update := all[0], all[1]
+
+	headers := make(map[string]string)
+	for _, h := range update.Headers() {
+		headers[h.Name] = h.Value
+	}
+	if headers["List-Unsubscribe-Post"] != "List-Unsubscribe=One-Click" {
+		t.Error("expected the one-click List-Unsubscribe-Post header, got", headers)
+	}
+
+	link := strings.Trim(headers["List-Unsubscribe"], "<>")
+	if !strings.HasPrefix(link, "http://localhost:4000"+OneClickUnsubscribePath+"?") {
+		t.Fatal("wrong List-Unsubscribe link:", link)
+	}
+	signer := urlsigner.Signer{Secret: []byte(s.SigningKey)}
+	if !signer.VerifyToken(link) {
+		t.Error("the List-Unsubscribe link is not signed")
+	}
+
+	footer := s.UnsubscribeURL(UnsubscribePath, "ada@here.com", data.EmailProduct)
+	if !strings.Contains(update.Plain, footer) {
+		t.Error("the unsubscribe link is missing from the footer:\n", update.Plain)
+	}
+
+	for _, h := range reset.Headers() {
+		if h.Name == "List-Unsubscribe" {
+			t.Error("transactional mail has a List-Unsubscribe header")
+		}
+	}
+	if strings.Contains(reset.Plain, "Unsubscribe") {
+		t.Error("transactional mail has an unsubscribe link")
+	}
+}
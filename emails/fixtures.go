@@ -0,0 +1,23 @@
+package emails
+
+// Fixtures is sample data for every mail template, for previews and tests
+var Fixtures = map[string]interface{}{
+	Welcome:         WelcomeData{FirstName: "Ada", Link: "http://localhost:4000/users/login"},
+	VerifyEmail:     VerifyEmailData{FirstName: "Ada", Link: "http://localhost:4000/users/verify?token=abc", Expires: "24 hours"},
+	PasswordReset:   PasswordResetData{Link: "http://localhost:4000/users/reset-password?email=ada@here.com&hash=abc"},
+	PasswordChanged: PasswordChangedData{FirstName: "Ada", Time: "Mon, 19 Oct 2026 12:00:00 UTC"},
+	NewDeviceLogin:  NewDeviceLoginData{FirstName: "Ada", Time: "Mon, 19 Oct 2026 12:00:00 UTC", Device: "Firefox on Linux", IP: "203.0.113.7"},
+	AccountLocked:   AccountLockedData{FirstName: "Ada", Until: "Mon, 19 Oct 2026 12:15:00 UTC", Link: "http://localhost:4000/users/forgot-password"},
+	ProductUpdate:   ProductUpdateData{FirstName: "Ada", Title: "Dark mode is here", Body: "You can now switch to dark mode from your settings.", Link: "http://localhost:4000/"},
+
+	// rendered by celeritas on their own
+	"test": nil,
+	"panic-alert": map[string]interface{}{
+		"AppName":   "myapp",
+		"RequestID": "host/abc-000001",
+		"Panic":     "runtime error: invalid memory address or nil pointer dereference",
+		"Stack":     "goroutine 1 [running]:\nmain.main()\n\t/app/main.go:12 +0x1d",
+		"Request":   "GET /users/1 HTTP/1.1\r\nHost: localhost:4000\r\n",
+		"Time":      "Mon, 19 Oct 2026 12:00:00 UTC",
+	},
+}
@@ -0,0 +1,274 @@
+package emails
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"time"
+
+	sp "github.com/SparkPost/gosparkpost"
+	"github.com/cmd-ctrl-q/celeritas/mailer"
+	"github.com/mailgun/mailgun-go/v4"
+	"github.com/sendgrid/sendgrid-go"
+	sg "github.com/sendgrid/sendgrid-go/helpers/mail"
+	"github.com/vanng822/go-premailer/premailer"
+	simplemail "github.com/xhit/go-simple-mail/v2"
+)
+
+// transportTimeout is how long connecting to and sending through the smtp
+// server or the api may take
+const transportTimeout = 10 * time.Second
+
+// Transport is the app's mailer, able to add headers to a message. Celeritas'
+// mailer.Message has no headers, so SendWithHeaders renders the message as
+// celeritas does and sends it through the smtp server or api celeritas would
+// use, read from celeritas' own mailer.Mail. Send is left to celeritas.
+type Transport struct {
+	*mailer.Mail
+}
+
+// NewTransport wraps celeritas' mailer
+func NewTransport(m *mailer.Mail) *Transport {
+	return &Transport{Mail: m}
+}
+
+// outgoing is a rendered message, as each provider is given it
+type outgoing struct {
+	mailer.Message
+	HTML, Plain string
+	Headers     map[string]string
+	Files       []file
+}
+
+// file is an attachment, read once for whichever provider sends it
+type file struct {
+	Name, Type string
+	Data       []byte
+}
+
+// from is the sender as "Name <address>"
+func (o outgoing) from() string {
+	return (&netmail.Address{Name: o.FromName, Address: o.From}).String()
+}
+
+// SendWithHeaders renders and sends the message, with its attachments and the extra headers
+func (t *Transport) SendWithHeaders(msg mailer.Message, headers map[string]string) error {
+	if len(headers) == 0 {
+		return t.Send(msg)
+	}
+
+	if msg.From == "" {
+		msg.From = t.FromAddress
+	}
+	if msg.FromName == "" {
+		msg.FromName = t.FromName
+	}
+	o := outgoing{Message: msg, Headers: headers}
+
+	var err error
+	if o.HTML, o.Plain, err = renderBody(t.Templates, msg.Template, msg.Data); err != nil {
+		return err
+	}
+	if o.HTML, err = inlineCSS(o.HTML); err != nil {
+		return err
+	}
+	if o.Files, err = readFiles(msg.Attachments); err != nil {
+		return err
+	}
+
+	// the same choice celeritas' Send makes
+	if t.API == "" || t.APIKey == "" || t.APIUrl == "" || t.API == "smtp" {
+		return t.sendSMTP(o)
+	}
+
+	switch t.API {
+	case "mailgun":
+		return t.sendMailgun(o)
+	case "sendgrid":
+		return t.sendSendGrid(o)
+	case "sparkpost":
+		return t.sendSparkPost(o)
+	}
+
+	return fmt.Errorf("unknown api %s; only mailgun, sparkpost or sendgrid accepted", t.API)
+}
+
+// inlineCSS moves the styles onto the elements, as celeritas does, since many
+// mail clients ignore style sheets
+func inlineCSS(html string) (string, error) {
+	options := premailer.Options{
+		RemoveClasses:     false,
+		CssToAttributes:   false,
+		KeepBangImportant: true,
+	}
+
+	prem, err := premailer.NewPremailerFromString(html, &options)
+	if err != nil {
+		return "", err
+	}
+
+	return prem.Transform()
+}
+
+func readFiles(paths []string) ([]file, error) {
+	var files []file
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		kind := mime.TypeByExtension(filepath.Ext(path))
+		if kind == "" {
+			kind = "application/octet-stream"
+		}
+		files = append(files, file{Name: filepath.Base(path), Type: kind, Data: b})
+	}
+
+	return files, nil
+}
+
+func (t *Transport) sendSMTP(o outgoing) error {
+	server := simplemail.NewSMTPClient()
+	server.Host = t.Host
+	server.Port = t.Port
+	server.Username = t.Username
+	server.Password = t.Password
+	server.Encryption = encryption(t.Encryption)
+	server.KeepAlive = false
+	server.ConnectTimeout = transportTimeout
+	server.SendTimeout = transportTimeout
+
+	client, err := server.Connect()
+	if err != nil {
+		return err
+	}
+
+	email := simplemail.NewMSG()
+	email.SetFrom(o.from()).AddTo(o.To).SetSubject(o.Subject)
+	for name, value := range o.Headers {
+		email.AddHeader(name, value)
+	}
+	email.SetBody(simplemail.TextHTML, o.HTML)
+	email.AddAlternative(simplemail.TextPlain, o.Plain)
+	for _, f := range o.Files {
+		email.Attach(&simplemail.File{Name: f.Name, MimeType: f.Type, Data: f.Data})
+	}
+	if email.Error != nil {
+		return email.Error
+	}
+
+	return email.Send(client)
+}
+
+// encryption maps celeritas' SMTP_ENCRYPTION setting
+func encryption(s string) simplemail.Encryption {
+	switch s {
+	case "tls":
+		return simplemail.EncryptionSTARTTLS
+	case "ssl":
+		return simplemail.EncryptionSSLTLS
+	case "none", "":
+		return simplemail.EncryptionNone
+	default:
+		return simplemail.EncryptionSTARTTLS
+	}
+}
+
+// sendMailgun sends to MAILER_URL, eg https://api.eu.mailgun.net/v3 for an EU domain
+func (t *Transport) sendMailgun(o outgoing) error {
+	client := mailgun.NewMailgun(t.Domain, t.APIKey)
+	client.SetAPIBase(t.APIUrl)
+
+	message := client.NewMessage(o.from(), o.Subject, o.Plain, o.To)
+	message.SetHtml(o.HTML)
+	for name, value := range o.Headers {
+		message.AddHeader(name, value)
+	}
+	for _, f := range o.Files {
+		message.AddBufferAttachment(f.Name, f.Data)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), transportTimeout)
+	defer cancel()
+
+	_, _, err := client.Send(ctx, message)
+	return err
+}
+
+// sendSendGrid sends to MAILER_URL, eg https://api.sendgrid.com
+func (t *Transport) sendSendGrid(o outgoing) error {
+	message := sg.NewV3Mail()
+	message.SetFrom(sg.NewEmail(o.FromName, o.From))
+	message.Subject = o.Subject
+
+	p := sg.NewPersonalization()
+	p.AddTos(sg.NewEmail("", o.To))
+	message.AddPersonalizations(p)
+
+	if o.Plain != "" {
+		message.AddContent(sg.NewContent("text/plain", o.Plain))
+	}
+	message.AddContent(sg.NewContent("text/html", o.HTML))
+	for name, value := range o.Headers {
+		message.SetHeader(name, value)
+	}
+	for _, f := range o.Files {
+		message.AddAttachment(sg.NewAttachment().
+			SetFilename(f.Name).
+			SetType(f.Type).
+			SetContent(base64.StdEncoding.EncodeToString(f.Data)))
+	}
+
+	request := sendgrid.GetRequest(t.APIKey, "/v3/mail/send", t.APIUrl)
+	request.Method = "POST"
+	request.Body = sg.GetRequestBody(message)
+
+	response, err := sendgrid.API(request)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("sendgrid: %d %s", response.StatusCode, response.Body)
+	}
+
+	return nil
+}
+
+// sendSparkPost sends to MAILER_URL, eg https://api.sparkpost.com
+func (t *Transport) sendSparkPost(o outgoing) error {
+	var client sp.Client
+	err := client.Init(&sp.Config{BaseUrl: t.APIUrl, ApiKey: t.APIKey, ApiVersion: 1})
+	if err != nil {
+		return err
+	}
+
+	content := sp.Content{
+		HTML:    o.HTML,
+		Text:    o.Plain,
+		From:    sp.From{Email: o.From, Name: o.FromName},
+		Subject: o.Subject,
+		Headers: o.Headers,
+	}
+	for _, f := range o.Files {
+		content.Attachments = append(content.Attachments, sp.Attachment{
+			MIMEType: f.Type,
+			Filename: f.Name,
+			B64Data:  base64.StdEncoding.EncodeToString(f.Data),
+		})
+	}
+
+	_, response, err := client.Send(&sp.Transmission{Recipients: []string{o.To}, Content: content})
+	if err != nil {
+		return err
+	}
+	if len(response.Errors) > 0 {
+		return response.Errors
+	}
+
+	return nil
+}
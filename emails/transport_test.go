@@ -0,0 +1,286 @@
+package emails
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"myapp/data"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cmd-ctrl-q/celeritas/mailer"
+)
+
+// smtpServer accepts one smtp session on a local port and sends the message
+// it was given on the channel
+func smtpServer(t *testing.T) (int, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		reply := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost ready")
+
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			switch command := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+				reply("250 localhost")
+			case command == "DATA":
+				reply("354 go ahead")
+				var data strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				received <- data.String()
+				reply("250 queued")
+			case command == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+
+	return l.Addr().(*net.TCPAddr).Port, received
+}
+
+// celeritasMail builds the mailer the way celeritas does, from the same
+// settings in the environment
+func celeritasMail(t *testing.T, env map[string]string) *mailer.Mail {
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+
+	port, _ := strconv.Atoi(os.Getenv("SMTP_PORT"))
+	return &mailer.Mail{
+		Domain:      os.Getenv("MAIL_DOMAIN"),
+		Templates:   "../mail",
+		Host:        os.Getenv("SMTP_HOST"),
+		Port:        port,
+		Username:    os.Getenv("SMTP_USERNAME"),
+		Password:    os.Getenv("SMTP_PASSWORD"),
+		Encryption:  os.Getenv("SMTP_ENCRYPTION"),
+		FromName:    os.Getenv("FROM_NAME"),
+		FromAddress: os.Getenv("FROM_ADDRESS"),
+		API:         os.Getenv("MAILER_API"),
+		APIKey:      os.Getenv("MAILER_KEY"),
+		APIUrl:      os.Getenv("MAILER_URL"),
+	}
+}
+
+// sendProductUpdate sends a product update with an attachment through the
+// transport and returns the List-Unsubscribe headers it should have
+func sendProductUpdate(t *testing.T, m *mailer.Mail) map[string]string {
+	t.Helper()
+
+	attachment := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(attachment, []byte("release notes"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Sender{Renderer: *testRenderer(), Mail: NewTransport(m), Preferences: preferences{}}
+	msg := mailer.Message{
+		To:          "ada@here.com",
+		Subject:     "What's new",
+		Template:    ProductUpdate,
+		Data:        Fixtures[ProductUpdate],
+		Attachments: []string{attachment},
+	}
+	if err := s.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	return s.UnsubscribeHeaders("ada@here.com", data.EmailProduct)
+}
+
+// apiServer is an https MAILER_URL, the api clients only talk to https. It
+// passes each request to handle, which writes the provider's answer.
+func apiServer(t *testing.T, handle func(w http.ResponseWriter, r *http.Request)) string {
+	srv := httptest.NewTLSServer(http.HandlerFunc(handle))
+	t.Cleanup(srv.Close)
+
+	// the clients use the default transport, trust the test certificate
+	original := http.DefaultTransport
+	http.DefaultTransport = srv.Client().Transport
+	t.Cleanup(func() { http.DefaultTransport = original })
+
+	return srv.URL
+}
+
+func TestTransport_SMTP(t *testing.T) {
+	port, received := smtpServer(t)
+
+	want := sendProductUpdate(t, celeritasMail(t, map[string]string{
+		"SMTP_HOST":       "127.0.0.1",
+		"SMTP_PORT":       strconv.Itoa(port),
+		"SMTP_ENCRYPTION": "none",
+		"FROM_NAME":       "MyApp",
+		"FROM_ADDRESS":    "hello@myapp.com",
+	}))
+
+	raw := <-received
+	sent, err := netmail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, value := range want {
+		if got := sent.Header.Get(name); got != value {
+			t.Errorf("%s: expected %q, got %q", name, value, got)
+		}
+	}
+	if got := sent.Header.Get("From"); got != `"MyApp" <hello@myapp.com>` {
+		t.Error("expected the mailer's from name and address, got", got)
+	}
+	if !strings.Contains(raw, `filename="notes.txt"`) {
+		t.Error("expected the attachment")
+	}
+}
+
+func TestTransport_Mailgun(t *testing.T) {
+	var form map[string][]string
+	var files []string
+	url := apiServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/mg.myapp.com/messages" {
+			t.Error("unexpected path", r.URL.Path)
+		}
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Error(err)
+			return
+		}
+		form = r.MultipartForm.Value
+		for _, f := range r.MultipartForm.File["attachment"] {
+			files = append(files, f.Filename)
+		}
+		_, _ = io.WriteString(w, `{"id":"<1@mg.myapp.com>","message":"Queued"}`)
+	})
+
+	want := sendProductUpdate(t, celeritasMail(t, map[string]string{
+		"MAILER_API":   "mailgun",
+		"MAILER_KEY":   "key",
+		"MAILER_URL":   url + "/v3",
+		"MAIL_DOMAIN":  "mg.myapp.com",
+		"FROM_NAME":    "MyApp",
+		"FROM_ADDRESS": "hello@myapp.com",
+	}))
+
+	for name, value := range want {
+		if got := form["h:"+name]; len(got) != 1 || got[0] != value {
+			t.Errorf("%s: expected %q, got %q", name, value, got)
+		}
+	}
+	if got := form["from"]; len(got) != 1 || got[0] != `"MyApp" <hello@myapp.com>` {
+		t.Error("expected the mailer's from name and address, got", got)
+	}
+	if len(files) != 1 || files[0] != "notes.txt" {
+		t.Error("expected the attachment, got", files)
+	}
+}
+
+func TestTransport_SendGrid(t *testing.T) {
+	var body struct {
+		From        struct{ Name, Email string }
+		Headers     map[string]string
+		Attachments []struct{ Filename string }
+	}
+	url := apiServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/mail/send" {
+			t.Error("unexpected path", r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	want := sendProductUpdate(t, celeritasMail(t, map[string]string{
+		"MAILER_API":   "sendgrid",
+		"MAILER_KEY":   "key",
+		"MAILER_URL":   url,
+		"FROM_NAME":    "MyApp",
+		"FROM_ADDRESS": "hello@myapp.com",
+	}))
+
+	for name, value := range want {
+		if got := body.Headers[name]; got != value {
+			t.Errorf("%s: expected %q, got %q", name, value, got)
+		}
+	}
+	if body.From.Name != "MyApp" || body.From.Email != "hello@myapp.com" {
+		t.Error("expected the mailer's from name and address, got", body.From)
+	}
+	if len(body.Attachments) != 1 || body.Attachments[0].Filename != "notes.txt" {
+		t.Error("expected the attachment, got", body.Attachments)
+	}
+}
+
+func TestTransport_SparkPost(t *testing.T) {
+	var body struct {
+		Content struct {
+			From        struct{ Name, Email string }
+			Headers     map[string]string
+			Attachments []struct{ Name string }
+		}
+	}
+	url := apiServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/transmissions" {
+			t.Error("unexpected path", r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"results":{"total_rejected_recipients":0,"total_accepted_recipients":1,"id":"1"}}`)
+	})
+
+	want := sendProductUpdate(t, celeritasMail(t, map[string]string{
+		"MAILER_API":   "sparkpost",
+		"MAILER_KEY":   "key",
+		"MAILER_URL":   url,
+		"FROM_NAME":    "MyApp",
+		"FROM_ADDRESS": "hello@myapp.com",
+	}))
+
+	for name, value := range want {
+		if got := body.Content.Headers[name]; got != value {
+			t.Errorf("%s: expected %q, got %q", name, value, got)
+		}
+	}
+	if body.Content.From.Name != "MyApp" || body.Content.From.Email != "hello@myapp.com" {
+		t.Error("expected the mailer's from name and address, got", body.Content.From)
+	}
+	if len(body.Content.Attachments) != 1 || body.Content.Attachments[0].Name != "notes.txt" {
+		t.Error("expected the attachment, got", body.Content.Attachments)
+	}
+}
@@ -0,0 +1,361 @@
+// Package events pushes server-sent events to the browsers of signed in
+// users. Each user has their own stream with a bounded buffer of recent
+// events, so a browser that reconnects with Last-Event-ID gets what it missed.
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errClosed = errors.New("events: the hub is closed")
+
+// the events sent to browsers
+const (
+	// Logout is sent to a user's other browsers when they sign out
+	Logout = "logout"
+	// PasswordChanged is sent when a user's password is reset
+	PasswordChanged = "password.changed"
+	// CacheChanged is sent to admins when the cache page changes the cache
+	CacheChanged = "cache.changed"
+	// Reset tells the browser events were missed and it should reload what it shows
+	Reset = "reset"
+)
+
+// Config holds the stream settings
+type Config struct {
+	// Heartbeat is how often a comment is sent on an idle stream, so proxies keep it open
+	Heartbeat time.Duration
+	// BufferSize is how many events per user are kept for resuming
+	BufferSize int
+	// MaxDuration ends a stream before the server's write timeout does, the browser reconnects
+	MaxDuration time.Duration
+	// Retry is the reconnect delay sent to browsers
+	Retry time.Duration
+	// IdleTTL is how long a stream no browser is connected to keeps its buffer
+	// after its last event, a browser that comes back later gets a reset
+	IdleTTL time.Duration
+}
+
+// NewConfig reads the event settings from the environment (.env)
+func NewConfig() Config {
+	heartbeat, err := strconv.Atoi(os.Getenv("SSE_HEARTBEAT"))
+	if err != nil || heartbeat < 1 {
+		heartbeat = 25
+	}
+
+	buffer, err := strconv.Atoi(os.Getenv("SSE_BUFFER"))
+	if err != nil || buffer < 1 {
+		buffer = 100
+	}
+
+	idle, err := strconv.Atoi(os.Getenv("SSE_IDLE_TTL"))
+	if err != nil || idle < 1 {
+		idle = 600
+	}
+
+	return Config{
+		Heartbeat:   time.Duration(heartbeat) * time.Second,
+		BufferSize:  buffer,
+		MaxDuration: 5 * time.Minute,
+		Retry:       3 * time.Second,
+		IdleTTL:     time.Duration(idle) * time.Second,
+	}
+}
+
+// Event is one message on a user's stream. IDs count up per user.
+type Event struct {
+	ID   int
+	Name string
+	Data []byte
+}
+
+// write sends the event in the text/event-stream format
+func (e Event) write(w http.ResponseWriter) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Name, e.Data)
+	return err
+}
+
+// stream is one user's buffer and connected browsers
+type stream struct {
+	lastID  int
+	buffer  []Event
+	clients map[chan Event]bool
+	// admin is set by the user's latest connection, admins get the admin broadcasts
+	admin bool
+	// active is when the stream last had an event or a browser leave
+	active time.Time
+}
+
+// Hub keeps a stream for every user that has had an event or a connection
+type Hub struct {
+	Config
+
+	mu      sync.Mutex
+	streams map[int]*stream
+	// swept is when idle streams were last dropped
+	swept   time.Time
+	done    chan struct{}
+	closed  bool
+	serving sync.WaitGroup
+}
+
+// New creates a hub
+func New(config Config) *Hub {
+	return &Hub{
+		Config:  config,
+		streams: make(map[int]*stream),
+		done:    make(chan struct{}),
+	}
+}
+
+// stream gets the user's stream, the caller holds the lock. Streams that have
+// been idle longer than IdleTTL are dropped on the way, at most once per IdleTTL.
+func (h *Hub) stream(userID int) *stream {
+	h.sweep()
+
+	s, ok := h.streams[userID]
+	if !ok {
+		s = &stream{clients: make(map[chan Event]bool), active: time.Now()}
+		h.streams[userID] = s
+	}
+
+	return s
+}
+
+// sweep drops the streams without browsers whose last activity is older than
+// IdleTTL, the caller holds the lock
+func (h *Hub) sweep() {
+	if h.IdleTTL <= 0 || time.Since(h.swept) < h.IdleTTL {
+		return
+	}
+	h.swept = time.Now()
+
+	for userID, s := range h.streams {
+		if len(s.clients) == 0 && time.Since(s.active) >= h.IdleTTL {
+			delete(h.streams, userID)
+		}
+	}
+}
+
+// Publish sends an event to every browser of one user. data is written as json.
+func (h *Hub) Publish(userID int, name string, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.send(h.stream(userID), name, body)
+	return nil
+}
+
+// Broadcast sends an event to every user the hub knows about
+func (h *Hub) Broadcast(name string, data interface{}) error {
+	return h.broadcast(name, data, false)
+}
+
+// BroadcastAdmins sends an event to every admin the hub knows about
+func (h *Hub) BroadcastAdmins(name string, data interface{}) error {
+	return h.broadcast(name, data, true)
+}
+
+func (h *Hub) broadcast(name string, data interface{}, admins bool) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.sweep()
+	for _, s := range h.streams {
+		if !admins || s.admin {
+			h.send(s, name, body)
+		}
+	}
+	return nil
+}
+
+// send buffers the event and hands it to the connected browsers. A browser
+// that has fallen behind is dropped, it resumes from the buffer when it
+// reconnects. The caller holds the lock.
+func (h *Hub) send(s *stream, name string, body []byte) {
+	if h.closed {
+		return
+	}
+
+	s.lastID++
+	s.active = time.Now()
+	e := Event{ID: s.lastID, Name: name, Data: body}
+
+	s.buffer = append(s.buffer, e)
+	if len(s.buffer) > h.BufferSize {
+		s.buffer = s.buffer[len(s.buffer)-h.BufferSize:]
+	}
+
+	for c := range s.clients {
+		select {
+		case c <- e:
+		default:
+			delete(s.clients, c)
+			close(c)
+		}
+	}
+}
+
+// subscribe connects a browser to the user's stream. When resuming it also
+// returns the events after lastID, ok is false when some of them are no
+// longer buffered.
+func (h *Hub) subscribe(userID int, admin bool, lastID int, resume bool) (c chan Event, missed []Event, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, nil, false
+	}
+	h.serving.Add(1)
+
+	s := h.stream(userID)
+	s.admin = admin
+	c = make(chan Event, h.BufferSize)
+	s.clients[c] = true
+
+	if !resume {
+		return c, nil, true
+	}
+	if lastID > s.lastID {
+		// an id from before a restart
+		return c, nil, false
+	}
+
+	for _, e := range s.buffer {
+		if e.ID > lastID {
+			missed = append(missed, e)
+		}
+	}
+	ok = len(s.buffer) == 0 || s.buffer[0].ID <= lastID+1
+
+	return c, missed, ok
+}
+
+// unsubscribe disconnects a browser, unless it was already dropped
+func (h *Hub) unsubscribe(userID int, c chan Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if s, ok := h.streams[userID]; ok && s.clients[c] {
+		delete(s.clients, c)
+		close(c)
+		s.active = time.Now()
+	}
+}
+
+// Serve streams the user's events until the browser goes away, the stream
+// reaches MaxDuration or the hub is closed. A Last-Event-ID header resumes
+// after that event, with a reset event first if some were missed. admin
+// says whether the user gets the admin broadcasts.
+func (h *Hub) Serve(w http.ResponseWriter, r *http.Request, userID int, admin bool) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("events: %T can't be flushed", w)
+	}
+
+	header := r.Header.Get("Last-Event-ID")
+	lastID, err := strconv.Atoi(header)
+	resume := header != ""
+	if resume && (err != nil || lastID < 0) {
+		lastID = -1
+	}
+
+	c, missed, complete := h.subscribe(userID, admin, lastID, resume)
+	if c == nil {
+		return errClosed
+	}
+	defer h.serving.Done()
+	defer h.unsubscribe(userID, c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", h.Retry.Milliseconds()); err != nil {
+		return nil
+	}
+	if !complete {
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: {}\n\n", Reset); err != nil {
+			return nil
+		}
+	}
+	for _, e := range missed {
+		if err := e.write(w); err != nil {
+			return nil
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(h.Heartbeat)
+	defer heartbeat.Stop()
+	deadline := time.NewTimer(h.MaxDuration)
+	defer deadline.Stop()
+
+	for {
+		var err error
+		select {
+		case e, open := <-c:
+			if !open {
+				// dropped for falling behind
+				return nil
+			}
+			err = e.write(w)
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		case <-deadline.C:
+			return nil
+		case <-h.done:
+			return nil
+		case <-r.Context().Done():
+			return nil
+		}
+
+		if err != nil {
+			// the browser has gone
+			return nil
+		}
+		flusher.Flush()
+	}
+}
+
+// Close ends every stream and waits up to timeout for them to finish. Browsers
+// reconnect on their own once the server is back.
+func (h *Hub) Close(timeout time.Duration) {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return
+	}
+	h.closed = true
+	close(h.done)
+	h.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		h.serving.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(timeout):
+	}
+}
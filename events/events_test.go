@@ -0,0 +1,211 @@
+package events
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testHub(buffer int) *Hub {
+	return New(Config{Heartbeat: time.Hour, BufferSize: buffer, MaxDuration: time.Minute, Retry: time.Second})
+}
+
+// connect opens user 1's stream, resuming after lastID when it isn't empty
+func connect(t *testing.T, hub *Hub, lastID string) (*bufio.Reader, func()) {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := hub.Serve(w, r, 1, false); err != nil {
+			t.Error(err)
+		}
+	}))
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Error("unexpected content type", ct)
+	}
+
+	return bufio.NewReader(resp.Body), func() {
+		resp.Body.Close()
+		server.Close()
+	}
+}
+
+// next reads the next event, skipping the retry and heartbeat messages
+func next(t *testing.T, r *bufio.Reader) map[string]string {
+	t.Helper()
+
+	fields := make(map[string]string)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal("stream ended:", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		if line == "" {
+			if fields["event"] != "" {
+				return fields
+			}
+			fields = make(map[string]string)
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		parts := strings.SplitN(line, ": ", 2)
+		fields[parts[0]] = parts[1]
+	}
+}
+
+// waitForClient waits until user 1 has a connected browser
+func waitForClient(hub *Hub) {
+	for i := 0; i < 100; i++ {
+		hub.mu.Lock()
+		s, ok := hub.streams[1]
+		n := 0
+		if ok {
+			n = len(s.clients)
+		}
+		hub.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	hub := testHub(10)
+	_ = hub.Publish(1, "old", nil)
+
+	r, done := connect(t, hub, "")
+	defer done()
+	waitForClient(hub)
+
+	_ = hub.Publish(2, "someone.else", nil)
+	_ = hub.Publish(1, PasswordChanged, map[string]int{"id": 1})
+
+	e := next(t, r)
+	if e["event"] != PasswordChanged || e["id"] != "2" || e["data"] != `{"id":1}` {
+		t.Error("expected the new event only, got", e)
+	}
+
+	_ = hub.Broadcast(CacheChanged, nil)
+	if e := next(t, r); e["event"] != CacheChanged {
+		t.Error("expected the broadcast, got", e)
+	}
+}
+
+func TestBroadcastAdmins(t *testing.T) {
+	hub := testHub(10)
+	user, _, _ := hub.subscribe(1, false, 0, false)
+	admin, _, _ := hub.subscribe(2, true, 0, false)
+
+	_ = hub.BroadcastAdmins(CacheChanged, nil)
+
+	if len(user) != 0 {
+		t.Error("expected nothing for the user who isn't an admin")
+	}
+	if len(admin) != 1 {
+		t.Error("expected the admin to get the broadcast")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	hub := testHub(10)
+	hub.IdleTTL = time.Minute
+	_ = hub.Publish(1, "old", nil)
+	c, _, _ := hub.subscribe(2, false, 0, false)
+
+	hub.mu.Lock()
+	for _, s := range hub.streams {
+		s.active = time.Now().Add(-time.Hour)
+	}
+	hub.swept = time.Time{}
+	hub.mu.Unlock()
+
+	_ = hub.Publish(3, "new", nil)
+
+	if _, ok := hub.streams[1]; ok {
+		t.Error("expected the idle stream to be dropped")
+	}
+	if _, ok := hub.streams[2]; !ok {
+		t.Error("expected the stream with a browser to be kept")
+	}
+	hub.unsubscribe(2, c)
+}
+
+func TestResume(t *testing.T) {
+	hub := testHub(10)
+	for _, name := range []string{"one", "two", "three"} {
+		_ = hub.Publish(1, name, nil)
+	}
+
+	r, done := connect(t, hub, "1")
+	defer done()
+
+	if e := next(t, r); e["event"] != "two" {
+		t.Error("expected to resume with two, got", e)
+	}
+	if e := next(t, r); e["event"] != "three" || e["id"] != "3" {
+		t.Error("expected three, got", e)
+	}
+}
+
+func TestResumeGap(t *testing.T) {
+	hub := testHub(2)
+	for _, name := range []string{"one", "two", "three", "four", "five"} {
+		_ = hub.Publish(1, name, nil)
+	}
+
+	r, done := connect(t, hub, "1")
+	defer done()
+
+	if e := next(t, r); e["event"] != Reset {
+		t.Error("expected a reset for the missed events, got", e)
+	}
+	if e := next(t, r); e["event"] != "four" {
+		t.Error("expected the buffered events, got", e)
+	}
+
+	// an id from before a restart
+	r, done2 := connect(t, hub, "99")
+	defer done2()
+	if e := next(t, r); e["event"] != Reset {
+		t.Error("expected a reset for an unknown id, got", e)
+	}
+}
+
+func TestClose(t *testing.T) {
+	hub := testHub(10)
+
+	r, done := connect(t, hub, "")
+	defer done()
+	waitForClient(hub)
+
+	hub.Close(time.Second)
+
+	if _, err := r.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := r.ReadString('\n'); err != nil {
+			break
+		}
+	}
+
+	if c, _, _ := hub.subscribe(1, false, 0, false); c != nil {
+		t.Error("a closed hub should refuse new streams")
+	}
+}
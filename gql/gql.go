@@ -0,0 +1,170 @@
+// Package gql runs graphql requests against a schema with depth and
+// complexity limits, and holds the batch loader and error mapping the
+// resolvers share. The schema itself lives with the handlers.
+package gql
+
+import (
+	"context"
+	"errors"
+	"myapp/apperr"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+)
+
+// Config holds the limits every query is checked against before it runs
+type Config struct {
+	// MaxDepth is how deeply selections may be nested
+	MaxDepth int
+	// MaxComplexity is the most fields a query may resolve, see Complexity
+	MaxComplexity int
+}
+
+// NewConfig reads the graphql limits from the environment (.env)
+func NewConfig() Config {
+	depth, err := strconv.Atoi(os.Getenv("GRAPHQL_MAX_DEPTH"))
+	if err != nil || depth < 1 {
+		depth = 8
+	}
+
+	complexity, err := strconv.Atoi(os.Getenv("GRAPHQL_MAX_COMPLEXITY"))
+	if err != nil || complexity < 1 {
+		complexity = 2000
+	}
+
+	return Config{
+		MaxDepth:      depth,
+		MaxComplexity: complexity,
+	}
+}
+
+// Request is the body of a graphql request
+type Request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+	// ReadOnly rejects mutations, set it for GET requests
+	ReadOnly bool `json:"-"`
+}
+
+// Execute parses, validates and limit checks the request and then runs it.
+// The second result is false when the request was rejected before it ran.
+func Execute(ctx context.Context, schema graphql.Schema, config Config, sizes ListSizes, req Request) (*graphql.Result, bool) {
+	doc, err := parse(req.Query)
+	if err != nil {
+		return &graphql.Result{Errors: gqlerrors.FormatErrors(err)}, false
+	}
+
+	validation := graphql.ValidateDocument(&schema, doc, nil)
+	if !validation.IsValid {
+		return &graphql.Result{Errors: validation.Errors}, false
+	}
+
+	if req.ReadOnly && hasMutation(doc, req.OperationName) {
+		err := &Error{
+			Message:    "mutations must be sent with POST",
+			extensions: map[string]interface{}{"code": "METHOD_NOT_ALLOWED"},
+		}
+		return &graphql.Result{Errors: []gqlerrors.FormattedError{err.format()}}, false
+	}
+
+	if err := checkLimits(doc, req.Variables, config, sizes); err != nil {
+		return &graphql.Result{Errors: []gqlerrors.FormattedError{err.format()}}, false
+	}
+
+	return graphql.Execute(graphql.ExecuteParams{
+		Schema:        schema,
+		AST:           doc,
+		OperationName: req.OperationName,
+		Args:          req.Variables,
+		Context:       ctx,
+	}), true
+}
+
+func parse(query string) (*ast.Document, error) {
+	return parser.Parse(parser.ParseParams{
+		Source: source.NewSource(&source.Source{Body: []byte(query), Name: "GraphQL request"}),
+	})
+}
+
+// hasMutation reports whether the operation that would run is a mutation
+func hasMutation(doc *ast.Document, operationName string) bool {
+	for _, def := range doc.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		if operationName != "" && (op.Name == nil || op.Name.Value != operationName) {
+			continue
+		}
+		if op.Operation == ast.OperationTypeMutation {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Error is an error sent to the client with an extensions object holding the
+// http style status, a code and any field errors
+type Error struct {
+	Message    string
+	extensions map[string]interface{}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Extensions implements gqlerrors.ExtendedError
+func (e *Error) Extensions() map[string]interface{} {
+	return e.extensions
+}
+
+// format is for errors returned outside a resolver, graphql only reads the extensions of resolver errors
+func (e *Error) format() gqlerrors.FormattedError {
+	f := gqlerrors.FormatError(e)
+	f.Extensions = e.extensions
+	return f
+}
+
+// codes for each status, named the way graphql clients expect
+var codes = map[int]string{
+	http.StatusBadRequest:          "BAD_REQUEST",
+	http.StatusUnauthorized:        "UNAUTHENTICATED",
+	http.StatusForbidden:           "FORBIDDEN",
+	http.StatusNotFound:            "NOT_FOUND",
+	http.StatusConflict:            "CONFLICT",
+	http.StatusUnprocessableEntity: "VALIDATION_FAILED",
+}
+
+// FromError turns any error into an Error. Like apperr, the message of an
+// unknown error is never shown, only a generic one.
+func FromError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+
+	appErr := apperr.From(err)
+	code, ok := codes[appErr.Status]
+	if !ok {
+		code = "INTERNAL"
+	}
+
+	extensions := map[string]interface{}{
+		"code":   code,
+		"status": appErr.Status,
+	}
+	if len(appErr.Fields) > 0 {
+		extensions["fields"] = appErr.Fields
+	}
+
+	return &Error{Message: appErr.Message, extensions: extensions}
+}
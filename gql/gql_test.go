@@ -0,0 +1,124 @@
+package gql
+
+import (
+	"errors"
+	"myapp/apperr"
+	"testing"
+)
+
+var sizes = ListSizes{
+	"users": func(args map[string]interface{}) int { return IntArg(args, "perPage", 20) },
+	"tokens": func(args map[string]interface{}) int {
+		return 5
+	},
+}
+
+var limitTests = []struct {
+	name       string
+	query      string
+	variables  map[string]interface{}
+	depth      int
+	complexity int
+}{
+	{"one field", `{ me { id } }`, nil, 2, 2},
+	{"list", `{ users(perPage: 10) { nodes { id email } } }`, nil, 3, 31},
+	{"list from a variable", `query($n: Int) { users(perPage: $n) { nodes { id } } }`, map[string]interface{}{"n": float64(50)}, 3, 101},
+	{"default page size", `{ users { nodes { id } } }`, nil, 3, 41},
+	{"nested lists", `{ users(perPage: 10) { nodes { tokens { id } } } }`, nil, 4, 71},
+	{"fragments", `{ me { ...f } } fragment f on User { id tokens { id } }`, nil, 3, 8},
+	{"introspection is free", `{ __schema { types { name fields { name type { ofType { ofType { name } } } } } } me { id } }`, nil, 2, 2},
+}
+
+func TestCheckLimits(t *testing.T) {
+	for _, e := range limitTests {
+		doc, err := parse(e.query)
+		if err != nil {
+			t.Fatalf("%s: %s", e.name, err)
+		}
+
+		// the exact limit passes, one less fails with the right code
+		if got := checkLimits(doc, e.variables, Config{MaxDepth: e.depth, MaxComplexity: e.complexity}, sizes); got != nil {
+			t.Errorf("%s: expected to pass at depth %d complexity %d, got %s", e.name, e.depth, e.complexity, got)
+		}
+
+		tooDeep := checkLimits(doc, e.variables, Config{MaxDepth: e.depth - 1, MaxComplexity: 1000000}, sizes)
+		if tooDeep == nil || tooDeep.Extensions()["code"] != "QUERY_TOO_DEEP" {
+			t.Errorf("%s: expected QUERY_TOO_DEEP, got %v", e.name, tooDeep)
+		}
+
+		tooComplex := checkLimits(doc, e.variables, Config{MaxDepth: 100, MaxComplexity: e.complexity - 1}, sizes)
+		if tooComplex == nil || tooComplex.Extensions()["code"] != "QUERY_TOO_COMPLEX" {
+			t.Errorf("%s: expected QUERY_TOO_COMPLEX, got %v", e.name, tooComplex)
+		}
+	}
+}
+
+func TestLoader(t *testing.T) {
+	var calls [][]int
+	loader := NewLoader(func(keys []int) (map[int]interface{}, error) {
+		calls = append(calls, keys)
+		values := make(map[int]interface{})
+		for _, k := range keys {
+			if k != 3 {
+				values[k] = k * 10
+			}
+		}
+		return values, nil
+	})
+
+	// every key is queued before any thunk runs, like graphql does
+	thunks := []func() (interface{}, error){loader.Load(1), loader.Load(2), loader.Load(1), loader.Load(3)}
+	var got []interface{}
+	for _, thunk := range thunks {
+		v, err := thunk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, v)
+	}
+
+	if len(calls) != 1 || len(calls[0]) != 3 {
+		t.Fatalf("expected one fetch of the three keys, got %v", calls)
+	}
+	want := []interface{}{10, 20, 10, nil}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("key %d: expected %v but got %v", i, want[i], got[i])
+		}
+	}
+
+	// keys queued later get a second fetch
+	if v, _ := loader.Load(4)(); v != 40 || len(calls) != 2 {
+		t.Errorf("expected a second fetch for a new key, got %v after %d fetches", v, len(calls))
+	}
+}
+
+func TestLoaderError(t *testing.T) {
+	boom := errors.New("boom")
+	loader := NewLoader(func(keys []int) (map[int]interface{}, error) {
+		return nil, boom
+	})
+
+	a, b := loader.Load(1), loader.Load(2)
+	if _, err := a(); err != boom {
+		t.Error("expected the fetch error, got", err)
+	}
+	if _, err := b(); err != boom {
+		t.Error("every key of a failed fetch should get the error, got", err)
+	}
+}
+
+func TestFromError(t *testing.T) {
+	e := FromError(apperr.Invalid(map[string]string{"email": "Invalid email address"}, map[string]string{"email": "email"}))
+	if e.Extensions()["code"] != "VALIDATION_FAILED" || e.Extensions()["status"] != 422 {
+		t.Error("wrong extensions", e.Extensions())
+	}
+	if fields, ok := e.Extensions()["fields"].([]apperr.FieldError); !ok || len(fields) != 1 {
+		t.Error("field errors are missing", e.Extensions())
+	}
+
+	internal := FromError(errors.New("pq: connection refused"))
+	if internal.Message == "pq: connection refused" || internal.Extensions()["code"] != "INTERNAL" {
+		t.Error("internal errors must be hidden, got", internal.Message, internal.Extensions())
+	}
+}
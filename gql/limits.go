@@ -0,0 +1,129 @@
+package gql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// ListSizes estimates how many items a list field returns, given its
+// arguments. Fields that are not in the map count once.
+type ListSizes map[string]func(args map[string]interface{}) int
+
+// checkLimits rejects documents that nest deeper than MaxDepth or whose
+// complexity is over MaxComplexity. Every field counts one towards the
+// complexity, and the selections under a list field count once per item. The
+// document must already be valid, so fragments can't be cyclic.
+func checkLimits(doc *ast.Document, variables map[string]interface{}, config Config, sizes ListSizes) *Error {
+	fragments := make(map[string]*ast.FragmentDefinition)
+	for _, def := range doc.Definitions {
+		if f, ok := def.(*ast.FragmentDefinition); ok {
+			fragments[f.Name.Value] = f
+		}
+	}
+
+	w := walker{fragments: fragments, variables: variables, sizes: sizes}
+	for _, def := range doc.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+
+		depth, complexity := w.selections(op.SelectionSet)
+		if depth > config.MaxDepth {
+			return &Error{
+				Message:    fmt.Sprintf("query is nested %d deep, the limit is %d", depth, config.MaxDepth),
+				extensions: map[string]interface{}{"code": "QUERY_TOO_DEEP", "depth": depth, "max_depth": config.MaxDepth},
+			}
+		}
+		if complexity > config.MaxComplexity {
+			return &Error{
+				Message:    fmt.Sprintf("query complexity is %d, the limit is %d", complexity, config.MaxComplexity),
+				extensions: map[string]interface{}{"code": "QUERY_TOO_COMPLEX", "complexity": complexity, "max_complexity": config.MaxComplexity},
+			}
+		}
+	}
+
+	return nil
+}
+
+type walker struct {
+	fragments map[string]*ast.FragmentDefinition
+	variables map[string]interface{}
+	sizes     ListSizes
+}
+
+// selections returns the depth and complexity of a selection set. Introspection
+// fields (__schema, __type) are free, so tools can always load the schema.
+func (w walker) selections(set *ast.SelectionSet) (depth, complexity int) {
+	if set == nil {
+		return 0, 0
+	}
+
+	for _, selection := range set.Selections {
+		var d, c int
+		switch s := selection.(type) {
+		case *ast.Field:
+			if strings.HasPrefix(s.Name.Value, "__") {
+				continue
+			}
+			d, c = w.selections(s.SelectionSet)
+			d++
+			c = 1 + w.size(s)*c
+		case *ast.InlineFragment:
+			d, c = w.selections(s.SelectionSet)
+		case *ast.FragmentSpread:
+			if f, ok := w.fragments[s.Name.Value]; ok {
+				d, c = w.selections(f.SelectionSet)
+			}
+		}
+
+		if d > depth {
+			depth = d
+		}
+		complexity += c
+	}
+
+	return depth, complexity
+}
+
+func (w walker) size(field *ast.Field) int {
+	size, ok := w.sizes[field.Name.Value]
+	if !ok {
+		return 1
+	}
+
+	args := make(map[string]interface{})
+	for _, arg := range field.Arguments {
+		switch v := arg.Value.(type) {
+		case *ast.IntValue:
+			if n, err := strconv.Atoi(v.Value); err == nil {
+				args[arg.Name.Value] = n
+			}
+		case *ast.Variable:
+			if value, ok := w.variables[v.Name.Value]; ok {
+				args[arg.Name.Value] = value
+			}
+		}
+	}
+
+	if n := size(args); n > 1 {
+		return n
+	}
+
+	return 1
+}
+
+// IntArg reads an int argument for a ListSizes func, variables arrive as float64 from json
+func IntArg(args map[string]interface{}, name string, def int) int {
+	switch v := args[name].(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	}
+
+	return def
+}
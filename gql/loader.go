@@ -0,0 +1,70 @@
+package gql
+
+import "sync"
+
+// BatchFunc loads the values for many keys in one go. Keys without a value
+// may be left out of the map.
+type BatchFunc func(keys []int) (map[int]interface{}, error)
+
+// Loader batches the loads of one request. Resolvers call Load and return the
+// thunk it gives them; graphql only runs the thunks once every field at that
+// level has been resolved, so the first thunk fetches every key at once.
+type Loader struct {
+	fetch BatchFunc
+
+	mu      sync.Mutex
+	pending []int
+	values  map[int]interface{}
+	err     error
+}
+
+// NewLoader creates a loader, make a new one for every request
+func NewLoader(fetch BatchFunc) *Loader {
+	return &Loader{
+		fetch:  fetch,
+		values: make(map[int]interface{}),
+	}
+}
+
+// Load queues key and returns a thunk for its value, nil if there isn't one
+func (l *Loader) Load(key int) func() (interface{}, error) {
+	l.mu.Lock()
+	l.pending = append(l.pending, key)
+	l.mu.Unlock()
+
+	return func() (interface{}, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		if len(l.pending) > 0 {
+			keys := l.pending
+			l.pending = nil
+
+			values, err := l.fetch(unique(keys))
+			if err != nil {
+				l.err = err
+			}
+			for k, v := range values {
+				l.values[k] = v
+			}
+		}
+
+		if l.err != nil {
+			return nil, l.err
+		}
+
+		return l.values[key], nil
+	}
+}
+
+func unique(keys []int) []int {
+	seen := make(map[int]bool, len(keys))
+	out := make([]int, 0, len(keys))
+	for _, k := range keys {
+		if !seen[k] {
+			seen[k] = true
+			out = append(out, k)
+		}
+	}
+	return out
+}
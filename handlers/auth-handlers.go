@@ -4,7 +4,11 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"myapp/apperr"
 	"myapp/data"
+	"myapp/emails"
+	"myapp/events"
+	"myapp/webhooks"
 	"net/http"
 	"time"
 
@@ -22,14 +26,11 @@ func (h *Handlers) GetUserLogin(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (h *Handlers) PostUserLogin(w http.ResponseWriter, r *http.Request) {
+func (h *Handlers) PostUserLogin(w http.ResponseWriter, r *http.Request) error {
 	// get info from the request
 	err := r.ParseForm()
 	if err != nil {
-		// bad request
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
-		return
+		return apperr.BadRequest("Could not read the login form", err)
 	}
 
 	email := r.Form.Get("email")
@@ -37,25 +38,20 @@ func (h *Handlers) PostUserLogin(w http.ResponseWriter, r *http.Request) {
 
 	user, err := h.Models.Users.GetByEmail(email)
 	if err != nil {
-		// internal server error
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-		return
+		if data.IsNotFound(err) {
+			// don't tell the client whether the email exists
+			return apperr.Unauthorized("Invalid credentials", nil)
+		}
+		return apperr.Internal(err)
 	}
 
 	matches, err := user.PasswordMatches(password)
 	if err != nil {
-		// internal server error
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("error validating password"))
-		return
+		return apperr.Internal(fmt.Errorf("error validating password: %w", err))
 	}
 
 	if !matches {
-		// unauthorized
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("invalid password"))
-		return
+		return apperr.Unauthorized("Invalid credentials", nil)
 	}
 
 	// did user check remember me?
@@ -65,8 +61,7 @@ func (h *Handlers) PostUserLogin(w http.ResponseWriter, r *http.Request) {
 		hasher := sha256.New()
 		_, err := hasher.Write([]byte(randomString))
 		if err != nil {
-			h.App.ErrorStatus(w, http.StatusBadRequest)
-			return
+			return apperr.Internal(err)
 		}
 
 		// insert token into db
@@ -74,8 +69,7 @@ func (h *Handlers) PostUserLogin(w http.ResponseWriter, r *http.Request) {
 		rm := data.RememberToken{}
 		err = rm.InsertToken(user.ID, sha)
 		if err != nil {
-			h.App.ErrorStatus(w, http.StatusBadRequest)
-			return
+			return apperr.Internal(err)
 		}
 
 		// set cookie
@@ -101,6 +95,7 @@ func (h *Handlers) PostUserLogin(w http.ResponseWriter, r *http.Request) {
 
 	// redirect user
 	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
 }
 
 func (h *Handlers) Logout(w http.ResponseWriter, r *http.Request) {
@@ -124,6 +119,11 @@ func (h *Handlers) Logout(w http.ResponseWriter, r *http.Request) {
 	}
 	http.SetCookie(w, &newCookie)
 
+	// tell the user's other browsers
+	if h.App.Session.Exists(r.Context(), "userID") {
+		h.notify(h.App.Session.GetInt(r.Context(), "userID"), events.Logout, struct{}{})
+	}
+
 	// renew token with the expired values
 	h.App.Session.RenewToken(r.Context())
 	h.App.Session.Remove(r.Context(), "userID")
@@ -175,25 +175,19 @@ func (h *Handlers) PostForgot(w http.ResponseWriter, r *http.Request) {
 	h.App.InfoLog.Println("Signed link is", signedLink)
 
 	// email the message
-	var data struct {
-		Link string
-	}
-
-	data.Link = signedLink
-
 	msg := mailer.Message{
 		To:       u.Email,
 		Subject:  "Password reset",
-		Template: "password-reset",
-		Data:     data,
+		Template: emails.PasswordReset,
+		Data:     emails.PasswordResetData{Link: signedLink},
 		From:     "admin@example.com",
 	}
 
-	// send to jobs queue
-	h.App.Mail.Jobs <- msg
-	res := <-h.App.Mail.Results
-	if res.Error != nil {
-		h.App.ErrorStatus(w, http.StatusBadRequest)
+	// queue it in the outbox, it is sent (and retried) in the background rather
+	// than making the user wait for the mail server. Failed mail is kept there.
+	if _, err := h.Outbox.Send(msg); err != nil {
+		h.App.ErrorLog.Println("error queueing password reset mail:", err)
+		h.App.Error500(w, r)
 		return
 	}
 
@@ -275,6 +269,8 @@ func (h *Handlers) PostResetPassword(w http.ResponseWriter, r *http.Request) {
 		h.App.Error500(w, r)
 		return
 	}
+	h.publish(webhooks.UserPasswordChanged, newUserResponse(user))
+	h.notify(user.ID, events.PasswordChanged, struct{}{})
 
 	// redirect
 	h.App.Session.Put(r.Context(), "flash", "Password reset. You can now login")
@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"myapp/apperr"
+	"myapp/bounces"
+	"myapp/data"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// maxMailEventsBody is the largest batch of events a provider can post
+const maxMailEventsBody = 5 << 20
+
+// BounceResponse is a hard bounce or spam complaint reported by a provider
+type BounceResponse struct {
+	ID        int       `json:"id" xml:"id,attr"`
+	Provider  string    `json:"provider" xml:"provider,attr"`
+	Kind      string    `json:"kind" xml:"kind,attr"`
+	Reason    string    `json:"reason" xml:",chardata"`
+	CreatedAt time.Time `json:"created_at" xml:"created_at,attr"`
+}
+
+// SuppressionResponse is an address no mail is sent to. Bounces are only
+// listed for a single suppression.
+type SuppressionResponse struct {
+	XMLName   xml.Name         `json:"-" xml:"suppression"`
+	ID        int              `json:"id" xml:"id"`
+	Email     string           `json:"email" xml:"email"`
+	UserID    *int             `json:"user_id" xml:"user_id,omitempty"`
+	Reason    string           `json:"reason" xml:"reason"`
+	ClearedAt *time.Time       `json:"cleared_at" xml:"cleared_at,omitempty"`
+	CreatedAt time.Time        `json:"created_at" xml:"created_at"`
+	UpdatedAt time.Time        `json:"updated_at" xml:"updated_at"`
+	Bounces   []BounceResponse `json:"bounces,omitempty" xml:"bounces>bounce,omitempty"`
+}
+
+// SuppressionListResponse is one page of the suppressed addresses, newest first
+type SuppressionListResponse struct {
+	XMLName      xml.Name              `json:"-" xml:"suppressions"`
+	Suppressions []SuppressionResponse `json:"suppressions" xml:"suppression"`
+	Page         int                   `json:"page" xml:"page"`
+	PerPage      int                   `json:"per_page" xml:"per_page"`
+	Total        int                   `json:"total" xml:"total"`
+	TotalPages   int                   `json:"total_pages" xml:"total_pages"`
+}
+
+func newSuppressionResponse(s *data.MailSuppression) SuppressionResponse {
+	return SuppressionResponse{
+		ID:        s.ID,
+		Email:     s.Email,
+		UserID:    s.UserID,
+		Reason:    s.Reason,
+		ClearedAt: s.ClearedAt,
+		CreatedAt: s.CreatedAt,
+		UpdatedAt: s.UpdatedAt,
+	}
+}
+
+// MailEvents takes in the bounce and complaint webhook of the {provider} in
+// the url. Only providers with credentials in .env have one.
+func (h *Handlers) MailEvents(w http.ResponseWriter, r *http.Request) error {
+	provider, ok := h.Bounces.Provider(chi.URLParam(r, "provider"))
+	if !ok {
+		return apperr.NotFound("No webhook for this provider", nil)
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMailEventsBody))
+	if err != nil {
+		return apperr.BadRequest("the body could not be read", err)
+	}
+
+	events, err := provider.Parse(r, body)
+	switch {
+	case errors.Is(err, bounces.ErrBadSignature):
+		return apperr.Unauthorized("invalid signature", err)
+	case errors.Is(err, bounces.ErrBadPayload):
+		return apperr.BadRequest("the body could not be read", err)
+	case err != nil:
+		return apperr.Internal(err)
+	}
+
+	if err := h.Bounces.Record(events); err != nil {
+		return apperr.Internal(err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// ShowMailSuppressions is the admin page for the suppressed addresses, it calls the api
+func (h *Handlers) ShowMailSuppressions(w http.ResponseWriter, r *http.Request) {
+	err := h.render(w, r, "mail-suppressions", nil, nil)
+	if err != nil {
+		h.App.ErrorLog.Println("error rendering:", err)
+	}
+}
+
+// ListMailSuppressions returns one page of the suppressed addresses
+func (h *Handlers) ListMailSuppressions(w http.ResponseWriter, r *http.Request) error {
+	page, err := queryInt(r, "page", 1)
+	if err != nil || page < 1 {
+		return apperr.BadRequest("page must be a positive number", err)
+	}
+
+	perPage, err := queryInt(r, "per_page", defaultPerPage)
+	if err != nil || perPage < 1 || perPage > maxPerPage {
+		return apperr.BadRequest(fmt.Sprintf("per_page must be between 1 and %d", maxPerPage), err)
+	}
+
+	suppressions, total, err := h.Models.MailSuppressions.GetPage(page, perPage)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	resp := SuppressionListResponse{
+		Suppressions: make([]SuppressionResponse, 0, len(suppressions)),
+		Page:         page,
+		PerPage:      perPage,
+		Total:        total,
+		TotalPages:   (total + perPage - 1) / perPage,
+	}
+	for _, s := range suppressions {
+		resp.Suppressions = append(resp.Suppressions, newSuppressionResponse(s))
+	}
+
+	return h.respond(w, r, http.StatusOK, resp, "")
+}
+
+// GetMailSuppression returns the suppression with the id in the url and the
+// address's latest bounces
+func (h *Handlers) GetMailSuppression(w http.ResponseWriter, r *http.Request) error {
+	s, err := h.suppressionFromURL(r)
+	if err != nil {
+		return err
+	}
+
+	bounced, err := h.Models.MailBounces.GetForEmail(s.Email, maxPerPage)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	resp := newSuppressionResponse(s)
+	for _, b := range bounced {
+		resp.Bounces = append(resp.Bounces, BounceResponse{
+			ID:        b.ID,
+			Provider:  b.Provider,
+			Kind:      b.Kind,
+			Reason:    b.Reason,
+			CreatedAt: b.CreatedAt,
+		})
+	}
+
+	return h.respond(w, r, http.StatusOK, resp, "")
+}
+
+// ClearMailSuppression lets mail be sent to the address again. The bounces
+// before now no longer count towards suppressing it.
+func (h *Handlers) ClearMailSuppression(w http.ResponseWriter, r *http.Request) error {
+	s, err := h.suppressionFromURL(r)
+	if err != nil {
+		return err
+	}
+
+	if err := h.Models.MailSuppressions.Clear(s.ID); err != nil {
+		if data.IsNotFound(err) {
+			return apperr.New(http.StatusConflict, "The address was already cleared", err)
+		}
+		return apperr.Internal(err)
+	}
+
+	cleared, err := h.Models.MailSuppressions.Get(s.ID)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	return h.respond(w, r, http.StatusOK, newSuppressionResponse(cleared), "")
+}
+
+// suppressionFromURL gets the suppression with the {id} url param
+func (h *Handlers) suppressionFromURL(r *http.Request) (*data.MailSuppression, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || id < 1 {
+		return nil, apperr.NotFound("Suppression not found", nil)
+	}
+
+	s, err := h.Models.MailSuppressions.Get(id)
+	if data.IsNotFound(err) {
+		return nil, apperr.NotFound("Suppression not found", err)
+	}
+	if err != nil {
+		return nil, apperr.Internal(err)
+	}
+
+	return s, nil
+}
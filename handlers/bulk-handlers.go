@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"myapp/apperr"
+	"myapp/bulk"
+	"myapp/data"
+	"myapp/webhooks"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// maxImportSize is the largest file ImportUsers reads (32mb)
+const maxImportSize = 33554432
+
+// importFormats maps the content types and file extensions an import may use to a format
+var importFormats = map[string]string{
+	"text/csv":             bulk.CSV,
+	"application/x-ndjson": bulk.NDJSON,
+	"application/jsonl":    bulk.NDJSON,
+	"application/json":     bulk.NDJSON,
+	".csv":                 bulk.CSV,
+	".ndjson":              bulk.NDJSON,
+	".jsonl":               bulk.NDJSON,
+}
+
+// Importer returns a user importer that sends the user.created webhook for every inserted user.
+// The command line import uses it too.
+func (h *Handlers) Importer(dryRun bool) *bulk.Importer {
+	return &bulk.Importer{
+		App:       h.App,
+		Store:     &h.Models.Users,
+		BatchSize: bulk.DefaultBatchSize,
+		DryRun:    dryRun,
+		Inserted: func(users []data.User) {
+			for n := range users {
+				h.publish(webhooks.UserCreated, newUserResponse(&users[n]))
+			}
+			h.purgePages("users")
+		},
+	}
+}
+
+// ImportUsers imports a csv or ndjson file of users, sent as the body or as the
+// "file" field of a multipart form. The format comes from ?format=, the content
+// type or the file name. With ?dry_run=true the rows are only validated.
+func (h *Handlers) ImportUsers(w http.ResponseWriter, r *http.Request) error {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	format := r.URL.Query().Get("format")
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	var body io.Reader = r.Body
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		reader, err := r.MultipartReader()
+		if err != nil {
+			return apperr.BadRequest("Could not read the upload", err)
+		}
+
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return apperr.BadRequest("The upload has no file field", nil)
+			}
+			if err != nil {
+				return apperr.BadRequest("Could not read the upload", err)
+			}
+			if part.FormName() == "file" {
+				body = part
+				if format == "" {
+					format = importFormats[strings.ToLower(filepath.Ext(part.FileName()))]
+				}
+				break
+			}
+		}
+	} else if format == "" {
+		format = importFormats[mediaType]
+	}
+
+	if format != bulk.CSV && format != bulk.NDJSON {
+		return apperr.New(http.StatusUnsupportedMediaType, "Upload a csv or ndjson file, or set ?format=csv or ?format=ndjson", nil)
+	}
+
+	report, err := h.Importer(dryRun).Import(body, format)
+	if err != nil {
+		var fileErr *bulk.FileError
+		if errors.As(err, &fileErr) && report.Inserted == 0 {
+			return apperr.BadRequest(fmt.Sprintf("Could not import the file: %s", err), err)
+		}
+		return apperr.New(http.StatusInternalServerError, fmt.Sprintf("The import stopped after %d users were inserted", report.Inserted), err)
+	}
+
+	return h.respond(w, r, http.StatusOK, report, "")
+}
+
+// ExportUsers streams every user as csv, ndjson or json (?format=, or the
+// Accept header). ?fields= picks the fields, password hashes are never exported.
+func (h *Handlers) ExportUsers(w http.ResponseWriter, r *http.Request) error {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		switch {
+		case strings.Contains(r.Header.Get("Accept"), "text/csv"):
+			format = bulk.CSV
+		case strings.Contains(r.Header.Get("Accept"), "application/x-ndjson"):
+			format = bulk.NDJSON
+		default:
+			format = bulk.JSON
+		}
+	}
+	if format != bulk.CSV && format != bulk.NDJSON && format != bulk.JSON {
+		return apperr.New(http.StatusNotAcceptable, "Supported formats are csv, ndjson, json", nil)
+	}
+
+	fields, err := bulk.ParseFields(r.URL.Query().Get("fields"))
+	if err != nil {
+		return apperr.BadRequest(err.Error(), err)
+	}
+
+	w.Header().Set("Content-Type", bulk.ContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="users.%s"`, format))
+
+	ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+	if err := bulk.Export(ww, &h.Models.Users, format, fields); err != nil {
+		if ww.BytesWritten() == 0 {
+			w.Header().Del("Content-Disposition")
+			return apperr.Internal(err)
+		}
+		// too late for an error response, the client gets a cut off file
+		h.App.ErrorLog.Println("error exporting users:", err)
+	}
+
+	return nil
+}
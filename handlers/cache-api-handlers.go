@@ -0,0 +1,296 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"myapp/appcache"
+	"myapp/apperr"
+	"myapp/data"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// maxCacheTTL is the longest ttl a client may set, a week
+const maxCacheTTL = 7 * 24 * 60 * 60
+
+// CacheValueRequest is the body of a cache PUT
+type CacheValueRequest struct {
+	// Value is any json value
+	Value json.RawMessage `json:"value"`
+	// TTL is the lifetime in seconds, 0 or missing keeps the value until it is deleted
+	TTL int `json:"ttl"`
+}
+
+// CacheTouchRequest is the body of a cache touch
+type CacheTouchRequest struct {
+	// TTL is the new lifetime in seconds, 0 keeps the value until it is deleted
+	TTL int `json:"ttl"`
+}
+
+// CacheKeysResponse lists cache keys
+type CacheKeysResponse struct {
+	Prefix string   `json:"prefix"`
+	Keys   []string `json:"keys"`
+	// Entries describes each key, with ?details=true
+	Entries []appcache.KeyInfo `json:"entries,omitempty"`
+}
+
+// CacheImportResponse says how many values a snapshot import saved
+type CacheImportResponse struct {
+	Imported int `json:"imported"`
+}
+
+// cacheError turns a cache store error into an api error
+func cacheError(err error) error {
+	switch {
+	case errors.Is(err, appcache.ErrNotFound):
+		return apperr.NotFound("Not found in cache", nil)
+	case errors.Is(err, appcache.ErrNoCache):
+		return apperr.New(http.StatusServiceUnavailable, "No cache is configured", err)
+	case errors.Is(err, appcache.ErrListUnsupported):
+		return apperr.New(http.StatusNotImplemented, "This cache can't list its keys", err)
+	case errors.Is(err, appcache.ErrInvalidSnapshot):
+		return apperr.New(http.StatusUnprocessableEntity, err.Error(), nil)
+	default:
+		return apperr.Internal(err)
+	}
+}
+
+// cachePrefix reads and checks the ?prefix= query param, which may be empty
+func cachePrefix(r *http.Request) (string, error) {
+	prefix := r.URL.Query().Get("prefix")
+	if prefix != "" {
+		if err := appcache.ValidKey(prefix); err != nil {
+			return "", apperr.BadRequest(fmt.Sprintf("Invalid prefix: %s", err), nil)
+		}
+	}
+
+	return prefix, nil
+}
+
+// cacheKey reads and checks the {key} url param
+func cacheKey(r *http.Request) (string, error) {
+	key := chi.URLParam(r, "key")
+	if err := appcache.ValidKey(key); err != nil {
+		return "", apperr.BadRequest(fmt.Sprintf("Invalid key: %s", err), nil)
+	}
+
+	return key, nil
+}
+
+// ListCacheKeys lists the keys in the cache namespace, ?prefix= narrows them
+// down and ?details=true adds the type, size and ttl of each
+func (h *Handlers) ListCacheKeys(w http.ResponseWriter, r *http.Request) error {
+	prefix, err := cachePrefix(r)
+	if err != nil {
+		return err
+	}
+
+	if details, _ := strconv.ParseBool(r.URL.Query().Get("details")); details {
+		entries, err := h.Cache.Describe(prefix)
+		if err != nil {
+			return cacheError(err)
+		}
+
+		keys := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			keys = append(keys, entry.Key)
+		}
+
+		return h.App.WriteJSON(w, http.StatusOK, CacheKeysResponse{Prefix: prefix, Keys: keys, Entries: entries})
+	}
+
+	keys, err := h.Cache.Keys(prefix)
+	if err != nil {
+		return cacheError(err)
+	}
+
+	return h.App.WriteJSON(w, http.StatusOK, CacheKeysResponse{Prefix: prefix, Keys: keys})
+}
+
+// CacheInfo names the cache backend, says whether it can list its keys and
+// returns the stats
+func (h *Handlers) CacheInfo(w http.ResponseWriter, r *http.Request) error {
+	return h.App.WriteJSON(w, http.StatusOK, h.Cache.Info())
+}
+
+// ExportCache downloads the values in the namespace, or those whose key starts
+// with ?prefix=, as a json snapshot
+func (h *Handlers) ExportCache(w http.ResponseWriter, r *http.Request) error {
+	prefix, err := cachePrefix(r)
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := h.Cache.Export(prefix)
+	if err != nil {
+		return cacheError(err)
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="cache-%s-%s.json"`, snapshot.Namespace, snapshot.ExportedAt.Format("20060102-150405")))
+	return h.App.WriteJSON(w, http.StatusOK, snapshot)
+}
+
+// ImportCache saves the values in a snapshot made by ExportCache
+func (h *Handlers) ImportCache(w http.ResponseWriter, r *http.Request) error {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		return apperr.New(http.StatusUnsupportedMediaType, "snapshots must be sent as application/json", nil)
+	}
+
+	var snapshot appcache.Snapshot
+	if err := h.App.ReadJSON(w, r, &snapshot); err != nil {
+		return apperr.BadRequest("Could not read the request body", err)
+	}
+
+	imported, err := h.Cache.Import(snapshot)
+	if err != nil {
+		return cacheError(err)
+	}
+
+	return h.App.WriteJSON(w, http.StatusOK, CacheImportResponse{Imported: imported})
+}
+
+// CacheStats returns the hit and miss counts of the cache api
+func (h *Handlers) CacheStats(w http.ResponseWriter, r *http.Request) error {
+	return h.App.WriteJSON(w, http.StatusOK, h.Cache.Stats())
+}
+
+// GetCacheValue returns a value and when it expires
+func (h *Handlers) GetCacheValue(w http.ResponseWriter, r *http.Request) error {
+	key, err := cacheKey(r)
+	if err != nil {
+		return err
+	}
+
+	entry, err := h.Cache.Get(key)
+	if err != nil {
+		return cacheError(err)
+	}
+
+	return h.App.WriteJSON(w, http.StatusOK, entry)
+}
+
+// PutCacheValue saves a json value, with an optional ttl in seconds. Values
+// may be any json, so the cache api only speaks json rather than using h.respond.
+func (h *Handlers) PutCacheValue(w http.ResponseWriter, r *http.Request) error {
+	key, err := cacheKey(r)
+	if err != nil {
+		return err
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		return apperr.New(http.StatusUnsupportedMediaType, "cache values must be sent as application/json", nil)
+	}
+
+	var req CacheValueRequest
+	if err := h.App.ReadJSON(w, r, &req); err != nil {
+		return apperr.BadRequest("Could not read the request body", err)
+	}
+
+	validator := data.NewValidator(h.App.Validator(nil))
+	validator.Rule(len(req.Value) > 0, "value", data.CodeRequired, "Value must be provided")
+	validator.Rule(req.TTL >= 0 && req.TTL <= maxCacheTTL, "ttl", data.CodeInvalid, fmt.Sprintf("TTL must be between 0 and %d seconds", maxCacheTTL))
+	if !validator.Valid() {
+		return apperr.Invalid(validator.Errors, validator.Codes)
+	}
+
+	existed, err := h.Cache.Has(key)
+	if err != nil {
+		return cacheError(err)
+	}
+
+	entry, err := h.Cache.Set(key, req.Value, time.Duration(req.TTL)*time.Second)
+	if err != nil {
+		return cacheError(err)
+	}
+
+	status := http.StatusCreated
+	if existed {
+		status = http.StatusOK
+	}
+
+	return h.App.WriteJSON(w, status, entry)
+}
+
+// TouchCacheValue gives a value a new ttl
+func (h *Handlers) TouchCacheValue(w http.ResponseWriter, r *http.Request) error {
+	key, err := cacheKey(r)
+	if err != nil {
+		return err
+	}
+
+	var req CacheTouchRequest
+	if err := h.App.ReadJSON(w, r, &req); err != nil {
+		return apperr.BadRequest("Could not read the request body", err)
+	}
+
+	validator := data.NewValidator(h.App.Validator(nil))
+	validator.Rule(req.TTL >= 0 && req.TTL <= maxCacheTTL, "ttl", data.CodeInvalid, fmt.Sprintf("TTL must be between 0 and %d seconds", maxCacheTTL))
+	if !validator.Valid() {
+		return apperr.Invalid(validator.Errors, validator.Codes)
+	}
+
+	entry, err := h.Cache.Touch(key, time.Duration(req.TTL)*time.Second)
+	if err != nil {
+		return cacheError(err)
+	}
+
+	return h.App.WriteJSON(w, http.StatusOK, entry)
+}
+
+// DeleteCacheValue removes a value
+func (h *Handlers) DeleteCacheValue(w http.ResponseWriter, r *http.Request) error {
+	key, err := cacheKey(r)
+	if err != nil {
+		return err
+	}
+
+	existed, err := h.Cache.Has(key)
+	if err != nil {
+		return cacheError(err)
+	}
+	if !existed {
+		return apperr.NotFound("Not found in cache", nil)
+	}
+
+	if err := h.Cache.Delete(key); err != nil {
+		return cacheError(err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// DeleteCacheValues removes every value in the namespace, those whose key
+// starts with ?prefix=, or those that match ?pattern= (eg user:*:settings)
+func (h *Handlers) DeleteCacheValues(w http.ResponseWriter, r *http.Request) error {
+	if pattern := r.URL.Query().Get("pattern"); pattern != "" {
+		if err := appcache.ValidPattern(pattern); err != nil {
+			return apperr.BadRequest(fmt.Sprintf("Invalid pattern: %s", err), nil)
+		}
+
+		if _, err := h.Cache.DeleteMatch(pattern); err != nil {
+			return cacheError(err)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	prefix, err := cachePrefix(r)
+	if err != nil {
+		return err
+	}
+
+	if err := h.Cache.DeletePrefix(prefix); err != nil {
+		return cacheError(err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
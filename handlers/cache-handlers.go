@@ -1,11 +1,40 @@
 package handlers
 
 import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"myapp/appcache"
+	"myapp/apperr"
+	"myapp/data"
+	"myapp/events"
 	"net/http"
+	"time"
 
 	"github.com/justinas/nosurf"
 )
 
+// CacheRequest is sent by the cache page, only the fields each action needs are set
+type CacheRequest struct {
+	Name string `json:"name" xml:"name"`
+	// Value is any json value. A form or xml value that isn't json is saved as a string.
+	Value json.RawMessage `json:"value,omitempty" xml:"value"`
+	// TTL is the lifetime in seconds, 0 keeps the value until it is deleted
+	TTL  int    `json:"ttl,omitempty" xml:"ttl"`
+	CSRF string `json:"csrf_token" xml:"csrf_token"`
+}
+
+// CacheResponse is written back to the cache page
+type CacheResponse struct {
+	XMLName xml.Name        `json:"-" xml:"response"`
+	Error   bool            `json:"error" xml:"error"`
+	Message string          `json:"message" xml:"message"`
+	Value   json.RawMessage `json:"value,omitempty" xml:"value,omitempty"`
+	// TTL is the number of seconds left, 0 when the value doesn't expire
+	TTL       int        `json:"ttl" xml:"ttl"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty" xml:"expires_at,omitempty"`
+}
+
 func (h *Handlers) ShowCachePage(w http.ResponseWriter, r *http.Request) {
 	err := h.render(w, r, "cache", nil, nil)
 	if err != nil {
@@ -13,167 +42,157 @@ func (h *Handlers) ShowCachePage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (h *Handlers) SaveInCache(w http.ResponseWriter, r *http.Request) {
-
-	var ok = true
-	var msg string
-
-	var userInput struct {
-		Name  string `json:"name"`
-		Value string `json:"value"`
-		CSRF  string `json:"csrf_token"`
+// ShowCacheBrowser displays the admin cache browser, which uses the /api/v1/cache api
+func (h *Handlers) ShowCacheBrowser(w http.ResponseWriter, r *http.Request) {
+	err := h.render(w, r, "cache-browser", nil, nil)
+	if err != nil {
+		h.App.ErrorLog.Println("error rendering:", err)
 	}
+}
+
+// readCacheRequest decodes the request, checks the csrf token, the ttl and,
+// when the action works on one value, the name
+func (h *Handlers) readCacheRequest(w http.ResponseWriter, r *http.Request, named bool) (CacheRequest, error) {
+	var userInput CacheRequest
 
-	// read json from client
-	err := h.App.ReadJSON(w, r, &userInput)
+	// read json (or xml or form data) from client
+	err := h.decode(w, r, &userInput)
 	if err != nil {
-		ok = false
-		msg = "Error reading json"
-		h.App.Error404(w, r)
+		return userInput, err
 	}
 
 	// verify csrf token
 	if !nosurf.VerifyToken(nosurf.Token(r), userInput.CSRF) {
-		h.App.Error500(w, r)
-		return
+		return userInput, apperr.Forbidden("Invalid csrf token", nil)
 	}
 
-	// set value in cache
-	err = h.App.Cache.Set(userInput.Name, userInput.Value)
-	if err != nil {
-		ok = false
-		msg = "Error setting values in cache"
-		h.App.Error500(w, r)
+	validator := data.NewValidator(h.App.Validator(nil))
+	if named {
+		err := appcache.ValidKey(userInput.Name)
+		validator.Rule(err == nil, "name", data.CodeInvalid, fmt.Sprintf("Invalid name: %v", err))
 	}
-
-	var resp struct {
-		Error   bool   `json:"error"`
-		Message string `json:"message"`
-	}
-
-	if !ok {
-		resp.Error = true
-		resp.Message = msg
-	} else {
-		resp.Error = false
-		resp.Message = "Saved in cache"
+	validator.Rule(userInput.TTL >= 0 && userInput.TTL <= maxCacheTTL, "ttl", data.CodeInvalid, fmt.Sprintf("TTL must be between 0 and %d seconds", maxCacheTTL))
+	if !validator.Valid() {
+		return userInput, apperr.Invalid(validator.Errors, validator.Codes)
 	}
 
-	_ = h.App.WriteJSON(w, http.StatusCreated, resp)
+	return userInput, nil
 }
 
-func (h *Handlers) GetFromCache(w http.ResponseWriter, r *http.Request) {
-	var userInput struct {
-		Name string `json:"name"`
-		CSRF string `json:"csrf_token"`
+func (h *Handlers) SaveInCache(w http.ResponseWriter, r *http.Request) error {
+	userInput, err := h.readCacheRequest(w, r, true)
+	if err != nil {
+		return err
 	}
 
-	var msg string
-	var inCache = true
+	value := userInput.Value
+	if len(value) == 0 || !json.Valid(value) {
+		value, err = json.Marshal(string(value))
+		if err != nil {
+			return apperr.Internal(err)
+		}
+	}
 
-	err := h.App.ReadJSON(w, r, &userInput)
+	// set value in cache
+	entry, err := h.Playground.Set(userInput.Name, value, time.Duration(userInput.TTL)*time.Second)
 	if err != nil {
-		h.App.Error404(w, r)
-		return
+		return apperr.New(http.StatusInternalServerError, "Error setting values in cache", err)
 	}
 
-	// verify csrf token
-	if !nosurf.VerifyToken(nosurf.Token(r), userInput.CSRF) {
-		h.App.Error500(w, r)
-		return
+	resp := CacheResponse{
+		Message:   "Saved in cache",
+		Value:     entry.Value,
+		TTL:       entry.TTL,
+		ExpiresAt: entry.ExpiresAt,
 	}
+	h.broadcastAdmins(events.CacheChanged, cacheEvent{Action: "save", Name: userInput.Name})
+
+	return h.respond(w, r, http.StatusCreated, resp, "")
+}
 
-	// save user input
-	fromCache, err := h.App.Cache.Get(userInput.Name)
+func (h *Handlers) GetFromCache(w http.ResponseWriter, r *http.Request) error {
+	userInput, err := h.readCacheRequest(w, r, true)
 	if err != nil {
-		msg = "Not found in cache"
-		inCache = false
+		return err
 	}
 
-	var resp struct {
-		Error   bool   `json:"error"`
-		Message string `json:"message"`
-		Value   string `json:"value"`
+	entry, err := h.Playground.Get(userInput.Name)
+	if err != nil {
+		return cacheError(err)
 	}
 
-	if inCache {
-		resp.Error = false
-		resp.Message = "Found in cache"
-		resp.Value = fromCache.(string)
-	} else {
-		resp.Error = true
-		resp.Message = msg
+	resp := CacheResponse{
+		Message:   "Found in cache",
+		Value:     entry.Value,
+		TTL:       entry.TTL,
+		ExpiresAt: entry.ExpiresAt,
 	}
 
 	// write json back to user
-	_ = h.App.WriteJSON(w, http.StatusOK, resp)
+	return h.respond(w, r, http.StatusOK, resp, "")
 }
 
-func (h *Handlers) DeleteFromCache(w http.ResponseWriter, r *http.Request) {
-	var userInput struct {
-		Name string `json:"name"`
-		CSRF string `json:"csrf_token"`
+// TouchCache gives a cached value a new ttl, 0 keeps it until it is deleted
+func (h *Handlers) TouchCache(w http.ResponseWriter, r *http.Request) error {
+	userInput, err := h.readCacheRequest(w, r, true)
+	if err != nil {
+		return err
 	}
 
-	err := h.App.ReadJSON(w, r, &userInput)
+	entry, err := h.Playground.Touch(userInput.Name, time.Duration(userInput.TTL)*time.Second)
 	if err != nil {
-		h.App.Error404(w, r)
-		return
+		return cacheError(err)
 	}
 
-	// verify csrf token
-	if !nosurf.VerifyToken(nosurf.Token(r), userInput.CSRF) {
-		h.App.Error500(w, r)
-		return
+	resp := CacheResponse{
+		Message:   "Expiry updated",
+		Value:     entry.Value,
+		TTL:       entry.TTL,
+		ExpiresAt: entry.ExpiresAt,
 	}
+	h.broadcastAdmins(events.CacheChanged, cacheEvent{Action: "touch", Name: userInput.Name})
+
+	return h.respond(w, r, http.StatusOK, resp, "")
+}
 
-	err = h.App.Cache.Forget(userInput.Name)
+func (h *Handlers) DeleteFromCache(w http.ResponseWriter, r *http.Request) error {
+	userInput, err := h.readCacheRequest(w, r, true)
 	if err != nil {
-		h.App.Error500(w, r)
-		return
+		return err
 	}
 
-	var resp struct {
-		Error   bool   `json:"error"`
-		Message string `json:"message"`
+	err = h.Playground.Delete(userInput.Name)
+	if err != nil {
+		return apperr.New(http.StatusInternalServerError, "Error deleting from cache", err)
 	}
 
+	var resp CacheResponse
+
 	resp.Error = false
 	resp.Message = "Deleted from cache (if it existed)"
+	h.broadcastAdmins(events.CacheChanged, cacheEvent{Action: "delete", Name: userInput.Name})
 
-	_ = h.App.WriteJSON(w, http.StatusOK, resp)
+	return h.respond(w, r, http.StatusOK, resp, "")
 }
 
-func (h *Handlers) EmptyCache(w http.ResponseWriter, r *http.Request) {
-	var userInput struct {
-		CSRF string `json:"csrf_token"`
-	}
-
-	err := h.App.ReadJSON(w, r, &userInput)
+// EmptyCache deletes everything saved through the cache page, the rest of the
+// cache (eg the api's values and idempotency records) is left alone
+func (h *Handlers) EmptyCache(w http.ResponseWriter, r *http.Request) error {
+	_, err := h.readCacheRequest(w, r, false)
 	if err != nil {
-		h.App.Error404(w, r)
-		return
+		return err
 	}
 
-	// verify csrf token
-	if !nosurf.VerifyToken(nosurf.Token(r), userInput.CSRF) {
-		h.App.Error500(w, r)
-		return
-	}
-
-	err = h.App.Cache.Empty()
+	err = h.Playground.DeletePrefix("")
 	if err != nil {
-		h.App.Error500(w, r)
-		return
+		return apperr.New(http.StatusInternalServerError, "Error emptying cache", err)
 	}
 
-	var resp struct {
-		Error   bool   `json:"error"`
-		Message string `json:"message"`
-	}
+	var resp CacheResponse
 
 	resp.Error = false
 	resp.Message = "Cache dumped"
+	h.broadcastAdmins(events.CacheChanged, cacheEvent{Action: "empty"})
 
-	_ = h.App.WriteJSON(w, http.StatusOK, resp)
+	return h.respond(w, r, http.StatusOK, resp, "")
 }
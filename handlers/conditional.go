@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"myapp/apperr"
+	"myapp/middleware"
+	"net/http"
+	"time"
+)
+
+// setVersion sets the ETag and Last-Modified headers of a single resource
+func setVersion(w http.ResponseWriter, etag string, modified time.Time) {
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModified sets the version headers and writes a 304 when the client's copy is
+// still fresh. The handler must stop when it returns true.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	setVersion(w, etag, modified)
+
+	fresh := false
+	if r.Header.Get("If-None-Match") != "" {
+		fresh = middleware.NoneMatch(r, etag)
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.IsZero() {
+		// http dates only have second precision
+		fresh = !modified.Truncate(time.Second).After(since)
+	}
+
+	if fresh {
+		w.WriteHeader(http.StatusNotModified)
+	}
+
+	return fresh
+}
+
+// precondition returns a 412 when If-Match or If-Unmodified-Since show the
+// client is writing over a version it has not seen. etags are the current
+// version's etags, one per representation; If-Match may hold any of them.
+func precondition(r *http.Request, etags []string, modified time.Time) error {
+	if ifMatchFails(r, etags) {
+		return apperr.New(http.StatusPreconditionFailed, "The resource was changed since you last fetched it", nil)
+	}
+
+	if r.Header.Get("If-Match") == "" {
+		since, err := http.ParseTime(r.Header.Get("If-Unmodified-Since"))
+		if err == nil && modified.Truncate(time.Second).After(since) {
+			return apperr.New(http.StatusPreconditionFailed, "The resource was changed since you last fetched it", nil)
+		}
+	}
+
+	return nil
+}
+
+// ifMatchFails reports whether If-Match matches none of etags
+func ifMatchFails(r *http.Request, etags []string) bool {
+	for _, etag := range etags {
+		if !middleware.IfMatchFails(r, etag) {
+			return false
+		}
+	}
+
+	return len(etags) > 0
+}
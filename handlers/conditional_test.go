@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"myapp/data"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPrecondition_AnyRepresentation(t *testing.T) {
+	u := &data.User{ID: 1, UpdatedAt: time.Unix(5, 0)}
+	if u.ETag(formatJSON) == u.ETag(formatXML) {
+		t.Fatal("expected a different etag per format")
+	}
+
+	for _, ifMatch := range []string{u.ETag(formatJSON), u.ETag(formatXML)} {
+		req := httptest.NewRequest("PUT", "/api/v1/users/1", nil)
+		req.Header.Set("If-Match", ifMatch)
+		if err := precondition(req, userETags(u), u.UpdatedAt); err != nil {
+			t.Errorf("%s: expected a match, got %v", ifMatch, err)
+		}
+	}
+
+	req := httptest.NewRequest("PUT", "/api/v1/users/1", nil)
+	req.Header.Set("If-Match", `"user-1-4-json"`)
+	if err := precondition(req, userETags(u), u.UpdatedAt); err == nil {
+		t.Error("expected a stale etag to fail")
+	}
+}
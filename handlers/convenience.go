@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"context"
+	"myapp/middleware"
 	"net/http"
 
 	"github.com/cmd-ctrl-q/celeritas"
@@ -12,6 +13,13 @@ func (h *Handlers) render(w http.ResponseWriter, r *http.Request, tmpl string, v
 	return h.App.Render.Page(w, r, tmpl, variables, data)
 }
 
+// purgePages drops the cached pages tagged with any of tags, call it after writing the models they show
+func (h *Handlers) purgePages(tags ...string) {
+	if err := middleware.PurgePages(h.App.Cache, tags...); err != nil {
+		h.App.ErrorLog.Println("error purging pages:", err)
+	}
+}
+
 // put is an alias to add key-value to a session
 func (h *Handlers) put(ctx context.Context, key string, val interface{}) {
 	h.App.Session.Put(ctx, key, val)
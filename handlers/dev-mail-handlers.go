@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"errors"
+	"myapp/emails"
+	"net/http"
+	"strconv"
+
+	"github.com/CloudyKit/jet/v6"
+	"github.com/go-chi/chi/v5"
+)
+
+// DevMail lists the mail caught in development, with the message picked by
+// ?id= (the newest by default) and the templates that can be previewed
+func (h *Handlers) DevMail(w http.ResponseWriter, r *http.Request) {
+	messages := h.MailCatcher.All()
+
+	var selected *emails.Caught
+	if id, err := strconv.Atoi(r.URL.Query().Get("id")); err == nil {
+		selected, _ = h.MailCatcher.Get(id)
+	} else if len(messages) > 0 {
+		selected = messages[0]
+	}
+
+	templates, err := emails.Names(h.MailCatcher.Templates)
+	if err != nil {
+		h.App.ErrorLog.Println("error listing mail templates:", err)
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("messages", messages)
+	vars.Set("selected", selected)
+	vars.Set("templates", templates)
+
+	err = h.render(w, r, "dev-mail", vars, nil)
+	if err != nil {
+		h.App.ErrorLog.Println("error rendering:", err)
+	}
+}
+
+// DevMailHTML writes out the html of a caught message, for the preview frame
+func (h *Handlers) DevMailHTML(w http.ResponseWriter, r *http.Request) {
+	msg, ok := h.caughtFromURL(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	writeMailPreview(w, "text/html", msg.HTML)
+}
+
+// DevMailPlain writes out the plain text of a caught message
+func (h *Handlers) DevMailPlain(w http.ResponseWriter, r *http.Request) {
+	msg, ok := h.caughtFromURL(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	writeMailPreview(w, "text/plain", msg.Plain)
+}
+
+// ClearDevMail forgets every caught message
+func (h *Handlers) ClearDevMail(w http.ResponseWriter, r *http.Request) {
+	h.MailCatcher.Clear()
+	http.Redirect(w, r, "/dev/mail", http.StatusSeeOther)
+}
+
+// PreviewMail renders a mail template with its fixture data without sending
+// anything, as html or with ?format=plain as plain text
+func (h *Handlers) PreviewMail(w http.ResponseWriter, r *http.Request) {
+	html, plain, err := h.Emails.Preview(chi.URLParam(r, "template"))
+	if errors.Is(err, emails.ErrNoTemplate) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		// a broken template is what the preview is for, so show the error
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "plain" {
+		writeMailPreview(w, "text/plain", plain)
+		return
+	}
+	writeMailPreview(w, "text/html", html)
+}
+
+// caughtFromURL gets the caught message with the {id} url param
+func (h *Handlers) caughtFromURL(r *http.Request) (*emails.Caught, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return nil, false
+	}
+
+	return h.MailCatcher.Get(id)
+}
+
+// writeMailPreview writes a message body. Mail never runs scripts, so the
+// sandbox keeps a preview from running any either.
+func writeMailPreview(w http.ResponseWriter, contentType, body string) {
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "sandbox allow-popups allow-popups-to-escape-sandbox")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write([]byte(body))
+}
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"myapp/apperr"
+	"myapp/data"
+	"myapp/middleware"
+	"net/http"
+
+	"github.com/CloudyKit/jet/v6"
+	"github.com/cmd-ctrl-q/celeritas/urlsigner"
+)
+
+// EmailPreference is whether the user gets mail in one category
+type EmailPreference struct {
+	Category   string `json:"category" xml:"category,attr"`
+	Subscribed bool   `json:"subscribed" xml:"subscribed,attr"`
+}
+
+// EmailPreferencesResponse is every category the user can opt out of
+type EmailPreferencesResponse struct {
+	XMLName     xml.Name          `json:"-" xml:"email_preferences"`
+	Preferences []EmailPreference `json:"preferences" xml:"preference"`
+}
+
+// EmailPreferencesRequest changes the categories in it, the others are left as they are
+type EmailPreferencesRequest struct {
+	XMLName     xml.Name          `json:"-" xml:"email_preferences"`
+	Preferences []EmailPreference `json:"preferences" xml:"preference"`
+}
+
+// Unsubscribe shows the page a signed unsubscribe link opens. It only asks
+// to confirm, so a mail scanner following the link doesn't unsubscribe anyone.
+func (h *Handlers) Unsubscribe(w http.ResponseWriter, r *http.Request) error {
+	category, err := h.unsubscribeLink(r)
+	if err != nil {
+		return err
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("email", r.URL.Query().Get("email"))
+	vars.Set("category", category)
+	vars.Set("action", r.RequestURI)
+	vars.Set("done", false)
+
+	return h.render(w, r, "unsubscribe", vars, nil)
+}
+
+// PostUnsubscribe unsubscribes the link's address from its category
+func (h *Handlers) PostUnsubscribe(w http.ResponseWriter, r *http.Request) error {
+	category, err := h.unsubscribeLink(r)
+	if err != nil {
+		return err
+	}
+
+	if err := h.unsubscribe(r.URL.Query().Get("email"), category); err != nil {
+		return err
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("email", r.URL.Query().Get("email"))
+	vars.Set("category", category)
+	vars.Set("done", true)
+
+	return h.render(w, r, "unsubscribe", vars, nil)
+}
+
+// OneClickUnsubscribe is the RFC 8058 List-Unsubscribe-Post target. Mail
+// clients post to it without a session or csrf token, the signature is enough.
+func (h *Handlers) OneClickUnsubscribe(w http.ResponseWriter, r *http.Request) error {
+	category, err := h.unsubscribeLink(r)
+	if err != nil {
+		return err
+	}
+
+	if err := h.unsubscribe(r.URL.Query().Get("email"), category); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// GetEmailPreferences lists the categories the user gets mail in
+func (h *Handlers) GetEmailPreferences(w http.ResponseWriter, r *http.Request) error {
+	u, ok := middleware.UserFromContext(r.Context())
+	if !ok {
+		return apperr.Unauthorized("invalid authentication credentials", nil)
+	}
+
+	return h.respondEmailPreferences(w, r, u.ID)
+}
+
+// UpdateEmailPreferences subscribes the user to categories or unsubscribes them
+func (h *Handlers) UpdateEmailPreferences(w http.ResponseWriter, r *http.Request) error {
+	u, ok := middleware.UserFromContext(r.Context())
+	if !ok {
+		return apperr.Unauthorized("invalid authentication credentials", nil)
+	}
+
+	var req EmailPreferencesRequest
+	if err := h.decode(w, r, &req); err != nil {
+		return err
+	}
+
+	validator := data.NewValidator(h.App.Validator(nil))
+	for _, pref := range req.Preferences {
+		validator.Rule(data.ValidEmailCategory(pref.Category), "category", data.CodeInvalid, "Unknown email category "+pref.Category)
+	}
+	if !validator.Valid() {
+		return apperr.Invalid(validator.Errors, validator.Codes)
+	}
+
+	for _, pref := range req.Preferences {
+		if err := h.Models.EmailPreferences.Set(u.ID, pref.Category, pref.Subscribed); err != nil {
+			return apperr.Internal(err)
+		}
+	}
+
+	return h.respondEmailPreferences(w, r, u.ID)
+}
+
+func (h *Handlers) respondEmailPreferences(w http.ResponseWriter, r *http.Request, userID int) error {
+	prefs, err := h.Models.EmailPreferences.GetForUser(userID)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	resp := EmailPreferencesResponse{Preferences: []EmailPreference{}}
+	for _, category := range data.EmailCategories {
+		resp.Preferences = append(resp.Preferences, EmailPreference{Category: category, Subscribed: prefs[category]})
+	}
+
+	return h.respond(w, r, http.StatusOK, resp, "")
+}
+
+// unsubscribeLink checks the request's url was signed by emails.UnsubscribeURL
+// and returns its category. The links don't expire, old mail keeps working.
+func (h *Handlers) unsubscribeLink(r *http.Request) (string, error) {
+	signer := urlsigner.Signer{
+		Secret: []byte(h.App.EncryptionKey),
+	}
+
+	if !signer.VerifyToken(h.App.Server.URL + r.RequestURI) {
+		return "", apperr.Forbidden("invalid unsubscribe link", nil)
+	}
+
+	category := r.URL.Query().Get("category")
+	if !data.ValidEmailCategory(category) {
+		return "", apperr.BadRequest("unknown email category", nil)
+	}
+
+	return category, nil
+}
+
+// unsubscribe opts the address out of category. An address that isn't a
+// user's gets no mail that could be opted out of, so there is nothing to do.
+func (h *Handlers) unsubscribe(email, category string) error {
+	u, err := h.Models.Users.GetByEmail(email)
+	if data.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	if err := h.Models.EmailPreferences.Set(u.ID, category, false); err != nil {
+		return apperr.Internal(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"myapp/apperr"
+	"myapp/middleware"
+	"net/http"
+)
+
+// EventStream streams the signed in user's events to the browser, see public/js/events.js
+func (h *Handlers) EventStream(w http.ResponseWriter, r *http.Request) error {
+	u, ok := middleware.UserFromContext(r.Context())
+	if !ok {
+		return apperr.Unauthorized("invalid authentication credentials", nil)
+	}
+
+	err := h.Events.Serve(w, r, u.ID, h.Admins.IsAdmin(u.Email))
+	if err != nil {
+		return apperr.New(http.StatusServiceUnavailable, "Events are not available", err)
+	}
+
+	return nil
+}
+
+// notify sends an event to one user's browsers
+func (h *Handlers) notify(userID int, event string, payload interface{}) {
+	if h.Events == nil {
+		return
+	}
+	if err := h.Events.Publish(userID, event, payload); err != nil {
+		h.App.ErrorLog.Println("error publishing", event, "event:", err)
+	}
+}
+
+// broadcastAdmins sends an event to every signed in admin's browsers
+func (h *Handlers) broadcastAdmins(event string, payload interface{}) {
+	if h.Events == nil {
+		return
+	}
+	if err := h.Events.BroadcastAdmins(event, payload); err != nil {
+		h.App.ErrorLog.Println("error broadcasting", event, "event:", err)
+	}
+}
+
+// cacheEvent is the payload of events.CacheChanged
+type cacheEvent struct {
+	Action string `json:"action"`
+	Name   string `json:"name,omitempty"`
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"fmt"
+	"myapp/apperr"
 	"myapp/data"
 	"net/http"
 
@@ -11,7 +12,7 @@ import (
 // display the form
 func (h *Handlers) Form(w http.ResponseWriter, r *http.Request) {
 	vars := make(jet.VarMap)
-	validator := h.App.Validator(nil)
+	validator := data.NewValidator(h.App.Validator(nil))
 	vars.Set("validator", validator)
 	vars.Set("user", data.User{})
 
@@ -21,35 +22,35 @@ func (h *Handlers) Form(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// submit form and validate data
-func (h *Handlers) PostForm(w http.ResponseWriter, r *http.Request) {
+// submit form and validate data, using the same rules as the api
+func (h *Handlers) PostForm(w http.ResponseWriter, r *http.Request) error {
 	err := r.ParseForm()
 	if err != nil {
-		h.App.ErrorLog.Println(err)
-		return
+		return apperr.BadRequest("Could not read the form", err)
 	}
 
-	validator := h.App.Validator(nil)
-	validator.Required(r, "first_name", "last_name", "email")
-	validator.IsEmail("email", r.Form.Get("email"))
+	var user data.User
+	user.FirstName = r.Form.Get("first_name")
+	user.LastName = r.Form.Get("last_name")
+	user.Email = r.Form.Get("email")
 
-	validator.Check(len(r.Form.Get("first_name")) > 1, "first_name", "Must be at least two characters")
-	validator.Check(len(r.Form.Get("last_name")) > 1, "last_name", "Must be at least two characters")
+	validator := data.NewValidator(h.App.Validator(r.PostForm))
+	user.Validate(validator)
 
 	if !validator.Valid() {
+		// fetch and api clients get the 422 json errors
+		if apperr.WantsJSON(r) {
+			return apperr.Invalid(validator.Errors, validator.Codes)
+		}
+
 		vars := make(jet.VarMap)
 		vars.Set("validator", validator)
-		var user data.User
-		user.FirstName = r.Form.Get("first_name")
-		user.LastName = r.Form.Get("last_name")
-		user.Email = r.Form.Get("email")
 		vars.Set("user", user)
 
-		if err := h.App.Render.Page(w, r, "form", vars, nil); err != nil {
-			h.App.ErrorLog.Println(err)
-			return
-		}
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return h.App.Render.Page(w, r, "form", vars, nil)
 	}
 
 	fmt.Fprint(w, "valid data")
+	return nil
 }
@@ -0,0 +1,425 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"myapp/apperr"
+	"myapp/data"
+	"myapp/gql"
+	"myapp/middleware"
+	"net/http"
+	"time"
+
+	"github.com/graphql-go/graphql"
+)
+
+// tokensPerUser is the guess used for the complexity of a user's tokens
+const tokensPerUser = 5
+
+type contextKey string
+
+const tokenLoaderKey contextKey = "graphql_token_loader"
+
+// graphQLSizes are the list fields the complexity limit multiplies by
+var graphQLSizes = gql.ListSizes{
+	"users": func(args map[string]interface{}) int {
+		return gql.IntArg(args, "perPage", defaultPerPage)
+	},
+	"tokens": func(args map[string]interface{}) int {
+		return tokensPerUser
+	},
+}
+
+// GraphQL runs a graphql query or mutation for the authenticated user. GET
+// may only run queries. POST must be json, so a form on another site can't
+// send it with the user's session cookie.
+func (h *Handlers) GraphQL(w http.ResponseWriter, r *http.Request) error {
+	var req gql.Request
+
+	switch r.Method {
+	case http.MethodGet:
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		req.ReadOnly = true
+		if vars := r.URL.Query().Get("variables"); vars != "" {
+			if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+				return apperr.BadRequest("variables must be a json object", err)
+			}
+		}
+	case http.MethodPost:
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType != "application/json" {
+			return apperr.New(http.StatusUnsupportedMediaType, "graphql requests must be application/json", nil)
+		}
+		if err := h.App.ReadJSON(w, r, &req); err != nil {
+			return apperr.BadRequest("Could not read the request body", err)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		return apperr.New(http.StatusMethodNotAllowed, "", nil)
+	}
+
+	if req.Query == "" {
+		return apperr.BadRequest("query must be provided", nil)
+	}
+
+	schema, err := h.graphQLSchema()
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	// one loader per request, so tokens are batched across the whole response
+	ctx := context.WithValue(r.Context(), tokenLoaderKey, gql.NewLoader(h.tokensForUsers))
+
+	result, ran := gql.Execute(ctx, schema, h.GraphQLConfig, graphQLSizes, req)
+	status := http.StatusOK
+	if !ran {
+		status = http.StatusBadRequest
+	}
+
+	return h.App.WriteJSON(w, status, result)
+}
+
+// graphQLSchema builds the schema the first time it is needed
+func (h *Handlers) graphQLSchema() (graphql.Schema, error) {
+	h.graphQLOnce.Do(func() {
+		h.graphQL, h.graphQLErr = h.newGraphQLSchema()
+	})
+
+	return h.graphQL, h.graphQLErr
+}
+
+func (h *Handlers) newGraphQLSchema() (graphql.Schema, error) {
+	tokenType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Token",
+		Description: "An api token. The token itself is only shown when it is created.",
+		Fields: graphql.Fields{
+			"id":        tokenField(graphql.NewNonNull(graphql.Int), func(t *data.Token) interface{} { return t.ID }),
+			"userId":    tokenField(graphql.NewNonNull(graphql.Int), func(t *data.Token) interface{} { return t.UserID }),
+			"expires":   tokenField(graphql.NewNonNull(graphql.DateTime), func(t *data.Token) interface{} { return t.Expires }),
+			"createdAt": tokenField(graphql.NewNonNull(graphql.DateTime), func(t *data.Token) interface{} { return t.CreatedAt }),
+			"updatedAt": tokenField(graphql.NewNonNull(graphql.DateTime), func(t *data.Token) interface{} { return t.UpdatedAt }),
+		},
+	})
+
+	userType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"id":        userField(graphql.NewNonNull(graphql.Int), func(u *data.User) interface{} { return u.ID }),
+			"firstName": userField(graphql.NewNonNull(graphql.String), func(u *data.User) interface{} { return u.FirstName }),
+			"lastName":  userField(graphql.NewNonNull(graphql.String), func(u *data.User) interface{} { return u.LastName }),
+			"email":     userField(graphql.NewNonNull(graphql.String), func(u *data.User) interface{} { return u.Email }),
+			"active":    userField(graphql.NewNonNull(graphql.Boolean), func(u *data.User) interface{} { return u.Active == 1 }),
+			"createdAt": userField(graphql.NewNonNull(graphql.DateTime), func(u *data.User) interface{} { return u.CreatedAt }),
+			"updatedAt": userField(graphql.NewNonNull(graphql.DateTime), func(u *data.User) interface{} { return u.UpdatedAt }),
+			"tokens": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(tokenType))),
+				Description: "The user's api tokens, loaded for every user in the response with one query. Empty for anyone but the caller, unless the caller is an admin.",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					u := p.Source.(*data.User)
+					if h.mayChangeUser(p.Context, u.ID) != nil {
+						return []*data.Token{}, nil
+					}
+					loader, ok := p.Context.Value(tokenLoaderKey).(*gql.Loader)
+					if !ok {
+						return nil, errors.New("graphql: no token loader in the context")
+					}
+
+					load := loader.Load(u.ID)
+					return func() (interface{}, error) {
+						tokens, err := load()
+						if err != nil {
+							return nil, h.graphQLError(err)
+						}
+						if tokens == nil {
+							return []*data.Token{}, nil
+						}
+						return tokens, nil
+					}, nil
+				},
+			},
+		},
+	})
+
+	userPageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "UserPage",
+		Fields: graphql.Fields{
+			"nodes":      &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(userType)))},
+			"page":       &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"perPage":    &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"total":      &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"totalPages": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		},
+	})
+
+	newTokenType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "NewToken",
+		Fields: graphql.Fields{
+			"token":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"expires": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+		},
+	})
+
+	userInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "UserInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"firstName": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"lastName":  &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"email":     &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"active":    &graphql.InputObjectFieldConfig{Type: graphql.Boolean},
+			"password": &graphql.InputObjectFieldConfig{
+				Type:        graphql.String,
+				Description: "required when creating a user, the password is left alone on update when it is empty",
+			},
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"me": &graphql.Field{
+				Type:        graphql.NewNonNull(userType),
+				Description: "The authenticated user",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					u, ok := middleware.UserFromContext(p.Context)
+					if !ok {
+						return nil, h.graphQLError(apperr.Unauthorized("invalid authentication credentials", nil))
+					}
+					return u, nil
+				},
+			},
+			"user": &graphql.Field{
+				Type:        userType,
+				Description: "A user by id, null if there is none",
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					u, err := h.Models.Users.Get(p.Args["id"].(int))
+					if err != nil {
+						if data.IsNotFound(err) {
+							return nil, nil
+						}
+						return nil, h.graphQLError(err)
+					}
+					return u, nil
+				},
+			},
+			"users": &graphql.Field{
+				Type:        graphql.NewNonNull(userPageType),
+				Description: "A page of users ordered by last name",
+				Args: graphql.FieldConfigArgument{
+					"page":    &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 1},
+					"perPage": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: defaultPerPage},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					page, perPage := p.Args["page"].(int), p.Args["perPage"].(int)
+					if page < 1 {
+						return nil, h.graphQLError(apperr.BadRequest("page must be a positive number", nil))
+					}
+					if perPage < 1 || perPage > maxPerPage {
+						return nil, h.graphQLError(apperr.BadRequest(fmt.Sprintf("perPage must be between 1 and %d", maxPerPage), nil))
+					}
+
+					users, total, err := h.Models.Users.GetPage(page, perPage)
+					if err != nil {
+						return nil, h.graphQLError(err)
+					}
+
+					return map[string]interface{}{
+						"nodes":      users,
+						"page":       page,
+						"perPage":    perPage,
+						"total":      total,
+						"totalPages": (total + perPage - 1) / perPage,
+					}, nil
+				},
+			},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createUser": &graphql.Field{
+				Type: graphql.NewNonNull(userType),
+				Args: graphql.FieldConfigArgument{
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(userInput)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					u, err := h.createUser(userRequestFromInput(p.Args["input"]))
+					if err != nil {
+						return nil, h.graphQLError(err)
+					}
+					return u, nil
+				},
+			},
+			"updateUser": &graphql.Field{
+				Type: graphql.NewNonNull(userType),
+				Args: graphql.FieldConfigArgument{
+					"id":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(userInput)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id := p.Args["id"].(int)
+					if err := h.mayChangeUser(p.Context, id); err != nil {
+						return nil, h.graphQLError(err)
+					}
+
+					u, err := h.userByID(id)
+					if err != nil {
+						return nil, h.graphQLError(err)
+					}
+					updated, err := h.updateUser(u, userRequestFromInput(p.Args["input"]))
+					if err != nil {
+						return nil, h.graphQLError(err)
+					}
+					return updated, nil
+				},
+			},
+			"deleteUser": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Boolean),
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id := p.Args["id"].(int)
+					if err := h.mayChangeUser(p.Context, id); err != nil {
+						return nil, h.graphQLError(err)
+					}
+
+					u, err := h.userByID(id)
+					if err != nil {
+						return nil, h.graphQLError(err)
+					}
+					if err := h.deleteUser(u); err != nil {
+						return nil, h.graphQLError(err)
+					}
+
+					return true, nil
+				},
+			},
+			"createToken": &graphql.Field{
+				Type:        graphql.NewNonNull(newTokenType),
+				Description: "Creates an api token for the authenticated user, replacing their existing tokens",
+				Args: graphql.FieldConfigArgument{
+					"ttlHours": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 24},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					u, ok := middleware.UserFromContext(p.Context)
+					if !ok {
+						return nil, h.graphQLError(apperr.Unauthorized("invalid authentication credentials", nil))
+					}
+
+					hours := p.Args["ttlHours"].(int)
+					if hours < 1 || hours > 24*365 {
+						return nil, h.graphQLError(apperr.BadRequest("ttlHours must be between 1 and 8760", nil))
+					}
+
+					token, err := h.Models.Tokens.GenerateToken(u.ID, time.Duration(hours)*time.Hour)
+					if err != nil {
+						return nil, h.graphQLError(err)
+					}
+					if err := h.Models.Tokens.Insert(*token, *u); err != nil {
+						return nil, h.graphQLError(err)
+					}
+
+					return map[string]interface{}{"token": token.PlainText, "expires": token.Expires}, nil
+				},
+			},
+			"deleteToken": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Boolean),
+				Description: "Deletes one of the authenticated user's tokens",
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					u, ok := middleware.UserFromContext(p.Context)
+					if !ok {
+						return nil, h.graphQLError(apperr.Unauthorized("invalid authentication credentials", nil))
+					}
+
+					token, err := h.Models.Tokens.Get(p.Args["id"].(int))
+					if err != nil || token.UserID != u.ID {
+						if err == nil || data.IsNotFound(err) {
+							return nil, h.graphQLError(apperr.NotFound("Token not found", nil))
+						}
+						return nil, h.graphQLError(err)
+					}
+
+					if err := h.Models.Tokens.Delete(token.ID); err != nil {
+						return nil, h.graphQLError(err)
+					}
+
+					return true, nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query:    query,
+		Mutation: mutation,
+	})
+}
+
+// tokensForUsers is the batch function of the token loader
+func (h *Handlers) tokensForUsers(ids []int) (map[int]interface{}, error) {
+	byUser, err := h.Models.Tokens.GetTokensForUsers(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[int]interface{}, len(byUser))
+	for id, tokens := range byUser {
+		values[id] = tokens
+	}
+
+	return values, nil
+}
+
+// graphQLError logs server errors and hides their cause from the client, like apperr.Write
+func (h *Handlers) graphQLError(err error) error {
+	e := apperr.From(err)
+	if e.Status >= http.StatusInternalServerError {
+		h.App.ErrorLog.Println("graphql:", e)
+	}
+
+	return gql.FromError(e)
+}
+
+func userRequestFromInput(input interface{}) UserRequest {
+	in, _ := input.(map[string]interface{})
+
+	var req UserRequest
+	req.FirstName, _ = in["firstName"].(string)
+	req.LastName, _ = in["lastName"].(string)
+	req.Email, _ = in["email"].(string)
+	req.Password, _ = in["password"].(string)
+	if active, ok := in["active"].(bool); ok {
+		req.Active = &active
+	}
+
+	return req
+}
+
+func userField(t graphql.Output, get func(u *data.User) interface{}) *graphql.Field {
+	return &graphql.Field{
+		Type: t,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return get(p.Source.(*data.User)), nil
+		},
+	}
+}
+
+func tokenField(t graphql.Output, get func(t *data.Token) interface{}) *graphql.Field {
+	return &graphql.Field{
+		Type: t,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return get(p.Source.(*data.Token)), nil
+		},
+	}
+}
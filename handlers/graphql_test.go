@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"myapp/data"
+	"myapp/gql"
+	"myapp/middleware"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/cmd-ctrl-q/celeritas"
+	"github.com/graphql-go/graphql"
+)
+
+type graphQLResponse struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []struct {
+		Message    string                 `json:"message"`
+		Extensions map[string]interface{} `json:"extensions"`
+	} `json:"errors"`
+}
+
+func graphQLGet(t *testing.T, h *Handlers, query string) (int, graphQLResponse) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/graphql?query="+url.QueryEscape(query), nil)
+	req = req.WithContext(middleware.WithUser(req.Context(), &data.User{ID: 7, FirstName: "Some", Email: "me@here.com", Active: 1}))
+	rr := httptest.NewRecorder()
+
+	if err := h.GraphQL(rr, req); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp graphQLResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal("response is not json:", err, rr.Body.String())
+	}
+
+	return rr.Code, resp
+}
+
+func TestHandlers_GraphQL(t *testing.T) {
+	h := &Handlers{
+		App:           &celeritas.Celeritas{ErrorLog: log.New(io.Discard, "", 0)},
+		GraphQLConfig: gql.Config{MaxDepth: 4, MaxComplexity: 100},
+	}
+
+	status, resp := graphQLGet(t, h, `{ me { id firstName email active } }`)
+	if status != http.StatusOK || len(resp.Errors) != 0 {
+		t.Fatalf("me: expected 200 without errors, got %d %v", status, resp.Errors)
+	}
+	me := resp.Data["me"].(map[string]interface{})
+	if me["id"] != float64(7) || me["email"] != "me@here.com" || me["active"] != true {
+		t.Error("me: wrong user", me)
+	}
+
+	status, resp = graphQLGet(t, h, `mutation { deleteUser(id: 7) }`)
+	if status != http.StatusBadRequest || len(resp.Errors) != 1 || resp.Errors[0].Extensions["code"] != "METHOD_NOT_ALLOWED" {
+		t.Errorf("mutation over GET: expected a 400 METHOD_NOT_ALLOWED, got %d %v", status, resp.Errors)
+	}
+
+	status, resp = graphQLGet(t, h, `{ users(perPage: 100) { nodes { id tokens { id } } } }`)
+	if status != http.StatusBadRequest || len(resp.Errors) != 1 || resp.Errors[0].Extensions["code"] != "QUERY_TOO_COMPLEX" {
+		t.Errorf("expensive query: expected a 400 QUERY_TOO_COMPLEX, got %d %v", status, resp.Errors)
+	}
+
+	status, resp = graphQLGet(t, h, `{ me { password } }`)
+	if status != http.StatusBadRequest || len(resp.Errors) == 0 {
+		t.Errorf("unknown field: expected a 400, got %d %v", status, resp.Errors)
+	}
+}
+
+func TestHandlers_GraphQLOtherUsers(t *testing.T) {
+	h := &Handlers{
+		App:           &celeritas.Celeritas{ErrorLog: log.New(io.Discard, "", 0)},
+		GraphQLConfig: gql.Config{MaxDepth: 4, MaxComplexity: 100},
+	}
+	schema, err := h.graphQLSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := middleware.WithUser(context.Background(), &data.User{ID: 7, Email: "me@here.com", Active: 1})
+
+	for _, mutation := range []string{
+		`mutation { deleteUser(id: 8) }`,
+		`mutation { updateUser(id: 8, input: {firstName: "A", lastName: "B", email: "admin@here.com"}) { id } }`,
+	} {
+		result := graphql.Do(graphql.Params{Schema: schema, RequestString: mutation, Context: ctx})
+		if len(result.Errors) != 1 || result.Errors[0].Extensions["code"] != "FORBIDDEN" {
+			t.Errorf("%s: expected FORBIDDEN, got %v", mutation, result.Errors)
+		}
+	}
+}
@@ -1,18 +1,49 @@
 package handlers
 
 import (
+	"encoding/xml"
 	"fmt"
+	"myapp/appcache"
+	"myapp/bounces"
 	"myapp/data"
+	"myapp/emails"
+	"myapp/events"
+	"myapp/gql"
+	"myapp/middleware"
+	"myapp/outbox"
+	"myapp/webhooks"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/CloudyKit/jet/v6"
 	"github.com/cmd-ctrl-q/celeritas"
+	"github.com/graphql-go/graphql"
 )
 
 type Handlers struct {
-	App    *celeritas.Celeritas
-	Models data.Models
+	App      *celeritas.Celeritas
+	Models   data.Models
+	Webhooks *webhooks.Dispatcher
+	Outbox   *outbox.Outbox
+	Bounces  *bounces.Ingester
+	Emails   *emails.Renderer
+	// MailCatcher keeps the mail sent in development, it is nil otherwise
+	MailCatcher *emails.Catcher
+	Events      *events.Hub
+	// Admins says who gets the admin events, the same admins the api lets in
+	Admins middleware.AdminConfig
+	Cache  *appcache.Store
+	// Playground is the anonymous cache page's store, in a namespace of its own
+	Playground    *appcache.Store
+	GraphQLConfig gql.Config
+
+	// the graphql schema is built on the first request
+	graphQLOnce sync.Once
+	graphQL     graphql.Schema
+	graphQLErr  error
 }
 
 func (h *Handlers) Home(w http.ResponseWriter, r *http.Request) {
@@ -55,38 +86,37 @@ func (h *Handlers) SessionTest(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (h *Handlers) JSON(w http.ResponseWriter, r *http.Request) {
-	var payload struct {
-		ID      int64    `json:"id"`
-		Name    string   `json:"name"`
-		Hobbies []string `json:"hobbies"`
-	}
-
-	payload.ID = 10
-	payload.Name = "John Wick"
-	payload.Hobbies = []string{"killing", "karati", "being cool"}
+// hobbies is the example payload, it can be written as json, xml, csv or html
+type hobbies struct {
+	XMLName xml.Name `json:"-" xml:"payload"`
+	ID      int64    `json:"id" xml:"id"`
+	Name    string   `json:"name" xml:"name"`
+	Hobbies []string `json:"hobbies" xml:"hobbies>hobby"`
+}
 
-	err := h.App.WriteJSON(w, http.StatusOK, payload)
-	if err != nil {
-		h.App.ErrorLog.Println(err)
-	}
+func (p hobbies) MarshalCSV() ([][]string, error) {
+	return [][]string{
+		{"id", "name", "hobbies"},
+		{strconv.FormatInt(p.ID, 10), p.Name, strings.Join(p.Hobbies, ";")},
+	}, nil
 }
 
-func (h *Handlers) XML(w http.ResponseWriter, r *http.Request) {
-	type Payload struct {
-		ID      int64    `xml:"id"`
-		Name    string   `xml:"name"`
-		Hobbies []string `xml:"hobbies>hobby"`
+// Payload writes the example payload in the format picked by content negotiation
+func (h *Handlers) Payload(w http.ResponseWriter, r *http.Request) error {
+	payload := hobbies{
+		ID:      10,
+		Name:    "John Wick",
+		Hobbies: []string{"killing", "karati", "being cool"},
 	}
 
-	var payload Payload
-	payload.ID = 10
-	payload.Name = "John Wick"
-	payload.Hobbies = []string{"killing", "karati", "being cool"}
+	return h.respond(w, r, http.StatusOK, payload, "payload")
+}
 
-	err := h.App.WriteXML(w, http.StatusOK, payload)
+// APIDocs displays the api documentation, built in the browser from /api/openapi.json
+func (h *Handlers) APIDocs(w http.ResponseWriter, r *http.Request) {
+	err := h.render(w, r, "api-docs", nil, nil)
 	if err != nil {
-		h.App.ErrorLog.Println(err)
+		h.App.ErrorLog.Println("error rendering:", err)
 	}
 }
 
@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"myapp/apperr"
+	"myapp/data"
+	"myapp/outbox"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// MailResponse is the api representation of an outbox message. The template
+// data is left out, it may hold links that log the user in.
+type MailResponse struct {
+	XMLName     xml.Name   `json:"-" xml:"mail"`
+	ID          int        `json:"id" xml:"id"`
+	To          string     `json:"to" xml:"to"`
+	From        string     `json:"from" xml:"from"`
+	Subject     string     `json:"subject" xml:"subject"`
+	Template    string     `json:"template" xml:"template"`
+	Status      string     `json:"status" xml:"status"`
+	Attempts    int        `json:"attempts" xml:"attempts"`
+	LastError   string     `json:"last_error" xml:"last_error"`
+	NextAttempt time.Time  `json:"next_attempt" xml:"next_attempt"`
+	SentAt      *time.Time `json:"sent_at" xml:"sent_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at" xml:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at" xml:"updated_at"`
+}
+
+// MailCounts is the number of outbox messages in each status
+type MailCounts struct {
+	Pending    int `json:"pending" xml:"pending"`
+	Sent       int `json:"sent" xml:"sent"`
+	Dead       int `json:"dead" xml:"dead"`
+	Cancelled  int `json:"cancelled" xml:"cancelled"`
+	Suppressed int `json:"suppressed" xml:"suppressed"`
+}
+
+// MailListResponse is one page of the outbox, newest first
+type MailListResponse struct {
+	XMLName    xml.Name       `json:"-" xml:"outbox"`
+	Messages   []MailResponse `json:"messages" xml:"mail"`
+	Counts     MailCounts     `json:"counts" xml:"counts"`
+	Page       int            `json:"page" xml:"page"`
+	PerPage    int            `json:"per_page" xml:"per_page"`
+	Total      int            `json:"total" xml:"total"`
+	TotalPages int            `json:"total_pages" xml:"total_pages"`
+}
+
+func newMailResponse(msg *data.OutboxMessage) MailResponse {
+	return MailResponse{
+		ID:          msg.ID,
+		To:          msg.To,
+		From:        msg.From,
+		Subject:     msg.Subject,
+		Template:    msg.Template,
+		Status:      msg.Status,
+		Attempts:    msg.Attempts,
+		LastError:   msg.LastError,
+		NextAttempt: msg.NextAttempt,
+		SentAt:      msg.SentAt,
+		CreatedAt:   msg.CreatedAt,
+		UpdatedAt:   msg.UpdatedAt,
+	}
+}
+
+// ShowMailOutbox is the admin page for the outbox, it calls the mail api
+func (h *Handlers) ShowMailOutbox(w http.ResponseWriter, r *http.Request) {
+	err := h.render(w, r, "mail-outbox", nil, nil)
+	if err != nil {
+		h.App.ErrorLog.Println("error rendering:", err)
+	}
+}
+
+// ListMail returns one page of the outbox, optionally only one status, with
+// the number of messages in each status
+func (h *Handlers) ListMail(w http.ResponseWriter, r *http.Request) error {
+	page, err := queryInt(r, "page", 1)
+	if err != nil || page < 1 {
+		return apperr.BadRequest("page must be a positive number", err)
+	}
+
+	perPage, err := queryInt(r, "per_page", defaultPerPage)
+	if err != nil || perPage < 1 || perPage > maxPerPage {
+		return apperr.BadRequest(fmt.Sprintf("per_page must be between 1 and %d", maxPerPage), err)
+	}
+
+	status := r.URL.Query().Get("status")
+	if status != "" && !validMailStatus(status) {
+		return apperr.BadRequest("status must be pending, sent, dead, cancelled or suppressed", nil)
+	}
+
+	messages, total, err := h.Models.Outbox.GetPage(status, page, perPage)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	counts, err := h.Models.Outbox.Counts()
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	resp := MailListResponse{
+		Messages: make([]MailResponse, 0, len(messages)),
+		Counts: MailCounts{
+			Pending:    counts[data.OutboxPending],
+			Sent:       counts[data.OutboxSent],
+			Dead:       counts[data.OutboxDead],
+			Cancelled:  counts[data.OutboxCancelled],
+			Suppressed: counts[data.OutboxSuppressed],
+		},
+		Page:       page,
+		PerPage:    perPage,
+		Total:      total,
+		TotalPages: (total + perPage - 1) / perPage,
+	}
+	for _, msg := range messages {
+		resp.Messages = append(resp.Messages, newMailResponse(msg))
+	}
+
+	return h.respond(w, r, http.StatusOK, resp, "")
+}
+
+// GetMail returns the outbox message with the id in the url
+func (h *Handlers) GetMail(w http.ResponseWriter, r *http.Request) error {
+	id, err := mailID(r)
+	if err != nil {
+		return err
+	}
+
+	msg, err := h.Models.Outbox.Get(id)
+	if err != nil {
+		return mailError(err)
+	}
+
+	return h.respond(w, r, http.StatusOK, newMailResponse(msg), "")
+}
+
+// RetryMail sends a dead, cancelled or suppressed message again, with a fresh set of attempts
+func (h *Handlers) RetryMail(w http.ResponseWriter, r *http.Request) error {
+	id, err := mailID(r)
+	if err != nil {
+		return err
+	}
+
+	msg, err := h.Outbox.Retry(id)
+	if err != nil {
+		return mailError(err)
+	}
+
+	return h.respond(w, r, http.StatusAccepted, newMailResponse(msg), "")
+}
+
+// CancelMail stops a pending, dead or suppressed message from being sent
+func (h *Handlers) CancelMail(w http.ResponseWriter, r *http.Request) error {
+	id, err := mailID(r)
+	if err != nil {
+		return err
+	}
+
+	msg, err := h.Outbox.Cancel(id)
+	if err != nil {
+		return mailError(err)
+	}
+
+	return h.respond(w, r, http.StatusOK, newMailResponse(msg), "")
+}
+
+// mailID reads the {id} url param, anything but a positive number is a 404
+func mailID(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || id < 1 {
+		return 0, apperr.NotFound("Message not found", nil)
+	}
+
+	return id, nil
+}
+
+// mailError maps outbox errors to api errors
+func mailError(err error) error {
+	switch {
+	case data.IsNotFound(err):
+		return apperr.NotFound("Message not found", nil)
+	case errors.Is(err, outbox.ErrSent):
+		return apperr.New(http.StatusConflict, "The message was already sent", err)
+	case errors.Is(err, outbox.ErrPending):
+		return apperr.New(http.StatusConflict, "The message is already waiting to be sent", err)
+	case errors.Is(err, outbox.ErrSending):
+		return apperr.New(http.StatusConflict, "The message may be being sent, try again once the attempt is over", err)
+	default:
+		return apperr.Internal(err)
+	}
+}
+
+func validMailStatus(status string) bool {
+	for _, s := range data.OutboxStatuses {
+		if s == status {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"myapp/apperr"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/CloudyKit/jet/v6"
+)
+
+const (
+	formatJSON = "json"
+	formatXML  = "xml"
+	formatCSV  = "csv"
+	formatHTML = "html"
+)
+
+// maxBodySize is the largest request body decode will read (1mb)
+const maxBodySize = 1048576
+
+// mediaTypes maps the accepted media types to a response format
+var mediaTypes = map[string]string{
+	"application/json": formatJSON,
+	"application/xml":  formatXML,
+	"text/xml":         formatXML,
+	"text/csv":         formatCSV,
+	"text/html":        formatHTML,
+}
+
+// CSVMarshaler is implemented by payloads that can be written as csv.
+// The first row returned is the header.
+type CSVMarshaler interface {
+	MarshalCSV() ([][]string, error)
+}
+
+// respond writes payload in the format the client asked for, using ?format= or
+// the Accept header. view is the jet template used for html, leave it empty when
+// the payload has no html representation. When no format fits a 406 is returned.
+func (h *Handlers) respond(w http.ResponseWriter, r *http.Request, status int, payload interface{}, view string) error {
+	offered := offers(payload, view)
+
+	format := negotiate(r, offered)
+	if format == "" {
+		return apperr.New(http.StatusNotAcceptable, fmt.Sprintf("Supported formats are %s", strings.Join(offered, ", ")), nil)
+	}
+
+	w.Header().Add("Vary", "Accept")
+
+	switch format {
+	case formatXML:
+		return h.App.WriteXML(w, status, payload)
+	case formatCSV:
+		return writeCSV(w, status, payload.(CSVMarshaler))
+	case formatHTML:
+		vars := make(jet.VarMap)
+		vars.Set("payload", payload)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		return h.render(w, r, view, vars, nil)
+	default:
+		return h.App.WriteJSON(w, status, payload)
+	}
+}
+
+// offers lists the formats payload can be written in
+func offers(payload interface{}, view string) []string {
+	offered := []string{formatJSON, formatXML}
+	if _, ok := payload.(CSVMarshaler); ok {
+		offered = append(offered, formatCSV)
+	}
+	if view != "" {
+		offered = append(offered, formatHTML)
+	}
+
+	return offered
+}
+
+// responseFormat is the format respond will write payload in, "" when none fit
+func responseFormat(r *http.Request, payload interface{}, view string) string {
+	return negotiate(r, offers(payload, view))
+}
+
+// negotiate picks one of the offered formats for the request, or "" if none fit
+func negotiate(r *http.Request, offered []string) string {
+	if f := strings.ToLower(r.URL.Query().Get("format")); f != "" {
+		if contains(offered, f) {
+			return f
+		}
+		return ""
+	}
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return offered[0]
+	}
+
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+		}
+		if q <= bestQ {
+			continue
+		}
+
+		var format string
+		switch {
+		case mediaType == "*/*", mediaType == "application/*":
+			format = offered[0]
+		case strings.HasSuffix(mediaType, "+json"):
+			format = formatJSON
+		case strings.HasSuffix(mediaType, "+xml"):
+			format = formatXML
+		default:
+			format = mediaTypes[mediaType]
+		}
+
+		if format != "" && contains(offered, format) {
+			best, bestQ = format, q
+		}
+	}
+
+	return best
+}
+
+func writeCSV(w http.ResponseWriter, status int, payload CSVMarshaler) error {
+	rows, err := payload.MarshalCSV()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.WriteHeader(status)
+
+	cw := csv.NewWriter(w)
+	return cw.WriteAll(rows)
+}
+
+// decode reads the request body into dst based on its Content-Type.
+// Json, xml and forms are supported, anything else gets a 415.
+func (h *Handlers) decode(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "application/json"
+	}
+
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		err = h.App.ReadJSON(w, r, dst)
+	case mediaType == "application/xml" || mediaType == "text/xml":
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+		err = xml.NewDecoder(r.Body).Decode(dst)
+	case mediaType == "application/x-www-form-urlencoded", mediaType == "multipart/form-data":
+		err = decodeForm(r, dst)
+	default:
+		return apperr.New(http.StatusUnsupportedMediaType, fmt.Sprintf("Unsupported content type %s", mediaType), nil)
+	}
+
+	if err != nil {
+		return apperr.BadRequest("Could not read the request body", err)
+	}
+
+	return nil
+}
+
+// decodeForm copies form values into the fields of the struct dst points to.
+// The field name is taken from the form tag, then the json tag.
+func decodeForm(r *http.Request, dst interface{}) error {
+	if err := r.ParseMultipartForm(maxBodySize); err != nil && err != http.ErrNotMultipart {
+		return err
+	}
+
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("decode form: dst must be a pointer to a struct, got %T", dst)
+	}
+	v = v.Elem()
+
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := fieldName(field)
+		if name == "" || field.PkgPath != "" {
+			continue
+		}
+
+		values, ok := r.Form[name]
+		if !ok || len(values) == 0 {
+			continue
+		}
+
+		if err := setField(v.Field(i), values); err != nil {
+			return fmt.Errorf("decode form: %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func fieldName(field reflect.StructField) string {
+	for _, key := range []string{"form", "json"} {
+		tag := strings.Split(field.Tag.Get(key), ",")[0]
+		if tag == "-" {
+			return ""
+		}
+		if tag != "" {
+			return tag
+		}
+	}
+
+	return field.Name
+}
+
+func setField(f reflect.Value, values []string) error {
+	value := values[0]
+
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			// checkboxes send "on"
+			b = value == "on"
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		f.SetFloat(n)
+	case reflect.Slice:
+		switch f.Type().Elem().Kind() {
+		case reflect.String:
+			f.Set(reflect.ValueOf(append([]string(nil), values...)))
+		case reflect.Uint8:
+			// eg json.RawMessage
+			f.SetBytes([]byte(value))
+		default:
+			return fmt.Errorf("unsupported slice type %s", f.Type())
+		}
+	default:
+		return fmt.Errorf("unsupported type %s", f.Type())
+	}
+
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
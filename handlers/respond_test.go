@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var negotiateTests = []struct {
+	name   string
+	url    string
+	accept string
+	want   string
+}{
+	{"no accept header", "/payload", "", formatJSON},
+	{"any", "/payload", "*/*", formatJSON},
+	{"browser", "/payload", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", formatHTML},
+	{"xml", "/payload", "application/xml", formatXML},
+	{"vendor json", "/payload", "application/problem+json", formatJSON},
+	{"quality", "/payload", "application/json;q=0.5, text/csv", formatCSV},
+	{"not acceptable", "/payload", "image/png", ""},
+	{"format param wins", "/payload?format=xml", "application/json", formatXML},
+	{"unknown format param", "/payload?format=yaml", "", ""},
+}
+
+func TestNegotiate(t *testing.T) {
+	offered := []string{formatJSON, formatXML, formatCSV, formatHTML}
+
+	for _, e := range negotiateTests {
+		req := httptest.NewRequest("GET", e.url, nil)
+		if e.accept != "" {
+			req.Header.Set("Accept", e.accept)
+		}
+
+		if got := negotiate(req, offered); got != e.want {
+			t.Errorf("%s: expected %q but got %q", e.name, e.want, got)
+		}
+	}
+}
+
+func TestDecodeForm(t *testing.T) {
+	var dst struct {
+		Name   string   `json:"name"`
+		Age    int      `form:"age"`
+		Active bool     `json:"active"`
+		Tags   []string `json:"tags"`
+		Secret string   `json:"-"`
+		Raw    []byte   `json:"raw"`
+	}
+
+	body := strings.NewReader("name=Jack&age=42&active=on&tags=a&tags=b&Secret=x&raw=%7B%7D")
+	req := httptest.NewRequest("POST", "/", body)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	if err := decodeForm(req, &dst); err != nil {
+		t.Fatal(err)
+	}
+
+	if dst.Name != "Jack" || dst.Age != 42 || !dst.Active {
+		t.Error("form not decoded", dst)
+	}
+	if len(dst.Tags) != 2 {
+		t.Error("expected 2 tags, got", dst.Tags)
+	}
+	if string(dst.Raw) != "{}" {
+		t.Error("expected raw bytes, got", dst.Raw)
+	}
+	if dst.Secret != "" {
+		t.Error("fields tagged - should be skipped")
+	}
+}
@@ -0,0 +1,381 @@
+package handlers
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"myapp/apperr"
+	"myapp/data"
+	"myapp/events"
+	"myapp/middleware"
+	"myapp/webhooks"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+)
+
+// UserResponse is the api representation of a user. It never includes the
+// password hash or the user's tokens.
+type UserResponse struct {
+	XMLName   xml.Name  `json:"-" xml:"user"`
+	ID        int       `json:"id" xml:"id"`
+	FirstName string    `json:"first_name" xml:"first_name"`
+	LastName  string    `json:"last_name" xml:"last_name"`
+	Email     string    `json:"email" xml:"email"`
+	Active    bool      `json:"active" xml:"active"`
+	CreatedAt time.Time `json:"created_at" xml:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" xml:"updated_at"`
+}
+
+// UserListResponse is one page of users
+type UserListResponse struct {
+	XMLName    xml.Name       `json:"-" xml:"users"`
+	Users      []UserResponse `json:"users" xml:"user"`
+	Page       int            `json:"page" xml:"page,attr"`
+	PerPage    int            `json:"per_page" xml:"per_page,attr"`
+	Total      int            `json:"total" xml:"total,attr"`
+	TotalPages int            `json:"total_pages" xml:"total_pages,attr"`
+}
+
+// UserRequest is the body accepted when creating or updating a user
+type UserRequest struct {
+	FirstName string `json:"first_name" xml:"first_name"`
+	LastName  string `json:"last_name" xml:"last_name"`
+	Email     string `json:"email" xml:"email"`
+	Active    *bool  `json:"active" xml:"active"`
+	Password  string `json:"password" xml:"password"`
+}
+
+func newUserResponse(u *data.User) UserResponse {
+	return UserResponse{
+		ID:        u.ID,
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		Email:     u.Email,
+		Active:    u.Active == 1,
+		CreatedAt: u.CreatedAt,
+		UpdatedAt: u.UpdatedAt,
+	}
+}
+
+// apply copies the request onto u
+func (req UserRequest) apply(u *data.User) {
+	u.FirstName = req.FirstName
+	u.LastName = req.LastName
+	u.Email = req.Email
+	if req.Active != nil {
+		u.Active = 0
+		if *req.Active {
+			u.Active = 1
+		}
+	}
+}
+
+// ListUsers returns a page of users, ?page= and ?per_page= pick the page
+func (h *Handlers) ListUsers(w http.ResponseWriter, r *http.Request) error {
+	page, err := queryInt(r, "page", 1)
+	if err != nil || page < 1 {
+		return apperr.BadRequest("page must be a positive number", err)
+	}
+
+	perPage, err := queryInt(r, "per_page", defaultPerPage)
+	if err != nil || perPage < 1 || perPage > maxPerPage {
+		return apperr.BadRequest(fmt.Sprintf("per_page must be between 1 and %d", maxPerPage), err)
+	}
+
+	users, total, err := h.Models.Users.GetPage(page, perPage)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	resp := UserListResponse{
+		Users:      make([]UserResponse, 0, len(users)),
+		Page:       page,
+		PerPage:    perPage,
+		Total:      total,
+		TotalPages: (total + perPage - 1) / perPage,
+	}
+	for _, u := range users {
+		resp.Users = append(resp.Users, newUserResponse(u))
+	}
+
+	return h.respond(w, r, http.StatusOK, resp, "")
+}
+
+// GetUser returns the user with the id in the url
+func (h *Handlers) GetUser(w http.ResponseWriter, r *http.Request) error {
+	u, err := h.userFromURL(r)
+	if err != nil {
+		return err
+	}
+
+	resp := newUserResponse(u)
+	if notModified(w, r, u.ETag(responseFormat(r, resp, "")), u.UpdatedAt) {
+		return nil
+	}
+
+	return h.respond(w, r, http.StatusOK, resp, "")
+}
+
+// Me returns the user that owns the bearer token
+func (h *Handlers) Me(w http.ResponseWriter, r *http.Request) error {
+	u, ok := middleware.UserFromContext(r.Context())
+	if !ok {
+		return apperr.Unauthorized("invalid authentication credentials", nil)
+	}
+
+	resp := newUserResponse(u)
+	if notModified(w, r, u.ETag(responseFormat(r, resp, "")), u.UpdatedAt) {
+		return nil
+	}
+
+	return h.respond(w, r, http.StatusOK, resp, "")
+}
+
+// CreateUser validates and inserts a new user
+func (h *Handlers) CreateUser(w http.ResponseWriter, r *http.Request) error {
+	var req UserRequest
+	if err := h.decode(w, r, &req); err != nil {
+		return err
+	}
+
+	created, err := h.createUser(req)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/users/%d", created.ID))
+	resp := newUserResponse(created)
+	setVersion(w, created.ETag(responseFormat(r, resp, "")), created.UpdatedAt)
+	return h.respond(w, r, http.StatusCreated, resp, "")
+}
+
+// UpdateUser replaces the user's details, and password if one is given. Users
+// may only update themselves, admins anyone. A stale If-Match (or
+// If-Unmodified-Since) gets a 412.
+func (h *Handlers) UpdateUser(w http.ResponseWriter, r *http.Request) error {
+	u, err := h.userFromURL(r)
+	if err != nil {
+		return err
+	}
+
+	if err := h.mayChangeUser(r.Context(), u.ID); err != nil {
+		return err
+	}
+	if err := precondition(r, userETags(u), u.UpdatedAt); err != nil {
+		return err
+	}
+
+	var req UserRequest
+	if err := h.decode(w, r, &req); err != nil {
+		return err
+	}
+
+	updated, err := h.updateUser(u, req)
+	if err != nil {
+		return err
+	}
+
+	resp := newUserResponse(updated)
+	setVersion(w, updated.ETag(responseFormat(r, resp, "")), updated.UpdatedAt)
+	return h.respond(w, r, http.StatusOK, resp, "")
+}
+
+// DeleteUser deletes the user with the id in the url, the signed in user or
+// anyone for admins
+func (h *Handlers) DeleteUser(w http.ResponseWriter, r *http.Request) error {
+	u, err := h.userFromURL(r)
+	if err != nil {
+		return err
+	}
+
+	if err := h.mayChangeUser(r.Context(), u.ID); err != nil {
+		return err
+	}
+	if err := precondition(r, userETags(u), u.UpdatedAt); err != nil {
+		return err
+	}
+
+	if err := h.deleteUser(u); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// createUser validates and inserts a new user, then tells the webhooks and the
+// page cache. The rest api and graphql both create users through it.
+func (h *Handlers) createUser(req UserRequest) (*data.User, error) {
+	u := data.User{Active: 1}
+	req.apply(&u)
+	u.Password = req.Password
+
+	validator := data.NewValidator(h.App.Validator(nil))
+	u.Validate(validator)
+	validator.Required("password", req.Password, "Password must be provided")
+	validator.MinLength("password", req.Password, 8, "Password must be at least eight characters")
+	if !validator.Valid() {
+		return nil, apperr.Invalid(validator.Errors, validator.Codes)
+	}
+
+	if err := h.emailAvailable(u.Email, 0); err != nil {
+		return nil, err
+	}
+
+	id, err := h.Models.Users.Insert(u)
+	if err != nil {
+		return nil, apperr.Internal(err)
+	}
+
+	created, err := h.Models.Users.Get(id)
+	if err != nil {
+		return nil, apperr.Internal(err)
+	}
+
+	h.publish(webhooks.UserCreated, newUserResponse(created))
+	h.purgePages("users")
+
+	return created, nil
+}
+
+// updateUser applies the request to u and saves it, with the new password if
+// one is given, then tells the webhooks, the page cache and the user's
+// browsers. The caller has checked mayChangeUser.
+func (h *Handlers) updateUser(u *data.User, req UserRequest) (*data.User, error) {
+	req.apply(u)
+
+	validator := data.NewValidator(h.App.Validator(nil))
+	u.Validate(validator)
+	if req.Password != "" {
+		validator.MinLength("password", req.Password, 8, "Password must be at least eight characters")
+	}
+	if !validator.Valid() {
+		return nil, apperr.Invalid(validator.Errors, validator.Codes)
+	}
+
+	if err := h.emailAvailable(u.Email, u.ID); err != nil {
+		return nil, err
+	}
+
+	// the password goes in the same write, so a failure changes nothing
+	if req.Password != "" {
+		if err := u.SetPassword(req.Password); err != nil {
+			return nil, apperr.Internal(err)
+		}
+	}
+	if err := u.Update(*u); err != nil {
+		return nil, apperr.Internal(err)
+	}
+
+	updated, err := h.Models.Users.Get(u.ID)
+	if err != nil {
+		return nil, apperr.Internal(err)
+	}
+
+	h.publish(webhooks.UserUpdated, newUserResponse(updated))
+	h.purgePages("users")
+	if req.Password != "" {
+		h.publish(webhooks.UserPasswordChanged, newUserResponse(updated))
+		h.notify(updated.ID, events.PasswordChanged, struct{}{})
+	}
+
+	return updated, nil
+}
+
+// deleteUser deletes u and tells the webhooks and the page cache. The caller
+// has checked mayChangeUser.
+func (h *Handlers) deleteUser(u *data.User) error {
+	if err := u.Delete(u.ID); err != nil {
+		return apperr.Internal(err)
+	}
+
+	h.publish(webhooks.UserDeleted, newUserResponse(u))
+	h.purgePages("users")
+
+	return nil
+}
+
+// mayChangeUser returns a 403 unless the signed in user is the user with id or
+// an admin. Admins are known by their email, so without this anyone could give
+// another account an admin's address.
+func (h *Handlers) mayChangeUser(ctx context.Context, id int) error {
+	caller, ok := middleware.UserFromContext(ctx)
+	if !ok {
+		return apperr.Unauthorized("invalid authentication credentials", nil)
+	}
+
+	if caller.ID != id && !h.Admins.IsAdmin(caller.Email) {
+		return apperr.Forbidden("Only admins may change other users", nil)
+	}
+
+	return nil
+}
+
+// userETags are the etags of every representation of the user, any of which
+// a client may send back in If-Match
+func userETags(u *data.User) []string {
+	var etags []string
+	for _, format := range offers(newUserResponse(u), "") {
+		etags = append(etags, u.ETag(format))
+	}
+
+	return etags
+}
+
+// userFromURL gets the user with the {id} url param, or a 404
+func (h *Handlers) userFromURL(r *http.Request) (*data.User, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || id < 1 {
+		return nil, apperr.NotFound("User not found", nil)
+	}
+
+	return h.userByID(id)
+}
+
+// userByID gets the user with id, or a 404
+func (h *Handlers) userByID(id int) (*data.User, error) {
+	u, err := h.Models.Users.Get(id)
+	if err != nil {
+		if data.IsNotFound(err) {
+			return nil, apperr.NotFound("User not found", nil)
+		}
+		return nil, apperr.Internal(err)
+	}
+
+	return u, nil
+}
+
+// emailAvailable returns a 409 when another user (not id) already has the email
+func (h *Handlers) emailAvailable(email string, id int) error {
+	existing, err := h.Models.Users.GetByEmail(email)
+	if err != nil {
+		if data.IsNotFound(err) {
+			return nil
+		}
+		return apperr.Internal(err)
+	}
+
+	if existing.ID != id {
+		return apperr.New(http.StatusConflict, "A user with that email already exists", nil)
+	}
+
+	return nil
+}
+
+// queryInt reads an int from the query string, returning def when it is missing
+func queryInt(r *http.Request, key string, def int) (int, error) {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return def, nil
+	}
+
+	return strconv.Atoi(value)
+}
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"context"
+	"myapp/apperr"
+	"myapp/data"
+	"myapp/middleware"
+	"net/http"
+	"testing"
+)
+
+func TestHandlers_MayChangeUser(t *testing.T) {
+	h := &Handlers{Admins: middleware.AdminConfig{Emails: []string{"admin@here.com"}}}
+
+	for _, e := range []struct {
+		name   string
+		caller *data.User
+		id     int
+		want   int
+	}{
+		{"signed out", nil, 1, http.StatusUnauthorized},
+		{"themselves", &data.User{ID: 1, Email: "me@here.com"}, 1, 0},
+		{"someone else", &data.User{ID: 1, Email: "me@here.com"}, 2, http.StatusForbidden},
+		{"admin", &data.User{ID: 3, Email: "Admin@here.com"}, 2, 0},
+	} {
+		ctx := context.Background()
+		if e.caller != nil {
+			ctx = middleware.WithUser(ctx, e.caller)
+		}
+
+		err := h.mayChangeUser(ctx, e.id)
+		status := 0
+		if err != nil {
+			status = apperr.From(err).Status
+		}
+		if status != e.want {
+			t.Errorf("%s: expected %d, got %d (%v)", e.name, e.want, status, err)
+		}
+	}
+}
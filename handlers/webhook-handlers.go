@@ -0,0 +1,258 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"myapp/apperr"
+	"myapp/data"
+	"myapp/webhooks"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const maxDeliveries = 100
+
+// WebhookResponse is the api representation of a webhook. The secret is only
+// sent back when the webhook is created.
+type WebhookResponse struct {
+	XMLName   xml.Name  `json:"-" xml:"webhook"`
+	ID        int       `json:"id" xml:"id"`
+	URL       string    `json:"url" xml:"url"`
+	Events    []string  `json:"events" xml:"event"`
+	Active    bool      `json:"active" xml:"active"`
+	Secret    string    `json:"secret,omitempty" xml:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at" xml:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" xml:"updated_at"`
+}
+
+// WebhookListResponse is every webhook
+type WebhookListResponse struct {
+	XMLName  xml.Name          `json:"-" xml:"webhooks"`
+	Webhooks []WebhookResponse `json:"webhooks" xml:"webhook"`
+}
+
+// WebhookRequest is the body accepted when creating a webhook. A secret is
+// generated when none is given.
+type WebhookRequest struct {
+	URL    string   `json:"url" xml:"url"`
+	Events []string `json:"events" xml:"event"`
+	Secret string   `json:"secret" xml:"secret"`
+	Active *bool    `json:"active" xml:"active"`
+}
+
+// DeliveryResponse is one entry of a webhook's delivery log
+type DeliveryResponse struct {
+	XMLName        xml.Name  `json:"-" xml:"delivery"`
+	ID             int       `json:"id" xml:"id"`
+	WebhookID      int       `json:"webhook_id" xml:"webhook_id"`
+	Event          string    `json:"event" xml:"event"`
+	Status         string    `json:"status" xml:"status"`
+	Attempts       int       `json:"attempts" xml:"attempts"`
+	ResponseStatus int       `json:"response_status" xml:"response_status"`
+	LastError      string    `json:"last_error" xml:"last_error"`
+	NextAttempt    time.Time `json:"next_attempt" xml:"next_attempt"`
+	CreatedAt      time.Time `json:"created_at" xml:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at" xml:"updated_at"`
+}
+
+// DeliveryListResponse is the newest deliveries of a webhook
+type DeliveryListResponse struct {
+	XMLName    xml.Name           `json:"-" xml:"deliveries"`
+	Deliveries []DeliveryResponse `json:"deliveries" xml:"delivery"`
+}
+
+func newWebhookResponse(hook *data.Webhook) WebhookResponse {
+	return WebhookResponse{
+		ID:        hook.ID,
+		URL:       hook.URL,
+		Events:    strings.Split(hook.Events, ","),
+		Active:    hook.Active == 1,
+		CreatedAt: hook.CreatedAt,
+		UpdatedAt: hook.UpdatedAt,
+	}
+}
+
+func newDeliveryResponse(d *data.WebhookDelivery) DeliveryResponse {
+	return DeliveryResponse{
+		ID:             d.ID,
+		WebhookID:      d.WebhookID,
+		Event:          d.Event,
+		Status:         d.Status,
+		Attempts:       d.Attempts,
+		ResponseStatus: d.ResponseStatus,
+		LastError:      d.LastError,
+		NextAttempt:    d.NextAttempt,
+		CreatedAt:      d.CreatedAt,
+		UpdatedAt:      d.UpdatedAt,
+	}
+}
+
+// Validate checks the url is absolute http(s) and every event exists
+func (req WebhookRequest) Validate(validator *data.Validator) {
+	u, err := url.Parse(req.URL)
+	validator.Required("url", req.URL, "URL must be provided")
+	validator.Rule(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "url", data.CodeInvalid, "URL must be an absolute http or https url")
+
+	validator.Rule(len(req.Events) > 0, "events", data.CodeRequired, "At least one event must be given, or *")
+	for _, event := range req.Events {
+		validator.Rule(webhooks.ValidEvent(event), "events", data.CodeInvalid, fmt.Sprintf("Unknown event %q", event))
+	}
+}
+
+// ListWebhooks returns every webhook
+func (h *Handlers) ListWebhooks(w http.ResponseWriter, r *http.Request) error {
+	hooks, err := h.Models.Webhooks.GetAll()
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	resp := WebhookListResponse{Webhooks: make([]WebhookResponse, 0, len(hooks))}
+	for _, hook := range hooks {
+		resp.Webhooks = append(resp.Webhooks, newWebhookResponse(hook))
+	}
+
+	return h.respond(w, r, http.StatusOK, resp, "")
+}
+
+// CreateWebhook subscribes a url to events
+func (h *Handlers) CreateWebhook(w http.ResponseWriter, r *http.Request) error {
+	var req WebhookRequest
+	if err := h.decode(w, r, &req); err != nil {
+		return err
+	}
+
+	validator := data.NewValidator(h.App.Validator(nil))
+	req.Validate(validator)
+	if validator.Valid() && !h.Webhooks.AllowPrivate {
+		err := webhooks.CheckURL(r.Context(), req.URL)
+		validator.Rule(!errors.Is(err, webhooks.ErrPrivateAddress), "url", data.CodeInvalid, "URL must not point at a local or private address")
+		validator.Rule(err == nil, "url", data.CodeInvalid, "URL host could not be resolved")
+	}
+	if !validator.Valid() {
+		return apperr.Invalid(validator.Errors, validator.Codes)
+	}
+
+	hook := data.Webhook{
+		URL:    req.URL,
+		Events: strings.Join(req.Events, ","),
+		Secret: req.Secret,
+		Active: 1,
+	}
+	if req.Active != nil && !*req.Active {
+		hook.Active = 0
+	}
+
+	if hook.Secret == "" {
+		secret, err := webhooks.NewSecret()
+		if err != nil {
+			return apperr.Internal(err)
+		}
+		hook.Secret = secret
+	}
+
+	id, err := h.Models.Webhooks.Insert(hook)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	created, err := h.Models.Webhooks.Get(id)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	resp := newWebhookResponse(created)
+	resp.Secret = created.Secret
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/webhooks/%d", id))
+	return h.respond(w, r, http.StatusCreated, resp, "")
+}
+
+// DeleteWebhook unsubscribes a webhook, its delivery log goes with it
+func (h *Handlers) DeleteWebhook(w http.ResponseWriter, r *http.Request) error {
+	hook, err := h.webhookFromURL(r)
+	if err != nil {
+		return err
+	}
+
+	if err := h.Models.Webhooks.Delete(hook.ID); err != nil {
+		return apperr.Internal(err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// ListDeliveries returns the newest deliveries of a webhook
+func (h *Handlers) ListDeliveries(w http.ResponseWriter, r *http.Request) error {
+	hook, err := h.webhookFromURL(r)
+	if err != nil {
+		return err
+	}
+
+	deliveries, err := h.Models.WebhookDeliveries.GetForWebhook(hook.ID, maxDeliveries)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	resp := DeliveryListResponse{Deliveries: make([]DeliveryResponse, 0, len(deliveries))}
+	for _, d := range deliveries {
+		resp.Deliveries = append(resp.Deliveries, newDeliveryResponse(d))
+	}
+
+	return h.respond(w, r, http.StatusOK, resp, "")
+}
+
+// Redeliver sends a logged delivery again, returning the new delivery
+func (h *Handlers) Redeliver(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || id < 1 {
+		return apperr.NotFound("Delivery not found", nil)
+	}
+
+	newID, err := h.Webhooks.Redeliver(id)
+	if err != nil {
+		if data.IsNotFound(err) {
+			return apperr.NotFound("Delivery not found", nil)
+		}
+		return apperr.Internal(err)
+	}
+
+	delivery, err := h.Models.WebhookDeliveries.Get(newID)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	return h.respond(w, r, http.StatusAccepted, newDeliveryResponse(delivery), "")
+}
+
+// webhookFromURL gets the webhook with the {id} url param, or a 404
+func (h *Handlers) webhookFromURL(r *http.Request) (*data.Webhook, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || id < 1 {
+		return nil, apperr.NotFound("Webhook not found", nil)
+	}
+
+	hook, err := h.Models.Webhooks.Get(id)
+	if err != nil {
+		if data.IsNotFound(err) {
+			return nil, apperr.NotFound("Webhook not found", nil)
+		}
+		return nil, apperr.Internal(err)
+	}
+
+	return hook, nil
+}
+
+// publish sends a user event to the subscribed webhooks. The change has already
+// been saved, so a failure here is logged rather than failing the request.
+func (h *Handlers) publish(event string, payload interface{}) {
+	if err := h.Webhooks.Publish(event, payload); err != nil {
+		h.App.ErrorLog.Println("error publishing", event, "webhook:", err)
+	}
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"myapp/data"
+	"testing"
+
+	"github.com/cmd-ctrl-q/celeritas"
+)
+
+var webhookRequestTests = []struct {
+	name  string
+	req   WebhookRequest
+	field string
+	code  string
+}{
+	{"valid", WebhookRequest{URL: "https://example.com/hook", Events: []string{"user.created", "user.deleted"}}, "", ""},
+	{"every event", WebhookRequest{URL: "http://example.com/hook", Events: []string{"*"}}, "", ""},
+	{"no url", WebhookRequest{Events: []string{"*"}}, "url", data.CodeRequired},
+	{"relative url", WebhookRequest{URL: "/hook", Events: []string{"*"}}, "url", data.CodeInvalid},
+	{"not http", WebhookRequest{URL: "ftp://example.com/hook", Events: []string{"*"}}, "url", data.CodeInvalid},
+	{"no events", WebhookRequest{URL: "https://example.com/hook"}, "events", data.CodeRequired},
+	{"unknown event", WebhookRequest{URL: "https://example.com/hook", Events: []string{"user.created", "user.exploded"}}, "events", data.CodeInvalid},
+}
+
+func TestWebhookRequest_Validate(t *testing.T) {
+	c := celeritas.Celeritas{}
+
+	for _, e := range webhookRequestTests {
+		v := data.NewValidator(c.Validator(nil))
+		e.req.Validate(v)
+
+		if e.field == "" {
+			if !v.Valid() {
+				t.Errorf("%s: expected no errors but got %v", e.name, v.Errors)
+			}
+			continue
+		}
+
+		if got := v.Code(e.field); !v.Valid() && got != e.code {
+			t.Errorf("%s: expected %s on %s but got %s", e.name, e.code, e.field, got)
+		}
+		if _, ok := v.Errors[e.field]; !ok {
+			t.Errorf("%s: expected an error on %s, got %v", e.name, e.field, v.Errors)
+		}
+	}
+}
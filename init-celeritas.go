@@ -2,9 +2,16 @@ package main
 
 import (
 	"log"
+	"myapp/appcache"
+	"myapp/bounces"
 	"myapp/data"
+	"myapp/emails"
+	"myapp/events"
+	"myapp/gql"
 	"myapp/handlers"
 	"myapp/middleware"
+	"myapp/outbox"
+	"myapp/webhooks"
 	"os"
 
 	"github.com/cmd-ctrl-q/celeritas"
@@ -26,11 +33,33 @@ func initApplication() *application {
 	cel.AppName = "myapp"
 
 	myMiddleware := &middleware.Middleware{
-		App: cel,
+		App:         cel,
+		CORSConfig:  middleware.NewCORSConfig(),
+		Alerts:      middleware.NewAlertConfig(),
+		Idempotency: middleware.NewIdempotencyConfig(),
+		Admins:      middleware.NewAdminConfig(),
+		PageCache:   middleware.NewPageCacheConfig(),
 	}
 
+	// mail is caught and shown at /dev/mail in development, rather than sent
+	emailConfig := emails.NewConfig(cel.Mail.Templates, cel.AppName, cel.Server.URL, cel.EncryptionKey)
+	var mailer emails.Mailer = emails.NewTransport(&cel.Mail)
+	var catcher *emails.Catcher
+	if config := emails.NewCatcherConfig(cel.Debug); config.Enabled {
+		catcher = emails.NewCatcher(cel.Mail.Templates, config)
+		mailer = catcher
+	}
+	myMiddleware.Alerts.Mailer = mailer
+
 	myHandlers := &handlers.Handlers{
-		App: cel,
+		App:           cel,
+		GraphQLConfig: gql.NewConfig(),
+		Events:        events.New(events.NewConfig()),
+		Admins:        myMiddleware.Admins,
+		Cache:         appcache.New(cel.Cache, appcache.NewConfig()),
+		Playground:    appcache.New(cel.Cache, appcache.NewPlaygroundConfig()),
+		Emails:        &emails.Renderer{Config: emailConfig},
+		MailCatcher:   catcher,
 	}
 
 	// build app variable
@@ -43,10 +72,21 @@ func initApplication() *application {
 	// for global access
 	app.App.Routes = app.routes()
 	app.Models = data.New(app.App.DB.Pool)
+	data.EnableCache(cel.Cache, data.NewCacheConfig())
 	app.Middleware.Models = app.Models
 
 	// gives handlers package access to models
 	myHandlers.Models = app.Models
 
+	// webhooks and mail are sent in the background once startWorkers is called
+	myHandlers.Webhooks = webhooks.New(app.Models, cel.ErrorLog, webhooks.NewConfig())
+	myHandlers.Outbox = outbox.New(app.Models, emails.NewSender(mailer, &app.Models.EmailPreferences, &app.Models.MailSuppressions, emailConfig), cel.ErrorLog, outbox.NewConfig())
+
+	// bounce and complaint webhooks for the providers set up in .env
+	myHandlers.Bounces, err = bounces.New(app.Models, bounces.NewConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	return app
 }
@@ -1,13 +1,24 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"myapp/data"
 	"myapp/handlers"
 	"myapp/middleware"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/cmd-ctrl-q/celeritas"
 )
 
+// shutdownTimeout is how long the requests in flight and the workers get to
+// finish once the app is told to stop
+const shutdownTimeout = 30 * time.Second
+
 type application struct {
 	App        *celeritas.Celeritas
 	Handlers   *handlers.Handlers
@@ -17,5 +28,69 @@ type application struct {
 
 func main() {
 	c := initApplication()
-	c.App.ListenAndServe()
+
+	// commands don't start the workers, what they queue (eg the webhooks of
+	// imported users) is saved and sent by the server
+	if len(os.Args) > 1 {
+		os.Exit(c.runCommand(os.Args[1:]))
+	}
+
+	c.startWorkers()
+	srv := c.newServer()
+	go func() {
+		c.App.InfoLog.Printf("Listening on port %s", os.Getenv("PORT"))
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			c.App.ErrorLog.Fatal(err)
+		}
+	}()
+
+	c.shutdownOnSignal(srv)
+}
+
+// newServer is the server celeritas' ListenAndServe would run, which keeps it
+// to itself, so it can be shut down gracefully
+func (a *application) newServer() *http.Server {
+	return &http.Server{
+		Addr:         fmt.Sprintf(":%s", os.Getenv("PORT")),
+		ErrorLog:     a.App.ErrorLog,
+		Handler:      a.App.Routes,
+		IdleTimeout:  30 * time.Second,
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 600 * time.Second,
+	}
+}
+
+// startWorkers sends webhooks and mail from the outbox in the background
+func (a *application) startWorkers() {
+	a.Handlers.Webhooks.Start()
+	a.Handlers.Outbox.Start()
+}
+
+// shutdownOnSignal waits for SIGINT or SIGTERM, then stops the app cleanly.
+// The event streams end first, the browsers reconnect once it is back, as
+// they would otherwise keep the server from finishing. Then the requests in
+// flight finish and the workers save the attempts they are making.
+func (a *application) shutdownOnSignal(srv *http.Server) {
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	a.App.InfoLog.Println("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	a.Handlers.Events.Close(5 * time.Second)
+	if err := srv.Shutdown(ctx); err != nil {
+		a.App.ErrorLog.Println("error shutting down the server:", err)
+	}
+	if err := a.Handlers.Outbox.Stop(ctx); err != nil {
+		a.App.ErrorLog.Println("error stopping the outbox:", err)
+	}
+	if err := a.Handlers.Webhooks.Stop(ctx); err != nil {
+		a.App.ErrorLog.Println("error stopping the webhooks:", err)
+	}
+
+	if a.App.DB.Pool != nil {
+		_ = a.App.DB.Pool.Close()
+	}
 }
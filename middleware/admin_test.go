@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"io"
+	"log"
+	"myapp/data"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cmd-ctrl-q/celeritas"
+)
+
+func TestMiddleware_Admin(t *testing.T) {
+	m := &Middleware{
+		App:    &celeritas.Celeritas{ErrorLog: log.New(io.Discard, "", 0)},
+		Admins: AdminConfig{Emails: []string{"admin@example.com"}},
+	}
+
+	handler := m.Admin(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, e := range []struct {
+		user *data.User
+		want int
+	}{
+		{nil, http.StatusUnauthorized},
+		{&data.User{Email: "someone@example.com"}, http.StatusForbidden},
+		{&data.User{Email: "Admin@Example.com"}, http.StatusNoContent},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/cache", nil)
+		req.Header.Set("Accept", "application/json")
+		if e.user != nil {
+			req = req.WithContext(WithUser(req.Context(), e.user))
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.want {
+			t.Errorf("%v: expected %d, got %d", e.user, e.want, rr.Code)
+		}
+	}
+}
+
+func TestMiddleware_CheckCSRFHeader(t *testing.T) {
+	m := &Middleware{App: &celeritas.Celeritas{ErrorLog: log.New(io.Discard, "", 0)}}
+
+	handler := m.CheckCSRFHeader(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, e := range []struct {
+		method string
+		bearer bool
+		want   int
+	}{
+		{http.MethodGet, false, http.StatusNoContent},
+		{http.MethodPut, true, http.StatusNoContent},
+		{http.MethodPut, false, http.StatusForbidden},
+		{http.MethodDelete, false, http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(e.method, "/api/v1/cache/key", nil)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set(CSRFHeader, "not-the-token")
+		if e.bearer {
+			req.Header.Set("Authorization", "Bearer abc")
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.want {
+			t.Errorf("%s bearer=%v: expected %d, got %d", e.method, e.bearer, e.want, rr.Code)
+		}
+	}
+}
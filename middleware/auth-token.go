@@ -1,21 +1,65 @@
 // api based authentication
 package middleware
 
-import "net/http"
+import (
+	"context"
+	"myapp/apperr"
+	"myapp/data"
+	"net/http"
+)
 
+type contextKey string
+
+const userKey contextKey = "user"
+
+// AuthToken authenticates the bearer token and stores its user in the request context
 func (m *Middleware) AuthToken(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		_, err := m.Models.Tokens.AuthenticateToken(r)
+		user, err := m.Models.Tokens.AuthenticateToken(r)
 		if err != nil {
-			var payload struct {
-				Error   bool   `json:"error"`
-				Message string `json:"message"`
-			}
+			apperr.Write(m.App, rw, r, apperr.Unauthorized("invalid authentication credentials", nil))
+			return
+		}
+
+		next.ServeHTTP(rw, r.WithContext(WithUser(r.Context(), user)))
+	})
+}
+
+// AuthTokenOrSession authenticates the bearer token when one is sent, and
+// otherwise the logged in user of the session. Either way the user is stored in the request context.
+func (m *Middleware) AuthTokenOrSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			m.AuthToken(next).ServeHTTP(rw, r)
+			return
+		}
 
-			payload.Error = true
-			payload.Message = "invalid authentication credentials"
+		if !m.App.Session.Exists(r.Context(), "userID") {
+			apperr.Write(m.App, rw, r, apperr.Unauthorized("invalid authentication credentials", nil))
+			return
+		}
 
-			_ = m.App.WriteJSON(rw, http.StatusUnauthorized, payload)
+		user, err := m.Models.Users.Get(m.App.Session.GetInt(r.Context(), "userID"))
+		if err != nil {
+			if data.IsNotFound(err) {
+				apperr.Write(m.App, rw, r, apperr.Unauthorized("invalid authentication credentials", nil))
+				return
+			}
+			apperr.Write(m.App, rw, r, apperr.Internal(err))
+			return
 		}
+
+		next.ServeHTTP(rw, r.WithContext(WithUser(r.Context(), user)))
 	})
 }
+
+// WithUser returns a copy of ctx holding the authenticated user
+func WithUser(ctx context.Context, user *data.User) context.Context {
+	return context.WithValue(ctx, userKey, user)
+}
+
+// UserFromContext returns the user stored by AuthToken, if any
+func UserFromContext(ctx context.Context) (*data.User, bool) {
+	user, ok := ctx.Value(userKey).(*data.User)
+	return user, ok && user != nil
+}
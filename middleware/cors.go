@@ -0,0 +1,183 @@
+package middleware
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// CORSConfig holds the cross origin settings for the api route group
+type CORSConfig struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           int
+}
+
+// NewCORSConfig reads the cors settings from the environment (.env).
+// Credentials are never allowed along with the * origin, since the origin is
+// echoed back and any site could then make requests with the user's cookies.
+// The api's own response headers (ETag for conditional requests, Location of a
+// created resource, Idempotent-Replayed) are exposed unless
+// CORS_EXPOSED_HEADERS says otherwise.
+func NewCORSConfig() CORSConfig {
+	maxAge, err := strconv.Atoi(os.Getenv("CORS_MAX_AGE"))
+	if err != nil {
+		maxAge = 300
+	}
+
+	origins := splitEnv("CORS_ALLOWED_ORIGINS", "")
+	credentials, _ := strconv.ParseBool(os.Getenv("CORS_ALLOW_CREDENTIALS"))
+	if containsFold(origins, "*") {
+		credentials = false
+	}
+
+	return CORSConfig{
+		AllowedOrigins:   origins,
+		AllowedMethods:   splitEnv("CORS_ALLOWED_METHODS", "GET,POST,PUT,PATCH,DELETE,OPTIONS"),
+		AllowedHeaders:   splitEnv("CORS_ALLOWED_HEADERS", "Accept,Authorization,Content-Type,X-CSRF-Token"),
+		ExposedHeaders:   splitEnv("CORS_EXPOSED_HEADERS", "ETag,Location,Idempotent-Replayed"),
+		AllowCredentials: credentials,
+		MaxAge:           maxAge,
+	}
+}
+
+// CORS adds the cross origin headers to api responses and answers preflight requests.
+// Only mount this on the api routes, never on the session based pages.
+func (m *Middleware) CORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		rw.Header().Add("Vary", "Origin")
+
+		// not a cross origin request
+		if origin == "" {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		if !m.CORSConfig.originAllowed(origin) {
+			if preflight {
+				rw.WriteHeader(http.StatusForbidden)
+				return
+			}
+			// let the request through without cors headers, the browser will block it
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		if preflight {
+			m.CORSConfig.preflight(rw, r, origin)
+			return
+		}
+
+		rw.Header().Set("Access-Control-Allow-Origin", origin)
+		if m.CORSConfig.AllowCredentials {
+			rw.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if len(m.CORSConfig.ExposedHeaders) > 0 {
+			rw.Header().Set("Access-Control-Expose-Headers", strings.Join(m.CORSConfig.ExposedHeaders, ", "))
+		}
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// preflight answers an OPTIONS preflight request without calling the next handler
+func (c CORSConfig) preflight(rw http.ResponseWriter, r *http.Request, origin string) {
+	rw.Header().Add("Vary", "Access-Control-Request-Method")
+	rw.Header().Add("Vary", "Access-Control-Request-Headers")
+
+	method := r.Header.Get("Access-Control-Request-Method")
+	if !containsFold(c.AllowedMethods, method) {
+		rw.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	requested := r.Header.Get("Access-Control-Request-Headers")
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.TrimSpace(h)
+		if h != "" && !containsFold(c.AllowedHeaders, h) && !containsFold(c.AllowedHeaders, "*") {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	rw.Header().Set("Access-Control-Allow-Origin", origin)
+	rw.Header().Set("Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
+	if requested != "" {
+		// echo back the requested headers since they have all been checked
+		rw.Header().Set("Access-Control-Allow-Headers", requested)
+	}
+	if c.AllowCredentials {
+		rw.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if c.MaxAge > 0 {
+		rw.Header().Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAge))
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// originAllowed checks the origin against the allowed list.
+// Patterns may contain a wildcard subdomain, eg https://*.example.com
+func (c CORSConfig) originAllowed(origin string) bool {
+	origin = strings.ToLower(origin)
+
+	for _, allowed := range c.AllowedOrigins {
+		allowed = strings.ToLower(allowed)
+
+		switch {
+		case allowed == "*":
+			return true
+		case allowed == origin:
+			return true
+		case strings.Contains(allowed, "://*."):
+			parts := strings.SplitN(allowed, "*", 2)
+			prefix, suffix := parts[0], parts[1]
+			if len(origin) > len(prefix)+len(suffix) &&
+				strings.HasPrefix(origin, prefix) &&
+				strings.HasSuffix(origin, suffix) {
+				// the wildcard must only match subdomain labels
+				sub := origin[len(prefix) : len(origin)-len(suffix)]
+				if !strings.ContainsAny(sub, "/:@") {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// splitEnv splits a comma separated environment variable, using def when it is not set
+func splitEnv(key, def string) []string {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		value = def
+	}
+
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+
+	return false
+}
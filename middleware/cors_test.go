@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var corsTests = []struct {
+	name   string
+	origin string
+	want   bool
+}{
+	{"exact match", "https://app.example.com", true},
+	{"wildcard subdomain", "https://admin.example.org", true},
+	{"wildcard nested subdomain", "https://a.b.example.org", true},
+	{"wildcard needs a subdomain", "https://example.org", false},
+	{"wrong scheme", "http://admin.example.org", false},
+	{"suffix trick", "https://evil.com.example.org.attacker.io", false},
+	{"unknown origin", "https://evil.com", false},
+}
+
+func TestCORSConfig_originAllowed(t *testing.T) {
+	c := CORSConfig{AllowedOrigins: []string{"https://app.example.com", "https://*.example.org"}}
+
+	for _, e := range corsTests {
+		if got := c.originAllowed(e.origin); got != e.want {
+			t.Errorf("%s: expected %v but got %v", e.name, e.want, got)
+		}
+	}
+}
+
+func TestNewCORSConfig_WildcardCredentials(t *testing.T) {
+	t.Setenv("CORS_ALLOW_CREDENTIALS", "true")
+
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://app.example.com")
+	if !NewCORSConfig().AllowCredentials {
+		t.Error("expected credentials for a listed origin")
+	}
+
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://app.example.com,*")
+	if NewCORSConfig().AllowCredentials {
+		t.Error("expected no credentials along with the * origin")
+	}
+}
+
+func TestNewCORSConfig_ExposedHeaders(t *testing.T) {
+	want := []string{"ETag", "Location", "Idempotent-Replayed"}
+	if got := NewCORSConfig().ExposedHeaders; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("expected the api's headers to be exposed by default, got %v", got)
+	}
+
+	t.Setenv("CORS_EXPOSED_HEADERS", "")
+	if got := NewCORSConfig().ExposedHeaders; len(got) != 0 {
+		t.Errorf("expected no exposed headers when set empty, got %v", got)
+	}
+}
+
+func TestMiddleware_CORS(t *testing.T) {
+	m := &Middleware{
+		CORSConfig: CORSConfig{
+			AllowedOrigins:   []string{"https://*.example.com"},
+			AllowedMethods:   []string{"GET", "POST"},
+			AllowedHeaders:   []string{"Content-Type", "Authorization"},
+			AllowCredentials: true,
+			MaxAge:           600,
+		},
+	}
+
+	called := false
+	next := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+	handler := m.CORS(next)
+
+	// preflight
+	req := httptest.NewRequest(http.MethodOptions, "/api/users", nil)
+	req.Header.Set("Origin", "https://spa.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "content-type, authorization")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if called {
+		t.Error("preflight should not call the next handler")
+	}
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("preflight: expected status %d but got %d", http.StatusNoContent, rr.Code)
+	}
+	if rr.Header().Get("Access-Control-Allow-Origin") != "https://spa.example.com" {
+		t.Error("preflight: wrong allow origin", rr.Header().Get("Access-Control-Allow-Origin"))
+	}
+	if rr.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Error("preflight: credentials not allowed")
+	}
+	if rr.Header().Get("Access-Control-Max-Age") != "600" {
+		t.Error("preflight: wrong max age", rr.Header().Get("Access-Control-Max-Age"))
+	}
+
+	// preflight with a method that is not allowed
+	req = httptest.NewRequest(http.MethodOptions, "/api/users", nil)
+	req.Header.Set("Origin", "https://spa.example.com")
+	req.Header.Set("Access-Control-Request-Method", "DELETE")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("disallowed method: expected status %d but got %d", http.StatusForbidden, rr.Code)
+	}
+
+	// simple request from an unknown origin
+	called = false
+	req = httptest.NewRequest(http.MethodGet, "/api/users", nil)
+	req.Header.Set("Origin", "https://evil.com")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if !called {
+		t.Error("next handler not called")
+	}
+	if rr.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Error("unknown origin should not get cors headers")
+	}
+}
@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// bufferedWriter holds the response so an etag can be computed before anything is sent
+type bufferedWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (b *bufferedWriter) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedWriter) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.buf.Write(p)
+}
+
+// ETag adds an etag to successful GET responses, hashing the body unless the
+// handler already set one (eg from UpdatedAt), and answers a matching
+// If-None-Match with a 304.
+func (m *Middleware) ETag(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		bw := &bufferedWriter{ResponseWriter: rw}
+		next.ServeHTTP(bw, r)
+
+		if bw.status == 0 {
+			bw.status = http.StatusOK
+		}
+
+		if bw.status == http.StatusOK {
+			etag := rw.Header().Get("ETag")
+			if etag == "" {
+				sum := sha256.Sum256(bw.buf.Bytes())
+				etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+				rw.Header().Set("ETag", etag)
+			}
+
+			if NoneMatch(r, etag) {
+				rw.Header().Del("Content-Type")
+				rw.Header().Del("Content-Length")
+				rw.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+
+		rw.WriteHeader(bw.status)
+		_, _ = rw.Write(bw.buf.Bytes())
+	})
+}
+
+// NoneMatch reports whether the If-None-Match header matches etag, ie the client's copy is fresh
+func NoneMatch(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+
+	return matchETag(header, etag, true)
+}
+
+// IfMatchFails reports whether an If-Match header is present and does not match etag,
+// in which case the write must be rejected with a 412
+func IfMatchFails(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return false
+	}
+
+	return !matchETag(header, etag, false)
+}
+
+// matchETag checks a list of etags from a header. Weak comparison ignores the W/ prefix.
+func matchETag(header, etag string, weak bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+			etag = strings.TrimPrefix(etag, "W/")
+		} else if strings.HasPrefix(candidate, "W/") || strings.HasPrefix(etag, "W/") {
+			continue
+		}
+
+		if candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddleware_ETag(t *testing.T) {
+	m := &Middleware{}
+
+	body := `{"id":1}`
+	handler := m.ETag(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		_, _ = rw.Write([]byte(body))
+	}))
+
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/users", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := get("")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" || first.Body.String() != body {
+		t.Fatalf("expected 200 with an etag, got %d %q %q", first.Code, etag, first.Body.String())
+	}
+
+	cached := get(etag)
+	if cached.Code != http.StatusNotModified || cached.Body.Len() != 0 {
+		t.Errorf("matching If-None-Match: expected an empty 304 but got %d %q", cached.Code, cached.Body.String())
+	}
+
+	if weak := get("W/" + etag); weak.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match uses weak comparison, expected 304 but got %d", weak.Code)
+	}
+
+	body = `{"id":2}`
+	changed := get(etag)
+	if changed.Code != http.StatusOK || changed.Header().Get("ETag") == etag {
+		t.Errorf("changed body: expected 200 with a new etag, got %d %q", changed.Code, changed.Header().Get("ETag"))
+	}
+}
+
+func TestMiddleware_ETagKeepsHandlerETag(t *testing.T) {
+	m := &Middleware{}
+
+	handler := m.ETag(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("ETag", `"user-1-5"`)
+		_, _ = rw.Write([]byte(`{"id":1}`))
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/users/1", nil)
+	req.Header.Set("If-None-Match", `"user-1-4", "user-1-5"`)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotModified || rr.Header().Get("ETag") != `"user-1-5"` {
+		t.Errorf("expected 304 with the handler's etag, got %d %q", rr.Code, rr.Header().Get("ETag"))
+	}
+
+	// errors are passed through untouched
+	notFound := m.ETag(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusNotFound)
+	}))
+	rr = httptest.NewRecorder()
+	notFound.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/users/9", nil))
+	if rr.Code != http.StatusNotFound || rr.Header().Get("ETag") != "" {
+		t.Errorf("expected a 404 without an etag, got %d %q", rr.Code, rr.Header().Get("ETag"))
+	}
+}
+
+var ifMatchTests = []struct {
+	name    string
+	ifMatch string
+	fails   bool
+}{
+	{"no header", "", false},
+	{"match", `"user-1-5"`, false},
+	{"one of many", `"user-1-4", "user-1-5"`, false},
+	{"any", "*", false},
+	{"stale", `"user-1-4"`, true},
+	{"weak never matches", `W/"user-1-5"`, true},
+}
+
+func TestIfMatchFails(t *testing.T) {
+	for _, e := range ifMatchTests {
+		req := httptest.NewRequest(http.MethodPut, "/api/v1/users/1", nil)
+		if e.ifMatch != "" {
+			req.Header.Set("If-Match", e.ifMatch)
+		}
+		if got := IfMatchFails(req, `"user-1-5"`); got != e.fails {
+			t.Errorf("%s: expected %v but got %v", e.name, e.fails, got)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"myapp/apperr"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	idempotencyPrefix = "idempotency"
+	maxIdempotencyKey = 255
+	maxIdempotentBody = 1048576
+)
+
+// IdempotencyConfig holds how long responses are kept for replay
+type IdempotencyConfig struct {
+	// TTL is how long a finished response is replayed for
+	TTL time.Duration
+	// LockTTL is how long a request may be in flight before a retry is let through
+	LockTTL time.Duration
+
+	mu *sync.Mutex
+}
+
+// NewIdempotencyConfig reads the idempotency settings from the environment (.env)
+func NewIdempotencyConfig() IdempotencyConfig {
+	ttl, err := strconv.Atoi(os.Getenv("IDEMPOTENCY_TTL"))
+	if err != nil {
+		ttl = 86400
+	}
+
+	return IdempotencyConfig{
+		TTL:     time.Duration(ttl) * time.Second,
+		LockTTL: time.Minute,
+		mu:      &sync.Mutex{},
+	}
+}
+
+// idempotentResponse is what is stored in the cache for each key, as json so any
+// cache backend can hold it
+type idempotentResponse struct {
+	Pending  bool        `json:"pending"`
+	BodyHash string      `json:"body_hash"`
+	Status   int         `json:"status"`
+	Header   http.Header `json:"header"`
+	Body     []byte      `json:"body"`
+}
+
+// Idempotent replays the first response for a repeated Idempotency-Key, so
+// retried POSTs do not create duplicates. Add it to the routes that need it
+// with r.With(a.Middleware.Idempotent). Requests without the header are not affected.
+func (m *Middleware) Idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" || r.Method != http.MethodPost {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKey {
+			apperr.Write(m.App, rw, r, apperr.BadRequest(fmt.Sprintf("%s must be at most %d characters", idempotencyHeader, maxIdempotencyKey), nil))
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentBody+1))
+		if err != nil || len(body) > maxIdempotentBody {
+			apperr.Write(m.App, rw, r, apperr.BadRequest("Could not read the request body", err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		sum := sha256.Sum256(body)
+		bodyHash := hex.EncodeToString(sum[:])
+		cacheKey := fmt.Sprintf("%s:%s:%s", idempotencyPrefix, m.idempotencyOwner(r), key)
+
+		previous, err := m.startIdempotent(cacheKey, bodyHash)
+		if err != nil {
+			apperr.Write(m.App, rw, r, err)
+			return
+		}
+
+		if previous != nil {
+			switch {
+			case previous.BodyHash != bodyHash:
+				apperr.Write(m.App, rw, r, apperr.New(http.StatusUnprocessableEntity, fmt.Sprintf("%s was already used with a different request body", idempotencyHeader), nil))
+			case previous.Pending:
+				apperr.Write(m.App, rw, r, apperr.New(http.StatusConflict, "A request with this Idempotency-Key is still being processed", nil))
+			default:
+				replay(rw, previous)
+			}
+			return
+		}
+
+		ww := middleware.NewWrapResponseWriter(rw, r.ProtoMajor)
+		var buf bytes.Buffer
+		ww.Tee(&buf)
+
+		finished := false
+		defer func() {
+			if !finished {
+				// the handler panicked, let the client retry
+				_ = m.App.Cache.Forget(cacheKey)
+			}
+		}()
+
+		next.ServeHTTP(ww, r)
+		finished = true
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		if status >= http.StatusInternalServerError {
+			// server errors are not final, the next retry runs the request again
+			_ = m.App.Cache.Forget(cacheKey)
+			return
+		}
+
+		header := ww.Header().Clone()
+		header.Del("Set-Cookie")
+
+		err = m.saveIdempotent(cacheKey, idempotentResponse{
+			BodyHash: bodyHash,
+			Status:   status,
+			Header:   header,
+			Body:     buf.Bytes(),
+		}, m.Idempotency.TTL)
+		if err != nil {
+			m.App.ErrorLog.Println("error saving idempotent response:", err)
+		}
+	})
+}
+
+// startIdempotent returns the stored response for cacheKey, or marks the key as in flight and returns nil
+func (m *Middleware) startIdempotent(cacheKey, bodyHash string) (*idempotentResponse, error) {
+	// the cache has no atomic set-if-missing, so at least stop races within this instance
+	m.Idempotency.mu.Lock()
+	defer m.Idempotency.mu.Unlock()
+
+	exists, err := m.App.Cache.Has(cacheKey)
+	if err != nil {
+		return nil, apperr.Internal(err)
+	}
+
+	if exists {
+		value, err := m.App.Cache.Get(cacheKey)
+		if err != nil {
+			return nil, apperr.Internal(err)
+		}
+
+		s, ok := value.(string)
+		if !ok {
+			return nil, apperr.Internal(fmt.Errorf("idempotency: unexpected cache value %T", value))
+		}
+
+		var previous idempotentResponse
+		if err := json.Unmarshal([]byte(s), &previous); err != nil {
+			return nil, apperr.Internal(err)
+		}
+
+		return &previous, nil
+	}
+
+	err = m.saveIdempotent(cacheKey, idempotentResponse{Pending: true, BodyHash: bodyHash}, m.Idempotency.LockTTL)
+	if err != nil {
+		return nil, apperr.Internal(err)
+	}
+
+	return nil, nil
+}
+
+func (m *Middleware) saveIdempotent(cacheKey string, resp idempotentResponse, ttl time.Duration) error {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	return m.App.Cache.Set(cacheKey, string(b), int(ttl.Seconds()))
+}
+
+// idempotencyOwner scopes keys to the user, so clients can't replay each other's responses
+func (m *Middleware) idempotencyOwner(r *http.Request) string {
+	if user, ok := UserFromContext(r.Context()); ok {
+		return strconv.Itoa(user.ID)
+	}
+
+	if m.App.Session.Exists(r.Context(), "userID") {
+		return strconv.Itoa(m.App.Session.GetInt(r.Context(), "userID"))
+	}
+
+	return "guest"
+}
+
+// replay writes a stored response back to the client
+func replay(rw http.ResponseWriter, resp *idempotentResponse) {
+	for k, v := range resp.Header {
+		rw.Header()[k] = v
+	}
+	rw.Header().Set("Idempotent-Replayed", "true")
+	rw.WriteHeader(resp.Status)
+	_, _ = rw.Write(resp.Body)
+}
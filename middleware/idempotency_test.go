@@ -0,0 +1,144 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"myapp/data"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cmd-ctrl-q/celeritas"
+)
+
+// memoryCache is a cache.Cache kept in a map, ttls are ignored
+type memoryCache struct {
+	mu    sync.Mutex
+	items map[string]interface{}
+}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{items: make(map[string]interface{})}
+}
+
+func (c *memoryCache) Has(key string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.items[key]
+	return ok, nil
+}
+
+func (c *memoryCache) Get(key string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.items[key]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return v, nil
+}
+
+func (c *memoryCache) Set(key string, value interface{}, expires ...int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items[key] = value
+	return nil
+}
+
+func (c *memoryCache) Forget(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.items, key)
+	return nil
+}
+
+func (c *memoryCache) EmptyByMatch(match string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k := range c.items {
+		if strings.HasPrefix(k, match) {
+			delete(c.items, k)
+		}
+	}
+	return nil
+}
+
+func (c *memoryCache) Empty() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items = make(map[string]interface{})
+	return nil
+}
+
+func TestMiddleware_Idempotent(t *testing.T) {
+	m := &Middleware{
+		App: &celeritas.Celeritas{
+			Cache:    newMemoryCache(),
+			ErrorLog: log.New(io.Discard, "", 0),
+		},
+		Idempotency: NewIdempotencyConfig(),
+	}
+
+	calls := 0
+	handler := m.Idempotent(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		calls++
+		rw.Header().Set("Location", "/api/v1/users/7")
+		rw.WriteHeader(http.StatusCreated)
+		_, _ = rw.Write([]byte(`{"id":7}`))
+	}))
+
+	send := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/users", strings.NewReader(body))
+		req.Header.Set(idempotencyHeader, key)
+		req.Header.Set("Accept", "application/json")
+		req = req.WithContext(WithUser(req.Context(), &data.User{ID: 1}))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := send("abc", `{"email":"a@b.com"}`)
+	if first.Code != http.StatusCreated || calls != 1 {
+		t.Fatalf("first request: expected 201 and 1 call, got %d and %d calls", first.Code, calls)
+	}
+
+	// retry is replayed without running the handler
+	retry := send("abc", `{"email":"a@b.com"}`)
+	if calls != 1 {
+		t.Error("retry ran the handler again")
+	}
+	if retry.Code != http.StatusCreated || retry.Body.String() != `{"id":7}` {
+		t.Errorf("retry: wrong response %d %s", retry.Code, retry.Body.String())
+	}
+	if retry.Header().Get("Location") != "/api/v1/users/7" || retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("retry: headers not replayed", retry.Header())
+	}
+
+	// same key, different body
+	reused := send("abc", `{"email":"other@b.com"}`)
+	if reused.Code != http.StatusUnprocessableEntity {
+		t.Errorf("reused key: expected 422 but got %d", reused.Code)
+	}
+
+	// still in flight
+	sum := sha256.Sum256([]byte(`{"email":"c@d.com"}`))
+	_ = m.saveIdempotent("idempotency:1:in-flight", idempotentResponse{Pending: true, BodyHash: hex.EncodeToString(sum[:])}, m.Idempotency.LockTTL)
+	pending := send("in-flight", `{"email":"c@d.com"}`)
+	if pending.Code != http.StatusConflict {
+		t.Errorf("in flight: expected 409 but got %d", pending.Code)
+	}
+
+	// another user may use the same key
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/users", strings.NewReader(`{"email":"a@b.com"}`))
+	req.Header.Set(idempotencyHeader, "abc")
+	req = req.WithContext(WithUser(req.Context(), &data.User{ID: 2}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if calls != 2 {
+		t.Error("a different user's key should not be replayed")
+	}
+}
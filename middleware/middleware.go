@@ -8,6 +8,11 @@ import (
 )
 
 type Middleware struct {
-	App    *celeritas.Celeritas
-	Models data.Models
+	App         *celeritas.Celeritas
+	Models      data.Models
+	CORSConfig  CORSConfig
+	Alerts      AlertConfig
+	Idempotency IdempotencyConfig
+	Admins      AdminConfig
+	PageCache   PageCacheConfig
 }
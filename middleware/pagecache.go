@@ -0,0 +1,300 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cmd-ctrl-q/celeritas/cache"
+	"github.com/justinas/nosurf"
+)
+
+const (
+	pageCacheHeader = "X-Cache"
+	pagePrefix      = "page"
+	pageTagPrefix   = "pagetag"
+	maxCachedPage   = 1048576
+)
+
+// PageCacheConfig holds the full page cache settings
+type PageCacheConfig struct {
+	// TTL is how long a page is kept when the handler doesn't say with Cache-Control max-age
+	TTL time.Duration
+	// Vary lists the request headers that give a page a different cache entry
+	Vary []string
+}
+
+// NewPageCacheConfig reads the page cache settings from the environment (.env)
+func NewPageCacheConfig() PageCacheConfig {
+	ttl, err := strconv.Atoi(os.Getenv("PAGE_CACHE_TTL"))
+	if err != nil {
+		ttl = 60
+	}
+
+	return PageCacheConfig{
+		TTL:  time.Duration(ttl) * time.Second,
+		Vary: splitEnv("PAGE_CACHE_VARY", "Accept,Accept-Language"),
+	}
+}
+
+// cachedPage is what is stored in the cache for each page, as json so any
+// cache backend can hold it. Tags holds the version of each tag when the page
+// was stored, the page is stale once any of them has been purged.
+type cachedPage struct {
+	Status int               `json:"status"`
+	Header http.Header       `json:"header"`
+	Body   []byte            `json:"body"`
+	Tags   map[string]string `json:"tags"`
+}
+
+// CachePage caches the complete response to anonymous GETs in App.Cache, for
+// pages that are the same for every visitor. Add it to a route with
+// a.App.Routes.With(a.Middleware.CachePage("users")). The tags name what the
+// page shows, PurgePages with one of them drops the page.
+//
+// Only 200s where the handler set no cookie are kept, and handlers can opt
+// out or change the ttl with Cache-Control (no-store, no-cache, private or
+// max-age). Pages with the visitor's csrf token in them (eg anything using
+// the jet layout) are never kept, the token belongs to one visitor. The
+// X-Cache header says HIT, MISS or BYPASS.
+func (m *Middleware) CachePage(tags ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if m.App.Cache == nil || !m.cacheable(r) {
+				rw.Header().Set(pageCacheHeader, "BYPASS")
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			key := m.pageKey(r)
+			versions, err := tagVersions(m.App.Cache, tags)
+			if err != nil {
+				m.App.ErrorLog.Println("page cache:", err)
+				rw.Header().Set(pageCacheHeader, "BYPASS")
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			if page, ok := m.cachedPage(key); ok && sameVersions(page.Tags, versions) {
+				for name, values := range page.Header {
+					rw.Header()[name] = values
+				}
+				rw.Header().Set(pageCacheHeader, "HIT")
+				rw.WriteHeader(page.Status)
+				if r.Method != http.MethodHead {
+					_, _ = rw.Write(page.Body)
+				}
+				return
+			}
+
+			rw.Header().Set(pageCacheHeader, "MISS")
+			rw.Header().Add("Vary", strings.Join(m.PageCache.Vary, ", "))
+			// cookies set before now are the visitor's own (eg the csrf cookie)
+			cookies := len(rw.Header()["Set-Cookie"])
+			rec := &pageRecorder{ResponseWriter: rw, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+
+			setCookie := len(rw.Header()["Set-Cookie"]) > cookies
+			ttl, ok := pageTTL(rec, setCookie, m.PageCache.TTL)
+			if !ok || r.Method == http.MethodHead || hasCSRFToken(rec, r) {
+				return
+			}
+
+			header := rw.Header().Clone()
+			header.Del(pageCacheHeader)
+			header.Del("Set-Cookie")
+			page := cachedPage{Status: rec.status, Header: header, Body: rec.body.Bytes(), Tags: versions}
+			stored, err := json.Marshal(page)
+			if err != nil {
+				m.App.ErrorLog.Println("page cache:", err)
+				return
+			}
+			if err := m.App.Cache.Set(key, string(stored), int(ttl/time.Second)); err != nil {
+				m.App.ErrorLog.Println("page cache:", err)
+			}
+		})
+	}
+}
+
+// PurgePages drops every cached page tagged with any of tags. Call it after
+// writing the models the pages show, eg PurgePages(app.Cache, "users").
+func PurgePages(c cache.Cache, tags ...string) error {
+	if c == nil {
+		return nil
+	}
+
+	version := strconv.FormatInt(time.Now().UnixNano(), 10)
+	for _, tag := range tags {
+		if err := c.Set(pageTagPrefix+":"+tag, version); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cacheable reports whether the request may be answered from the cache
+func (m *Middleware) cacheable(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" {
+		return false
+	}
+	if strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+		return false
+	}
+
+	return !m.App.Session.Exists(r.Context(), "userID")
+}
+
+// pageKey is built from the path, the sorted query and the Vary headers
+func (m *Middleware) pageKey(r *http.Request) string {
+	hash := sha256.New()
+	hash.Write([]byte(r.URL.Path))
+	hash.Write([]byte{0})
+
+	query := r.URL.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range query[name] {
+			hash.Write([]byte(name + "=" + value + "&"))
+		}
+	}
+
+	for _, header := range m.PageCache.Vary {
+		hash.Write([]byte{0})
+		hash.Write([]byte(r.Header.Get(header)))
+	}
+
+	return pagePrefix + ":" + hex.EncodeToString(hash.Sum(nil))
+}
+
+// cachedPage gets a stored page, any error is a miss
+func (m *Middleware) cachedPage(key string) (cachedPage, bool) {
+	var page cachedPage
+
+	value, err := m.App.Cache.Get(key)
+	if err != nil {
+		return page, false
+	}
+
+	stored, ok := value.(string)
+	if !ok || json.Unmarshal([]byte(stored), &page) != nil {
+		return page, false
+	}
+
+	return page, true
+}
+
+// tagVersions gets the current version of each tag, "0" for a tag never purged
+func tagVersions(c cache.Cache, tags []string) (map[string]string, error) {
+	versions := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		key := pageTagPrefix + ":" + tag
+		has, err := c.Has(key)
+		if err != nil {
+			return nil, err
+		}
+
+		versions[tag] = "0"
+		if !has {
+			continue
+		}
+
+		value, err := c.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if version, ok := value.(string); ok {
+			versions[tag] = version
+		}
+	}
+
+	return versions, nil
+}
+
+func sameVersions(stored, current map[string]string) bool {
+	if len(stored) != len(current) {
+		return false
+	}
+	for tag, version := range current {
+		if stored[tag] != version {
+			return false
+		}
+	}
+
+	return true
+}
+
+// pageTTL decides from the response whether to keep it and for how long
+func pageTTL(rec *pageRecorder, setCookie bool, ttl time.Duration) (time.Duration, bool) {
+	if rec.status != http.StatusOK || rec.overflow || setCookie {
+		return 0, false
+	}
+
+	for _, directive := range strings.Split(rec.Header().Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store", directive == "no-cache", directive == "private":
+			return 0, false
+		case strings.HasPrefix(directive, "max-age="), strings.HasPrefix(directive, "s-maxage="):
+			seconds, err := strconv.Atoi(directive[strings.Index(directive, "=")+1:])
+			if err != nil || seconds <= 0 {
+				return 0, false
+			}
+			ttl = time.Duration(seconds) * time.Second
+		}
+	}
+
+	return ttl, ttl >= time.Second
+}
+
+// hasCSRFToken reports whether the page holds the visitor's csrf token
+func hasCSRFToken(rec *pageRecorder, r *http.Request) bool {
+	token := nosurf.Token(r)
+	return token != "" && bytes.Contains(rec.body.Bytes(), []byte(token))
+}
+
+// pageRecorder passes the response on to the client and keeps a copy of it
+type pageRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+	overflow    bool
+}
+
+func (p *pageRecorder) WriteHeader(status int) {
+	if !p.wroteHeader {
+		p.status = status
+		p.wroteHeader = true
+	}
+	p.ResponseWriter.WriteHeader(status)
+}
+
+func (p *pageRecorder) Write(b []byte) (int, error) {
+	p.wroteHeader = true
+	if !p.overflow {
+		if p.body.Len()+len(b) > maxCachedPage {
+			// too big to keep
+			p.overflow = true
+			p.body.Reset()
+		} else {
+			p.body.Write(b)
+		}
+	}
+
+	return p.ResponseWriter.Write(b)
+}
@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/cmd-ctrl-q/celeritas"
+	"github.com/justinas/nosurf"
+)
+
+func TestMiddleware_CachePage(t *testing.T) {
+	session := scs.New()
+	m := &Middleware{
+		App: &celeritas.Celeritas{
+			Cache:    newMemoryCache(),
+			Session:  session,
+			ErrorLog: log.New(io.Discard, "", 0),
+		},
+		PageCache: PageCacheConfig{TTL: 60e9, Vary: []string{"Accept"}},
+	}
+
+	renders := 0
+	cacheControl := ""
+	handler := m.CachePage("users")(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		renders++
+		if cacheControl != "" {
+			rw.Header().Set("Cache-Control", cacheControl)
+		}
+		rw.Header().Set("Content-Type", "text/html")
+		_, _ = rw.Write([]byte("<h1>users</h1>"))
+	}))
+
+	get := func(url string, loggedIn bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		ctx, err := session.Load(req.Context(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loggedIn {
+			session.Put(ctx, "userID", 1)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req.WithContext(ctx))
+		return rr
+	}
+
+	if rr := get("/users?b=2&a=1", false); rr.Header().Get("X-Cache") != "MISS" || renders != 1 {
+		t.Fatal("expected the first request to miss, got", rr.Header().Get("X-Cache"))
+	}
+
+	rr := get("/users?a=1&b=2", false)
+	if rr.Header().Get("X-Cache") != "HIT" || renders != 1 {
+		t.Error("expected the same query in another order to hit, got", rr.Header().Get("X-Cache"))
+	}
+	if rr.Body.String() != "<h1>users</h1>" || rr.Header().Get("Content-Type") != "text/html" {
+		t.Error("cached page not replayed", rr.Header(), rr.Body.String())
+	}
+
+	if rr := get("/users?a=1&b=2", true); rr.Header().Get("X-Cache") != "BYPASS" || renders != 2 {
+		t.Error("expected signed in users to bypass the cache, got", rr.Header().Get("X-Cache"))
+	}
+
+	if err := PurgePages(m.App.Cache, "users"); err != nil {
+		t.Fatal(err)
+	}
+	if rr := get("/users?a=1&b=2", false); rr.Header().Get("X-Cache") != "MISS" || renders != 3 {
+		t.Error("expected a miss after purging the tag, got", rr.Header().Get("X-Cache"))
+	}
+
+	cacheControl = "no-store"
+	get("/other", false)
+	get("/other", false)
+	if renders != 5 {
+		t.Error("expected no-store pages to be rendered every time, got", renders)
+	}
+}
+
+func TestMiddleware_CachePageCSRF(t *testing.T) {
+	session := scs.New()
+	m := &Middleware{
+		App: &celeritas.Celeritas{
+			Cache:    newMemoryCache(),
+			Session:  session,
+			ErrorLog: log.New(io.Discard, "", 0),
+		},
+		PageCache: PageCacheConfig{TTL: 60e9},
+	}
+
+	// like the jet layout, the page holds the visitor's csrf token
+	page := m.CachePage()(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte(`<meta name="csrf-token" content="` + nosurf.Token(r) + `">`))
+	}))
+	handler := session.LoadAndSave(nosurf.New(page))
+
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rr.Header().Get("X-Cache") != "MISS" {
+			t.Fatal("expected a page with a csrf token never to be cached, got", rr.Header().Get("X-Cache"))
+		}
+	}
+}
+
+func TestPageTTL(t *testing.T) {
+	for _, e := range []struct {
+		cacheControl string
+		setCookie    bool
+		status       int
+		want         int
+	}{
+		{"", false, http.StatusOK, 60},
+		{"public, max-age=300", false, http.StatusOK, 300},
+		{"max-age=0", false, http.StatusOK, 0},
+		{"private", false, http.StatusOK, 0},
+		{"", true, http.StatusOK, 0},
+		{"", false, http.StatusNotFound, 0},
+	} {
+		rec := &pageRecorder{ResponseWriter: httptest.NewRecorder(), status: e.status}
+		rec.Header().Set("Cache-Control", e.cacheControl)
+
+		ttl, ok := pageTTL(rec, e.setCookie, 60e9)
+		got := 0
+		if ok {
+			got = int(ttl.Seconds())
+		}
+		if got != e.want {
+			t.Errorf("%q cookie=%v status=%d: expected %d seconds, got %d", e.cacheControl, e.setCookie, e.status, e.want, got)
+		}
+	}
+}
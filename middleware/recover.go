@@ -0,0 +1,219 @@
+package middleware
+
+import (
+	"fmt"
+	"myapp/apperr"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cmd-ctrl-q/celeritas/mailer"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// redacted headers and form/query fields never leave the server in an alert
+var (
+	redactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "X-Csrf-Token", "Idempotency-Key"}
+	redactedFields  = []string{"password", "csrf_token", "token", "email", "signature", "hash"}
+)
+
+// Mailer sends a message, *mailer.Mail satisfies it
+type Mailer interface {
+	Send(msg mailer.Message) error
+}
+
+// AlertConfig holds who gets emailed when a handler panics
+type AlertConfig struct {
+	To       []string
+	From     string
+	Interval time.Duration
+	// Mailer sends the alerts, the app's mailer when it is nil
+	Mailer Mailer
+
+	mu *sync.Mutex
+	// sent is when each route last alerted, entries older than Interval are dropped
+	sent map[string]time.Time
+}
+
+// NewAlertConfig reads the alert settings from the environment (.env)
+func NewAlertConfig() AlertConfig {
+	interval, err := strconv.Atoi(os.Getenv("ALERT_INTERVAL"))
+	if err != nil {
+		interval = 300
+	}
+
+	return AlertConfig{
+		To:       splitEnv("ALERT_EMAILS", ""),
+		From:     os.Getenv("ALERT_FROM"),
+		Interval: time.Duration(interval) * time.Second,
+		mu:       &sync.Mutex{},
+		sent:     make(map[string]time.Time),
+	}
+}
+
+// allow reports whether an alert for key may be sent now, at most once per interval
+func (c AlertConfig) allow(key string) bool {
+	if len(c.To) == 0 || c.mu == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, last := range c.sent {
+		if time.Since(last) >= c.Interval {
+			delete(c.sent, k)
+		}
+	}
+
+	if _, ok := c.sent[key]; ok {
+		return false
+	}
+	c.sent[key] = time.Now()
+
+	return true
+}
+
+// Recover catches a panic in any later handler, logs the stack with the
+// request id, writes the standard 500 page (or json) and emails the developers.
+func (m *Middleware) Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(rw, r.ProtoMajor)
+
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				// the handler wants the connection dropped
+				panic(rec)
+			}
+
+			reqID := middleware.GetReqID(r.Context())
+			stack := debug.Stack()
+			m.App.ErrorLog.Printf("[%s] panic: %v\n%s", reqID, rec, stack)
+
+			m.alert(r, reqID, rec, stack)
+
+			if ww.Status() != 0 {
+				// part of the response has already been sent, nothing more can be done
+				return
+			}
+			apperr.Write(m.App, ww, r, apperr.Internal(fmt.Errorf("panic: %v", rec)))
+		}()
+
+		next.ServeHTTP(ww, r)
+	})
+}
+
+// alertKey is what alerts are throttled by: the method and the route pattern,
+// not the path or the panic, so a crawler can't grow the list without end
+func alertKey(r *http.Request) string {
+	pattern := "unmatched route"
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+		pattern = rctx.RoutePattern()
+	}
+
+	return r.Method + " " + pattern
+}
+
+// alert emails the panic to the developers in the background
+func (m *Middleware) alert(r *http.Request, reqID string, rec interface{}, stack []byte) {
+	if !m.Alerts.allow(alertKey(r)) {
+		return
+	}
+
+	var data struct {
+		AppName   string
+		RequestID string
+		Panic     string
+		Stack     string
+		Request   string
+		Time      string
+	}
+
+	data.AppName = m.App.AppName
+	data.RequestID = reqID
+	data.Panic = fmt.Sprint(rec)
+	data.Stack = string(stack)
+	data.Request = dumpRequest(r)
+	data.Time = time.Now().Format(time.RFC1123)
+
+	from := m.Alerts.From
+	if from == "" {
+		from = m.App.Mail.FromAddress
+	}
+
+	var mail Mailer = &m.App.Mail
+	if m.Alerts.Mailer != nil {
+		mail = m.Alerts.Mailer
+	}
+
+	for _, to := range m.Alerts.To {
+		msg := mailer.Message{
+			From:     from,
+			To:       to,
+			Subject:  fmt.Sprintf("[%s] panic: %v", m.App.AppName, rec),
+			Template: "panic-alert",
+			Data:     data,
+		}
+
+		// send directly so a slow mail server never holds up the request
+		go func() {
+			if err := mail.Send(msg); err != nil {
+				m.App.ErrorLog.Println("error sending panic alert:", err)
+			}
+		}()
+	}
+}
+
+// dumpRequest writes out the request with credentials and personal data removed
+func dumpRequest(r *http.Request) string {
+	clone := r.Clone(r.Context())
+	clone.Body = nil
+	clone.ContentLength = 0
+
+	for _, h := range redactedHeaders {
+		if clone.Header.Get(h) != "" {
+			clone.Header.Set(h, "[redacted]")
+		}
+	}
+
+	u := *r.URL
+	u.RawQuery = redactValues(r.URL.Query()).Encode()
+	clone.URL = &u
+	clone.RequestURI = u.RequestURI()
+
+	dump, err := httputil.DumpRequest(clone, false)
+	if err != nil {
+		return fmt.Sprintf("could not dump request: %v", err)
+	}
+
+	out := string(dump)
+	if len(r.PostForm) > 0 {
+		out += "\n" + redactValues(r.PostForm).Encode()
+	}
+
+	return out
+}
+
+func redactValues(values url.Values) url.Values {
+	clean := make(url.Values, len(values))
+	for key, v := range values {
+		if containsFold(redactedFields, key) || strings.Contains(strings.ToLower(key), "password") {
+			clean.Set(key, "[redacted]")
+			continue
+		}
+		clean[key] = v
+	}
+
+	return clean
+}
@@ -25,6 +25,12 @@ func (m *Middleware) CheckRemember(next http.Handler) http.Handler {
 				if len(key) > 0 {
 					// cookie contains data, validate it
 					split := strings.Split(key, "|")
+					if len(split) != 2 {
+						// malformed cookie, expire it
+						m.deleteRememberCookie(rw, r)
+						next.ServeHTTP(rw, r)
+						return
+					}
 					uid, hash := split[0], split[1]
 					id, _ := strconv.Atoi(uid)
 					// check if hash is valid
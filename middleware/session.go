@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"myapp/apperr"
+	"net/http"
+)
+
+// LoadSession loads the session for a route that is served outside the
+// celeritas routes. Their session middleware buffers the whole response, which
+// a stream can't wait for, so use this instead for streamed responses. Changes
+// to the session are not saved.
+func (m *Middleware) LoadSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var token string
+		if cookie, err := r.Cookie(m.App.Session.Cookie.Name); err == nil {
+			token = cookie.Value
+		}
+
+		ctx, err := m.App.Session.Load(r.Context(), token)
+		if err != nil {
+			apperr.Write(m.App, rw, r, apperr.Internal(err))
+			return
+		}
+
+		next.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
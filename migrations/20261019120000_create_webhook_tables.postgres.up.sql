@@ -0,0 +1,35 @@
+CREATE TABLE webhooks (
+    id SERIAL PRIMARY KEY,
+    url character varying(2048) NOT NULL,
+    events character varying(512) NOT NULL DEFAULT '*',
+    secret character varying(255) NOT NULL,
+    active integer NOT NULL DEFAULT 1,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    updated_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE TRIGGER set_timestamp
+    BEFORE UPDATE ON webhooks
+    FOR EACH ROW
+    EXECUTE PROCEDURE trigger_set_timestamp();
+
+CREATE TABLE webhook_deliveries (
+    id SERIAL PRIMARY KEY,
+    webhook_id integer NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    event character varying(255) NOT NULL,
+    payload text NOT NULL,
+    status character varying(20) NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    response_status integer NOT NULL DEFAULT 0,
+    last_error text NOT NULL DEFAULT '',
+    next_attempt timestamp without time zone NOT NULL DEFAULT now(),
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    updated_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX webhook_deliveries_due ON webhook_deliveries (status, next_attempt);
+
+CREATE TRIGGER set_timestamp
+    BEFORE UPDATE ON webhook_deliveries
+    FOR EACH ROW
+    EXECUTE PROCEDURE trigger_set_timestamp();
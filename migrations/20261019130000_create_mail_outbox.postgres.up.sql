@@ -0,0 +1,24 @@
+CREATE TABLE mail_outbox (
+    id SERIAL PRIMARY KEY,
+    to_address character varying(255) NOT NULL,
+    from_address character varying(255) NOT NULL DEFAULT '',
+    from_name character varying(255) NOT NULL DEFAULT '',
+    subject character varying(998) NOT NULL DEFAULT '',
+    template character varying(255) NOT NULL,
+    data text NOT NULL DEFAULT 'null',
+    attachments text NOT NULL DEFAULT '[]',
+    status character varying(20) NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    last_error text NOT NULL DEFAULT '',
+    next_attempt timestamp without time zone NOT NULL DEFAULT now(),
+    sent_at timestamp without time zone,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    updated_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX mail_outbox_due ON mail_outbox (status, next_attempt);
+
+CREATE TRIGGER set_timestamp
+    BEFORE UPDATE ON mail_outbox
+    FOR EACH ROW
+    EXECUTE PROCEDURE trigger_set_timestamp();
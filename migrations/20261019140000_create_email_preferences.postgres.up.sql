@@ -0,0 +1,14 @@
+CREATE TABLE email_preferences (
+    id SERIAL PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    category character varying(50) NOT NULL,
+    subscribed integer NOT NULL DEFAULT 1,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    updated_at timestamp without time zone NOT NULL DEFAULT now(),
+    UNIQUE (user_id, category)
+);
+
+CREATE TRIGGER set_timestamp
+    BEFORE UPDATE ON email_preferences
+    FOR EACH ROW
+    EXECUTE PROCEDURE trigger_set_timestamp();
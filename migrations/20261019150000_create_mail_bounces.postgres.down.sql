@@ -0,0 +1,2 @@
+drop table if exists mail_suppressions;
+drop table if exists mail_bounces;
@@ -0,0 +1,34 @@
+CREATE TABLE mail_bounces (
+    id SERIAL PRIMARY KEY,
+    user_id integer REFERENCES users(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    email character varying(255) NOT NULL,
+    provider character varying(50) NOT NULL,
+    event_id character varying(255),
+    kind character varying(20) NOT NULL,
+    reason text NOT NULL DEFAULT '',
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    updated_at timestamp without time zone NOT NULL DEFAULT now(),
+    UNIQUE (provider, event_id)
+);
+
+CREATE INDEX mail_bounces_email ON mail_bounces (email, kind, created_at);
+
+CREATE TRIGGER set_timestamp
+    BEFORE UPDATE ON mail_bounces
+    FOR EACH ROW
+    EXECUTE PROCEDURE trigger_set_timestamp();
+
+CREATE TABLE mail_suppressions (
+    id SERIAL PRIMARY KEY,
+    user_id integer REFERENCES users(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    email character varying(255) NOT NULL UNIQUE,
+    reason text NOT NULL DEFAULT '',
+    cleared_at timestamp without time zone,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    updated_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE TRIGGER set_timestamp
+    BEFORE UPDATE ON mail_suppressions
+    FOR EACH ROW
+    EXECUTE PROCEDURE trigger_set_timestamp();
@@ -0,0 +1,311 @@
+// Package openapi builds an OpenAPI 3 document from a list of operations and
+// the Go structs they read and write.
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Spec is an OpenAPI 3 document under construction. Error is a zero value of
+// the body written for every error response.
+type Spec struct {
+	Title      string
+	Version    string
+	ServerURL  string
+	Error      interface{}
+	operations []Operation
+	schemas    map[string]interface{}
+}
+
+// Param is a path or query parameter
+type Param struct {
+	Name        string
+	In          string
+	Description string
+	Type        string
+	Required    bool
+}
+
+// Operation describes one route. Request and Response are zero values of the
+// structs the handler decodes and writes, leave them nil when there is no body.
+type Operation struct {
+	Method      string
+	Path        string
+	Summary     string
+	Tag         string
+	Params      []Param
+	Request     interface{}
+	Response    interface{}
+	Status      int
+	ContentType string
+	Errors      []int
+	Auth        bool
+	// Conditional documents the ETag header and the 304 sent for a matching If-None-Match
+	Conditional bool
+}
+
+// New creates an empty spec
+func New(title, version, serverURL string) *Spec {
+	return &Spec{
+		Title:     title,
+		Version:   version,
+		ServerURL: serverURL,
+		schemas:   make(map[string]interface{}),
+	}
+}
+
+// Add describes an operation
+func (s *Spec) Add(op Operation) {
+	if op.Status == 0 {
+		op.Status = http.StatusOK
+	}
+	op.Method = strings.ToUpper(op.Method)
+	s.operations = append(s.operations, op)
+}
+
+// Has reports whether the method and path have been described
+func (s *Spec) Has(method, path string) bool {
+	for _, op := range s.operations {
+		if op.Method == strings.ToUpper(method) && op.Path == path {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Document builds the document, ready to be written as json
+func (s *Spec) Document() map[string]interface{} {
+	paths := make(map[string]interface{})
+
+	for _, op := range s.operations {
+		item, ok := paths[op.Path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[op.Path] = item
+		}
+		item[strings.ToLower(op.Method)] = s.operation(op)
+	}
+
+	if s.Error != nil {
+		s.schemas["Error"] = s.schemaOf(reflect.TypeOf(s.Error), true)
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   s.Title,
+			"version": s.Version,
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"url": s.ServerURL},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": s.schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{
+					"type":   "http",
+					"scheme": "bearer",
+				},
+			},
+		},
+	}
+}
+
+func (s *Spec) operation(op Operation) map[string]interface{} {
+	o := map[string]interface{}{
+		"summary":     op.Summary,
+		"operationId": operationID(op),
+	}
+
+	if op.Tag != "" {
+		o["tags"] = []string{op.Tag}
+	}
+
+	if op.Auth {
+		o["security"] = []interface{}{
+			map[string]interface{}{"bearerAuth": []string{}},
+		}
+	}
+
+	var params []interface{}
+	for _, p := range op.Params {
+		t := p.Type
+		if t == "" {
+			t = "string"
+		}
+		params = append(params, map[string]interface{}{
+			"name":        p.Name,
+			"in":          p.In,
+			"description": p.Description,
+			"required":    p.Required || p.In == "path",
+			"schema":      map[string]interface{}{"type": t},
+		})
+	}
+	if len(params) > 0 {
+		o["parameters"] = params
+	}
+
+	if op.Request != nil {
+		schema := s.schemaOf(reflect.TypeOf(op.Request), false)
+		o["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json":                  map[string]interface{}{"schema": schema},
+				"application/xml":                   map[string]interface{}{"schema": schema},
+				"application/x-www-form-urlencoded": map[string]interface{}{"schema": schema},
+			},
+		}
+	}
+
+	responses := make(map[string]interface{})
+	success := map[string]interface{}{"description": http.StatusText(op.Status)}
+	if op.Response != nil {
+		contentType := op.ContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		success["content"] = map[string]interface{}{
+			contentType: map[string]interface{}{"schema": s.schemaOf(reflect.TypeOf(op.Response), false)},
+		}
+	}
+	if op.Conditional {
+		success["headers"] = map[string]interface{}{
+			"ETag": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+		}
+		responses[statusKey(http.StatusNotModified)] = map[string]interface{}{"description": http.StatusText(http.StatusNotModified)}
+	}
+	responses[statusKey(op.Status)] = success
+
+	errs := op.Errors
+	if op.Auth {
+		errs = append(errs, http.StatusUnauthorized)
+	}
+	for _, status := range errs {
+		responses[statusKey(status)] = map[string]interface{}{
+			"description": http.StatusText(status),
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": map[string]interface{}{"$ref": "#/components/schemas/Error"},
+				},
+			},
+		}
+	}
+	o["responses"] = responses
+
+	return o
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaOf builds the json schema of t. Named structs are added to the
+// components and referenced, unless inline is set.
+func (s *Spec) schemaOf(t reflect.Type, inline bool) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == rawMessageType {
+		// any json value
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": s.schemaOf(t.Elem(), false)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schemaOf(t.Elem(), false)}
+	case reflect.Struct:
+		if t == timeType {
+			return map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		if t.Name() != "" && !inline {
+			if _, ok := s.schemas[t.Name()]; !ok {
+				// reserve the name first in case the struct refers to itself
+				s.schemas[t.Name()] = map[string]interface{}{}
+				s.schemas[t.Name()] = s.schemaOf(t, true)
+			}
+			return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		}
+		return s.structSchema(t)
+	default:
+		// interface{}, any json value
+		return map[string]interface{}{}
+	}
+}
+
+func (s *Spec) structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		tag := strings.Split(field.Tag.Get("json"), ",")
+		name := tag[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		properties[name] = s.schemaOf(field.Type, false)
+
+		omitempty := len(tag) > 1 && tag[1] == "omitempty"
+		if !omitempty && field.Type.Kind() != reflect.Ptr {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+
+	return schema
+}
+
+func operationID(op Operation) string {
+	id := strings.ToLower(op.Method)
+	for _, part := range strings.Split(op.Path, "/") {
+		part = strings.Trim(part, "{}")
+		for _, word := range strings.FieldsFunc(part, func(r rune) bool { return r == '-' || r == '_' || r == '.' }) {
+			id += strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+
+	return id
+}
+
+func statusKey(status int) string {
+	return strconv.Itoa(status)
+}
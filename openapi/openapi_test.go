@@ -0,0 +1,53 @@
+package openapi
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+type testUser struct {
+	ID        int             `json:"id"`
+	Email     string          `json:"email"`
+	Password  string          `json:"-"`
+	Nickname  *string         `json:"nickname"`
+	Tags      []string        `json:"tags,omitempty"`
+	Settings  json.RawMessage `json:"settings,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+func TestSpec_Document(t *testing.T) {
+	spec := New("test", "1.0.0", "/api")
+	spec.Add(Operation{Method: "get", Path: "/users/{id}", Response: testUser{}, Errors: []int{404}})
+
+	if !spec.Has("GET", "/users/{id}") {
+		t.Error("operation not found")
+	}
+
+	doc := spec.Document()
+	if _, err := json.Marshal(doc); err != nil {
+		t.Fatal("document is not valid json:", err)
+	}
+
+	schemas := doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	user, ok := schemas["testUser"].(map[string]interface{})
+	if !ok {
+		t.Fatal("named struct not added to the components")
+	}
+
+	properties := user["properties"].(map[string]interface{})
+	if _, ok := properties["Password"]; ok {
+		t.Error("fields tagged json:\"-\" should not be described")
+	}
+	if properties["created_at"].(map[string]interface{})["format"] != "date-time" {
+		t.Error("time.Time should be a date-time string")
+	}
+	if len(properties["settings"].(map[string]interface{})) != 0 {
+		t.Error("json.RawMessage should be any json value")
+	}
+
+	required := user["required"].([]string)
+	if len(required) != 3 {
+		t.Error("expected id, email and created_at to be required, got", required)
+	}
+}
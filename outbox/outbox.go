@@ -0,0 +1,387 @@
+// Package outbox sends mail from the mail_outbox table. Handlers insert a
+// message, ideally in the same transaction as the change it is about, and
+// workers deliver it in the background, retrying with exponential backoff
+// until it is sent or has failed MaxAttempts times and is dead. A caller that
+// needs to know how it went waits on the Pending returned by Send.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"myapp/backoff"
+	"myapp/data"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cmd-ctrl-q/celeritas/mailer"
+)
+
+var (
+	// ErrSent is returned when retrying or cancelling a message that was already sent
+	ErrSent = errors.New("outbox: the message was already sent")
+	// ErrPending is returned when retrying a message that is still waiting to be sent
+	ErrPending = errors.New("outbox: the message is already pending")
+	// ErrSending is returned when cancelling a message a worker may be sending,
+	// or that is waiting for its next attempt
+	ErrSending = errors.New("outbox: the message may be being sent")
+	// ErrSuppressed is returned by a Sender that won't send the message, eg
+	// because the recipient opted out of its category. It isn't retried.
+	ErrSuppressed = errors.New("outbox: the message was suppressed")
+)
+
+// Sender sends one message, *mailer.Mail satisfies it
+type Sender interface {
+	Send(msg mailer.Message) error
+}
+
+// Config holds the delivery settings
+type Config struct {
+	// MaxAttempts is how many times a message is tried before it is dead
+	MaxAttempts int
+	// Workers is how many messages are sent at once
+	Workers int
+	// BaseDelay is the wait before the first retry, it doubles on each retry up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// PollInterval is how often due messages are looked for
+	PollInterval time.Duration
+	// Lease is how long a worker has to send a message before another may take
+	// it, eg because the instance sending it stopped
+	Lease time.Duration
+}
+
+// NewConfig reads the outbox settings from the environment (.env)
+func NewConfig() Config {
+	attempts, err := strconv.Atoi(os.Getenv("MAIL_MAX_ATTEMPTS"))
+	if err != nil || attempts < 1 {
+		attempts = 6
+	}
+
+	workers, err := strconv.Atoi(os.Getenv("MAIL_WORKERS"))
+	if err != nil || workers < 1 {
+		workers = 2
+	}
+
+	return Config{
+		MaxAttempts:  attempts,
+		Workers:      workers,
+		BaseDelay:    30 * time.Second,
+		MaxDelay:     6 * time.Hour,
+		PollInterval: 10 * time.Second,
+		Lease:        5 * time.Minute,
+	}
+}
+
+// Backoff is the wait after the given number of failed attempts
+func (c Config) Backoff(attempts int) time.Duration {
+	return backoff.Exponential(c.BaseDelay, c.MaxDelay, attempts)
+}
+
+// Outbox queues and sends mail. A message is claimed in the database before it
+// is sent, so two workers (or instances) never send the same one.
+type Outbox struct {
+	Config
+	Models   data.Models
+	Sender   Sender
+	ErrorLog *log.Logger
+
+	queue   chan int
+	done    chan struct{}
+	running sync.WaitGroup
+
+	// waiters are the Pendings waited on in this instance, by message id
+	mu      sync.Mutex
+	waiters map[int][]*Pending
+}
+
+// New creates an outbox, call Start to begin sending
+func New(models data.Models, sender Sender, errorLog *log.Logger, config Config) *Outbox {
+	return &Outbox{
+		Config:   config,
+		Models:   models,
+		Sender:   sender,
+		ErrorLog: errorLog,
+		queue:    make(chan int, 100),
+		done:     make(chan struct{}),
+		waiters:  make(map[int][]*Pending),
+	}
+}
+
+// Start runs the workers and the poller. New messages are sent straight away,
+// retries (and anything queued before a restart) are picked up every PollInterval.
+func (o *Outbox) Start() {
+	o.running.Add(o.Workers + 1)
+	for i := 0; i < o.Workers; i++ {
+		go func() {
+			defer o.running.Done()
+			for {
+				select {
+				case <-o.done:
+					return
+				case id := <-o.queue:
+					o.process(id)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer o.running.Done()
+
+		ticker := time.NewTicker(o.PollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-o.done:
+				return
+			case <-ticker.C:
+			}
+
+			due, err := o.Models.Outbox.GetDue(time.Now(), cap(o.queue))
+			if err != nil {
+				o.ErrorLog.Println("outbox: error getting due messages:", err)
+				continue
+			}
+			for _, msg := range due {
+				// block rather than drop, the workers are behind
+				select {
+				case o.queue <- msg.ID:
+				case <-o.done:
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Stop lets the started workers finish the messages they are sending and
+// waits for them, or for ctx to end. Their outcomes are saved, so nothing is
+// left claimed; what is left is sent once the app is started again.
+func (o *Outbox) Stop(ctx context.Context) error {
+	close(o.done)
+
+	stopped := make(chan struct{})
+	go func() {
+		o.running.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// QueueTx saves the message in the transaction, without a transaction use
+// Send. The message isn't handed to a worker until the transaction commits,
+// the poller picks it up after that; call Wake with the id once it has
+// committed to send it sooner, and Track to wait for it.
+func (o *Outbox) QueueTx(tx *data.Tx, msg mailer.Message) (int, error) {
+	row, err := NewRow(msg)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := o.Models.Outbox.InsertTx(tx, row)
+	if err != nil {
+		return 0, err
+	}
+
+	if tx == nil {
+		o.Wake(id)
+	}
+
+	return id, nil
+}
+
+// Wake hands the message to a worker. When the queue is full the poller sends it instead.
+func (o *Outbox) Wake(id int) {
+	select {
+	case o.queue <- id:
+	default:
+	}
+}
+
+// Retry makes a dead, cancelled or suppressed message pending again with a
+// fresh set of attempts, and sends it straight away. A pending message is
+// ErrPending, it may be being sent right now.
+func (o *Outbox) Retry(id int) (*data.OutboxMessage, error) {
+	requeued, err := o.Models.Outbox.Requeue(id)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := o.Models.Outbox.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !requeued {
+		if msg.Status == data.OutboxSent {
+			return nil, ErrSent
+		}
+		return nil, ErrPending
+	}
+	o.Wake(id)
+
+	return msg, nil
+}
+
+// Cancel stops a dead or suppressed message, or a pending one no worker has
+// claimed, from being sent. Cancelling a cancelled message does nothing. A
+// pending message with its next attempt ahead is ErrSending, a worker may
+// hold it.
+func (o *Outbox) Cancel(id int) (*data.OutboxMessage, error) {
+	cancelled, err := o.Models.Outbox.CancelIfIdle(id)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := o.Models.Outbox.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !cancelled {
+		switch msg.Status {
+		case data.OutboxSent:
+			return nil, ErrSent
+		case data.OutboxCancelled:
+			return msg, nil
+		}
+		return nil, ErrSending
+	}
+	o.notify(msg)
+
+	return msg, nil
+}
+
+// process claims a message that is pending and due, sends it and saves the outcome
+func (o *Outbox) process(id int) {
+	claimed, err := o.Models.Outbox.Claim(id, time.Now().Add(o.Lease))
+	if err != nil {
+		o.ErrorLog.Println("outbox: error claiming message", id, err)
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	msg, err := o.Models.Outbox.Get(id)
+	if err != nil {
+		o.ErrorLog.Println("outbox: error getting message", id, err)
+		return
+	}
+
+	o.Attempt(msg)
+
+	saved, err := o.Models.Outbox.SaveAttempt(*msg)
+	if err != nil {
+		o.ErrorLog.Println("outbox: error saving message", id, err)
+		return
+	}
+	if !saved {
+		o.ErrorLog.Println("outbox: message", id, "changed while it was being sent, the outcome was", msg.Status)
+		return
+	}
+	o.notify(msg)
+}
+
+// Attempt sends the message once and records the outcome on it: sent on
+// success, suppressed when the Sender won't send it, otherwise pending with
+// the next attempt backed off, or dead once MaxAttempts is reached.
+func (o *Outbox) Attempt(msg *data.OutboxMessage) {
+	now := time.Now()
+	msg.Attempts++
+	msg.LastError = ""
+
+	err := o.send(msg)
+	if err == nil {
+		msg.Status = data.OutboxSent
+		msg.SentAt = &now
+		return
+	}
+
+	msg.LastError = err.Error()
+	if errors.Is(err, ErrSuppressed) {
+		msg.Status = data.OutboxSuppressed
+		return
+	}
+	if msg.Attempts >= o.MaxAttempts {
+		msg.Status = data.OutboxDead
+		return
+	}
+
+	msg.Status = data.OutboxPending
+	msg.NextAttempt = now.Add(o.Backoff(msg.Attempts))
+}
+
+func (o *Outbox) send(row *data.OutboxMessage) error {
+	msg, err := Message(row)
+	if err != nil {
+		return err
+	}
+
+	return o.Sender.Send(msg)
+}
+
+// NewRow turns a mail message into an outbox row, the template data and
+// attachments are saved as json
+func NewRow(msg mailer.Message) (data.OutboxMessage, error) {
+	templateData, err := json.Marshal(msg.Data)
+	if err != nil {
+		return data.OutboxMessage{}, err
+	}
+
+	attachments := msg.Attachments
+	if attachments == nil {
+		attachments = []string{}
+	}
+	files, err := json.Marshal(attachments)
+	if err != nil {
+		return data.OutboxMessage{}, err
+	}
+
+	return data.OutboxMessage{
+		To:          msg.To,
+		From:        msg.From,
+		FromName:    msg.FromName,
+		Subject:     msg.Subject,
+		Template:    msg.Template,
+		Data:        string(templateData),
+		Attachments: string(files),
+	}, nil
+}
+
+// Message turns an outbox row back into a mail message. The template data
+// comes back as maps and slices rather than the struct it was queued as, which
+// the templates can't tell apart.
+func Message(row *data.OutboxMessage) (mailer.Message, error) {
+	msg := mailer.Message{
+		To:       row.To,
+		From:     row.From,
+		FromName: row.FromName,
+		Subject:  row.Subject,
+		Template: row.Template,
+	}
+
+	if row.Data != "" {
+		if err := json.Unmarshal([]byte(row.Data), &msg.Data); err != nil {
+			return msg, err
+		}
+	}
+	if row.Attachments != "" {
+		if err := json.Unmarshal([]byte(row.Attachments), &msg.Attachments); err != nil {
+			return msg, err
+		}
+	}
+
+	return msg, nil
+}
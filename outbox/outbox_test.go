@@ -0,0 +1,190 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"myapp/data"
+	"testing"
+	"time"
+
+	"github.com/cmd-ctrl-q/celeritas/mailer"
+)
+
+// sender is a Sender that fails the first failures messages
+type sender struct {
+	failures int
+	sent     []mailer.Message
+}
+
+func (s *sender) Send(msg mailer.Message) error {
+	s.sent = append(s.sent, msg)
+	if len(s.sent) <= s.failures {
+		return errors.New("mail server unavailable")
+	}
+	return nil
+}
+
+func testOutbox(s Sender) *Outbox {
+	config := Config{
+		MaxAttempts: 3,
+		Workers:     1,
+		BaseDelay:   time.Minute,
+		MaxDelay:    time.Hour,
+	}
+	return New(data.Models{}, s, nil, config)
+}
+
+func TestOutbox_Attempt(t *testing.T) {
+	s := &sender{failures: 1}
+	o := testOutbox(s)
+
+	row, err := NewRow(mailer.Message{
+		To:       "me@here.com",
+		From:     "admin@example.com",
+		Subject:  "Password reset",
+		Template: "password-reset",
+		Data:     struct{ Link string }{Link: "http://localhost/reset"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &row
+	msg.ID = 42
+	msg.Status = data.OutboxPending
+
+	// the first attempt fails and is retried later
+	before := time.Now()
+	o.Attempt(msg)
+	if msg.Status != data.OutboxPending || msg.Attempts != 1 || msg.LastError == "" || msg.SentAt != nil {
+		t.Fatalf("failed attempt: wrong message state %+v", msg)
+	}
+	if msg.NextAttempt.Before(before.Add(time.Minute)) {
+		t.Error("failed attempt: the retry was not backed off", msg.NextAttempt)
+	}
+
+	o.Attempt(msg)
+	if msg.Status != data.OutboxSent || msg.Attempts != 2 || msg.LastError != "" || msg.SentAt == nil {
+		t.Fatalf("second attempt: wrong message state %+v", msg)
+	}
+
+	// the template data survives the trip through the database as json
+	sent := s.sent[1]
+	if sent.To != "me@here.com" || sent.Template != "password-reset" || sent.Subject != "Password reset" {
+		t.Errorf("wrong message sent %+v", sent)
+	}
+	templateData, ok := sent.Data.(map[string]interface{})
+	if !ok || templateData["Link"] != "http://localhost/reset" {
+		t.Errorf("wrong template data %#v", sent.Data)
+	}
+	if sent.Attachments == nil || len(sent.Attachments) != 0 {
+		t.Errorf("expected no attachments, got %#v", sent.Attachments)
+	}
+}
+
+func TestOutbox_AttemptGivesUp(t *testing.T) {
+	o := testOutbox(&sender{failures: 10})
+	msg := &data.OutboxMessage{ID: 1, To: "me@here.com", Template: "test", Data: "null", Attachments: "[]", Status: data.OutboxPending}
+
+	for i := 0; i < o.MaxAttempts; i++ {
+		o.Attempt(msg)
+	}
+
+	if msg.Status != data.OutboxDead || msg.Attempts != o.MaxAttempts {
+		t.Errorf("expected dead after %d attempts, got %s after %d", o.MaxAttempts, msg.Status, msg.Attempts)
+	}
+
+	// a row that can't be turned back into a message is an error too
+	s := &sender{}
+	o = testOutbox(s)
+	msg = &data.OutboxMessage{ID: 2, To: "me@here.com", Template: "test", Data: "{not json", Status: data.OutboxPending}
+	o.Attempt(msg)
+	if msg.Status != data.OutboxPending || msg.LastError == "" || len(s.sent) != 0 {
+		t.Errorf("bad data: wrong message state %+v", msg)
+	}
+}
+
+func TestConfig_Backoff(t *testing.T) {
+	c := Config{BaseDelay: 30 * time.Second, MaxDelay: 10 * time.Minute}
+
+	want := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute}
+	for i, w := range want {
+		if got := c.Backoff(i + 1); got != w {
+			t.Errorf("after %d attempts: expected %s but got %s", i+1, w, got)
+		}
+	}
+}
+
+func TestOutbox_Notify(t *testing.T) {
+	o := testOutbox(&sender{})
+	first, second := o.Track(1), o.Track(2)
+	o.watch(first)
+	o.watch(second)
+
+	// each waiter only hears about its own message
+	o.notify(&data.OutboxMessage{ID: 1, Status: data.OutboxSent})
+	select {
+	case <-first.done:
+	default:
+		t.Fatal("the sent message's waiter was not woken")
+	}
+	if first.result.Error != nil || first.result.Status != data.OutboxSent {
+		t.Errorf("wrong result for the sent message %+v", first.result)
+	}
+
+	// a failed attempt that will be retried isn't a result yet
+	o.notify(&data.OutboxMessage{ID: 2, Status: data.OutboxPending, LastError: "try again"})
+	select {
+	case <-second.done:
+		t.Fatal("a pending message's waiter was woken")
+	default:
+	}
+
+	o.notify(&data.OutboxMessage{ID: 2, Status: data.OutboxDead, LastError: "mailbox full"})
+	<-second.done
+	if !errors.Is(second.result.Error, ErrDead) || second.result.ID != 2 {
+		t.Errorf("wrong result for the dead message %+v", second.result)
+	}
+
+	o.unwatch(first)
+	o.unwatch(second)
+	if len(o.waiters) != 0 {
+		t.Error("waiters were left behind", o.waiters)
+	}
+}
+
+func TestOutbox_AttemptSuppressed(t *testing.T) {
+	o := testOutbox(suppressor{})
+	msg := &data.OutboxMessage{ID: 1, To: "me@here.com", Template: "test", Data: "null", Attachments: "[]", Status: data.OutboxPending}
+
+	// opting out isn't retried
+	o.Attempt(msg)
+	if msg.Status != data.OutboxSuppressed || msg.Attempts != 1 || msg.SentAt != nil {
+		t.Errorf("wrong message state %+v", msg)
+	}
+
+	result, ok := resultFor(msg)
+	if !ok || !errors.Is(result.Error, ErrSuppressed) {
+		t.Errorf("wrong result %+v", result)
+	}
+}
+
+// suppressor is a Sender for a recipient that opted out
+type suppressor struct{}
+
+func (suppressor) Send(msg mailer.Message) error {
+	return fmt.Errorf("%w of %s", ErrSuppressed, msg.Template)
+}
+
+func TestOutbox_Stop(t *testing.T) {
+	o := testOutbox(&sender{})
+	o.Workers = 2
+	o.PollInterval = time.Hour
+	o.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := o.Stop(ctx); err != nil {
+		t.Error("expected the idle workers to stop, got", err)
+	}
+}
@@ -0,0 +1,188 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"myapp/data"
+	"sync"
+	"time"
+
+	"github.com/cmd-ctrl-q/celeritas/mailer"
+)
+
+var (
+	// ErrDead is the Result error of a message that failed every attempt
+	ErrDead = errors.New("outbox: the message could not be sent")
+	// ErrCancelled is the Result error of a cancelled message
+	ErrCancelled = errors.New("outbox: the message was cancelled")
+)
+
+// Result is how sending one message ended. Error is nil once it is sent,
+// ErrDead, ErrCancelled or ErrSuppressed when it never will be, or the
+// context's error when Wait gave up first.
+type Result struct {
+	ID     int
+	Status string
+	Error  error
+}
+
+// Pending is a message that was queued. Every Pending is tied to its own
+// message, so unlike the mailer's shared Results channel a caller never gets
+// another message's result.
+type Pending struct {
+	ID int
+
+	outbox *Outbox
+	once   sync.Once
+	done   chan struct{}
+	result Result
+}
+
+// Send queues the message and returns a Pending for it. Sending carries on
+// whether or not anyone waits for it.
+func (o *Outbox) Send(msg mailer.Message) (*Pending, error) {
+	id, err := o.QueueTx(nil, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return o.Track(id), nil
+}
+
+// SendFunc queues the message and calls fn with the result once it is sent
+// or never will be, or with ctx's error when ctx ends first. fn runs in its
+// own goroutine.
+func (o *Outbox) SendFunc(ctx context.Context, msg mailer.Message, fn func(Result)) (*Pending, error) {
+	p, err := o.Send(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		fn(p.Wait(ctx))
+	}()
+
+	return p, nil
+}
+
+// Track returns a Pending for a message queued earlier, eg with QueueTx
+func (o *Outbox) Track(id int) *Pending {
+	return &Pending{ID: id, outbox: o, done: make(chan struct{})}
+}
+
+// Wait blocks until the message is sent or never will be, or ctx ends; use
+// a ctx with a deadline for a timeout. Giving up doesn't stop the message
+// being sent, call Cancel for that. Messages sent by another instance are
+// noticed every PollInterval.
+func (p *Pending) Wait(ctx context.Context) Result {
+	o := p.outbox
+	o.watch(p)
+	defer o.unwatch(p)
+
+	// it may have finished before it was watched
+	p.check()
+
+	interval := o.PollInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return p.result
+		case <-ctx.Done():
+			return Result{ID: p.ID, Status: data.OutboxPending, Error: ctx.Err()}
+		case <-ticker.C:
+			p.check()
+		}
+	}
+}
+
+// Cancel stops the message from being sent, it returns ErrSent when it is too late
+func (p *Pending) Cancel() error {
+	_, err := p.outbox.Cancel(p.ID)
+	return err
+}
+
+// check reads the message and finishes p if it has ended. An error reading it
+// is left for the next check.
+func (p *Pending) check() {
+	msg, err := p.outbox.Models.Outbox.Get(p.ID)
+	if err != nil {
+		return
+	}
+	p.finish(msg)
+}
+
+// finish records the result of an ended message and wakes the waiters
+func (p *Pending) finish(msg *data.OutboxMessage) {
+	result, ok := resultFor(msg)
+	if !ok {
+		return
+	}
+
+	p.once.Do(func() {
+		p.result = result
+		close(p.done)
+	})
+}
+
+// resultFor reports how msg ended, false while it is pending
+func resultFor(msg *data.OutboxMessage) (Result, bool) {
+	result := Result{ID: msg.ID, Status: msg.Status}
+
+	switch msg.Status {
+	case data.OutboxSent:
+	case data.OutboxDead:
+		result.Error = fmt.Errorf("%w: %s", ErrDead, msg.LastError)
+	case data.OutboxCancelled:
+		result.Error = ErrCancelled
+	case data.OutboxSuppressed:
+		result.Error = ErrSuppressed
+	default:
+		return result, false
+	}
+
+	return result, true
+}
+
+func (o *Outbox) watch(p *Pending) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.waiters[p.ID] = append(o.waiters[p.ID], p)
+}
+
+func (o *Outbox) unwatch(p *Pending) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	waiters := o.waiters[p.ID]
+	for i, w := range waiters {
+		if w == p {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+
+	if len(waiters) == 0 {
+		delete(o.waiters, p.ID)
+	} else {
+		o.waiters[p.ID] = waiters
+	}
+}
+
+// notify finishes everyone waiting on msg in this instance, once it has ended
+func (o *Outbox) notify(msg *data.OutboxMessage) {
+	o.mu.Lock()
+	waiters := append([]*Pending(nil), o.waiters[msg.ID]...)
+	o.mu.Unlock()
+
+	for _, p := range waiters {
+		p.finish(msg)
+	}
+}
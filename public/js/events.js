@@ -0,0 +1,60 @@
+// appEvents listens to /events, the server-sent events of the signed in user.
+//
+//   appEvents.on("cache.changed", function (data) { ... });
+//
+// data is the parsed json of the event. The browser reconnects on its own and
+// resumes where it left off, a "reset" event means some events were missed.
+// Nothing is opened until the first listener is added, and a page of a signed
+// out user stops after the first failed connection.
+(function () {
+    let source = null;
+    const listeners = {};
+
+    function connect() {
+        source = new EventSource("/events");
+        source.onerror = function () {
+            if (source.readyState === EventSource.CLOSED) {
+                // not signed in, or the server refused
+                source = null;
+            }
+        };
+        for (const name in listeners) {
+            listen(name);
+        }
+    }
+
+    function listen(name) {
+        source.addEventListener(name, function (e) {
+            let data = {};
+            try {
+                data = JSON.parse(e.data);
+            } catch (err) {
+                // leave data empty
+            }
+            listeners[name].forEach(function (fn) {
+                fn(data, e);
+            });
+        });
+    }
+
+    window.appEvents = {
+        on: function (name, fn) {
+            if (!listeners[name]) {
+                listeners[name] = [];
+                if (source) {
+                    listen(name);
+                }
+            }
+            listeners[name].push(fn);
+            if (!source) {
+                connect();
+            }
+        },
+        close: function () {
+            if (source) {
+                source.close();
+                source = null;
+            }
+        },
+    };
+})();
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"myapp/apperr"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// apiRoutes holds every route under /api. Middleware meant only for the api
+// (eg cors) is added here so it never touches the session based pages.
+func (a *application) apiRoutes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(a.Middleware.CORS)
+	r.Use(apperr.JSON)
+	// recover again once the request is marked as json, so api panics get a json error
+	r.Use(a.Middleware.Recover)
+
+	// documentation, kept in sync with these routes by api-spec.go
+	r.Get("/openapi.json", a.serveSpec(apiSpec()))
+	r.Get("/docs", a.Handlers.APIDocs)
+
+	// initiated by calling fetch in javascript
+	r.Post("/save-in-cache", a.handle(a.Handlers.SaveInCache))
+	r.Post("/get-from-cache", a.handle(a.Handlers.GetFromCache))
+	r.Post("/touch-cache", a.handle(a.Handlers.TouchCache))
+	r.Post("/delete-from-cache", a.handle(a.Handlers.DeleteFromCache))
+	r.Post("/empty-cache", a.handle(a.Handlers.EmptyCache))
+
+	// graphql over the users and their tokens, for the session's user or a bearer token
+	r.With(a.Middleware.AuthTokenOrSession).Get("/graphql", a.handle(a.Handlers.GraphQL))
+	r.With(a.Middleware.AuthTokenOrSession).Post("/graphql", a.handle(a.Handlers.GraphQL))
+
+	r.Route("/v1", func(r chi.Router) {
+		// the List-Unsubscribe-Post target, authenticated by the link's signature
+		r.Post("/unsubscribe", a.handle(a.Handlers.OneClickUnsubscribe))
+		// bounce and complaint webhooks, signed by each provider
+		r.Post("/mail-events/{provider}", a.handle(a.Handlers.MailEvents))
+
+		// cache, mail, webhook and bulk user administration, for admins with a bearer token or their session.
+		// Browsers send the csrf token in the X-CSRF-Token header.
+		r.Group(func(r chi.Router) {
+			r.Use(a.Middleware.AuthTokenOrSession, a.Middleware.Admin, a.Middleware.CheckCSRFHeader)
+
+			r.Get("/cache", a.handle(a.Handlers.ListCacheKeys))
+			r.Delete("/cache", a.handle(a.Handlers.DeleteCacheValues))
+			r.Get("/cache-stats", a.handle(a.Handlers.CacheStats))
+			r.Get("/cache-info", a.handle(a.Handlers.CacheInfo))
+			r.Get("/cache-snapshot", a.handle(a.Handlers.ExportCache))
+			r.Post("/cache-snapshot", a.handle(a.Handlers.ImportCache))
+			r.Get("/cache/{key}", a.handle(a.Handlers.GetCacheValue))
+			r.Put("/cache/{key}", a.handle(a.Handlers.PutCacheValue))
+			r.Post("/cache/{key}/touch", a.handle(a.Handlers.TouchCacheValue))
+			r.Delete("/cache/{key}", a.handle(a.Handlers.DeleteCacheValue))
+
+			// the mail outbox
+			r.Get("/mail", a.handle(a.Handlers.ListMail))
+			r.Get("/mail/{id}", a.handle(a.Handlers.GetMail))
+			r.Post("/mail/{id}/retry", a.handle(a.Handlers.RetryMail))
+			r.Post("/mail/{id}/cancel", a.handle(a.Handlers.CancelMail))
+
+			// addresses suppressed after bouncing or complaining
+			r.Get("/mail-suppressions", a.handle(a.Handlers.ListMailSuppressions))
+			r.Get("/mail-suppressions/{id}", a.handle(a.Handlers.GetMailSuppression))
+			r.Post("/mail-suppressions/{id}/clear", a.handle(a.Handlers.ClearMailSuppression))
+
+			// outbound webhooks for user events, they carry every user's details
+			r.Get("/webhooks", a.handle(a.Handlers.ListWebhooks))
+			r.Post("/webhooks", a.handle(a.Handlers.CreateWebhook))
+			r.Delete("/webhooks/{id}", a.handle(a.Handlers.DeleteWebhook))
+			r.Get("/webhooks/{id}/deliveries", a.handle(a.Handlers.ListDeliveries))
+			r.Post("/webhook-deliveries/{id}/redeliver", a.handle(a.Handlers.Redeliver))
+
+			// bulk import and export of every user. The export is streamed, so it is kept out
+			// of the etag group, which buffers the whole response.
+			r.Post("/users/import", a.handle(a.Handlers.ImportUsers))
+			r.Get("/users/export", a.handle(a.Handlers.ExportUsers))
+		})
+
+		// everything else is authenticated with a bearer token
+		r.Group(func(r chi.Router) {
+			r.Use(a.Middleware.AuthToken)
+
+			r.Group(func(r chi.Router) {
+				// etags and 304s for every GET
+				r.Use(a.Middleware.ETag)
+
+				r.Get("/users", a.handle(a.Handlers.ListUsers))
+				// retried creates with the same Idempotency-Key get the first response back
+				r.With(a.Middleware.Idempotent).Post("/users", a.handle(a.Handlers.CreateUser))
+				r.Get("/users/me", a.handle(a.Handlers.Me))
+				r.Get("/users/me/email-preferences", a.handle(a.Handlers.GetEmailPreferences))
+				r.Put("/users/me/email-preferences", a.handle(a.Handlers.UpdateEmailPreferences))
+				r.Get("/users/{id}", a.handle(a.Handlers.GetUser))
+				r.Put("/users/{id}", a.handle(a.Handlers.UpdateUser))
+				r.Delete("/users/{id}", a.handle(a.Handlers.DeleteUser))
+			})
+		})
+	})
+
+	return r
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"myapp/handlers"
+	"myapp/middleware"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// TestAPISpecCoversRoutes fails when a route is added to apiRoutes without
+// being described in apiSpec, or described without being routed.
+func TestAPISpecCoversRoutes(t *testing.T) {
+	a := &application{
+		Handlers:   &handlers.Handlers{},
+		Middleware: &middleware.Middleware{},
+	}
+
+	spec := apiSpec()
+	routed := make(map[string]bool)
+
+	err := chi.Walk(a.apiRoutes(), func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		route = strings.TrimSuffix(route, "/")
+		routed[method+" "+route] = true
+
+		if !spec.Has(method, route) {
+			t.Errorf("%s /api%s is routed but missing from the openapi spec", method, route)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc := spec.Document()
+	for path, item := range doc["paths"].(map[string]interface{}) {
+		for method := range item.(map[string]interface{}) {
+			if !routed[strings.ToUpper(method)+" "+path] {
+				t.Errorf("%s /api%s is in the openapi spec but not routed", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
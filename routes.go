@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"myapp/data"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/cmd-ctrl-q/celeritas/mailer"
 	"github.com/go-chi/chi/v5"
@@ -12,10 +14,12 @@ import (
 
 func (a *application) routes() *chi.Mux {
 	// middleware must come before any routes
+	a.use(a.Middleware.Recover)
 	a.use(a.Middleware.CheckRemember)
 
 	// add routes
-	a.get("/", a.Handlers.Home)
+	// not page cached, the layout holds the visitor's csrf token
+	a.App.Routes.Get("/", a.Handlers.Home)
 	a.App.Routes.Get("/go-page", a.Handlers.GoPage)
 	a.App.Routes.Get("/jet-page", a.Handlers.JetPage)
 	a.App.Routes.Get("/sessions", a.Handlers.SessionTest)
@@ -23,28 +27,53 @@ func (a *application) routes() *chi.Mux {
 	// GET: for retreiving the login page
 	a.App.Routes.Get("/users/login", a.Handlers.GetUserLogin)
 	// POST: for handling the login form
-	a.post("/users/login", a.Handlers.PostUserLogin)
+	a.post("/users/login", a.handle(a.Handlers.PostUserLogin))
 	a.App.Routes.Get("/users/logout", a.Handlers.Logout)
 	a.get("/users/forgot-password", a.Handlers.Forgot)
 	a.post("/users/forgot-password", a.Handlers.PostForgot)
 	a.get("/users/reset-password", a.Handlers.ResetPasswordForm)
 	a.post("/users/reset-password", a.Handlers.PostResetPassword)
+	// signed links from the footer of mail that can be opted out of, no login needed
+	a.get("/users/unsubscribe", a.handle(a.Handlers.Unsubscribe))
+	a.post("/users/unsubscribe", a.handle(a.Handlers.PostUnsubscribe))
 
 	a.App.Routes.Get("/form", a.Handlers.Form)
-	a.App.Routes.Post("/form", a.Handlers.PostForm)
+	a.App.Routes.Post("/form", a.handle(a.Handlers.PostForm))
 
-	a.get("/json", a.Handlers.JSON)
-	a.get("/xml", a.Handlers.XML)
+	// json, xml, csv or html picked from the Accept header or ?format=
+	a.get("/payload", a.handle(a.Handlers.Payload))
+	// old urls for the payload
+	a.get("/json", redirect("/payload?format=json"))
+	a.get("/xml", redirect("/payload?format=xml"))
 	a.get("/download-file", a.Handlers.DownloadFile)
 
 	a.get("/crypto", a.Handlers.TestCrypto)
 
 	a.get("/cache-test", a.Handlers.ShowCachePage)
-	// initiated by calling fetch in javascript
-	a.post("/api/save-in-cache", a.Handlers.SaveInCache)
-	a.post("/api/get-from-cache", a.Handlers.GetFromCache)
-	a.post("/api/delete-from-cache", a.Handlers.DeleteFromCache)
-	a.post("/api/empty-cache", a.Handlers.EmptyCache)
+	// the cache browser, for admins
+	a.App.Routes.With(a.Middleware.AuthTokenOrSession, a.Middleware.Admin).Get("/admin/cache", a.Handlers.ShowCacheBrowser)
+	// the mail outbox, for admins
+	a.App.Routes.With(a.Middleware.AuthTokenOrSession, a.Middleware.Admin).Get("/admin/mail", a.Handlers.ShowMailOutbox)
+	a.App.Routes.With(a.Middleware.AuthTokenOrSession, a.Middleware.Admin).Get("/admin/mail-suppressions", a.Handlers.ShowMailSuppressions)
+
+	// mail caught in development, and previews of the mail templates. The catcher
+	// can be turned on outside debug mode (eg on staging), where the mail is for admins only.
+	if a.Handlers.MailCatcher != nil {
+		a.App.Routes.Group(func(r chi.Router) {
+			if !a.App.Debug {
+				r.Use(a.Middleware.AuthTokenOrSession, a.Middleware.Admin)
+			}
+
+			r.Get("/dev/mail", a.Handlers.DevMail)
+			r.Post("/dev/mail/clear", a.Handlers.ClearDevMail)
+			r.Get("/dev/mail/{id}/html", a.Handlers.DevMailHTML)
+			r.Get("/dev/mail/{id}/plain", a.Handlers.DevMailPlain)
+			r.Get("/dev/mail/preview/{template}", a.Handlers.PreviewMail)
+		})
+	}
+
+	// api routes
+	a.App.Routes.Mount("/api", a.apiRoutes())
 
 	a.get("/test-mail", func(rw http.ResponseWriter, r *http.Request) {
 		msg := mailer.Message{
@@ -56,11 +85,22 @@ func (a *application) routes() *chi.Mux {
 			Data:        nil,
 		}
 
-		// send via channel
-		a.App.Mail.Jobs <- msg
-		res := <-a.App.Mail.Results
+		// send via the outbox, and wait a while to see how it went
+		pending, err := a.Handlers.Outbox.Send(msg)
+		if err != nil {
+			a.App.ErrorLog.Println(err)
+			a.App.Error500(rw, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+
+		res := pending.Wait(ctx)
 		if res.Error != nil {
 			a.App.ErrorLog.Println(res.Error)
+			fmt.Fprintf(rw, "Mail %d is %s: %v, see /admin/mail", res.ID, res.Status, res.Error)
+			return
 		}
 
 		// send via function
@@ -70,7 +110,7 @@ func (a *application) routes() *chi.Mux {
 		// 	return
 		// }
 
-		fmt.Fprint(rw, "Sent mail!")
+		fmt.Fprintf(rw, "Sent mail %d!", res.ID)
 	})
 
 	a.App.Routes.Get("/create-user", func(rw http.ResponseWriter, r *http.Request) {
@@ -89,10 +129,12 @@ func (a *application) routes() *chi.Mux {
 			return
 		}
 
+		a.purgePages("users")
+
 		fmt.Fprintf(rw, "%d: %s", id, u.FirstName)
 	})
 
-	a.App.Routes.Get("/get-all-users", func(rw http.ResponseWriter, r *http.Request) {
+	a.App.Routes.With(a.Middleware.CachePage("users")).Get("/get-all-users", func(rw http.ResponseWriter, r *http.Request) {
 		users, err := a.Models.Users.GetAll()
 		if err != nil {
 			// bad request
@@ -132,7 +174,7 @@ func (a *application) routes() *chi.Mux {
 		u.LastName = a.App.RandomString(10)
 
 		// validation
-		validator := a.App.Validator(nil)
+		validator := data.NewValidator(a.App.Validator(nil))
 		u.LastName = "diepenbrock"
 
 		u.Validate(validator)
@@ -149,6 +191,8 @@ func (a *application) routes() *chi.Mux {
 			return
 		}
 
+		a.purgePages("users")
+
 		fmt.Fprintf(rw, "update last name to %s", u.LastName)
 	})
 
@@ -172,5 +216,20 @@ func (a *application) routes() *chi.Mux {
 	// add these routes to the celeritas routes
 	a.App.Routes.Handle("/public/*", http.StripPrefix("/public", fileServer))
 
-	return a.App.Routes
+	return a.streamRoutes(a.App.Routes)
+}
+
+// streamRoutes serves the streamed responses in front of the celeritas routes,
+// whose session middleware buffers the whole response. Everything else goes
+// on to routes.
+func (a *application) streamRoutes(routes *chi.Mux) *chi.Mux {
+	mux := chi.NewRouter()
+
+	// server-sent events for the signed in user, see public/js/events.js
+	mux.With(a.Middleware.Recover, a.Middleware.LoadSession, a.Middleware.CheckRemember, a.Middleware.AuthTokenOrSession).
+		Get("/events", a.handle(a.Handlers.EventStream))
+
+	mux.Mount("/", routes)
+
+	return mux
 }
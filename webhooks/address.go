@@ -0,0 +1,82 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+)
+
+// ErrPrivateAddress is returned for a webhook url that points at this
+// machine or the private network, so webhooks can't be used to reach
+// internal services
+var ErrPrivateAddress = errors.New("webhook url resolves to a private or local address")
+
+// sharedAddressSpace is 100.64.0.0/10, used by carrier grade nat and some clouds
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// PublicIP reports whether deliveries may be sent to ip: it isn't loopback,
+// link-local, private or unspecified
+func PublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsUnspecified() ||
+		sharedAddressSpace.Contains(ip))
+}
+
+// CheckURL resolves the url's host and returns ErrPrivateAddress when any
+// of its addresses isn't public
+func CheckURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range addrs {
+		if !PublicIP(addr.IP) {
+			return ErrPrivateAddress
+		}
+	}
+
+	return nil
+}
+
+// newClient makes the delivery client. Unless private addresses are allowed
+// it refuses to connect to one, which also covers redirects and a host that
+// resolves differently once the webhook was saved.
+func newClient(config Config) *http.Client {
+	if config.AllowPrivate {
+		return &http.Client{Timeout: config.Timeout}
+	}
+
+	dialer := &net.Dialer{
+		Timeout: config.Timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !PublicIP(ip) {
+				return ErrPrivateAddress
+			}
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would be dialled instead of the webhook, and may well be private
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{Timeout: config.Timeout, Transport: transport}
+}
@@ -0,0 +1,391 @@
+// Package webhooks sends user lifecycle events to the urls subscribed in the
+// webhooks table. Every delivery is logged in webhook_deliveries and retried
+// with exponential backoff until the receiver answers with a 2xx.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"myapp/backoff"
+	"myapp/data"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the events a webhook can subscribe to
+const (
+	UserCreated         = "user.created"
+	UserUpdated         = "user.updated"
+	UserDeleted         = "user.deleted"
+	UserPasswordChanged = "user.password_changed"
+)
+
+// Events lists every event, for validating subscriptions
+var Events = []string{UserCreated, UserUpdated, UserDeleted, UserPasswordChanged}
+
+// headers sent with every delivery
+const (
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+	TimestampHeader = "X-Webhook-Timestamp"
+	SignatureHeader = "X-Webhook-Signature"
+)
+
+var (
+	errBadSignature = errors.New("webhook signature does not match")
+	errOldTimestamp = errors.New("webhook timestamp is outside the tolerance")
+)
+
+// Config holds the delivery settings
+type Config struct {
+	// MaxAttempts is how many times a delivery is tried before it is marked failed
+	MaxAttempts int
+	// Timeout is how long a receiver has to answer
+	Timeout time.Duration
+	// BaseDelay is the wait before the first retry, it doubles on each retry up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// PollInterval is how often pending retries are looked for
+	PollInterval time.Duration
+	// AllowPrivate lets webhooks point at local and private addresses, eg
+	// for trying them out in development
+	AllowPrivate bool
+}
+
+// NewConfig reads the webhook settings from the environment (.env)
+func NewConfig() Config {
+	attempts, err := strconv.Atoi(os.Getenv("WEBHOOK_MAX_ATTEMPTS"))
+	if err != nil || attempts < 1 {
+		attempts = 8
+	}
+
+	timeout, err := strconv.Atoi(os.Getenv("WEBHOOK_TIMEOUT"))
+	if err != nil || timeout < 1 {
+		timeout = 10
+	}
+
+	return Config{
+		MaxAttempts:  attempts,
+		Timeout:      time.Duration(timeout) * time.Second,
+		BaseDelay:    30 * time.Second,
+		MaxDelay:     6 * time.Hour,
+		PollInterval: 15 * time.Second,
+		AllowPrivate: os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true",
+	}
+}
+
+// Backoff is the wait after the given number of failed attempts
+func (c Config) Backoff(attempts int) time.Duration {
+	return backoff.Exponential(c.BaseDelay, c.MaxDelay, attempts)
+}
+
+// Event is the json body posted to a webhook
+type Event struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Dispatcher queues and sends deliveries. A single worker sends them one at a
+// time, so a delivery is never sent twice by the same instance.
+type Dispatcher struct {
+	Config
+	Models   data.Models
+	Client   *http.Client
+	ErrorLog *log.Logger
+
+	queue   chan int
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// New creates a dispatcher, call Start to begin sending
+func New(models data.Models, errorLog *log.Logger, config Config) *Dispatcher {
+	return &Dispatcher{
+		Config:   config,
+		Models:   models,
+		Client:   newClient(config),
+		ErrorLog: errorLog,
+		queue:    make(chan int, 100),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// Start runs the worker. New deliveries are sent straight away, retries (and
+// anything queued before a restart) are picked up every PollInterval.
+func (d *Dispatcher) Start() {
+	go func() {
+		defer close(d.stopped)
+
+		ticker := time.NewTicker(d.PollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-d.done:
+				return
+			case id := <-d.queue:
+				d.process(id)
+			case <-ticker.C:
+				due, err := d.Models.WebhookDeliveries.GetDue(time.Now())
+				if err != nil {
+					d.ErrorLog.Println("webhooks: error getting due deliveries:", err)
+					continue
+				}
+				for _, delivery := range due {
+					select {
+					case <-d.done:
+						return
+					default:
+						d.process(delivery.ID)
+					}
+				}
+			}
+		}
+	}()
+}
+
+// Stop lets the started worker finish the delivery it is sending and waits
+// for it, or for ctx to end. What is left is sent once the app is started again.
+func (d *Dispatcher) Stop(ctx context.Context) error {
+	close(d.done)
+
+	select {
+	case <-d.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Publish logs a delivery of the event for every webhook subscribed to it and queues them
+func (d *Dispatcher) Publish(event string, payload interface{}) error {
+	hooks, err := d.Models.Webhooks.GetForEvent(event)
+	if err != nil {
+		return err
+	}
+
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	body, err := NewEvent(event, payload)
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range hooks {
+		id, err := d.Models.WebhookDeliveries.Insert(data.WebhookDelivery{
+			WebhookID: hook.ID,
+			Event:     event,
+			Payload:   string(body),
+		})
+		if err != nil {
+			return err
+		}
+		d.enqueue(id)
+	}
+
+	return nil
+}
+
+// Redeliver sends the payload of an earlier delivery again, as a new delivery
+// so the log keeps both. It returns the new delivery's id.
+func (d *Dispatcher) Redeliver(deliveryID int) (int, error) {
+	previous, err := d.Models.WebhookDeliveries.Get(deliveryID)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := d.Models.WebhookDeliveries.Insert(data.WebhookDelivery{
+		WebhookID: previous.WebhookID,
+		Event:     previous.Event,
+		Payload:   previous.Payload,
+	})
+	if err != nil {
+		return 0, err
+	}
+	d.enqueue(id)
+
+	return id, nil
+}
+
+// enqueue hands the delivery to the worker. When the queue is full the poller sends it instead.
+func (d *Dispatcher) enqueue(id int) {
+	select {
+	case d.queue <- id:
+	default:
+	}
+}
+
+// process sends a pending delivery that is due and saves the outcome
+func (d *Dispatcher) process(id int) {
+	delivery, err := d.Models.WebhookDeliveries.Get(id)
+	if err != nil {
+		d.ErrorLog.Println("webhooks: error getting delivery", id, err)
+		return
+	}
+
+	if delivery.Status != data.DeliveryPending || delivery.NextAttempt.After(time.Now()) {
+		return
+	}
+
+	hook, err := d.Models.Webhooks.Get(delivery.WebhookID)
+	if err != nil {
+		d.ErrorLog.Println("webhooks: error getting webhook", delivery.WebhookID, err)
+		return
+	}
+
+	d.Attempt(hook, delivery)
+
+	err = d.Models.WebhookDeliveries.Update(*delivery)
+	if err != nil {
+		d.ErrorLog.Println("webhooks: error saving delivery", id, err)
+	}
+}
+
+// Attempt posts the delivery to the webhook once and records the outcome on
+// delivery: delivered on a 2xx, otherwise pending with the next attempt
+// backed off, or failed once MaxAttempts is reached.
+func (d *Dispatcher) Attempt(hook *data.Webhook, delivery *data.WebhookDelivery) {
+	now := time.Now()
+	delivery.Attempts++
+
+	status, err := d.post(hook, delivery, now)
+	delivery.ResponseStatus = status
+	delivery.LastError = ""
+
+	if err == nil {
+		delivery.Status = data.DeliveryDelivered
+		return
+	}
+
+	delivery.LastError = err.Error()
+	if delivery.Attempts >= d.MaxAttempts {
+		delivery.Status = data.DeliveryFailed
+		return
+	}
+
+	delivery.Status = data.DeliveryPending
+	delivery.NextAttempt = now.Add(d.Backoff(delivery.Attempts))
+}
+
+func (d *Dispatcher) post(hook *data.Webhook, delivery *data.WebhookDelivery, now time.Time) (int, error) {
+	body := []byte(delivery.Payload)
+	timestamp := now.Unix()
+
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "myapp-webhooks")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, strconv.Itoa(delivery.ID))
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, "sha256="+Sign(hook.Secret, timestamp, body))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// read a little of the body so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver answered %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// NewEvent builds the json body for an event
+func NewEvent(event string, payload interface{}) ([]byte, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(Event{
+		ID:        hex.EncodeToString(id),
+		Type:      event,
+		CreatedAt: time.Now().UTC(),
+		Data:      b,
+	})
+}
+
+// Sign is the hex HMAC-SHA256 of "timestamp.body" with the webhook's secret.
+// Receivers compute the same and compare it to the X-Webhook-Signature header.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = fmt.Fprintf(mac, "%d.", timestamp)
+	_, _ = mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature and timestamp headers of a delivery, rejecting
+// timestamps further than tolerance from now so old deliveries can't be replayed
+func Verify(secret string, header http.Header, body []byte, tolerance time.Duration) error {
+	timestamp, err := strconv.ParseInt(header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return errOldTimestamp
+	}
+
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > tolerance || age < -tolerance {
+		return errOldTimestamp
+	}
+
+	signature := strings.TrimPrefix(header.Get(SignatureHeader), "sha256=")
+	if !hmac.Equal([]byte(signature), []byte(Sign(secret, timestamp, body))) {
+		return errBadSignature
+	}
+
+	return nil
+}
+
+// NewSecret makes a random signing secret for a new webhook
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// ValidEvent reports whether event can be subscribed to, * is every event
+func ValidEvent(event string) bool {
+	if event == "*" {
+		return true
+	}
+
+	for _, e := range Events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
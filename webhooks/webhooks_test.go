@@ -0,0 +1,213 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"myapp/data"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver is an httptest server that fails the first failures requests
+type receiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	failures int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newReceiver(failures int) *receiver {
+	rec := &receiver{failures: failures}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		rec.requests = append(rec.requests, r)
+		rec.bodies = append(rec.bodies, body)
+
+		if len(rec.requests) <= rec.failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return rec
+}
+
+func testDispatcher() *Dispatcher {
+	config := Config{
+		MaxAttempts: 3,
+		Timeout:     time.Second,
+		BaseDelay:   time.Minute,
+		MaxDelay:    time.Hour,
+		// the receivers are httptest servers on localhost
+		AllowPrivate: true,
+	}
+	return New(data.Models{}, nil, config)
+}
+
+func TestDispatcher_Attempt(t *testing.T) {
+	rec := newReceiver(1)
+	defer rec.Close()
+
+	d := testDispatcher()
+	hook := &data.Webhook{ID: 1, URL: rec.URL, Secret: "shh"}
+
+	payload, err := NewEvent(UserCreated, map[string]interface{}{"id": 7, "email": "me@here.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery := &data.WebhookDelivery{ID: 42, WebhookID: 1, Event: UserCreated, Payload: string(payload), Status: data.DeliveryPending}
+
+	// the first attempt is refused and retried later
+	before := time.Now()
+	d.Attempt(hook, delivery)
+	if delivery.Status != data.DeliveryPending || delivery.Attempts != 1 || delivery.ResponseStatus != http.StatusServiceUnavailable {
+		t.Fatalf("failed attempt: wrong delivery state %+v", delivery)
+	}
+	if delivery.LastError == "" {
+		t.Error("failed attempt: the error was not logged")
+	}
+	if delivery.NextAttempt.Before(before.Add(time.Minute)) {
+		t.Error("failed attempt: the retry was not backed off", delivery.NextAttempt)
+	}
+
+	d.Attempt(hook, delivery)
+	if delivery.Status != data.DeliveryDelivered || delivery.Attempts != 2 || delivery.ResponseStatus != http.StatusNoContent || delivery.LastError != "" {
+		t.Fatalf("second attempt: wrong delivery state %+v", delivery)
+	}
+
+	// the receiver can check what it was sent
+	r := rec.requests[1]
+	if r.Header.Get(EventHeader) != UserCreated || r.Header.Get(DeliveryHeader) != "42" {
+		t.Error("wrong event headers", r.Header)
+	}
+	if err := Verify("shh", r.Header, rec.bodies[1], 5*time.Minute); err != nil {
+		t.Error("signature did not verify:", err)
+	}
+	if err := Verify("wrong secret", r.Header, rec.bodies[1], 5*time.Minute); err == nil {
+		t.Error("signature verified with the wrong secret")
+	}
+
+	var event Event
+	if err := json.Unmarshal(rec.bodies[1], &event); err != nil {
+		t.Fatal("body is not an event:", err)
+	}
+	if event.Type != UserCreated || event.ID == "" || string(event.Data) != `{"email":"me@here.com","id":7}` {
+		t.Errorf("wrong event %+v", event)
+	}
+}
+
+func TestDispatcher_AttemptGivesUp(t *testing.T) {
+	rec := newReceiver(10)
+	defer rec.Close()
+
+	d := testDispatcher()
+	hook := &data.Webhook{ID: 1, URL: rec.URL, Secret: "shh"}
+	delivery := &data.WebhookDelivery{ID: 1, WebhookID: 1, Event: UserDeleted, Payload: "{}", Status: data.DeliveryPending}
+
+	for i := 0; i < d.MaxAttempts; i++ {
+		d.Attempt(hook, delivery)
+	}
+
+	if delivery.Status != data.DeliveryFailed || delivery.Attempts != d.MaxAttempts {
+		t.Errorf("expected failed after %d attempts, got %s after %d", d.MaxAttempts, delivery.Status, delivery.Attempts)
+	}
+
+	// an unreachable receiver is an error too
+	rec.Close()
+	delivery = &data.WebhookDelivery{ID: 2, WebhookID: 1, Event: UserDeleted, Payload: "{}", Status: data.DeliveryPending}
+	d.Attempt(hook, delivery)
+	if delivery.Status != data.DeliveryPending || delivery.ResponseStatus != 0 || delivery.LastError == "" {
+		t.Errorf("unreachable receiver: wrong delivery state %+v", delivery)
+	}
+}
+
+func TestConfig_Backoff(t *testing.T) {
+	c := Config{BaseDelay: 30 * time.Second, MaxDelay: 10 * time.Minute}
+
+	want := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute}
+	for i, w := range want {
+		if got := c.Backoff(i + 1); got != w {
+			t.Errorf("after %d attempts: expected %s but got %s", i+1, w, got)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"type":"user.created"}`)
+	old := time.Now().Add(-time.Hour).Unix()
+
+	header := http.Header{}
+	header.Set(TimestampHeader, "1")
+	header.Set(SignatureHeader, "sha256="+Sign("shh", old, body))
+	if err := Verify("shh", header, body, 5*time.Minute); err != errOldTimestamp {
+		t.Error("expected an old timestamp error, got", err)
+	}
+
+	header.Set(TimestampHeader, "not a number")
+	if err := Verify("shh", header, body, 5*time.Minute); err == nil {
+		t.Error("a bad timestamp should not verify")
+	}
+}
+
+func TestPublicIP(t *testing.T) {
+	for ip, want := range map[string]bool{
+		"93.184.216.34":   true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"fe80::1":         false,
+		"fd00::1":         false,
+		"100.64.0.1":      false,
+		"0.0.0.0":         false,
+	} {
+		if got := PublicIP(net.ParseIP(ip)); got != want {
+			t.Errorf("%s: expected %v, got %v", ip, want, got)
+		}
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	for _, u := range []string{"http://127.0.0.1:8080/hook", "http://localhost/hook", "http://[::1]/hook"} {
+		if err := CheckURL(context.Background(), u); !errors.Is(err, ErrPrivateAddress) {
+			t.Errorf("%s: expected ErrPrivateAddress, got %v", u, err)
+		}
+	}
+}
+
+func TestDispatcher_PrivateAddress(t *testing.T) {
+	rec := newReceiver(0)
+	defer rec.Close()
+
+	// without AllowPrivate the client won't connect to the local receiver
+	client := newClient(Config{Timeout: time.Second})
+	_, err := client.Get(rec.URL)
+	if !errors.Is(err, ErrPrivateAddress) {
+		t.Error("expected ErrPrivateAddress connecting to localhost, got", err)
+	}
+}
+
+func TestDispatcher_Stop(t *testing.T) {
+	d := testDispatcher()
+	d.PollInterval = time.Hour
+	d.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := d.Stop(ctx); err != nil {
+		t.Error("expected the idle worker to stop, got", err)
+	}
+}